@@ -0,0 +1,110 @@
+package api
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+)
+
+// ErrBlocked 是被屏蔽的域名在拒绝模式下返回的错误
+var ErrBlocked = errors.New("domain is blocked")
+
+// Blocklist 是DNS屏蔽列表，匹配不区分大小写
+// 普通条目精确匹配域名，"*.example.com" 形式的条目匹配其所有子域名
+type Blocklist struct {
+	exact    map[string]struct{}
+	suffixes map[string]struct{}
+	// Sinkhole 为true时被屏蔽的域名解析为 0.0.0.0，否则返回 ErrBlocked
+	Sinkhole bool
+}
+
+// hostsIgnored 是hosts文件中常见的本机条目，不应被屏蔽
+var hostsIgnored = map[string]bool{
+	"localhost":             true,
+	"localhost.localdomain": true,
+	"local":                 true,
+	"broadcasthost":         true,
+	"ip6-localhost":         true,
+	"ip6-loopback":          true,
+}
+
+// LoadBlocklist 从文件加载屏蔽列表
+// 支持hosts格式（"0.0.0.0 ads.example.com"）与每行一个域名的列表，# 之后的内容为注释
+func LoadBlocklist(path string, sinkhole bool) (*Blocklist, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open blocklist: %w", err)
+	}
+	defer f.Close()
+
+	b := &Blocklist{
+		exact:    make(map[string]struct{}),
+		suffixes: make(map[string]struct{}),
+		Sinkhole: sinkhole,
+	}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if i := strings.IndexByte(line, '#'); i >= 0 {
+			line = line[:i]
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		// hosts格式：第一列为地址，其后为域名
+		if len(fields) > 1 && net.ParseIP(fields[0]) != nil {
+			fields = fields[1:]
+		}
+		for _, name := range fields {
+			b.add(name)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read blocklist: %w", err)
+	}
+	return b, nil
+}
+
+func (b *Blocklist) add(name string) {
+	name = normalizeName(name)
+	if name == "" || hostsIgnored[name] || net.ParseIP(name) != nil {
+		return
+	}
+	if suffix, ok := strings.CutPrefix(name, "*."); ok {
+		b.suffixes[suffix] = struct{}{}
+		return
+	}
+	b.exact[name] = struct{}{}
+}
+
+// Len 返回列表中的条目数
+func (b *Blocklist) Len() int {
+	return len(b.exact) + len(b.suffixes)
+}
+
+// Match 报告域名是否被屏蔽
+func (b *Blocklist) Match(name string) bool {
+	if b == nil {
+		return false
+	}
+	name = normalizeName(name)
+	if _, ok := b.exact[name]; ok {
+		return true
+	}
+	// 逐级检查父域名是否有通配条目
+	for i := strings.IndexByte(name, '.'); i >= 0; i = strings.IndexByte(name, '.') {
+		name = name[i+1:]
+		if _, ok := b.suffixes[name]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+func normalizeName(name string) string {
+	return strings.ToLower(strings.TrimSuffix(name, "."))
+}
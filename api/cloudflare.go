@@ -4,15 +4,124 @@ import (
 	"bytes"
 	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
+	"net/url"
+	"strconv"
 	"time"
 
 	"github.com/HynoR/uscf/internal"
 	"github.com/HynoR/uscf/models"
 )
 
+// apiClient is the HTTP client used for all requests to the Cloudflare API.
+// Like http.DefaultClient it honors HTTPS_PROXY and the related environment variables.
+var apiClient = http.DefaultClient
+
+// SetProxy routes all API requests through the proxy at proxyURL, which may use the
+// http, https or socks5 scheme. An empty proxyURL restores the default client.
+// The MASQUE tunnel does not use this client and is not affected.
+func SetProxy(proxyURL string) error {
+	if proxyURL == "" {
+		apiClient = http.DefaultClient
+		return nil
+	}
+	u, err := url.Parse(proxyURL)
+	if err != nil {
+		return fmt.Errorf("invalid API proxy: %v", err)
+	}
+	switch u.Scheme {
+	case "http", "https", "socks5", "socks5h":
+	default:
+		return fmt.Errorf("invalid API proxy %q: unsupported scheme %q", proxyURL, u.Scheme)
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = http.ProxyURL(u)
+	apiClient = &http.Client{Transport: transport}
+	return nil
+}
+
+// Errors returned by the API functions. Failed requests wrap a *StatusError when the
+// API answered with an error status, or a *url.Error when it could not be reached.
+var (
+	// ErrTOSNotAccepted is returned by Register when the user declines the Terms of Service.
+	ErrTOSNotAccepted = errors.New("user did not accept TOS")
+	// ErrTOSRequired is returned by Register when the Terms of Service were not accepted
+	// in advance and the user cannot be asked, e.g. because stdin is not a terminal.
+	ErrTOSRequired = errors.New("the Terms of Service must be accepted to register")
+	// ErrRateLimited matches a *StatusError for an HTTP 429 response.
+	ErrRateLimited = errors.New("rate limited by the API")
+)
+
+// maxErrorBodySize limits how much of an error response is read.
+const maxErrorBodySize = 64 * 1024
+
+// StatusError reports an unexpected HTTP status from the API, with the structured
+// errors from the response body when it has any.
+type StatusError struct {
+	StatusCode int
+	Status     string
+	Errors     []models.ErrorInfo
+	RetryAfter time.Duration // from the Retry-After header, zero when absent
+}
+
+// newStatusError builds a StatusError from resp and its body.
+func newStatusError(resp *http.Response, body []byte) *StatusError {
+	e := &StatusError{StatusCode: resp.StatusCode, Status: resp.Status}
+	var apiErr models.APIError
+	if json.Unmarshal(body, &apiErr) == nil {
+		e.Errors = apiErr.Errors
+	}
+	if secs, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil && secs > 0 {
+		e.RetryAfter = time.Duration(secs) * time.Second
+	}
+	return e
+}
+
+// readStatusError reads the error response body of resp and returns its StatusError.
+func readStatusError(resp *http.Response) *StatusError {
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, maxErrorBodySize))
+	return newStatusError(resp, body)
+}
+
+func (e *StatusError) Error() string {
+	if len(e.Errors) == 0 {
+		return e.Status
+	}
+	apiErr := models.APIError{Errors: e.Errors}
+	return e.Status + ": " + apiErr.ErrorsAsString("; ")
+}
+
+// Is makes errors.Is(err, ErrRateLimited) report rate limiting.
+func (e *StatusError) Is(target error) bool {
+	return target == ErrRateLimited && e.StatusCode == http.StatusTooManyRequests
+}
+
+// HasErrorMessage reports whether the response listed an error with the given
+// message, such as models.InvalidPublicKey.
+func (e *StatusError) HasErrorMessage(message string) bool {
+	apiErr := models.APIError{Errors: e.Errors}
+	return apiErr.HasErrorMessage(message)
+}
+
+// IsRetryable reports whether an error from the API functions is likely transient:
+// a network failure, a 5xx response or rate limiting. Client errors such as 4xx
+// responses or a declined Terms of Service are permanent.
+func IsRetryable(err error) bool {
+	if errors.Is(err, ErrRateLimited) {
+		return true
+	}
+	var statusErr *StatusError
+	if errors.As(err, &statusErr) {
+		return statusErr.StatusCode >= 500
+	}
+	var urlErr *url.Error
+	return errors.As(err, &urlErr)
+}
+
 // Register creates a new user account by registering a WireGuard public key and generating a random Android-like device identifier.
 // The WireGuard private key isn't stored anywhere, therefore it won't be usable. It's sole purpose is to mimic the Android app's registration process.
 //
@@ -26,7 +135,8 @@ import (
 //
 // Returns:
 //   - models.AccountData: The account data returned from the registration process.
-//   - error:              An error if registration fails at any step.
+//   - error:              An error if registration fails at any step: ErrTOSNotAccepted or ErrTOSRequired
+//     when the Terms of Service were not accepted, a *StatusError for an error response.
 //
 // Example:
 //
@@ -48,10 +158,10 @@ func Register(model, locale, jwt string, acceptTos bool) (models.AccountData, er
 		fmt.Print("You must accept the Terms of Service (https://www.cloudflare.com/application/terms/) to register. Do you agree? (y/n): ")
 		var response string
 		if _, err := fmt.Scanln(&response); err != nil {
-			return models.AccountData{}, fmt.Errorf("failed to read user input: %v", err)
+			return models.AccountData{}, fmt.Errorf("%w: failed to read user input: %v", ErrTOSRequired, err)
 		}
 		if response != "y" {
-			return models.AccountData{}, fmt.Errorf("user did not accept TOS")
+			return models.AccountData{}, ErrTOSNotAccepted
 		}
 	}
 
@@ -86,14 +196,14 @@ func Register(model, locale, jwt string, acceptTos bool) (models.AccountData, er
 		req.Header.Set("CF-Access-Jwt-Assertion", jwt)
 	}
 
-	resp, err := http.DefaultClient.Do(req)
+	resp, err := apiClient.Do(req)
 	if err != nil {
-		return models.AccountData{}, fmt.Errorf("failed to send request: %v", err)
+		return models.AccountData{}, fmt.Errorf("failed to send request: %w", err)
 	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode != http.StatusOK {
-		return models.AccountData{}, fmt.Errorf("failed to register: %v", resp.Status)
+		return models.AccountData{}, fmt.Errorf("failed to register: %w", readStatusError(resp))
 	}
 
 	var accountData models.AccountData
@@ -115,15 +225,16 @@ func Register(model, locale, jwt string, acceptTos bool) (models.AccountData, er
 //
 // Returns:
 //   - models.AccountData: The updated account data.
-//   - error:              An error if the update process fails.
+//   - error:              An error if the update process fails, wrapping a *StatusError with the
+//     API's error list for an error response.
 //
 // Example:
 //
-//	updatedAccount, apiErr, err := EnrollKey(account, pubKey, "PC")
+//	updatedAccount, err := EnrollKey(account, pubKey, "PC")
 //	if err != nil {
 //	    log.Fatalf("Key enrollment failed: %v", err)
 //	}
-func EnrollKey(accountData models.AccountData, pubKey []byte, deviceName string) (models.AccountData, *models.APIError, error) {
+func EnrollKey(accountData models.AccountData, pubKey []byte, deviceName string) (models.AccountData, error) {
 	deviceUpdate := models.DeviceUpdate{
 		Key:     base64.StdEncoding.EncodeToString(pubKey),
 		KeyType: internal.KeyTypeMasque,
@@ -136,12 +247,12 @@ func EnrollKey(accountData models.AccountData, pubKey []byte, deviceName string)
 
 	jsonData, err := json.Marshal(deviceUpdate)
 	if err != nil {
-		return models.AccountData{}, nil, fmt.Errorf("failed to marshal json: %v", err)
+		return models.AccountData{}, fmt.Errorf("failed to marshal json: %v", err)
 	}
 
 	req, err := http.NewRequest("PATCH", internal.ApiUrl+"/"+internal.ApiVersion+"/reg/"+accountData.ID, bytes.NewBuffer(jsonData))
 	if err != nil {
-		return models.AccountData{}, nil, fmt.Errorf("failed to create request: %v", err)
+		return models.AccountData{}, fmt.Errorf("failed to create request: %v", err)
 	}
 
 	for k, v := range internal.Headers {
@@ -149,28 +260,63 @@ func EnrollKey(accountData models.AccountData, pubKey []byte, deviceName string)
 	}
 	req.Header.Set("Authorization", "Bearer "+accountData.Token)
 
-	resp, err := http.DefaultClient.Do(req)
+	resp, err := apiClient.Do(req)
 	if err != nil {
-		return models.AccountData{}, nil, fmt.Errorf("failed to send request: %v", err)
+		return models.AccountData{}, fmt.Errorf("failed to send request: %w", err)
 	}
 	defer resp.Body.Close()
 
 	body, err := io.ReadAll(resp.Body)
 	if err != nil {
-		return models.AccountData{}, nil, fmt.Errorf("failed to read response body: %v", err)
+		return models.AccountData{}, fmt.Errorf("failed to read response body: %v", err)
 	}
 
 	if resp.StatusCode != http.StatusOK {
-		var apiErr models.APIError
-		if err := json.Unmarshal(body, &apiErr); err != nil {
-			return models.AccountData{}, nil, fmt.Errorf("failed to parse error response: %v", err)
-		}
-		return models.AccountData{}, &apiErr, fmt.Errorf("failed to update: %s", resp.Status)
+		return models.AccountData{}, fmt.Errorf("failed to update: %w", newStatusError(resp, body))
 	}
 
 	if err := json.Unmarshal(body, &accountData); err != nil {
-		return models.AccountData{}, nil, fmt.Errorf("failed to decode response: %v", err)
+		return models.AccountData{}, fmt.Errorf("failed to decode response: %v", err)
 	}
 
-	return accountData, nil, nil
+	return accountData, nil
+}
+
+// ErrDeviceNotFound is returned by DeleteDevice when the device no longer exists.
+var ErrDeviceNotFound = errors.New("device not found")
+
+// DeleteDevice removes a registered device from the account.
+//
+// This function sends a DELETE request for the device registration.
+//
+// Parameters:
+//   - id: string - The device identifier returned by registration.
+//   - token: string - The access token of the device.
+//
+// Returns:
+//   - error: ErrDeviceNotFound if the device is already gone, or another error if the request fails.
+func DeleteDevice(id, token string) error {
+	req, err := http.NewRequest("DELETE", internal.ApiUrl+"/"+internal.ApiVersion+"/reg/"+id, nil)
+	if err != nil {
+		return fmt.Errorf("failed to create request: %v", err)
+	}
+
+	for k, v := range internal.Headers {
+		req.Header.Set(k, v)
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+
+	resp, err := apiClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to send request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK, http.StatusNoContent:
+		return nil
+	case http.StatusNotFound:
+		return ErrDeviceNotFound
+	}
+	return fmt.Errorf("failed to delete device: %w", readStatusError(resp))
 }
@@ -0,0 +1,111 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/HynoR/uscf/internal"
+	"github.com/HynoR/uscf/internal/logger"
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/http3"
+)
+
+// errTunnelRejected 表示服务端拒绝了 CONNECT-IP 请求
+var errTunnelRejected = errors.New("tunnel connection failed")
+
+// rejectedError 记录服务端拒绝 CONNECT-IP 请求时的响应状态，与 errTunnelRejected 匹配
+type rejectedError struct {
+	StatusCode int
+	Status     string
+}
+
+func (e *rejectedError) Error() string {
+	return fmt.Sprintf("%v: %s", errTunnelRejected, e.Status)
+}
+
+func (e *rejectedError) Is(target error) bool {
+	return target == errTunnelRejected
+}
+
+// identityRejected 报告 err 是否为服务端以 401 或 403 拒绝了设备身份
+func identityRejected(err error) bool {
+	var rejected *rejectedError
+	return errors.As(err, &rejected) &&
+		(rejected.StatusCode == http.StatusUnauthorized || rejected.StatusCode == http.StatusForbidden)
+}
+
+// IPConn 是隧道转发使用的 CONNECT-IP 连接，*connectip.Conn 实现了该接口
+type IPConn interface {
+	ReadPacket(b []byte, allowAny bool) (int, error)
+	WritePacket(b []byte) (icmp []byte, err error)
+	Close() error
+}
+
+// Connector 建立一次隧道连接，返回用于转发的连接以及释放全部资源的函数
+// MaintainTunnel 通过它建立连接，测试中可以替换为返回预设结果的实现
+type Connector interface {
+	Connect(ctx context.Context, config ConnectionConfig) (IPConn, func(), error)
+}
+
+// CloseTimeout 是关闭隧道连接时等待 QUIC CONNECTION_CLOSE 发出的最长时间
+const CloseTimeout = 500 * time.Millisecond
+
+// CloseQUIC 以 H3_NO_ERROR 关闭 QUIC 连接，使服务端立即释放连接状态，而不必等到空闲超时
+// 尽力而为，最多等待 CloseTimeout
+func CloseQUIC(conn quic.Connection) {
+	if conn == nil {
+		return
+	}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		conn.CloseWithError(quic.ApplicationErrorCode(http3.ErrCodeNoError), "")
+	}()
+	select {
+	case <-done:
+	case <-time.After(CloseTimeout):
+		logger.Logger.Debugf("Timed out closing QUIC connection")
+	}
+}
+
+// MasqueConnector 通过 ConnectTunnel 与 config.Endpoint 建立 MASQUE 连接，是默认的 Connector
+type MasqueConnector struct{}
+
+func (MasqueConnector) Connect(ctx context.Context, config ConnectionConfig) (IPConn, func(), error) {
+	connectURI := config.ConnectURI
+	if connectURI == "" {
+		connectURI = internal.ConnectURI
+	}
+	udpConn, tr, conn, ipConn, rsp, err := ConnectTunnel(
+		ctx,
+		config.TLSConfig,
+		internal.DefaultQuicConfig(config.KeepAlivePeriod, config.InitialPacketSize),
+		connectURI,
+		config.Endpoint,
+		config.UDPOptions,
+	)
+	if err != nil {
+		return nil, nil, err
+	}
+	release := func() {
+		if ipConn != nil {
+			ipConn.Close()
+		}
+		// 在关闭UDP套接字之前通知服务端关闭连接
+		CloseQUIC(conn)
+		if udpConn != nil {
+			udpConn.Close()
+		}
+		if tr != nil {
+			tr.Close()
+		}
+	}
+	if rsp.StatusCode != http.StatusOK {
+		release()
+		return nil, nil, &rejectedError{StatusCode: rsp.StatusCode, Status: rsp.Status}
+	}
+	return ipConn, release, nil
+}
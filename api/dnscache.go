@@ -0,0 +1,328 @@
+package api
+
+import (
+	"container/list"
+	"context"
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ttlUnknown 表示无法从应答中获取TTL
+const ttlUnknown time.Duration = -1
+
+const (
+	// defaultNegativeTTL 是查询失败结果的默认缓存时间
+	defaultNegativeTTL = 30 * time.Second
+	// dnsSweepInterval 是写入时清理过期条目的最小间隔
+	dnsSweepInterval = time.Minute
+)
+
+// DNSCacheEntry 表示缓存中的一个条目
+// Err 不为空时表示这是一个查询失败的否定缓存条目
+type DNSCacheEntry struct {
+	IP        net.IP   // 首选地址，即 IPs[0]
+	IPs       []net.IP // 全部地址，IPv4在前
+	Err       error
+	ExpiresAt time.Time
+	TTL       time.Duration // 写入时的缓存时间，用于计算提前刷新的窗口
+}
+
+// dnsCacheItem 是 lru 链表中存放的元素
+type dnsCacheItem struct {
+	name       string
+	entry      DNSCacheEntry
+	prefetched bool // 已为当前条目发起过提前刷新
+}
+
+// dnsLookupFunc 执行一次上游查询，返回地址与记录TTL
+type dnsLookupFunc func(ctx context.Context, name string) ([]net.IP, time.Duration, error)
+
+// dnsFlight 是一次进行中的上游查询，由同一域名的所有并发调用者共享
+// 所有等待者都取消后查询随之取消，不会继续占用上游连接
+type dnsFlight struct {
+	done    chan struct{}
+	ips     []net.IP
+	err     error
+	waiters int
+	cancel  context.CancelFunc
+}
+
+// dnsCache 是各DNS解析器共享的缓存层，负责缓存、TTL限制与查询合并
+type dnsCache struct {
+	// 缓存过期时间（秒），无法获取记录TTL时使用
+	CacheTTL int
+	// 记录TTL的下限与上限，MaxTTL为0时使用CacheTTL作为上限
+	MinTTL time.Duration
+	MaxTTL time.Duration
+	// 查询失败结果的缓存时间，为0时使用默认值30秒，小于0时禁用否定缓存
+	NegativeTTL time.Duration
+	// 缓存的最大条目数，超出时淘汰最久未使用的条目，为0时不限制
+	MaxEntries int
+	// 提前刷新窗口占TTL的比例，条目在剩余时间少于该比例时被访问会在后台重新查询，
+	// 期间继续返回缓存的结果，为0时不提前刷新
+	PrefetchWindow float64
+	// 缓存，lru 中越靠前的条目越近被使用
+	cache     map[string]*list.Element
+	lru       *list.List
+	lastSweep time.Time
+	cacheLock sync.Mutex
+	// 合并同一域名的并发查询，键为域名
+	flights   map[string]*dnsFlight
+	flightsMu sync.Mutex
+	// 屏蔽列表，可在运行时替换
+	blocklist atomic.Pointer[Blocklist]
+	// 静态域名映射，优先于屏蔽列表、缓存与上游查询
+	hosts map[string]net.IP
+}
+
+func newDNSCache(cacheTTLSeconds int) dnsCache {
+	if cacheTTLSeconds <= 0 {
+		cacheTTLSeconds = 600 // 默认10分钟
+	}
+	return dnsCache{
+		CacheTTL: cacheTTLSeconds,
+		cache:    make(map[string]*list.Element),
+		lru:      list.New(),
+		flights:  make(map[string]*dnsFlight),
+	}
+}
+
+// resolve 先查询缓存，未命中时通过 lookup 查询上游并写入缓存，返回的地址列表不为空
+func (c *dnsCache) resolve(ctx context.Context, name string, lookup dnsLookupFunc) ([]net.IP, error) {
+	if ip := net.ParseIP(name); ip != nil {
+		return []net.IP{ip}, nil
+	}
+
+	if ip, ok := c.hosts[normalizeName(name)]; ok {
+		return []net.IP{ip}, nil
+	}
+
+	// 屏蔽检查在缓存之前进行，使替换列表后立即生效
+	if list := c.blocklist.Load(); list.Match(name) {
+		if list.Sinkhole {
+			return []net.IP{net.IPv4zero}, nil
+		}
+		return nil, fmt.Errorf("%s: %w", name, ErrBlocked)
+	}
+
+	// 先检查缓存，如果缓存中存在且未过期，直接返回（包括缓存的失败结果）
+	if entry, prefetch, ok := c.get(name); ok {
+		if prefetch {
+			c.prefetch(name, lookup)
+		}
+		return entry.IPs, entry.Err
+	}
+
+	// 缓存不存在或已过期，进行实际的DNS查询
+	// 同一域名的并发查询合并为一次上游查询，实现"查询合并"
+	c.flightsMu.Lock()
+	f, ok := c.flights[name]
+	if !ok {
+		f = c.startFlight(name, lookup)
+	}
+	f.waiters++
+	c.flightsMu.Unlock()
+
+	// 等待DNS查询完成或上下文取消
+	select {
+	case <-ctx.Done():
+		c.leaveFlight(name, f)
+		return nil, ctx.Err()
+	case <-f.done:
+		return f.ips, f.err
+	}
+}
+
+// startFlight 发起一次上游查询并登记到 flights，调用者需持有 flightsMu
+func (c *dnsCache) startFlight(name string, lookup dnsLookupFunc) *dnsFlight {
+	lookupCtx, cancel := context.WithCancel(context.Background())
+	f := &dnsFlight{done: make(chan struct{}), cancel: cancel}
+	c.flights[name] = f
+	go c.runFlight(lookupCtx, name, f, lookup)
+	return f
+}
+
+// prefetch 在后台刷新即将过期的条目，已有进行中的查询时不重复发起
+// 刷新查询自身占用一个等待者名额，不会因其他调用者取消而中断
+func (c *dnsCache) prefetch(name string, lookup dnsLookupFunc) {
+	c.flightsMu.Lock()
+	defer c.flightsMu.Unlock()
+	if _, ok := c.flights[name]; ok {
+		return
+	}
+	c.startFlight(name, lookup).waiters++
+}
+
+// runFlight 执行一次共享的上游查询并写入缓存
+// 查询因所有等待者离开而取消时不缓存失败结果
+func (c *dnsCache) runFlight(ctx context.Context, name string, f *dnsFlight, lookup dnsLookupFunc) {
+	defer f.cancel()
+	ips, ttl, err := lookup(ctx, name)
+	if err == nil {
+		c.cacheLock.Lock()
+		ttl = c.entryTTL(ttl)
+		c.set(name, DNSCacheEntry{IP: ips[0], IPs: ips, ExpiresAt: time.Now().Add(ttl), TTL: ttl})
+		c.cacheLock.Unlock()
+	} else if ctx.Err() == nil {
+		c.storeNegative(name, err)
+	}
+
+	c.flightsMu.Lock()
+	if c.flights[name] == f {
+		delete(c.flights, name)
+	}
+	f.ips, f.err = ips, err
+	c.flightsMu.Unlock()
+	close(f.done)
+}
+
+// leaveFlight 在调用者放弃等待时调用，最后一个等待者离开时取消上游查询
+// 取消的查询立即从 flights 中移除，之后的调用者会发起新的查询
+func (c *dnsCache) leaveFlight(name string, f *dnsFlight) {
+	c.flightsMu.Lock()
+	defer c.flightsMu.Unlock()
+	f.waiters--
+	if f.waiters > 0 {
+		return
+	}
+	f.cancel()
+	if c.flights[name] == f {
+		delete(c.flights, name)
+	}
+}
+
+// SetHosts 设置静态域名映射，匹配不区分大小写且不受TTL影响
+// 必须在解析器开始使用前调用
+func (c *dnsCache) SetHosts(hosts map[string]net.IP) {
+	c.hosts = make(map[string]net.IP, len(hosts))
+	for name, ip := range hosts {
+		c.hosts[normalizeName(name)] = ip
+	}
+}
+
+// SetBlocklist 替换屏蔽列表，为nil时不屏蔽任何域名
+func (c *dnsCache) SetBlocklist(list *Blocklist) {
+	c.blocklist.Store(list)
+}
+
+// storeNegative 缓存查询失败的结果，使重复查询快速失败
+// 不会覆盖仍然有效的成功结果
+func (c *dnsCache) storeNegative(name string, err error) {
+	ttl := c.NegativeTTL
+	if ttl < 0 {
+		return
+	}
+	if ttl == 0 {
+		ttl = defaultNegativeTTL
+	}
+
+	now := time.Now()
+	c.cacheLock.Lock()
+	defer c.cacheLock.Unlock()
+	if elem, ok := c.cache[name]; ok {
+		if entry := elem.Value.(*dnsCacheItem).entry; entry.Err == nil && now.Before(entry.ExpiresAt) {
+			return
+		}
+	}
+	c.set(name, DNSCacheEntry{Err: err, ExpiresAt: now.Add(ttl)})
+}
+
+// get 返回未过期的缓存条目，并将其标记为最近使用
+// prefetch 表示成功条目已进入提前刷新窗口且尚未刷新过，由调用者发起刷新
+func (c *dnsCache) get(name string) (entry DNSCacheEntry, prefetch, ok bool) {
+	c.cacheLock.Lock()
+	defer c.cacheLock.Unlock()
+
+	elem, ok := c.cache[name]
+	if !ok {
+		return DNSCacheEntry{}, false, false
+	}
+	item := elem.Value.(*dnsCacheItem)
+	remaining := time.Until(item.entry.ExpiresAt)
+	if remaining <= 0 {
+		return DNSCacheEntry{}, false, false
+	}
+	c.lru.MoveToFront(elem)
+	if c.PrefetchWindow > 0 && item.entry.Err == nil && !item.prefetched &&
+		remaining < time.Duration(float64(item.entry.TTL)*c.PrefetchWindow) {
+		item.prefetched = true
+		prefetch = true
+	}
+	return item.entry, prefetch, true
+}
+
+// set 写入缓存条目，必要时清理过期条目并淘汰最久未使用的条目，调用者需持有 cacheLock
+func (c *dnsCache) set(name string, entry DNSCacheEntry) {
+	now := time.Now()
+	if now.Sub(c.lastSweep) >= dnsSweepInterval {
+		c.sweep(now)
+	}
+
+	if elem, ok := c.cache[name]; ok {
+		item := elem.Value.(*dnsCacheItem)
+		item.entry = entry
+		item.prefetched = false
+		c.lru.MoveToFront(elem)
+		return
+	}
+	c.cache[name] = c.lru.PushFront(&dnsCacheItem{name: name, entry: entry})
+
+	for c.MaxEntries > 0 && c.lru.Len() > c.MaxEntries {
+		c.remove(c.lru.Back())
+	}
+}
+
+// sweep 删除所有已过期的条目，调用者需持有 cacheLock
+func (c *dnsCache) sweep(now time.Time) {
+	c.lastSweep = now
+	for elem := c.lru.Back(); elem != nil; {
+		prev := elem.Prev()
+		if !now.Before(elem.Value.(*dnsCacheItem).entry.ExpiresAt) {
+			c.remove(elem)
+		}
+		elem = prev
+	}
+}
+
+func (c *dnsCache) remove(elem *list.Element) {
+	c.lru.Remove(elem)
+	delete(c.cache, elem.Value.(*dnsCacheItem).name)
+}
+
+// Len 返回缓存中的条目数（包括尚未清理的过期条目）
+func (c *dnsCache) Len() int {
+	c.cacheLock.Lock()
+	defer c.cacheLock.Unlock()
+	return c.lru.Len()
+}
+
+// entryTTL 将记录TTL限制在 [MinTTL, MaxTTL] 范围内，TTL未知时使用 CacheTTL
+func (c *dnsCache) entryTTL(ttl time.Duration) time.Duration {
+	flat := time.Duration(c.CacheTTL) * time.Second
+	if ttl == ttlUnknown {
+		return flat
+	}
+
+	maxTTL := c.MaxTTL
+	if maxTTL <= 0 {
+		maxTTL = flat
+	}
+	if ttl < c.MinTTL {
+		ttl = c.MinTTL
+	}
+	if ttl > maxTTL {
+		ttl = maxTTL
+	}
+	return ttl
+}
+
+// ClearCache 清除DNS缓存
+func (c *dnsCache) ClearCache() {
+	c.cacheLock.Lock()
+	defer c.cacheLock.Unlock()
+	c.cache = make(map[string]*list.Element)
+	c.lru.Init()
+}
@@ -0,0 +1,102 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"net"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestResolveCancelLeavesNoGoroutines(t *testing.T) {
+	c := newDNSCache(60)
+	var lookups atomic.Int32
+	started := make(chan struct{}, 2)
+	lookup := func(ctx context.Context, name string) ([]net.IP, time.Duration, error) {
+		lookups.Add(1)
+		started <- struct{}{}
+		// 上游查询一直挂起，直到被取消
+		<-ctx.Done()
+		return nil, ttlUnknown, ctx.Err()
+	}
+
+	before := runtime.NumGoroutine()
+
+	// 两个调用者合并为一次查询，第一个离开时查询继续进行
+	ctx1, cancel1 := context.WithCancel(context.Background())
+	ctx2, cancel2 := context.WithCancel(context.Background())
+	var wg sync.WaitGroup
+	errs := make([]error, 2)
+	for i, ctx := range []context.Context{ctx1, ctx2} {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, errs[i] = c.resolve(ctx, "example.com", lookup)
+		}()
+	}
+	<-started
+	waitFor(t, func() bool {
+		c.flightsMu.Lock()
+		defer c.flightsMu.Unlock()
+		f := c.flights["example.com"]
+		return f != nil && f.waiters == 2
+	})
+
+	cancel1()
+	time.Sleep(20 * time.Millisecond)
+	c.flightsMu.Lock()
+	f := c.flights["example.com"]
+	c.flightsMu.Unlock()
+	if f == nil {
+		t.Fatal("flight removed while a waiter remains")
+	}
+	select {
+	case <-f.done:
+		t.Fatal("lookup finished while a waiter remains")
+	default:
+	}
+
+	// 最后一个等待者离开后上游查询被取消，其 goroutine 随之退出
+	cancel2()
+	wg.Wait()
+	for i, err := range errs {
+		if !errors.Is(err, context.Canceled) {
+			t.Errorf("caller %d got %v, want context.Canceled", i+1, err)
+		}
+	}
+	select {
+	case <-f.done:
+	case <-time.After(time.Second):
+		t.Fatal("lookup not canceled after the last waiter left")
+	}
+	waitFor(t, func() bool { return runtime.NumGoroutine() <= before })
+
+	c.flightsMu.Lock()
+	remaining := len(c.flights)
+	c.flightsMu.Unlock()
+	if remaining != 0 {
+		t.Errorf("%d flights left after cancellation", remaining)
+	}
+	// 取消的查询不写入否定缓存，之后的调用者会重新查询
+	if _, _, ok := c.get("example.com"); ok {
+		t.Error("canceled lookup was cached")
+	}
+	if lookups.Load() != 1 {
+		t.Errorf("%d upstream lookups, want 1", lookups.Load())
+	}
+}
+
+// waitFor 在一秒内轮询 cond，超时后使测试失败
+func waitFor(t *testing.T, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("condition not met within 1s")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
@@ -0,0 +1,219 @@
+package api
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+var (
+	// errDNSTruncated 表示UDP响应被截断，需要使用其他方式重新查询
+	errDNSTruncated = errors.New("dns response truncated")
+	// errDNSMismatch 表示响应与查询不匹配
+	errDNSMismatch = errors.New("unexpected dns response")
+)
+
+// buildDNSQuery 构造一个请求递归解析的DNS查询报文
+func buildDNSQuery(name string, qtype dnsmessage.Type) ([]byte, uint16, error) {
+	if !strings.HasSuffix(name, ".") {
+		name += "."
+	}
+	qname, err := dnsmessage.NewName(name)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	var idBuf [2]byte
+	if _, err := rand.Read(idBuf[:]); err != nil {
+		return nil, 0, err
+	}
+	id := binary.BigEndian.Uint16(idBuf[:])
+
+	msg := dnsmessage.Message{
+		Header: dnsmessage.Header{ID: id, RecursionDesired: true},
+		Questions: []dnsmessage.Question{{
+			Name:  qname,
+			Type:  qtype,
+			Class: dnsmessage.ClassINET,
+		}},
+	}
+	packed, err := msg.Pack()
+	return packed, id, err
+}
+
+// parseDNSResponse 解析DNS响应，返回地址列表以及应答中最小的TTL
+func parseDNSResponse(b []byte, id uint16, name string) ([]net.IP, time.Duration, error) {
+	var p dnsmessage.Parser
+	header, err := p.Start(b)
+	if err != nil {
+		return nil, 0, err
+	}
+	if header.ID != id || !header.Response {
+		return nil, 0, errDNSMismatch
+	}
+	if header.Truncated {
+		return nil, 0, errDNSTruncated
+	}
+	switch header.RCode {
+	case dnsmessage.RCodeSuccess:
+	case dnsmessage.RCodeNameError:
+		return nil, 0, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+	default:
+		return nil, 0, &net.DNSError{Err: fmt.Sprintf("server returned %s", header.RCode), Name: name}
+	}
+	if err := p.SkipAllQuestions(); err != nil {
+		return nil, 0, err
+	}
+
+	var ips []net.IP
+	var minTTL uint32
+	first := true
+	for {
+		h, err := p.AnswerHeader()
+		if errors.Is(err, dnsmessage.ErrSectionDone) {
+			break
+		}
+		if err != nil {
+			return nil, 0, err
+		}
+		if first || h.TTL < minTTL {
+			minTTL = h.TTL
+			first = false
+		}
+		switch h.Type {
+		case dnsmessage.TypeA:
+			r, err := p.AResource()
+			if err != nil {
+				return nil, 0, err
+			}
+			ips = append(ips, net.IP(r.A[:]))
+		case dnsmessage.TypeAAAA:
+			r, err := p.AAAAResource()
+			if err != nil {
+				return nil, 0, err
+			}
+			ips = append(ips, net.IP(r.AAAA[:]))
+		default:
+			if err := p.SkipAnswer(); err != nil {
+				return nil, 0, err
+			}
+		}
+	}
+	return ips, time.Duration(minTTL) * time.Second, nil
+}
+
+// exchangeUDP 通过UDP向指定DNS服务器发送单个查询
+func exchangeUDP(ctx context.Context, server, name string, qtype dnsmessage.Type) ([]net.IP, time.Duration, error) {
+	query, id, err := buildDNSQuery(name, qtype)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "udp", server)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	// 上下文取消时立即中断读取，避免查询在调用者离开后继续等待响应
+	stop := context.AfterFunc(ctx, func() {
+		conn.SetDeadline(time.Now())
+	})
+	defer stop()
+
+	if _, err := conn.Write(query); err != nil {
+		return nil, 0, err
+	}
+
+	buf := make([]byte, 1232)
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil, 0, ctx.Err()
+			}
+			return nil, 0, err
+		}
+		ips, ttl, err := parseDNSResponse(buf[:n], id, name)
+		if errors.Is(err, errDNSMismatch) {
+			// 忽略不匹配的响应，继续等待
+			continue
+		}
+		return ips, ttl, err
+	}
+}
+
+// dnsExchangeFunc 发送单个DNS查询，返回地址列表与最小TTL
+type dnsExchangeFunc func(ctx context.Context, name string, qtype dnsmessage.Type) ([]net.IP, time.Duration, error)
+
+// queryAddrs 同时查询A与AAAA记录，返回全部地址（IPv4在前）及其中最小的TTL
+// 任一查询响应被截断时返回 errDNSTruncated
+func queryAddrs(ctx context.Context, name string, exchange dnsExchangeFunc) ([]net.IP, time.Duration, error) {
+	type answer struct {
+		ips []net.IP
+		ttl time.Duration
+		err error
+	}
+	v4 := make(chan answer, 1)
+	v6 := make(chan answer, 1)
+	go func() {
+		ips, ttl, err := exchange(ctx, name, dnsmessage.TypeA)
+		v4 <- answer{ips, ttl, err}
+	}()
+	go func() {
+		ips, ttl, err := exchange(ctx, name, dnsmessage.TypeAAAA)
+		v6 <- answer{ips, ttl, err}
+	}()
+	a, aaaa := <-v4, <-v6
+
+	if errors.Is(a.err, errDNSTruncated) || errors.Is(aaaa.err, errDNSTruncated) {
+		return nil, 0, errDNSTruncated
+	}
+
+	var ips []net.IP
+	ttl := ttlUnknown
+	for _, ans := range []answer{a, aaaa} {
+		if ans.err == nil && len(ans.ips) > 0 {
+			ips = append(ips, ans.ips...)
+			if ttl == ttlUnknown || ans.ttl < ttl {
+				ttl = ans.ttl
+			}
+		}
+	}
+	if len(ips) > 0 {
+		return ips, ttl, nil
+	}
+	if a.err != nil {
+		return nil, 0, a.err
+	}
+	if aaaa.err != nil {
+		return nil, 0, aaaa.err
+	}
+	return nil, 0, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+}
+
+// sortAddrs 将地址按IPv4在前、IPv6在后排序，同族地址保持原有顺序
+func sortAddrs(ips []net.IP) []net.IP {
+	sorted := make([]net.IP, 0, len(ips))
+	for _, ip := range ips {
+		if ip.To4() != nil {
+			sorted = append(sorted, ip)
+		}
+	}
+	for _, ip := range ips {
+		if ip.To4() == nil {
+			sorted = append(sorted, ip)
+		}
+	}
+	return sorted
+}
@@ -0,0 +1,110 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// DefaultDoHEndpoint 是默认的DNS-over-HTTPS服务地址
+const DefaultDoHEndpoint = "https://cloudflare-dns.com/dns-query"
+
+// maxDoHResponseSize 限制DoH响应体大小，DNS报文最大为64KiB
+const maxDoHResponseSize = 64 * 1024
+
+// DoHResolver 实现了基于DNS-over-HTTPS (RFC 8484) 的带缓存解析器
+type DoHResolver struct {
+	dnsCache
+	// DoH服务地址，如 "https://cloudflare-dns.com/dns-query"
+	Endpoint string
+	// 单次查询的超时时间
+	Timeout time.Duration
+	client  *http.Client
+}
+
+// NewDoHResolver 创建一个新的DoH解析器
+// endpoint: DoH服务地址，为空时使用 DefaultDoHEndpoint
+// dial: 建立HTTPS连接使用的拨号函数，通常为隧道内的网络栈，以避免查询泄漏到隧道外
+// timeout: 单次查询的超时时间
+// cacheTTLSeconds: 缓存有效期（秒）
+func NewDoHResolver(endpoint string, dial func(ctx context.Context, network, addr string) (net.Conn, error), timeout time.Duration, cacheTTLSeconds int) *DoHResolver {
+	if endpoint == "" {
+		endpoint = DefaultDoHEndpoint
+	}
+	if timeout <= 0 {
+		timeout = 5 * time.Second
+	}
+
+	transport := &http.Transport{
+		DialContext:         dial,
+		ForceAttemptHTTP2:   true,
+		MaxIdleConns:        4,
+		IdleConnTimeout:     90 * time.Second,
+		TLSHandshakeTimeout: timeout,
+	}
+
+	return &DoHResolver{
+		dnsCache: newDNSCache(cacheTTLSeconds),
+		Endpoint: endpoint,
+		Timeout:  timeout,
+		client:   &http.Client{Transport: transport},
+	}
+}
+
+// Resolve 实现NameResolver接口，解析域名为IP地址
+func (r *DoHResolver) Resolve(ctx context.Context, name string) (context.Context, net.IP, error) {
+	ips, err := r.resolve(ctx, name, r.lookup)
+	if err != nil {
+		return ctx, nil, err
+	}
+	return ctx, ips[0], nil
+}
+
+// ResolveAll 返回域名的全部地址，IPv4在前，首个地址与 Resolve 的结果相同
+func (r *DoHResolver) ResolveAll(ctx context.Context, name string) ([]net.IP, error) {
+	return r.resolve(ctx, name, r.lookup)
+}
+
+// lookup 通过DoH同时查询A与AAAA记录
+func (r *DoHResolver) lookup(ctx context.Context, name string) ([]net.IP, time.Duration, error) {
+	ctx, cancel := context.WithTimeout(ctx, r.Timeout)
+	defer cancel()
+	return queryAddrs(ctx, name, r.exchange)
+}
+
+// exchange 通过HTTP POST发送单个DNS查询
+func (r *DoHResolver) exchange(ctx context.Context, name string, qtype dnsmessage.Type) ([]net.IP, time.Duration, error) {
+	query, id, err := buildDNSQuery(name, qtype)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, r.Endpoint, bytes.NewReader(query))
+	if err != nil {
+		return nil, 0, err
+	}
+	req.Header.Set("Content-Type", "application/dns-message")
+	req.Header.Set("Accept", "application/dns-message")
+
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, 0, fmt.Errorf("doh query failed: %s", resp.Status)
+	}
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxDoHResponseSize))
+	if err != nil {
+		return nil, 0, err
+	}
+	return parseDNSResponse(body, id, name)
+}
@@ -0,0 +1,44 @@
+package api
+
+import (
+	"net"
+	"time"
+
+	"github.com/HynoR/uscf/internal/logger"
+)
+
+// EventHandler 接收 MaintainTunnel 的连接生命周期事件，供嵌入方构建界面或告警
+// 回调在 MaintainTunnel 的协程中同步调用，不应阻塞
+type EventHandler interface {
+	// OnConnecting 在开始建立连接时调用，attempt 是连续失败后的第几次尝试（从1开始）
+	OnConnecting(endpoint *net.UDPAddr, attempt int)
+	// OnConnected 在握手完成、隧道可以转发数据时调用
+	OnConnected(endpoint *net.UDPAddr, handshakeRTT time.Duration)
+	// OnDisconnected 在连接尝试失败或已建立的连接断开时调用
+	// 连接没有出错地结束（如上下文取消或空闲关闭）时 err 为 nil
+	OnDisconnected(err error)
+	// OnReconnectScheduled 在出错后等待重连前调用
+	OnReconnectScheduled(delay time.Duration)
+}
+
+// LogEvents 是默认的 EventHandler，将事件写入日志
+// 自定义的 EventHandler 可以嵌入它以保留日志输出
+type LogEvents struct{}
+
+func (LogEvents) OnConnecting(endpoint *net.UDPAddr, attempt int) {
+	logger.Logger.Infof("Establishing MASQUE connection to %s:%d (attempt #%d)", endpoint.IP, endpoint.Port, attempt)
+}
+
+func (LogEvents) OnConnected(_ *net.UDPAddr, handshakeRTT time.Duration) {
+	logger.Logger.Infof("Connected to MASQUE server in %v", handshakeRTT.Round(time.Millisecond))
+}
+
+func (LogEvents) OnDisconnected(err error) {
+	if err != nil {
+		logger.Logger.Warnf("Connection error: %v", err)
+	}
+}
+
+func (LogEvents) OnReconnectScheduled(delay time.Duration) {
+	logger.Logger.Infof("Will retry in %v", delay.Round(time.Millisecond))
+}
@@ -0,0 +1,247 @@
+package api
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hkdf"
+	"crypto/sha256"
+	"encoding/binary"
+	"net"
+
+	"github.com/quic-go/quic-go/quicvarint"
+)
+
+// quicV1InitialSalt 是 QUIC v1 派生 Initial 密钥使用的盐值（RFC 9001 5.2）
+var quicV1InitialSalt = []byte{
+	0x38, 0x76, 0x2c, 0xf7, 0xf5, 0x59, 0x34, 0xb3, 0x4d, 0x17,
+	0x9a, 0xe6, 0xa4, 0xc8, 0x0c, 0xad, 0xcc, 0xbb, 0x7f, 0x0a,
+}
+
+// maxFragmentGrowth 是拆分 CRYPTO 帧时 Initial 数据包最多允许增长的字节数，
+// 数据包中的 PADDING 不足以容纳新增的帧头时使用
+const maxFragmentGrowth = 32
+
+// fragmentConn 在发送客户端 Initial 数据包时，将其中的 CRYPTO 帧拆分为多个小帧并倒序排列，
+// 使 ClientHello（包括 SNI）不再以连续数据出现在数据包中
+// 只嵌入 net.PacketConn 接口，避免 quic-go 绕过 WriteTo 直接调用 WriteMsgUDP
+type fragmentConn struct {
+	net.PacketConn
+	size int
+}
+
+// SetReadBuffer 与 SetWriteBuffer 转发给底层的UDP连接，quic-go 会通过它们调整缓冲区大小
+func (c *fragmentConn) SetReadBuffer(bytes int) error {
+	return c.PacketConn.(*net.UDPConn).SetReadBuffer(bytes)
+}
+
+func (c *fragmentConn) SetWriteBuffer(bytes int) error {
+	return c.PacketConn.(*net.UDPConn).SetWriteBuffer(bytes)
+}
+
+func (c *fragmentConn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	out, ok := fragmentInitial(p, c.size)
+	if !ok {
+		return c.PacketConn.WriteTo(p, addr)
+	}
+	if _, err := c.PacketConn.WriteTo(out, addr); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// fragmentInitial 解密客户端 Initial 数据包，重排其中的 CRYPTO 帧后重新加密
+// 不是 QUIC v1 客户端 Initial 数据包、无法解密或包含其他帧时返回 false，由调用方原样发送
+func fragmentInitial(p []byte, size int) ([]byte, bool) {
+	// 长包头且类型为 Initial
+	if len(p) < 7 || p[0]&0xf0 != 0xc0 || binary.BigEndian.Uint32(p[1:5]) != 1 {
+		return nil, false
+	}
+	pos := 5
+	dcidLen := int(p[pos])
+	pos++
+	if dcidLen > 20 || pos+dcidLen >= len(p) {
+		return nil, false
+	}
+	dcid := p[pos : pos+dcidLen]
+	pos += dcidLen
+	pos += 1 + int(p[pos])
+	if pos >= len(p) {
+		return nil, false
+	}
+	tokenLen, n, err := quicvarint.Parse(p[pos:])
+	if err != nil || tokenLen > uint64(len(p)) {
+		return nil, false
+	}
+	pos += n + int(tokenLen)
+	if pos >= len(p) {
+		return nil, false
+	}
+	length, lenBytes, err := quicvarint.Parse(p[pos:])
+	if err != nil {
+		return nil, false
+	}
+	lengthPos := pos
+	pnOffset := pos + lenBytes
+	end := pnOffset + int(length)
+	if length < 20 || end > len(p) {
+		return nil, false
+	}
+
+	key, iv, hp := initialClientKeys(dcid)
+	hpBlock, err := aes.NewCipher(hp)
+	if err != nil {
+		return nil, false
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, false
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, false
+	}
+
+	// 去除包头保护
+	pkt := append([]byte(nil), p[:end]...)
+	mask := make([]byte, aes.BlockSize)
+	hpBlock.Encrypt(mask, pkt[pnOffset+4:pnOffset+4+aes.BlockSize])
+	pkt[0] ^= mask[0] & 0x0f
+	pnLen := int(pkt[0]&0x03) + 1
+	var pn uint64
+	for i := 0; i < pnLen; i++ {
+		pkt[pnOffset+i] ^= mask[1+i]
+		pn = pn<<8 | uint64(pkt[pnOffset+i])
+	}
+
+	nonce := append([]byte(nil), iv...)
+	for i := 0; i < 8; i++ {
+		nonce[len(nonce)-1-i] ^= byte(pn >> (8 * i))
+	}
+	header := pkt[:pnOffset+pnLen]
+	payload, err := aead.Open(nil, nonce, pkt[pnOffset+pnLen:], header)
+	if err != nil {
+		return nil, false
+	}
+
+	// 帧头开销超出允许的增长时增大每帧的大小
+	var newPayload []byte
+	for ok := false; !ok; size *= 2 {
+		var more bool
+		newPayload, ok, more = splitCrypto(payload, size, len(payload)+maxFragmentGrowth)
+		if !ok && !more {
+			return nil, false
+		}
+	}
+
+	// Length 字段保持原有的编码长度
+	newLength := uint64(pnLen + len(newPayload) + aead.Overhead())
+	if quicvarint.Len(newLength) > lenBytes {
+		return nil, false
+	}
+	copy(header[lengthPos:pnOffset], quicvarint.AppendWithLen(nil, newLength, lenBytes))
+
+	out := make([]byte, 0, len(header)+len(newPayload)+aead.Overhead()+len(p)-end)
+	out = append(out, header...)
+	out = aead.Seal(out, nonce, newPayload, header)
+
+	// 重新加上包头保护
+	hpBlock.Encrypt(mask, out[pnOffset+4:pnOffset+4+aes.BlockSize])
+	out[0] ^= mask[0] & 0x0f
+	for i := 0; i < pnLen; i++ {
+		out[pnOffset+i] ^= mask[1+i]
+	}
+	// 同一数据报中合并发送的后续数据包保持不变
+	return append(out, p[end:]...), true
+}
+
+// cryptoFrame 是 CRYPTO 帧携带的一段握手数据
+type cryptoFrame struct {
+	offset uint64
+	data   []byte
+}
+
+// splitCrypto 将明文载荷中的 CRYPTO 帧拆分为不超过 size 字节的帧并倒序排列，不足原长度时以 PADDING 补齐
+// 载荷超过 maxLen 时返回 ok=false，more 表示增大 size 后可以重试
+func splitCrypto(payload []byte, size, maxLen int) (out []byte, ok, more bool) {
+	var frames []cryptoFrame
+	pings := 0
+	for i := 0; i < len(payload); {
+		switch payload[i] {
+		case 0x00: // PADDING
+			i++
+		case 0x01: // PING
+			pings++
+			i++
+		case 0x06: // CRYPTO
+			offset, n1, err := quicvarint.Parse(payload[i+1:])
+			if err != nil {
+				return nil, false, false
+			}
+			length, n2, err := quicvarint.Parse(payload[i+1+n1:])
+			if err != nil {
+				return nil, false, false
+			}
+			start := i + 1 + n1 + n2
+			if length > uint64(len(payload)-start) {
+				return nil, false, false
+			}
+			frames = append(frames, cryptoFrame{offset, payload[start : start+int(length)]})
+			i = start + int(length)
+		default:
+			// ACK 等其他帧不处理
+			return nil, false, false
+		}
+	}
+
+	var chunks []cryptoFrame
+	for _, f := range frames {
+		for len(f.data) > 0 {
+			n := min(size, len(f.data))
+			chunks = append(chunks, cryptoFrame{f.offset, f.data[:n]})
+			f.offset += uint64(n)
+			f.data = f.data[n:]
+		}
+	}
+	if len(chunks) < 2 {
+		return nil, false, false
+	}
+
+	out = make([]byte, 0, maxLen)
+	for i := 0; i < pings; i++ {
+		out = append(out, 0x01)
+	}
+	for i := len(chunks) - 1; i >= 0; i-- {
+		c := chunks[i]
+		out = append(out, 0x06)
+		out = quicvarint.Append(out, c.offset)
+		out = quicvarint.Append(out, uint64(len(c.data)))
+		out = append(out, c.data...)
+	}
+	if len(out) > maxLen {
+		return nil, false, true
+	}
+	for len(out) < len(payload) {
+		out = append(out, 0x00)
+	}
+	return out, true, false
+}
+
+// initialClientKeys 按 RFC 9001 5.2 由目标连接ID派生客户端 Initial 数据包的密钥
+func initialClientKeys(dcid []byte) (key, iv, hp []byte) {
+	initialSecret, _ := hkdf.Extract(sha256.New, dcid, quicV1InitialSalt)
+	clientSecret := hkdfExpandLabel(initialSecret, "client in", sha256.Size)
+	return hkdfExpandLabel(clientSecret, "quic key", 16),
+		hkdfExpandLabel(clientSecret, "quic iv", 12),
+		hkdfExpandLabel(clientSecret, "quic hp", 16)
+}
+
+// hkdfExpandLabel 实现 TLS 1.3 的 HKDF-Expand-Label，上下文为空
+func hkdfExpandLabel(secret []byte, label string, length int) []byte {
+	label = "tls13 " + label
+	info := binary.BigEndian.AppendUint16(nil, uint16(length))
+	info = append(info, byte(len(label)))
+	info = append(info, label...)
+	info = append(info, 0)
+	out, _ := hkdf.Expand(sha256.New, secret, string(info), length)
+	return out
+}
@@ -84,29 +84,19 @@ func PrepareTlsConfig(privKey *ecdsa.PrivateKey, peerPubKey *ecdsa.PublicKey, ce
 //   - quicConfig: *quic.Config - The QUIC configuration settings.
 //   - connectUri: string - The URI template for the Connect-IP request.
 //   - endpoint: *net.UDPAddr - The UDP address of the QUIC server.
+//   - udpOpts: UDPOptions - Socket options for the local UDP socket.
 //
 // Returns:
 //   - *net.UDPConn: The UDP connection used for the QUIC session.
 //   - *http3.Transport: The HTTP/3 transport used for initial request.
+//   - quic.Connection: The QUIC connection carrying the tunnel, to be closed with CloseQUIC.
 //   - *connectip.Conn: The Connect-IP connection instance.
 //   - *http.Response: The response from the Connect-IP handshake.
 //   - error: An error if the connection setup fails.
-func ConnectTunnel(ctx context.Context, tlsConfig *tls.Config, quicConfig *quic.Config, connectUri string, endpoint *net.UDPAddr) (*net.UDPConn, *http3.Transport, *connectip.Conn, *http.Response, error) {
-	var udpConn *net.UDPConn
-	var err error
-	if endpoint.IP.To4() == nil {
-		udpConn, err = net.ListenUDP("udp", &net.UDPAddr{
-			IP:   net.IPv6zero,
-			Port: 0,
-		})
-	} else {
-		udpConn, err = net.ListenUDP("udp", &net.UDPAddr{
-			IP:   net.IPv4zero,
-			Port: 0,
-		})
-	}
+func ConnectTunnel(ctx context.Context, tlsConfig *tls.Config, quicConfig *quic.Config, connectUri string, endpoint *net.UDPAddr, udpOpts UDPOptions) (*net.UDPConn, *http3.Transport, quic.Connection, *connectip.Conn, *http.Response, error) {
+	udpConn, err := listenUDP(endpoint, udpOpts)
 	if err != nil {
-		return nil, nil, nil, nil, err
+		return nil, nil, nil, nil, nil, err
 	}
 
 	// Increase UDP buffer sizes for better throughput
@@ -119,14 +109,14 @@ func ConnectTunnel(ctx context.Context, tlsConfig *tls.Config, quicConfig *quic.
 
 	conn, err := quic.Dial(
 		ctx,
-		udpConn,
+		udpOpts.packetConn(udpConn),
 		endpoint,
 		tlsConfig,
 		quicConfig,
 	)
 	if err != nil {
 		udpConn.Close()
-		return nil, nil, nil, nil, err
+		return nil, nil, nil, nil, nil, err
 	}
 
 	tr := &http3.Transport{
@@ -154,13 +144,13 @@ func ConnectTunnel(ctx context.Context, tlsConfig *tls.Config, quicConfig *quic.
 			conn.CloseWithError(0, "connect-ip dial failed")
 			tr.Close()
 			udpConn.Close()
-			return nil, nil, nil, nil, errors.New("login failed! Please double-check if your tls key and cert is enrolled in the Cloudflare Access service")
+			return nil, nil, nil, nil, nil, errors.New("login failed! Please double-check if your tls key and cert is enrolled in the Cloudflare Access service")
 		}
 		conn.CloseWithError(0, "connect-ip dial failed")
 		tr.Close()
 		udpConn.Close()
-		return nil, nil, nil, nil, fmt.Errorf("failed to dial connect-ip: %v", err)
+		return nil, nil, nil, nil, nil, fmt.Errorf("failed to dial connect-ip: %v", err)
 	}
 
-	return udpConn, tr, ipConn, rsp, nil
+	return udpConn, tr, conn, ipConn, rsp, nil
 }
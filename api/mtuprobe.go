@@ -0,0 +1,202 @@
+package api
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net/netip"
+	"time"
+
+	"github.com/HynoR/uscf/internal/logger"
+)
+
+// MTU探测的范围，上限是以太网的MTU，更大的数据包在常见路径上都会被分片或丢弃
+const (
+	mtuProbeMin = 576
+	mtuProbeMax = 1500
+)
+
+const (
+	// mtuProbeAttempts 是每个大小的探测次数，QUIC 在连接建立后才逐步提高允许的数据报大小，失败时需要重试
+	mtuProbeAttempts = 3
+	// mtuProbeTimeout 是等待每次探测回复的时间
+	mtuProbeTimeout = time.Second
+	// icmpEchoID 是探测使用的 ICMP Echo 标识符
+	icmpEchoID = 0x7573
+)
+
+// ProbeMTU 建立一条隧道连接，探测可以完整往返的最大IP数据包，探测结束后关闭连接
+// 从隧道地址 src 向 dst 发送设置了DF标志的 ICMP Echo 请求，先确认最小的数据包能收到回复，
+// 再在 mtuProbeMin 与 mtuProbeMax 之间二分查找，只支持IPv4
+func ProbeMTU(ctx context.Context, config ConnectionConfig, src, dst netip.Addr) (int, error) {
+	if !src.Is4() || !dst.Is4() {
+		return 0, errors.New("MTU probing requires IPv4 addresses")
+	}
+
+	connectCtx, cancel := ctx, context.CancelFunc(func() {})
+	if config.ConnectTimeout > 0 {
+		connectCtx, cancel = context.WithTimeout(ctx, config.ConnectTimeout)
+	}
+	connector := config.Connector
+	if connector == nil {
+		connector = MasqueConnector{}
+	}
+	ipConn, release, err := connector.Connect(connectCtx, config)
+	cancel()
+	if err != nil {
+		return 0, err
+	}
+	defer release()
+
+	replies := make(chan echoReply, 16)
+	go readEchoReplies(ipConn, src, dst, replies)
+
+	p := &mtuProber{ipConn: ipConn, src: src, dst: dst, replies: replies}
+	if !p.fits(ctx, mtuProbeMin) {
+		if ctx.Err() != nil {
+			return 0, ctx.Err()
+		}
+		return 0, fmt.Errorf("no reply from %s to a %d byte probe", dst, mtuProbeMin)
+	}
+
+	// lo 总是可以往返的大小，hi 之上的大小均未通过
+	lo, hi := mtuProbeMin, mtuProbeMax
+	for lo < hi {
+		mid := (lo + hi + 1) / 2
+		if p.fits(ctx, mid) {
+			lo = mid
+		} else {
+			hi = mid - 1
+		}
+		if ctx.Err() != nil {
+			return 0, ctx.Err()
+		}
+	}
+	return lo, nil
+}
+
+// mtuProber 在一条隧道连接上发送探测数据包
+type mtuProber struct {
+	ipConn   IPConn
+	src, dst netip.Addr
+	seq      uint16
+	replies  <-chan echoReply
+}
+
+// echoReply 是收到的 ICMP Echo 回复
+type echoReply struct {
+	seq  uint16
+	size int // IP数据包的总长度
+}
+
+// fits 发送 size 字节的探测数据包，收到等长回复时返回 true
+func (p *mtuProber) fits(ctx context.Context, size int) bool {
+	for attempt := 0; attempt < mtuProbeAttempts; attempt++ {
+		p.seq++
+		icmp, err := p.ipConn.WritePacket(echoRequest(p.src, p.dst, p.seq, size))
+		if err != nil {
+			logger.Logger.Debugf("MTU probe of %d bytes failed: %v", size, err)
+			return false
+		}
+		// 数据包超出当前允许的数据报大小时会得到 Packet Too Big，稍后重试
+		if len(icmp) > 0 {
+			logger.Logger.Debugf("MTU probe of %d bytes is larger than the tunnel allows", size)
+		}
+
+		timer := time.NewTimer(mtuProbeTimeout)
+		for waiting := true; waiting; {
+			select {
+			case <-ctx.Done():
+				timer.Stop()
+				return false
+			case <-timer.C:
+				waiting = false
+			case reply := <-p.replies:
+				if reply.seq == p.seq && reply.size == size {
+					timer.Stop()
+					logger.Logger.Debugf("MTU probe of %d bytes succeeded", size)
+					return true
+				}
+			}
+		}
+	}
+	logger.Logger.Debugf("MTU probe of %d bytes got no reply", size)
+	return false
+}
+
+// readEchoReplies 读取从 dst 发往 src 的 ICMP Echo 回复并发送到 replies，直到连接关闭
+func readEchoReplies(ipConn IPConn, src, dst netip.Addr, replies chan<- echoReply) {
+	buf := make([]byte, mtuProbeMax+packetBuffCap)
+	for {
+		n, err := ipConn.ReadPacket(buf, true)
+		if err != nil {
+			return
+		}
+		if seq, ok := parseEchoReply(buf[:n], src, dst); ok {
+			select {
+			case replies <- echoReply{seq: seq, size: n}:
+			default:
+			}
+		}
+	}
+}
+
+// echoRequest 构造设置了DF标志、总长度为 size 的 IPv4 ICMP Echo 请求
+func echoRequest(src, dst netip.Addr, seq uint16, size int) []byte {
+	pkt := make([]byte, size)
+	pkt[0] = 0x45
+	binary.BigEndian.PutUint16(pkt[2:], uint16(size))
+	binary.BigEndian.PutUint16(pkt[6:], 0x4000) // DF
+	pkt[8] = 64
+	pkt[9] = 1 // ICMP
+	s, d := src.As4(), dst.As4()
+	copy(pkt[12:16], s[:])
+	copy(pkt[16:20], d[:])
+	binary.BigEndian.PutUint16(pkt[10:], internetChecksum(pkt[:20]))
+
+	icmp := pkt[20:]
+	icmp[0] = 8 // Echo
+	binary.BigEndian.PutUint16(icmp[4:], icmpEchoID)
+	binary.BigEndian.PutUint16(icmp[6:], seq)
+	binary.BigEndian.PutUint16(icmp[2:], internetChecksum(icmp))
+	return pkt
+}
+
+// parseEchoReply 返回从 dst 发往 src 的 ICMP Echo 回复的序列号，分片的回复不被接受
+func parseEchoReply(pkt []byte, src, dst netip.Addr) (uint16, bool) {
+	if len(pkt) < 28 || pkt[0]>>4 != 4 || pkt[9] != 1 {
+		return 0, false
+	}
+	// MF 标志或非零的片偏移
+	if binary.BigEndian.Uint16(pkt[6:])&0x3fff != 0 {
+		return 0, false
+	}
+	ihl := int(pkt[0]&0x0f) * 4
+	if ihl < 20 || len(pkt) < ihl+8 || int(binary.BigEndian.Uint16(pkt[2:])) != len(pkt) {
+		return 0, false
+	}
+	if netip.AddrFrom4([4]byte(pkt[12:16])) != dst || netip.AddrFrom4([4]byte(pkt[16:20])) != src {
+		return 0, false
+	}
+	icmp := pkt[ihl:]
+	if icmp[0] != 0 || binary.BigEndian.Uint16(icmp[4:]) != icmpEchoID {
+		return 0, false
+	}
+	return binary.BigEndian.Uint16(icmp[6:]), true
+}
+
+// internetChecksum 计算 RFC 1071 校验和
+func internetChecksum(b []byte) uint16 {
+	var sum uint32
+	for i := 0; i+1 < len(b); i += 2 {
+		sum += uint32(binary.BigEndian.Uint16(b[i:]))
+	}
+	if len(b)%2 == 1 {
+		sum += uint32(b[len(b)-1]) << 8
+	}
+	for sum>>16 != 0 {
+		sum = sum&0xffff + sum>>16
+	}
+	return ^uint16(sum)
+}
@@ -0,0 +1,30 @@
+package api
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"time"
+
+	"github.com/HynoR/uscf/internal"
+	"github.com/quic-go/quic-go"
+)
+
+// ProbeEndpoint 与端点完成一次QUIC握手并返回耗时，握手使用与隧道相同的TLS配置
+// 只建立QUIC连接，不发起CONNECT-IP请求，握手完成后立即关闭
+func ProbeEndpoint(ctx context.Context, tlsConfig *tls.Config, initialPacketSize uint16, endpoint *net.UDPAddr, udpOpts UDPOptions) (time.Duration, error) {
+	udpConn, err := listenUDP(endpoint, udpOpts)
+	if err != nil {
+		return 0, err
+	}
+	defer udpConn.Close()
+
+	start := time.Now()
+	conn, err := quic.Dial(ctx, udpOpts.packetConn(udpConn), endpoint, tlsConfig.Clone(), internal.DefaultQuicConfig(0, initialPacketSize))
+	if err != nil {
+		return 0, err
+	}
+	rtt := time.Since(start)
+	conn.CloseWithError(0, "")
+	return rtt, nil
+}
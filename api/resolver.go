@@ -2,118 +2,134 @@ package api
 
 import (
 	"context"
+	"errors"
 	"net"
-	"sync"
 	"time"
-)
 
-// DNSCacheEntry 表示缓存中的一个条目
-type DNSCacheEntry struct {
-	IP        net.IP
-	ExpiresAt time.Time
-}
+	"github.com/HynoR/uscf/internal/logger"
+	"golang.org/x/net/dns/dnsmessage"
+)
 
 // CachingDNSResolver 实现了带缓存的DNS解析器
 type CachingDNSResolver struct {
-	// DNS服务器地址
-	DNSServer string
-	// 缓存过期时间（秒）
-	CacheTTL int
-	// 缓存
-	cache     map[string]DNSCacheEntry
-	cacheLock sync.RWMutex
+	dnsCache
+	// DNS服务器地址列表，按顺序尝试，超时后切换到下一个
+	DNSServers []string
+	// 单个DNS服务器的查询超时时间
+	Timeout time.Duration
+	// 所有DNS服务器都查询失败或超时时，改用系统解析器重试
+	// 系统解析器使用主机配置的DNS服务器，会向其泄露查询的域名
+	FallbackSystem bool
 }
 
 // NewCachingDNSResolver 创建一个新的缓存DNS解析器
-// dnsServer: DNS服务器地址，如 "8.8.8.8:53"
+// dnsServers: DNS服务器地址列表，如 "1.1.1.1" 或 "8.8.8.8:53"，未指定端口时使用53
+// timeout: 单个DNS服务器的查询超时时间
 // cacheTTLSeconds: 缓存有效期（秒）
-func NewCachingDNSResolver(dnsServer string, cacheTTLSeconds int) *CachingDNSResolver {
-	if cacheTTLSeconds <= 0 {
-		cacheTTLSeconds = 600 // 默认10分钟
+func NewCachingDNSResolver(dnsServers []string, timeout time.Duration, cacheTTLSeconds int) *CachingDNSResolver {
+	if timeout <= 0 {
+		timeout = 5 * time.Second
 	}
 
-	if dnsServer == "" {
-		dnsServer = "8.8.8.8:53" // 默认使用谷歌DNS
+	servers := make([]string, 0, len(dnsServers))
+	for _, server := range dnsServers {
+		if _, _, err := net.SplitHostPort(server); err != nil {
+			server = net.JoinHostPort(server, "53")
+		}
+		servers = append(servers, server)
+	}
+	if len(servers) == 0 {
+		servers = append(servers, "8.8.8.8:53") // 默认使用谷歌DNS
 	}
 
 	return &CachingDNSResolver{
-		DNSServer: dnsServer,
-		CacheTTL:  cacheTTLSeconds,
-		cache:     make(map[string]DNSCacheEntry),
+		dnsCache:   newDNSCache(cacheTTLSeconds),
+		DNSServers: servers,
+		Timeout:    timeout,
 	}
 }
 
-type dnsLookupResult struct {
-	ip  net.IP
-	err error
-}
-
 // Resolve 实现NameResolver接口，解析域名为IP地址
 func (r *CachingDNSResolver) Resolve(ctx context.Context, name string) (context.Context, net.IP, error) {
-	// 先检查缓存
-	r.cacheLock.RLock()
-	entry, exists := r.cache[name]
-	now := time.Now()
-	cacheHit := exists && now.Before(entry.ExpiresAt)
-	r.cacheLock.RUnlock()
-
-	// 如果缓存中存在且未过期，直接返回
-	if cacheHit {
-		return ctx, entry.IP, nil
+	ips, err := r.resolve(ctx, name, r.lookup)
+	if err != nil {
+		return ctx, nil, err
 	}
+	return ctx, ips[0], nil
+}
 
-	// 使用单独锁来防止对同一域名的并发DNS查询，实现"查询合并"
-	resultChan := make(chan dnsLookupResult, 1)
+// ResolveAll 返回域名的全部地址，IPv4在前，首个地址与 Resolve 的结果相同
+func (r *CachingDNSResolver) ResolveAll(ctx context.Context, name string) ([]net.IP, error) {
+	return r.resolve(ctx, name, r.lookup)
+}
 
-	// 缓存不存在或已过期，进行实际的DNS查询
-	// 这里可以添加错误重试逻辑
-	go func() {
-		resolver := &net.Resolver{
-			PreferGo: true,
-			Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
-				d := net.Dialer{Timeout: time.Second * 5}
-				return d.DialContext(ctx, "udp", r.DNSServer)
-			},
+// lookup 按顺序向配置的DNS服务器查询，超时或网络错误时切换到下一个服务器
+func (r *CachingDNSResolver) lookup(ctx context.Context, name string) ([]net.IP, time.Duration, error) {
+	var lastErr error
+	for _, server := range r.DNSServers {
+		lctx, cancel := context.WithTimeout(ctx, r.Timeout)
+		ips, ttl, err := r.lookupServer(lctx, server, name)
+		cancel()
+		if err == nil {
+			return ips, ttl, nil
 		}
 
-		ips, err := resolver.LookupIP(ctx, "ip", name)
-		if err != nil {
-			resultChan <- dnsLookupResult{nil, err}
-			return
+		lastErr = err
+		if ctx.Err() != nil {
+			return nil, 0, ctx.Err()
 		}
-
-		if len(ips) == 0 {
-			resultChan <- dnsLookupResult{nil, net.ErrClosed}
-			return
+		// 域名不存在是确定的结果，无需再尝试其他服务器
+		var dnsErr *net.DNSError
+		if errors.As(err, &dnsErr) && dnsErr.IsNotFound {
+			return nil, 0, err
 		}
-
-		resultChan <- dnsLookupResult{ips[0], nil}
-	}()
-
-	// 等待DNS查询完成或上下文取消
-	select {
-	case <-ctx.Done():
-		return ctx, nil, ctx.Err()
-	case result := <-resultChan:
-		if result.err != nil {
-			return ctx, nil, result.err
+	}
+	if r.FallbackSystem {
+		logger.Logger.Warnf("DNS servers failed to resolve %s (%v), falling back to the system resolver", name, lastErr)
+		lctx, cancel := context.WithTimeout(ctx, r.Timeout)
+		defer cancel()
+		ips, err := net.DefaultResolver.LookupIP(lctx, "ip", name)
+		if err != nil {
+			return nil, 0, err
 		}
-
-		// 更新缓存
-		r.cacheLock.Lock()
-		r.cache[name] = DNSCacheEntry{
-			IP:        result.ip,
-			ExpiresAt: now.Add(time.Duration(r.CacheTTL) * time.Second),
+		if len(ips) == 0 {
+			return nil, 0, lastErr
 		}
-		r.cacheLock.Unlock()
+		return sortAddrs(ips), ttlUnknown, nil
+	}
+	return nil, 0, lastErr
+}
 
-		return ctx, result.ip, nil
+// lookupServer 向单个DNS服务器同时查询A与AAAA记录，并返回应答中的最小TTL
+// 响应被截断时回退到标准库解析器（支持TCP），此时TTL未知
+func (r *CachingDNSResolver) lookupServer(ctx context.Context, server, name string) ([]net.IP, time.Duration, error) {
+	exchange := func(ctx context.Context, name string, qtype dnsmessage.Type) ([]net.IP, time.Duration, error) {
+		return exchangeUDP(ctx, server, name, qtype)
+	}
+	ips, ttl, err := queryAddrs(ctx, name, exchange)
+	if errors.Is(err, errDNSTruncated) {
+		ips, err := r.systemLookup(ctx, server, name)
+		return ips, ttlUnknown, err
 	}
+	return ips, ttl, err
 }
 
-// ClearCache 清除DNS缓存
-func (r *CachingDNSResolver) ClearCache() {
-	r.cacheLock.Lock()
-	defer r.cacheLock.Unlock()
-	r.cache = make(map[string]DNSCacheEntry)
+// systemLookup 使用标准库解析器经指定服务器查询
+func (r *CachingDNSResolver) systemLookup(ctx context.Context, server, name string) ([]net.IP, error) {
+	resolver := &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+			d := net.Dialer{Timeout: r.Timeout}
+			return d.DialContext(ctx, network, server)
+		},
+	}
+
+	ips, err := resolver.LookupIP(ctx, "ip", name)
+	if err != nil {
+		return nil, err
+	}
+	if len(ips) == 0 {
+		return nil, net.ErrClosed
+	}
+	return sortAddrs(ips), nil
 }
@@ -0,0 +1,93 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"net"
+)
+
+// UDPOptions 是隧道UDP套接字的选项
+type UDPOptions struct {
+	Mark      int    // 设置到套接字的 SO_MARK（fwmark），仅 Linux 有效，为0时不设置
+	LocalAddr string // 绑定的本地IP地址或网卡名，为空时由系统选择
+	// SNIFragment 大于0时将 Initial 数据包中的 CRYPTO 帧拆分为不超过该字节数的小帧并倒序发送，使 SNI 不连续出现
+	SNIFragment int
+}
+
+// packetConn 返回交给 quic-go 使用的连接，启用 SNIFragment 时包装 conn 以改写 Initial 数据包
+func (o UDPOptions) packetConn(conn *net.UDPConn) net.PacketConn {
+	if o.SNIFragment > 0 {
+		return &fragmentConn{PacketConn: conn, size: o.SNIFragment}
+	}
+	return conn
+}
+
+// Check 尝试按 opts 创建一次套接字，用于在启动时发现不可用的本地地址或权限问题
+func (o UDPOptions) Check(endpoint *net.UDPAddr) error {
+	conn, err := listenUDP(endpoint, o)
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
+
+// localAddr 返回要绑定的本地地址，网卡名取该网卡上与 endpoint 同协议族的第一个非链路本地地址
+func (o UDPOptions) localAddr(endpoint *net.UDPAddr) (*net.UDPAddr, error) {
+	v6 := endpoint.IP.To4() == nil
+	if o.LocalAddr == "" {
+		if v6 {
+			return &net.UDPAddr{IP: net.IPv6zero}, nil
+		}
+		return &net.UDPAddr{IP: net.IPv4zero}, nil
+	}
+
+	if ip := net.ParseIP(o.LocalAddr); ip != nil {
+		if (ip.To4() == nil) != v6 {
+			return nil, fmt.Errorf("local address %s does not match the address family of endpoint %s", ip, endpoint.IP)
+		}
+		return &net.UDPAddr{IP: ip}, nil
+	}
+
+	iface, err := net.InterfaceByName(o.LocalAddr)
+	if err != nil {
+		return nil, fmt.Errorf("local address %q is neither an IP address nor a network interface: %w", o.LocalAddr, err)
+	}
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list addresses of interface %s: %w", iface.Name, err)
+	}
+	for _, addr := range addrs {
+		ipNet, ok := addr.(*net.IPNet)
+		if !ok || (ipNet.IP.To4() == nil) != v6 || ipNet.IP.IsLinkLocalUnicast() {
+			continue
+		}
+		return &net.UDPAddr{IP: ipNet.IP}, nil
+	}
+	family := "IPv4"
+	if v6 {
+		family = "IPv6"
+	}
+	return nil, fmt.Errorf("interface %s has no %s address", iface.Name, family)
+}
+
+// isInterface 报告 LocalAddr 是否为网卡名
+func (o UDPOptions) isInterface() bool {
+	return o.LocalAddr != "" && net.ParseIP(o.LocalAddr) == nil
+}
+
+// listenUDP 创建用于连接 endpoint 的UDP套接字，并按 opts 设置本地地址与套接字选项
+func listenUDP(endpoint *net.UDPAddr, opts UDPOptions) (*net.UDPConn, error) {
+	laddr, err := opts.localAddr(endpoint)
+	if err != nil {
+		return nil, err
+	}
+	lc := net.ListenConfig{Control: opts.control}
+	conn, err := lc.ListenPacket(context.Background(), "udp", laddr.String())
+	if err != nil {
+		if opts.LocalAddr != "" {
+			return nil, fmt.Errorf("failed to bind local address %s: %w", laddr.IP, err)
+		}
+		return nil, err
+	}
+	return conn.(*net.UDPConn), nil
+}
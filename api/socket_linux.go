@@ -0,0 +1,32 @@
+//go:build linux
+
+package api
+
+import (
+	"fmt"
+	"syscall"
+)
+
+// control 在绑定前设置套接字选项，绑定网卡名时同时设置 SO_BINDTODEVICE 以确保从该网卡发出
+func (o UDPOptions) control(network, address string, c syscall.RawConn) error {
+	if o.Mark == 0 && !o.isInterface() {
+		return nil
+	}
+	var sockErr error
+	if err := c.Control(func(fd uintptr) {
+		if o.Mark != 0 {
+			if err := syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_MARK, o.Mark); err != nil {
+				sockErr = fmt.Errorf("failed to set fwmark %d (requires CAP_NET_ADMIN): %w", o.Mark, err)
+				return
+			}
+		}
+		if o.isInterface() {
+			if err := syscall.BindToDevice(int(fd), o.LocalAddr); err != nil {
+				sockErr = fmt.Errorf("failed to bind to interface %s (requires CAP_NET_RAW): %w", o.LocalAddr, err)
+			}
+		}
+	}); err != nil {
+		return err
+	}
+	return sockErr
+}
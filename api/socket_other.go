@@ -0,0 +1,22 @@
+//go:build !linux
+
+package api
+
+import (
+	"sync"
+	"syscall"
+
+	"github.com/HynoR/uscf/internal/logger"
+)
+
+var markWarning sync.Once
+
+// control 在非 Linux 平台上忽略 SO_MARK
+func (o UDPOptions) control(network, address string, c syscall.RawConn) error {
+	if o.Mark != 0 {
+		markWarning.Do(func() {
+			logger.Logger.Warn("fwmark is only supported on Linux, ignoring it")
+		})
+	}
+	return nil
+}
@@ -0,0 +1,66 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"github.com/HynoR/uscf/internal"
+	"github.com/HynoR/uscf/internal/logger"
+)
+
+// statsFileInterval 是写入统计文件的间隔
+const statsFileInterval = 10 * time.Second
+
+// statsFileContent 是写入统计文件的JSON文档
+type statsFileContent struct {
+	StatsSnapshot
+	State     string    `json:"state"` // connected、disconnected 或 stopped
+	StartedAt time.Time `json:"started_at"`
+	Uptime    int64     `json:"uptime_seconds"` // 自隧道启动以来的秒数
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// writeStatsFile 定期将统计信息写入 path，每次写入都原子地替换旧文件，ctx 取消时以 stopped 状态写入最后一次
+func writeStatsFile(ctx context.Context, stats *TunnelStats, path string) {
+	started := time.Now()
+	failing := false
+	write := func(stopped bool) {
+		now := time.Now()
+		content := statsFileContent{
+			StatsSnapshot: stats.Snapshot(),
+			State:         "disconnected",
+			StartedAt:     started,
+			Uptime:        int64(now.Sub(started).Seconds()),
+			UpdatedAt:     now,
+		}
+		if stopped {
+			content.State = "stopped"
+		} else if content.Connected {
+			content.State = "connected"
+		}
+		data, err := json.MarshalIndent(content, "", "  ")
+		if err == nil {
+			err = internal.WriteFileAtomic(path, append(data, '\n'))
+		}
+		// 只在首次失败时输出日志，避免每个周期重复
+		if err != nil && !failing {
+			logger.Logger.Warnf("Failed to write stats file %s: %v", path, err)
+		}
+		failing = err != nil
+	}
+
+	ticker := time.NewTicker(statsFileInterval)
+	defer ticker.Stop()
+
+	write(false)
+	for {
+		select {
+		case <-ctx.Done():
+			write(true)
+			return
+		case <-ticker.C:
+			write(false)
+		}
+	}
+}
@@ -1,24 +1,34 @@
 package api
 
 import (
-       "context"
-       "crypto/tls"
-       "fmt"
-       "math/rand"
-       "net"
-       "sync"
-       "sync/atomic"
-       "time"
-
-       connectip "github.com/Diniboy1123/connect-ip-go"
-       "github.com/HynoR/uscf/internal"
-       "github.com/HynoR/uscf/internal/logger"
-       "golang.zx2c4.com/wireguard/tun"
+	"context"
+	"crypto/tls"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math"
+	"math/rand"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/HynoR/uscf/internal/logger"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/time/rate"
+	"golang.zx2c4.com/wireguard/tun"
 )
 
+// packetBuffCap 是未配置MTU时数据包缓冲区的默认容量
 const packetBuffCap = 2048
 
-var packetBufferPool *NetBuffer
+// packetBufSize 返回给定MTU下数据包缓冲区的容量
+func packetBufSize(mtu int) int {
+	if mtu > 0 {
+		return mtu
+	}
+	return packetBuffCap
+}
 
 // NetBuffer is a pool of byte slices with a fixed capacity.
 // Helps to reduce memory allocations and improve performance.
@@ -27,25 +37,57 @@ var packetBufferPool *NetBuffer
 type NetBuffer struct {
 	capacity int
 	buf      sync.Pool
+
+	gets     atomic.Uint64
+	puts     atomic.Uint64
+	discards atomic.Uint64
+	news     atomic.Uint64
+}
+
+// NetBufferStats counts the operations on a NetBuffer since it was created.
+// Gets minus News is the number of buffers reused from the pool. Puts counts the
+// buffers returned to the pool and Discards those dropped because their capacity
+// did not match the pool's.
+type NetBufferStats struct {
+	Gets     uint64
+	Puts     uint64
+	Discards uint64
+	News     uint64
+}
+
+// Stats returns the operation counters of the pool.
+func (n *NetBuffer) Stats() NetBufferStats {
+	return NetBufferStats{
+		Gets:     n.gets.Load(),
+		Puts:     n.puts.Load(),
+		Discards: n.discards.Load(),
+		News:     n.news.Load(),
+	}
 }
 
 // Get returns a byte slice from the pool.
 func (n *NetBuffer) GetBuf() *[]byte {
+	n.gets.Add(1)
 	return n.buf.Get().(*[]byte)
 }
 
 // Put places a byte slice back into the pool.
 // It checks if the capacity of the byte slice matches the pool's capacity.
 // If it doesn't match, the byte slice is not returned to the pool.
+// The slice is restored to its full length so a later GetBuf sees the whole buffer.
 func (n *NetBuffer) PutBuf(buf *[]byte) {
 	if cap(*buf) != n.capacity {
+		n.discards.Add(1)
 		return
 	}
+	*buf = (*buf)[:n.capacity]
+	n.puts.Add(1)
 	n.buf.Put(buf)
 }
 
 // Get returns a byte slice from the pool.
 func (n *NetBuffer) Get() []byte {
+	n.gets.Add(1)
 	return *(n.buf.Get().(*[]byte))
 }
 
@@ -54,8 +96,10 @@ func (n *NetBuffer) Get() []byte {
 // If it doesn't match, the byte slice is not returned to the pool.
 func (n *NetBuffer) Put(buf []byte) {
 	if cap(buf) != n.capacity {
+		n.discards.Add(1)
 		return
 	}
+	n.puts.Add(1)
 	n.buf.Put(&buf)
 }
 
@@ -65,15 +109,13 @@ func NewNetBuffer(capacity int) *NetBuffer {
 	if capacity <= 0 {
 		panic("capacity must be greater than 0")
 	}
-	return &NetBuffer{
-		capacity: capacity,
-		buf: sync.Pool{
-			New: func() interface{} {
-				b := make([]byte, capacity)
-				return &b
-			},
-		},
+	n := &NetBuffer{capacity: capacity}
+	n.buf.New = func() interface{} {
+		n.news.Add(1)
+		b := make([]byte, capacity)
+		return &b
 	}
+	return n
 }
 
 // TunnelDevice abstracts a TUN device so that we can use the same tunnel-maintenance code
@@ -85,6 +127,16 @@ type TunnelDevice interface {
 	WritePacket(pkt []byte) error
 }
 
+// BatchTunnelDevice 是支持一次读取多个数据包的 TunnelDevice
+// 设备实现该接口且 BatchSize 大于1时，隧道使用批量读取以减少系统调用开销，否则退回逐包读取
+type BatchTunnelDevice interface {
+	TunnelDevice
+	// BatchSize 返回单次 ReadPackets 最多读取的数据包数量
+	BatchSize() int
+	// ReadPackets 读取最多 len(bufs) 个数据包并返回读取的数量，bufs[i] 被截断为第i个数据包的长度
+	ReadPackets(bufs [][]byte) (int, error)
+}
+
 // TunnelStats 用于跟踪隧道性能指标
 type TunnelStats struct {
 	PacketsIn     uint64
@@ -93,8 +145,32 @@ type TunnelStats struct {
 	BytesOut      uint64
 	Errors        uint64
 	HandShake     uint64
+	Reconnects    uint64
 	LastReconnect time.Time
-	mu            sync.Mutex
+	// 最近一次与滑动平均的建立连接耗时（QUIC握手与CONNECT-IP请求）
+	HandshakeTime    time.Duration
+	AvgHandshakeTime time.Duration
+	connected        atomic.Bool
+	ready            chan struct{} // 首次握手成功后关闭
+	logged           StatsSnapshot // 上次输出统计信息时的快照，用于计算速率
+	loggedAt         time.Time
+	mu               sync.Mutex
+}
+
+// StatsSnapshot 是 TunnelStats 在某一时刻的副本
+type StatsSnapshot struct {
+	PacketsIn     uint64    `json:"packets_in"`
+	PacketsOut    uint64    `json:"packets_out"`
+	BytesIn       uint64    `json:"bytes_in"`
+	BytesOut      uint64    `json:"bytes_out"`
+	Errors        uint64    `json:"errors"`
+	HandShake     uint64    `json:"handshakes"`
+	Reconnects    uint64    `json:"reconnects"`
+	LastReconnect time.Time `json:"last_handshake"`
+	Connected     bool      `json:"connected"`
+	// 建立连接耗时，JSON中以纳秒表示
+	HandshakeTime    time.Duration `json:"handshake_time"`
+	AvgHandshakeTime time.Duration `json:"avg_handshake_time"`
 }
 
 func (s *TunnelStats) RecordPacketIn(bytes int) {
@@ -116,6 +192,77 @@ func (s *TunnelStats) RecordHandShake() {
 	defer s.mu.Unlock()
 	s.HandShake++
 	s.LastReconnect = time.Now()
+	s.connected.Store(true)
+	if s.HandShake == 1 {
+		close(s.readyChan())
+	}
+}
+
+// Ready 返回在隧道首次握手成功后关闭的通道
+func (s *TunnelStats) Ready() <-chan struct{} {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.readyChan()
+}
+
+// readyChan 返回 ready 通道，必要时创建，调用方需持有 s.mu
+func (s *TunnelStats) readyChan() chan struct{} {
+	if s.ready == nil {
+		s.ready = make(chan struct{})
+	}
+	return s.ready
+}
+
+// handshakeEWMAWeight 是新样本在滑动平均中的权重
+const handshakeEWMAWeight = 0.2
+
+// RecordHandshakeTime 记录一次建立连接的耗时并更新滑动平均值
+func (s *TunnelStats) RecordHandshakeTime(d time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.HandshakeTime = d
+	if s.AvgHandshakeTime == 0 {
+		s.AvgHandshakeTime = d
+	} else {
+		s.AvgHandshakeTime = time.Duration(handshakeEWMAWeight*float64(d) + (1-handshakeEWMAWeight)*float64(s.AvgHandshakeTime))
+	}
+}
+
+func (s *TunnelStats) RecordReconnect() {
+	atomic.AddUint64(&s.Reconnects, 1)
+}
+
+// RecordDisconnect 标记隧道已断开
+func (s *TunnelStats) RecordDisconnect() {
+	s.connected.Store(false)
+}
+
+// Connected 返回隧道当前是否处于已连接状态
+func (s *TunnelStats) Connected() bool {
+	return s.connected.Load()
+}
+
+// Snapshot 返回当前统计信息的一致副本
+func (s *TunnelStats) Snapshot() StatsSnapshot {
+	s.mu.Lock()
+	handShake, lastReconnect := s.HandShake, s.LastReconnect
+	handshakeTime, avgHandshakeTime := s.HandshakeTime, s.AvgHandshakeTime
+	s.mu.Unlock()
+
+	return StatsSnapshot{
+		PacketsIn:     atomic.LoadUint64(&s.PacketsIn),
+		PacketsOut:    atomic.LoadUint64(&s.PacketsOut),
+		BytesIn:       atomic.LoadUint64(&s.BytesIn),
+		BytesOut:      atomic.LoadUint64(&s.BytesOut),
+		Errors:        atomic.LoadUint64(&s.Errors),
+		HandShake:     handShake,
+		Reconnects:    atomic.LoadUint64(&s.Reconnects),
+		LastReconnect: lastReconnect,
+		Connected:     s.connected.Load(),
+
+		HandshakeTime:    handshakeTime,
+		AvgHandshakeTime: avgHandshakeTime,
+	}
 }
 
 // NetstackAdapter wraps a tun.Device (e.g. from netstack) to satisfy TunnelDevice.
@@ -149,6 +296,27 @@ func (n *NetstackAdapter) ReadPacket(buf []byte) (int, error) {
 	return (*sizes)[0], nil
 }
 
+// BatchSize 返回底层设备单次读取的最大数据包数量
+func (n *NetstackAdapter) BatchSize() int {
+	return n.dev.BatchSize()
+}
+
+// ReadPackets 批量读取数据包，每个缓冲区被截断为对应数据包的长度
+func (n *NetstackAdapter) ReadPackets(bufs [][]byte) (int, error) {
+	sizes := n.sizesPool.Get().(*[]int)
+	defer n.sizesPool.Put(sizes)
+	if cap(*sizes) < len(bufs) {
+		*sizes = make([]int, len(bufs))
+	}
+	*sizes = (*sizes)[:len(bufs)]
+
+	count, err := n.dev.Read(bufs, *sizes, 0)
+	for i := 0; i < count; i++ {
+		bufs[i] = bufs[i][:(*sizes)[i]]
+	}
+	return count, err
+}
+
 func (n *NetstackAdapter) WritePacket(pkt []byte) error {
 	// Write expects a slice of packet buffers.
 	_, err := n.dev.Write([][]byte{pkt}, 0)
@@ -173,18 +341,119 @@ func NewNetstackAdapter(dev tun.Device) TunnelDevice {
 	}
 }
 
+// tunOffset 是平台TUN设备读写时在数据包前预留的字节数，Linux上用于virtio-net头
+const tunOffset = 16
+
+// TunAdapter 将操作系统的 tun.Device 适配为 TunnelDevice
+// 平台TUN设备要求数据包前预留 tunOffset 字节，且开启GSO时一次读取可能拆分为多个数据包，
+// 因此读写都经过内部缓冲区，并在调用方缓冲区之间复制
+type TunAdapter struct {
+	dev tun.Device
+
+	readMu   sync.Mutex
+	readBufs [][]byte
+	sizes    []int
+
+	writeMu  sync.Mutex
+	writeBuf []byte
+}
+
+// NewTunAdapter creates a TunAdapter for a platform TUN device with the given MTU.
+func NewTunAdapter(dev tun.Device, mtu int) *TunAdapter {
+	batch := max(dev.BatchSize(), 1)
+	bufs := make([][]byte, batch)
+	for i := range bufs {
+		bufs[i] = make([]byte, tunOffset+mtu)
+	}
+	return &TunAdapter{
+		dev:      dev,
+		readBufs: bufs,
+		sizes:    make([]int, batch),
+		writeBuf: make([]byte, tunOffset+mtu),
+	}
+}
+
+// BatchSize 返回底层设备单次读取的最大数据包数量
+func (t *TunAdapter) BatchSize() int {
+	return len(t.readBufs)
+}
+
+func (t *TunAdapter) ReadPacket(buf []byte) (int, error) {
+	bufs := [][]byte{buf}
+	if _, err := t.ReadPackets(bufs); err != nil {
+		return 0, err
+	}
+	return len(bufs[0]), nil
+}
+
+// ReadPackets 批量读取数据包，每个缓冲区被截断为对应数据包的长度
+// 一次读取拆分出的数据包多于 len(bufs) 时多出的部分被丢弃，因此调用方应提供 BatchSize 个缓冲区
+func (t *TunAdapter) ReadPackets(bufs [][]byte) (int, error) {
+	t.readMu.Lock()
+	defer t.readMu.Unlock()
+
+	count, err := t.dev.Read(t.readBufs, t.sizes, tunOffset)
+	if err != nil {
+		return 0, err
+	}
+	n := 0
+	for i := 0; i < count && n < len(bufs); i++ {
+		pkt := t.readBufs[i][tunOffset : tunOffset+t.sizes[i]]
+		if len(pkt) > len(bufs[n]) {
+			logger.Logger.Debugf("Dropping %d byte packet larger than the buffer", len(pkt))
+			continue
+		}
+		bufs[n] = bufs[n][:copy(bufs[n], pkt)]
+		n++
+	}
+	return n, nil
+}
+
+func (t *TunAdapter) WritePacket(pkt []byte) error {
+	t.writeMu.Lock()
+	defer t.writeMu.Unlock()
+
+	if tunOffset+len(pkt) > cap(t.writeBuf) {
+		t.writeBuf = make([]byte, tunOffset+len(pkt))
+	}
+	buf := t.writeBuf[:tunOffset+len(pkt)]
+	copy(buf[tunOffset:], pkt)
+	_, err := t.dev.Write([][]byte{buf}, tunOffset)
+	return err
+}
+
 // ConnectionConfig 包含连接配置选项
 type ConnectionConfig struct {
 	TLSConfig         *tls.Config
 	KeepAlivePeriod   time.Duration
 	InitialPacketSize uint16
 	Endpoint          *net.UDPAddr
+	ConnectURI        string         // CONNECT-IP 请求的URI，为空时使用 internal.ConnectURI
+	ConnectTimeout    time.Duration  // 建立MASQUE连接的超时时间，为0时不限制
+	Endpoints         []*net.UDPAddr // 候选端点列表，为空时仅使用 Endpoint
+	FailoverAfter     int            // 连续失败多少次后切换到下一个端点，小于等于0时不切换
+	MaxReconnects     int            // 连续失败多少次后放弃重连并返回 ErrReconnectLimit，小于等于0时一直重连
+	MaxRejections     int            // 设备身份连续被拒绝（401/403）多少次后返回 ErrIdentityRejected，小于等于0时不检测
 	MTU               int
-	MaxPacketRate     float64 // 每秒最大数据包处理速率
+	MaxPacketRate     float64 // 每秒最大数据包处理速率，小于等于0时不限制
 	MaxBurst          int     // 突发处理数据包的最大数量
+	MaxBandwidth      int64   // 每个方向每秒最大字节数，上行与下行各自独立限速，小于等于0时不限制
 	ReconnectStrategy BackoffStrategy
+	Stats             *TunnelStats  // 隧道统计信息，为空时由 MaintainTunnel 创建
+	StatsInterval     time.Duration // 统计日志输出间隔，为0时使用默认值，小于0时禁用
+	StatsFile         string        // 定期写入JSON统计信息的文件路径，为空时不写入
+	PacketDumpBytes   int           // trace 日志级别下转储每个数据包的前多少字节，为0时使用 DefaultPacketDumpBytes
+	StallTimeout      time.Duration // 有发出流量但无回包超过该时间时强制重连，为0时禁用
+	IdleTimeout       time.Duration // 两个方向都没有流量超过该时间时关闭隧道且不再重连，为0时禁用
+	UDPOptions        UDPOptions    // 隧道UDP套接字的选项
+	Connector         Connector     // 建立连接的方式，为空时使用 MasqueConnector
+	Events            EventHandler  // 连接生命周期事件的接收者，为空时使用 LogEvents
+	Reconnector       *Reconnector  // 用于从外部要求立即重连，为空时不响应重连请求
 }
 
+// jitterRand 返回 [0,1) 内的随机数，用于重连延迟的抖动，测试中可以替换为固定值
+var jitterRand = rand.Float64
+
 // BackoffStrategy 定义重连策略接口
 type BackoffStrategy interface {
 	NextDelay(attempt int) time.Duration
@@ -192,222 +461,702 @@ type BackoffStrategy interface {
 }
 
 // ExponentialBackoff 实现指数退避重连策略
+// 第 n 次重连（从1开始）的延迟为 InitialDelay * Factor^(n-1)，且不超过 MaxDelay
 type ExponentialBackoff struct {
 	InitialDelay time.Duration
 	MaxDelay     time.Duration
 	Factor       float64
-	attempt      int
+	attempt      int // 最近一次计算延迟时的重连次数
 }
 
+// NextDelay 返回第 attempt 次重连前的等待时间
+// attempt 小于等于0时使用内部计数（上一次的次数加1）
 func (b *ExponentialBackoff) NextDelay(attempt int) time.Duration {
 	if attempt <= 0 {
 		attempt = b.attempt + 1
 	}
+	b.attempt = attempt
+
+	// 计算指数退避延迟，使用浮点数比较避免溢出
+	delay := b.MaxDelay
+	if d := float64(b.InitialDelay) * math.Pow(b.Factor, float64(attempt-1)); d < float64(b.MaxDelay) {
+		delay = time.Duration(d)
+	}
+
+	// 添加随机抖动以避免雷暴问题
+	jitter := time.Duration(float64(delay) * 0.1) // 10%的抖动
+	return delay - jitter + time.Duration(float64(jitter*2)*jitterRand())
+}
+
+// Reset 清除内部重连计数，下一次 NextDelay(0) 将返回 InitialDelay
+func (b *ExponentialBackoff) Reset() {
+	b.attempt = 0
+}
+
+// LinearBackoff 实现线性退避重连策略，每次重连的延迟增加固定的 Increment，
+// 直到达到 MaxDelay。
+// 与指数退避相比，延迟增长更平缓、可预测，适合端点短暂抖动后能快速恢复的场景；
+// 但在端点长时间不可用时会产生更多的重连尝试。
+type LinearBackoff struct {
+	InitialDelay time.Duration
+	Increment    time.Duration
+	MaxDelay     time.Duration
+	attempt      int
+}
 
-	// 计算指数退避延迟
-	delay := b.InitialDelay
-	maxDelayInFloat := float64(b.MaxDelay) / b.Factor
-	for i := 0; i < attempt && float64(delay) < maxDelayInFloat; i++ {
-		delay = time.Duration(float64(delay) * b.Factor)
+func (b *LinearBackoff) NextDelay(attempt int) time.Duration {
+	if attempt <= 0 {
+		attempt = b.attempt + 1
 	}
 
-	// 确保不超过最大延迟
-	if delay > b.MaxDelay {
+	// 计算线性退避延迟，第一次重连使用 InitialDelay
+	delay := b.InitialDelay + time.Duration(attempt-1)*b.Increment
+	if b.MaxDelay > 0 && (delay > b.MaxDelay || delay < b.InitialDelay) {
 		delay = b.MaxDelay
 	}
 
 	// 添加随机抖动以避免雷暴问题
 	jitter := time.Duration(float64(delay) * 0.1) // 10%的抖动
-	delay = delay - jitter + time.Duration(float64(jitter*2)*rand.Float64())
+	delay = delay - jitter + time.Duration(float64(jitter*2)*jitterRand())
 
 	b.attempt = attempt
 	return delay
 }
 
-func (b *ExponentialBackoff) Reset() {
+func (b *LinearBackoff) Reset() {
 	b.attempt = 0
 }
 
-// handleForwarding 处理数据包的转发
-func handleForwarding(ctx context.Context, device TunnelDevice, ipConn *connectip.Conn, stats *TunnelStats) error {
+// ConstantBackoff 实现固定延迟重连策略，无论重连次数多少都返回相同的延迟
+type ConstantBackoff struct {
+	Delay  time.Duration
+	Jitter float64 // 抖动比例，如0.1表示±10%，为0时不添加抖动
+}
+
+func (b *ConstantBackoff) NextDelay(attempt int) time.Duration {
+	delay := b.Delay
+	if b.Jitter > 0 {
+		jitter := time.Duration(float64(delay) * b.Jitter)
+		delay = delay - jitter + time.Duration(float64(jitter*2)*jitterRand())
+	}
+	return delay
+}
+
+// Reset 对固定延迟策略无意义，仅用于实现 BackoffStrategy 接口
+func (b *ConstantBackoff) Reset() {}
+
+// newPacketLimiter 根据配置创建设备到IP方向的令牌桶限速器，不限速时返回nil
+func newPacketLimiter(config ConnectionConfig) *rate.Limiter {
+	if config.MaxPacketRate <= 0 {
+		return nil
+	}
+	burst := config.MaxBurst
+	if burst <= 0 {
+		burst = 1
+	}
+	return rate.NewLimiter(rate.Limit(config.MaxPacketRate), burst)
+}
+
+// newByteLimiter 根据配置创建按字节计量的令牌桶限速器，不限速时返回nil
+// 桶容量为一秒的流量，且至少能容纳一个最大的数据包
+func newByteLimiter(config ConnectionConfig) *rate.Limiter {
+	if config.MaxBandwidth <= 0 {
+		return nil
+	}
+	burst := max(int(min(config.MaxBandwidth, math.MaxInt32)), packetBufSize(config.MTU))
+	return rate.NewLimiter(rate.Limit(config.MaxBandwidth), burst)
+}
+
+// devicePacket 是从TUN设备读取的一个数据包或读取错误
+type devicePacket struct {
+	buf *[]byte
+	n   int
+	err error
+}
+
+// readDevice 在隧道的整个生命周期内持续从设备读取数据包并发送到 packets，缓冲区取自 pool
+// 设备读取在独立的goroutine中进行，handleForwarding 因此不会阻塞在 ReadPacket 上，断线时可以及时退出
+func readDevice(ctx context.Context, device TunnelDevice, pool *NetBuffer, packets chan<- devicePacket) {
+	if bd, ok := device.(BatchTunnelDevice); ok && bd.BatchSize() > 1 {
+		readDeviceBatch(ctx, bd, pool, packets)
+		return
+	}
+
+	for {
+		buf := pool.GetBuf()
+		n, err := device.ReadPacket(*buf)
+		if err != nil {
+			pool.PutBuf(buf)
+			buf = nil
+		}
+
+		select {
+		case packets <- devicePacket{buf: buf, n: n, err: err}:
+		case <-ctx.Done():
+			if buf != nil {
+				pool.PutBuf(buf)
+			}
+			return
+		}
+	}
+}
+
+// readDeviceBatch 是 readDevice 的批量版本，每次从设备读取最多 BatchSize 个数据包后逐个发送到 packets
+func readDeviceBatch(ctx context.Context, device BatchTunnelDevice, pool *NetBuffer, packets chan<- devicePacket) {
+	bufs := make([]*[]byte, device.BatchSize())
+	views := make([][]byte, len(bufs))
+	defer func() {
+		for _, buf := range bufs {
+			if buf != nil {
+				pool.PutBuf(buf)
+			}
+		}
+	}()
+
+	for {
+		for i := range bufs {
+			if bufs[i] == nil {
+				bufs[i] = pool.GetBuf()
+			}
+			views[i] = *bufs[i]
+		}
+
+		n, err := device.ReadPackets(views)
+		for i := 0; i < n; i++ {
+			select {
+			case packets <- devicePacket{buf: bufs[i], n: len(views[i])}:
+				bufs[i] = nil // 所有权已转交给转发goroutine
+			case <-ctx.Done():
+				return
+			}
+		}
+		if err != nil {
+			select {
+			case packets <- devicePacket{err: err}:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}
+}
+
+// DefaultPacketDumpBytes 是 trace 日志中默认转储的数据包字节数
+const DefaultPacketDumpBytes = 64
+
+// tracePacket 在 trace 日志级别输出数据包的长度与前 limit 个字节的十六进制转储
+// 先检查日志级别，未启用时不构造转储内容，不影响转发的性能
+func tracePacket(direction string, pkt []byte, limit int) {
+	if !logger.Logger.IsLevelEnabled(logrus.TraceLevel) {
+		return
+	}
+	if limit <= 0 {
+		limit = DefaultPacketDumpBytes
+	}
+	logger.Logger.Tracef("%s packet, %d bytes:\n%s", direction, len(pkt), hex.Dump(pkt[:min(len(pkt), limit)]))
+}
+
+// forwardToIP 将一个设备数据包发送到IP连接，并把可能产生的ICMP回复写回设备
+// 无论成功与否，数据包缓冲区都会在返回时归还到 pool
+func forwardToIP(ctx context.Context, pkt devicePacket, pool *NetBuffer, limiter, bandwidth *rate.Limiter, device TunnelDevice, ipConn IPConn, stats *TunnelStats, dumpBytes int) error {
+	defer pool.PutBuf(pkt.buf)
+
+	if limiter != nil {
+		// 等待令牌，上下文取消时立即退出
+		if err := limiter.Wait(ctx); err != nil {
+			return err
+		}
+	}
+	if bandwidth != nil {
+		if err := bandwidth.WaitN(ctx, pkt.n); err != nil {
+			return err
+		}
+	}
+
+	stats.RecordPacketOut(pkt.n)
+	tracePacket("Outbound", (*pkt.buf)[:pkt.n], dumpBytes)
+	icmp, err := ipConn.WritePacket((*pkt.buf)[:pkt.n])
+	if err != nil {
+		return fmt.Errorf("failed to write to IP connection: %v", err)
+	}
+
+	if len(icmp) > 0 {
+		tracePacket("ICMP reply", icmp, dumpBytes)
+		if err := device.WritePacket(icmp); err != nil {
+			return fmt.Errorf("failed to write ICMP to TUN device: %v", err)
+		}
+		stats.RecordPacketIn(len(icmp))
+	}
+	return nil
+}
+
+// forwardToDevice 从IP连接读取一个数据包并写入设备，缓冲区取自 pool 并在返回时归还
+// bandwidth 不为nil时在写入设备前等待相应的字节令牌
+func forwardToDevice(ctx context.Context, pool *NetBuffer, bandwidth *rate.Limiter, device TunnelDevice, ipConn IPConn, stats *TunnelStats, dumpBytes int) error {
+	buf := pool.GetBuf()
+	defer pool.PutBuf(buf)
+
+	n, err := ipConn.ReadPacket(*buf, true)
+	if err != nil {
+		return fmt.Errorf("failed to read from IP connection: %v", err)
+	}
+	if bandwidth != nil {
+		if err := bandwidth.WaitN(ctx, n); err != nil {
+			return err
+		}
+	}
+
+	stats.RecordPacketIn(n)
+	tracePacket("Inbound", (*buf)[:n], dumpBytes)
+	if err := device.WritePacket((*buf)[:n]); err != nil {
+		return fmt.Errorf("failed to write to TUN device: %v", err)
+	}
+	return nil
+}
+
+// handleForwarding 处理数据包的转发，packets 中的缓冲区属于 pool
+// 返回前会关闭 ipConn 并等待两个方向的转发goroutine全部退出
+func handleForwarding(parent context.Context, config ConnectionConfig, device TunnelDevice, pool *NetBuffer, packets <-chan devicePacket, ipConn IPConn, stats *TunnelStats) error {
+	limiter := newPacketLimiter(config)
+	// 上行与下行使用各自的字节限速器，互不占用对方的额度
+	upBandwidth, downBandwidth := newByteLimiter(config), newByteLimiter(config)
 	errChan := make(chan error, 2)
-	ctx, cancel := context.WithCancel(ctx)
+	ctx, cancel := context.WithCancel(parent)
 	defer cancel() // 确保在函数退出时取消上下文
 
+	var wg sync.WaitGroup
+	wg.Add(3)
+
+	// 上下文取消时关闭IP连接，以唤醒阻塞在 ReadPacket 上的goroutine
+	go func() {
+		defer wg.Done()
+		<-ctx.Done()
+		ipConn.Close()
+	}()
+
 	// 从设备到IP连接的转发
 	go func() {
+		defer wg.Done()
 		defer cancel() // 确保在goroutine退出时取消上下文
 		for {
+			var pkt devicePacket
 			select {
 			case <-ctx.Done():
 				return
-			default:
-				buf := packetBufferPool.GetBuf()
-
-				n, err := device.ReadPacket(*buf)
-				if err != nil {
-					packetBufferPool.PutBuf(buf)
-					errChan <- fmt.Errorf("failed to read from TUN device: %v", err)
-					return
-				}
-
-				stats.RecordPacketOut(n)
-				icmp, err := ipConn.WritePacket((*buf)[:n])
-				if err != nil {
-					packetBufferPool.PutBuf(buf)
-					errChan <- fmt.Errorf("failed to write to IP connection: %v", err)
-					return
-				}
-				if cap(*buf) < 2*packetBuffCap {
-					packetBufferPool.PutBuf(buf)
-				}
-
-				if len(icmp) > 0 {
-					if err := device.WritePacket(icmp); err != nil {
-						errChan <- fmt.Errorf("failed to write ICMP to TUN device: %v", err)
-						return
-					}
-					stats.RecordPacketIn(len(icmp))
+			case pkt = <-packets:
+			}
+			if pkt.err != nil {
+				errChan <- fmt.Errorf("failed to read from TUN device: %v", pkt.err)
+				return
+			}
+			if err := forwardToIP(ctx, pkt, pool, limiter, upBandwidth, device, ipConn, stats, config.PacketDumpBytes); err != nil {
+				if ctx.Err() == nil {
+					errChan <- err
 				}
+				return
 			}
 		}
 	}()
 
 	// 从IP连接到设备的转发
 	go func() {
+		defer wg.Done()
 		defer cancel() // 确保在goroutine退出时取消上下文
-		for {
-			select {
-			case <-ctx.Done():
+		for ctx.Err() == nil {
+			if err := forwardToDevice(ctx, pool, downBandwidth, device, ipConn, stats, config.PacketDumpBytes); err != nil {
+				errChan <- err
 				return
-			default:
-				buf := packetBufferPool.GetBuf()
-
-				n, err := ipConn.ReadPacket(*buf, true)
-				if err != nil {
-					packetBufferPool.PutBuf(buf)
-					errChan <- fmt.Errorf("failed to read from IP connection: %v", err)
-					return
-				}
-
-				stats.RecordPacketIn(n)
-				if err := device.WritePacket((*buf)[:n]); err != nil {
-					packetBufferPool.PutBuf(buf)
-					errChan <- fmt.Errorf("failed to write to TUN device: %v", err)
-					return
-				}
-				if cap(*buf) < 2*packetBuffCap {
-					packetBufferPool.PutBuf(buf)
-				}
 			}
 		}
 	}()
 
 	// 等待错误或上下文取消
+	var err error
 	select {
-	case err := <-errChan:
-		return err
+	case err = <-errChan:
 	case <-ctx.Done():
-		return ctx.Err()
+		err = context.Cause(ctx)
 	}
+	cancel()
+	wg.Wait()
+	// 外部取消（如卡死或空闲检测）的原因优先于由此引发的读写错误
+	if parent.Err() != nil {
+		return context.Cause(parent)
+	}
+	return err
 }
 
-// monitorStats 监控统计信息
-func monitorStats(ctx context.Context, stats *TunnelStats) {
-	ticker := time.NewTicker(300 * time.Second)
+// errTunnelStalled 表示隧道在发出数据后长时间没有收到任何回包
+var errTunnelStalled = errors.New("tunnel stalled: no inbound traffic")
+
+// watchStall 定期检查统计计数，当有数据发出但超过 timeout 仍未收到任何数据时调用 cancel 触发重连
+// 两个方向都没有流量的空闲隧道不会被视为卡死
+func watchStall(ctx context.Context, stats *TunnelStats, timeout time.Duration, cancel context.CancelCauseFunc) {
+	if timeout <= 0 {
+		return
+	}
+	interval := min(max(timeout/3, time.Second), 5*time.Second)
+	ticker := time.NewTicker(interval)
 	defer ticker.Stop()
 
+	prev := stats.Snapshot()
+	var waitingSince time.Time // 首次观察到只出不进的时间
 	for {
 		select {
 		case <-ctx.Done():
 			return
-		case <-ticker.C:
-                       logger.Logger.Infof("Tunnel stats: In: %d pkts (%d bytes), Out: %d pkts (%d bytes), Errors: %d, HandShake: %d",
-                               stats.PacketsIn, stats.BytesIn, stats.PacketsOut, stats.BytesOut, stats.Errors, stats.HandShake)
+		case now := <-ticker.C:
+			snap := stats.Snapshot()
+			switch {
+			case snap.BytesIn != prev.BytesIn:
+				waitingSince = time.Time{}
+			case snap.BytesOut != prev.BytesOut && waitingSince.IsZero():
+				waitingSince = now
+			}
+			prev = snap
+
+			if !waitingSince.IsZero() && now.Sub(waitingSince) >= timeout {
+				logger.Logger.Warnf("No inbound traffic for %v while sending, forcing reconnect", now.Sub(waitingSince).Round(time.Second))
+				cancel(errTunnelStalled)
+				return
+			}
 		}
 	}
 }
 
-// handleConnection 处理单次连接
-func handleConnection(ctx context.Context, config ConnectionConfig, device TunnelDevice, stats *TunnelStats, reconnectAttempt int) (int, error) {
-       logger.Logger.Infof("Establishing MASQUE connection to %s:%d (attempt #%d)",
-               config.Endpoint.IP, config.Endpoint.Port, reconnectAttempt+1)
-
-	udpConn, tr, ipConn, rsp, err := ConnectTunnel(
-		ctx,
-		config.TLSConfig,
-		internal.DefaultQuicConfig(config.KeepAlivePeriod, config.InitialPacketSize),
-		internal.ConnectURI,
-		config.Endpoint,
-	)
+// ErrReconnectLimit 表示连续连接失败的次数达到了 MaxReconnects，MaintainTunnel 已放弃重连
+var ErrReconnectLimit = errors.New("giving up after too many failed connection attempts")
 
-	if err != nil {
-		return reconnectAttempt + 1, err
+// ErrIdentityRejected 表示服务端连续 MaxRejections 次以 401 或 403 拒绝了设备身份，继续重试同一身份没有意义
+var ErrIdentityRejected = errors.New("device identity rejected by the server")
+
+// errReconnectRequested 表示通过 Reconnector 要求了立即重连
+var errReconnectRequested = errors.New("reconnect requested")
+
+// Reconnector 让 MaintainTunnel 之外的代码（如控制接口）要求隧道立即重连
+type Reconnector struct {
+	ch chan struct{}
+}
+
+// NewReconnector 创建 Reconnector，通过 ConnectionConfig.Reconnector 交给 MaintainTunnel
+func NewReconnector() *Reconnector {
+	return &Reconnector{ch: make(chan struct{}, 1)}
+}
+
+// Reconnect 要求隧道断开当前连接并立即重新建立，退避从头开始；正在等待重连时跳过剩余的等待
+// 不会阻塞，尚未处理的多个请求合并为一次
+func (r *Reconnector) Reconnect() {
+	select {
+	case r.ch <- struct{}{}:
+	default:
 	}
-	defer func() {
-		if ipConn != nil {
-			ipConn.Close()
+}
+
+// requested 返回接收重连请求的通道，r 为空时返回永不就绪的 nil 通道
+func (r *Reconnector) requested() <-chan struct{} {
+	if r == nil {
+		return nil
+	}
+	return r.ch
+}
+
+// discard 丢弃建立新连接之前收到的请求，新连接已经满足了它们
+func (r *Reconnector) discard() {
+	select {
+	case <-r.requested():
+	default:
+	}
+}
+
+// watchReconnect 在收到重连请求时以 errReconnectRequested 调用 cancel 结束当前连接
+func watchReconnect(ctx context.Context, r *Reconnector, cancel context.CancelCauseFunc) {
+	select {
+	case <-ctx.Done():
+	case <-r.requested():
+		logger.Logger.Info("Reconnect requested, closing the current connection")
+		cancel(errReconnectRequested)
+	}
+}
+
+// errTunnelIdle 表示隧道在空闲超时内两个方向都没有流量
+var errTunnelIdle = errors.New("tunnel idle")
+
+// watchIdle 定期检查统计计数，两个方向都没有流量超过 timeout 时调用 cancel 关闭隧道
+func watchIdle(ctx context.Context, stats *TunnelStats, timeout time.Duration, cancel context.CancelCauseFunc) {
+	if timeout <= 0 {
+		return
+	}
+	interval := min(max(timeout/3, time.Second), 5*time.Second)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	prev := stats.Snapshot()
+	lastActive := time.Now()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			snap := stats.Snapshot()
+			if snap.BytesIn != prev.BytesIn || snap.BytesOut != prev.BytesOut {
+				lastActive = now
+			}
+			prev = snap
+
+			if now.Sub(lastActive) >= timeout {
+				cancel(errTunnelIdle)
+				return
+			}
 		}
-		if udpConn != nil {
-			udpConn.Close()
+	}
+}
+
+// DefaultStatsInterval 是统计日志的默认输出间隔
+const DefaultStatsInterval = 300 * time.Second
+
+// monitorStats 监控统计信息，debug 日志级别下同时输出该隧道缓冲池 pool 的计数
+func monitorStats(ctx context.Context, stats *TunnelStats, pool *NetBuffer, interval time.Duration) {
+	if interval < 0 {
+		return
+	}
+	if interval == 0 {
+		interval = DefaultStatsInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	stats.markLogged()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			stats.logStats("Tunnel stats")
+			if logger.Logger.IsLevelEnabled(logrus.DebugLevel) {
+				ps := pool.Stats()
+				logger.Logger.Debugf("Packet buffer pool: %d gets, %d new, %d puts, %d discarded",
+					ps.Gets, ps.News, ps.Puts, ps.Discards)
+			}
 		}
-		if tr != nil {
-			tr.Close()
+	}
+}
+
+// LogStats 立即输出一次统计信息，格式与周期性输出相同，速率为自上次输出以来的平均值
+func (s *TunnelStats) LogStats() {
+	s.logStats("Tunnel stats (on demand)")
+}
+
+// markLogged 在尚未输出过统计信息时记录速率计算的起点
+func (s *TunnelStats) markLogged() {
+	snap := s.Snapshot()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.loggedAt.IsZero() {
+		s.logged, s.loggedAt = snap, time.Now()
+	}
+}
+
+// logStats 输出当前统计信息及自上次输出以来的每秒速率
+func (s *TunnelStats) logStats(title string) {
+	snap, now := s.Snapshot(), time.Now()
+	s.mu.Lock()
+	prev, prevAt := s.logged, s.loggedAt
+	s.logged, s.loggedAt = snap, now
+	s.mu.Unlock()
+
+	secs := 0.0
+	if !prevAt.IsZero() {
+		secs = now.Sub(prevAt).Seconds()
+	}
+	rate := func(cur, old uint64) float64 {
+		if secs <= 0 || cur < old {
+			return 0
 		}
-	}()
+		return float64(cur-old) / secs
+	}
+	logger.Logger.Infof("%s: In: %d pkts (%d bytes), Out: %d pkts (%d bytes), Errors: %d, HandShake: %d "+
+		"(last %v, avg %v) | Rate In: %.1f pkts/s (%.0f B/s), Out: %.1f pkts/s (%.0f B/s)",
+		title, snap.PacketsIn, snap.BytesIn, snap.PacketsOut, snap.BytesOut, snap.Errors, snap.HandShake,
+		snap.HandshakeTime.Round(time.Millisecond), snap.AvgHandshakeTime.Round(time.Millisecond),
+		rate(snap.PacketsIn, prev.PacketsIn), rate(snap.BytesIn, prev.BytesIn),
+		rate(snap.PacketsOut, prev.PacketsOut), rate(snap.BytesOut, prev.BytesOut))
+}
 
-	if rsp.StatusCode != 200 {
-		stats.RecordError()
-		return reconnectAttempt + 1, fmt.Errorf("tunnel connection failed: %s", rsp.Status)
+// handleConnection 处理单次连接
+func handleConnection(ctx context.Context, config ConnectionConfig, device TunnelDevice, pool *NetBuffer, packets <-chan devicePacket, stats *TunnelStats, reconnectAttempt int) (int, error) {
+	config.Events.OnConnecting(config.Endpoint, reconnectAttempt+1)
+
+	// 握手超时只作用于建立连接阶段，父上下文的取消仍然优先生效
+	connectCtx, cancelConnect := ctx, context.CancelFunc(func() {})
+	if config.ConnectTimeout > 0 {
+		connectCtx, cancelConnect = context.WithTimeout(ctx, config.ConnectTimeout)
+	}
+	connector := config.Connector
+	if connector == nil {
+		connector = MasqueConnector{}
+	}
+	connectStart := time.Now()
+	ipConn, release, err := connector.Connect(connectCtx, config)
+	connectErr := connectCtx.Err()
+	cancelConnect()
+
+	if err != nil {
+		if errors.Is(err, errTunnelRejected) {
+			stats.RecordError()
+		}
+		if ctx.Err() == nil && errors.Is(connectErr, context.DeadlineExceeded) {
+			err = fmt.Errorf("MASQUE handshake timed out after %v: %w", config.ConnectTimeout, err)
+		}
+		return reconnectAttempt + 1, err
 	}
+	defer release()
 
+	connectTime := time.Since(connectStart)
+	stats.RecordHandshakeTime(connectTime)
 	stats.RecordHandShake()
-       logger.Logger.Info("Connected to MASQUE server")
+	defer stats.RecordDisconnect()
+	config.Events.OnConnected(config.Endpoint, connectTime)
 
 	// 创建子上下文用于转发
-	forwardingCtx, cancel := context.WithCancel(ctx)
-	defer cancel()
+	forwardingCtx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
 
 	// 启动监控统计
-	go monitorStats(forwardingCtx, stats)
+	config.Reconnector.discard()
+	go monitorStats(forwardingCtx, stats, pool, config.StatsInterval)
+	go watchStall(forwardingCtx, stats, config.StallTimeout, cancel)
+	go watchIdle(forwardingCtx, stats, config.IdleTimeout, cancel)
+	go watchReconnect(forwardingCtx, config.Reconnector, cancel)
 
 	// 处理转发
-
-	if err = handleForwarding(forwardingCtx, device, ipConn, stats); err != nil {
-               logger.Logger.Errorf("Forwarding error: %v", err)
+	err = handleForwarding(forwardingCtx, config, device, pool, packets, ipConn, stats)
+	if errors.Is(err, errTunnelIdle) || errors.Is(err, errReconnectRequested) {
+		return 0, err
+	}
+	if err != nil {
 		stats.RecordError()
 	}
 
 	return 0, err
 }
 
-func MaintainTunnel(ctx context.Context, config ConnectionConfig, device TunnelDevice) {
-	stats := &TunnelStats{}
+// MaintainTunnel 建立隧道并在连接断开后重连，直到 ctx 取消或隧道空闲关闭，此时返回 nil
+// 设置了 MaxReconnects 时，连续失败达到该次数后返回包装了 ErrReconnectLimit 的错误，握手成功时重新计数
+// 设置了 MaxRejections 时，身份连续被拒绝达到该次数后返回包装了 ErrIdentityRejected 的错误，
+// 其间的其他连接错误不影响计数，握手成功时重新计数
+// 通过 Reconnector 要求重连时断开当前连接并立即重连，不计入失败次数
+func MaintainTunnel(ctx context.Context, config ConnectionConfig, device TunnelDevice) error {
+	stats := config.Stats
+	if stats == nil {
+		stats = &TunnelStats{}
+	}
+	if config.Events == nil {
+		config.Events = LogEvents{}
+	}
 	reconnectAttempt := 0
-	packetBufferPool = NewNetBuffer(config.MTU)
+	// 每个隧道使用自己的缓冲池，容量统一为 packetBufSize(MTU)，各隧道的MTU可以不同
+	pool := NewNetBuffer(packetBufSize(config.MTU))
+
+	// 空闲关闭时 MaintainTunnel 先于调用方的上下文返回，需要单独结束设备读取
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	if config.StatsFile != "" {
+		written := make(chan struct{})
+		go func() {
+			defer close(written)
+			writeStatsFile(ctx, stats, config.StatsFile)
+		}()
+		// 等待最后一次写入完成，使文件反映隧道已停止
+		defer func() {
+			cancel()
+			<-written
+		}()
+	}
+
+	packets := make(chan devicePacket)
+	go readDevice(ctx, device, pool, packets)
+
+	endpoints := config.Endpoints
+	if len(endpoints) == 0 {
+		endpoints = []*net.UDPAddr{config.Endpoint}
+	}
+	active, failures, rejections := 0, 0, 0
+	if len(endpoints) > 1 {
+		logger.Logger.Infof("Using endpoint %s (1/%d)", endpoints[active], len(endpoints))
+	}
 
 	for {
 		select {
 		case <-ctx.Done():
-                        logger.Logger.Info("Context canceled, stopping tunnel maintenance")
-			return
+			logger.Logger.Info("Context canceled, stopping tunnel maintenance")
+			return nil
 		default:
 		}
 
-		reconnectAttempt, err := handleConnection(ctx, config, device, stats, reconnectAttempt)
+		var err error
+		config.Endpoint = endpoints[active]
+		reconnectAttempt, err = handleConnection(ctx, config, device, pool, packets, stats, reconnectAttempt)
 		if ctx.Err() != nil {
-			return
+			config.Events.OnDisconnected(nil)
+			return nil
+		}
+		if errors.Is(err, errTunnelIdle) {
+			logger.Logger.Infof("No traffic for %v, closing tunnel", config.IdleTimeout)
+			config.Events.OnDisconnected(nil)
+			return nil
+		}
+		if errors.Is(err, errReconnectRequested) {
+			// 主动断开不算作失败，立即重连
+			config.Events.OnDisconnected(nil)
+			stats.RecordReconnect()
+			config.ReconnectStrategy.Reset()
+			continue
+		}
+		config.Events.OnDisconnected(err)
+		if identityRejected(err) {
+			rejections++
+		} else if reconnectAttempt == 0 {
+			rejections = 0
+		}
+		if config.MaxRejections > 0 && rejections >= config.MaxRejections {
+			logger.Logger.Errorf("Device identity rejected %d times in a row, giving up on it", rejections)
+			return fmt.Errorf("%w (%d in a row): %v", ErrIdentityRejected, rejections, err)
+		}
+		if config.MaxReconnects > 0 && reconnectAttempt >= config.MaxReconnects {
+			logger.Logger.Errorf("Connection failed %d times in a row, giving up", reconnectAttempt)
+			return fmt.Errorf("%w (%d in a row): %v", ErrReconnectLimit, reconnectAttempt, err)
+		}
+		stats.RecordReconnect()
+
+		// 握手成功时清零失败计数，连续失败达到阈值时切换到下一个端点
+		if reconnectAttempt == 0 {
+			failures = 0
+		} else if failures++; len(endpoints) > 1 && config.FailoverAfter > 0 && failures >= config.FailoverAfter {
+			active = (active + 1) % len(endpoints)
+			failures = 0
+			logger.Logger.Warnf("Endpoint failed %d times in a row, switching to %s (%d/%d)",
+				config.FailoverAfter, endpoints[active], active+1, len(endpoints))
 		}
 
 		if err != nil {
-			delay := config.ReconnectStrategy.NextDelay(reconnectAttempt)
-                       logger.Logger.Warnf("Connection error: %v. Will retry in %v", err, delay)
+			if reconnectAttempt == 0 {
+				// 连接曾成功建立，从头开始退避
+				config.ReconnectStrategy.Reset()
+			}
+			// 退避次数只由策略的内部计数决定：reconnectAttempt 在连接断开后从0重新计数，
+			// 与断开后的第一次退避相差一次，混用两者会使断开后的首个延迟重复一次
+			delay := config.ReconnectStrategy.NextDelay(0)
+			config.Events.OnReconnectScheduled(delay)
 
 			select {
 			case <-time.After(delay):
 				continue
+			case <-config.Reconnector.requested():
+				logger.Logger.Info("Reconnect requested, retrying now")
+				config.ReconnectStrategy.Reset()
+				continue
 			case <-ctx.Done():
-				return
+				return nil
 			}
 		}
 
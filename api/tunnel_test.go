@@ -0,0 +1,349 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestPacketBuffersRecycledAtMTU(t *testing.T) {
+	const mtu = 1280
+	pool := NewNetBuffer(packetBufSize(mtu))
+
+	for i := 0; i < 3; i++ {
+		buf := pool.GetBuf()
+		if len(*buf) != mtu || cap(*buf) != mtu {
+			t.Fatalf("GetBuf returned len %d cap %d, want %d", len(*buf), cap(*buf), mtu)
+		}
+		// 转发后的缓冲区被截短为数据包长度，归还时应恢复完整长度
+		*buf = (*buf)[:100]
+		pool.PutBuf(buf)
+	}
+
+	// 其他MTU的缓冲区不会进入池中
+	other := make([]byte, 1500)
+	pool.PutBuf(&other)
+
+	stats := pool.Stats()
+	if stats.Gets != 3 || stats.Puts != 3 || stats.Discards != 1 {
+		t.Errorf("stats = %+v, want 3 gets, 3 puts, 1 discard", stats)
+	}
+	if buf := pool.GetBuf(); len(*buf) != mtu {
+		t.Errorf("recycled buffer has len %d, want %d", len(*buf), mtu)
+	}
+}
+
+// noJitter 使抖动取区间中点，重连延迟因此等于未加抖动的值
+func noJitter(t *testing.T) {
+	t.Helper()
+	jitterRand = func() float64 { return 0.5 }
+	t.Cleanup(func() { jitterRand = rand.Float64 })
+}
+
+func TestExponentialBackoffSequence(t *testing.T) {
+	noJitter(t)
+	tests := []struct {
+		name    string
+		backoff ExponentialBackoff
+		want    []time.Duration
+	}{
+		{
+			name:    "doubling capped at max",
+			backoff: ExponentialBackoff{InitialDelay: time.Second, MaxDelay: 10 * time.Second, Factor: 2},
+			want:    []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 8 * time.Second, 10 * time.Second, 10 * time.Second},
+		},
+		{
+			name:    "fractional factor",
+			backoff: ExponentialBackoff{InitialDelay: 100 * time.Millisecond, MaxDelay: time.Second, Factor: 1.5},
+			want: []time.Duration{100 * time.Millisecond, 150 * time.Millisecond, 225 * time.Millisecond,
+				337500 * time.Microsecond, 506250 * time.Microsecond, 759375 * time.Microsecond, time.Second},
+		},
+		{
+			name:    "initial delay above max",
+			backoff: ExponentialBackoff{InitialDelay: time.Minute, MaxDelay: 30 * time.Second, Factor: 2},
+			want:    []time.Duration{30 * time.Second, 30 * time.Second},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := tt.backoff
+			for i, want := range tt.want {
+				if got := b.NextDelay(0); got != want {
+					t.Errorf("delay #%d = %v, want %v", i+1, got, want)
+				}
+			}
+			// Reset 后从 InitialDelay 重新开始
+			b.Reset()
+			if got := b.NextDelay(0); got != tt.want[0] {
+				t.Errorf("delay after Reset = %v, want %v", got, tt.want[0])
+			}
+		})
+	}
+}
+
+func TestExponentialBackoffExplicitAttempt(t *testing.T) {
+	noJitter(t)
+	b := ExponentialBackoff{InitialDelay: time.Second, MaxDelay: 5 * time.Minute, Factor: 2}
+	if got := b.NextDelay(4); got != 8*time.Second {
+		t.Errorf("NextDelay(4) = %v, want 8s", got)
+	}
+	// 内部计数从给定的次数继续
+	if got := b.NextDelay(0); got != 16*time.Second {
+		t.Errorf("NextDelay(0) after 4 = %v, want 16s", got)
+	}
+	// 次数很大时不溢出，停在 MaxDelay
+	if got := b.NextDelay(10000); got != 5*time.Minute {
+		t.Errorf("NextDelay(10000) = %v, want 5m", got)
+	}
+}
+
+func TestLinearBackoffSequence(t *testing.T) {
+	noJitter(t)
+	tests := []struct {
+		name    string
+		backoff LinearBackoff
+		want    []time.Duration
+	}{
+		{
+			name:    "capped at max",
+			backoff: LinearBackoff{InitialDelay: time.Second, Increment: time.Second, MaxDelay: 3 * time.Second},
+			want:    []time.Duration{time.Second, 2 * time.Second, 3 * time.Second, 3 * time.Second},
+		},
+		{
+			name:    "no max",
+			backoff: LinearBackoff{InitialDelay: 500 * time.Millisecond, Increment: 250 * time.Millisecond},
+			want:    []time.Duration{500 * time.Millisecond, 750 * time.Millisecond, time.Second, 1250 * time.Millisecond},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := tt.backoff
+			for i, want := range tt.want {
+				if got := b.NextDelay(0); got != want {
+					t.Errorf("delay #%d = %v, want %v", i+1, got, want)
+				}
+			}
+			b.Reset()
+			if got := b.NextDelay(0); got != tt.want[0] {
+				t.Errorf("delay after Reset = %v, want %v", got, tt.want[0])
+			}
+		})
+	}
+}
+
+func TestBackoffJitterBounds(t *testing.T) {
+	b := ExponentialBackoff{InitialDelay: time.Second, MaxDelay: time.Minute, Factor: 2}
+	for i := 0; i < 100; i++ {
+		b.Reset()
+		if got := b.NextDelay(0); got < 900*time.Millisecond || got > 1100*time.Millisecond {
+			t.Fatalf("jittered delay %v outside 1s ±10%%", got)
+		}
+	}
+}
+
+// faultyDevice 是总能读到数据包的 TunnelDevice，第 failAt 次写入起返回错误
+type faultyDevice struct {
+	failAt int64
+	writes atomic.Int64
+}
+
+func (d *faultyDevice) ReadPacket(buf []byte) (int, error) {
+	time.Sleep(time.Millisecond)
+	return copy(buf, make([]byte, 60)), nil
+}
+
+func (d *faultyDevice) WritePacket(pkt []byte) error {
+	if d.writes.Add(1) >= d.failAt {
+		return errors.New("device write failed")
+	}
+	return nil
+}
+
+// scriptedIPConn 在关闭前持续返回入站数据包，icmp 不为空时每次写入都返回该ICMP回复
+type scriptedIPConn struct {
+	icmp      []byte
+	writeErr  error
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+func newScriptedIPConn() *scriptedIPConn {
+	return &scriptedIPConn{closed: make(chan struct{})}
+}
+
+func (c *scriptedIPConn) ReadPacket(b []byte, _ bool) (int, error) {
+	select {
+	case <-c.closed:
+		return 0, errors.New("connection closed")
+	case <-time.After(time.Millisecond):
+		return copy(b, make([]byte, 80)), nil
+	}
+}
+
+func (c *scriptedIPConn) WritePacket(b []byte) ([]byte, error) {
+	return c.icmp, c.writeErr
+}
+
+func (c *scriptedIPConn) Close() error {
+	c.closeOnce.Do(func() { close(c.closed) })
+	return nil
+}
+
+func TestForwardingReturnsBuffersOnErrors(t *testing.T) {
+	tests := []struct {
+		name   string
+		failAt int64
+		conn   func() *scriptedIPConn
+	}{
+		{"device write error", 5, newScriptedIPConn},
+		{"ICMP reply write error", 3, func() *scriptedIPConn {
+			c := newScriptedIPConn()
+			c.icmp = make([]byte, 28)
+			return c
+		}},
+		{"IP write error", 1 << 30, func() *scriptedIPConn {
+			c := newScriptedIPConn()
+			c.writeErr = errors.New("ip write failed")
+			return c
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := ConnectionConfig{MTU: 1280, Events: LogEvents{}}
+			pool := NewNetBuffer(packetBufSize(config.MTU))
+			device := &faultyDevice{failAt: tt.failAt}
+
+			ctx, cancel := context.WithCancel(context.Background())
+			packets := make(chan devicePacket)
+			readerDone := make(chan struct{})
+			go func() {
+				defer close(readerDone)
+				readDevice(ctx, device, pool, packets)
+			}()
+
+			err := handleForwarding(ctx, config, device, pool, packets, tt.conn(), &TunnelStats{})
+			if err == nil {
+				t.Fatal("handleForwarding returned nil, want the injected error")
+			}
+			cancel()
+			<-readerDone
+
+			stats := pool.Stats()
+			if outstanding := int64(stats.Gets) - int64(stats.Puts) - int64(stats.Discards); outstanding != 0 {
+				t.Errorf("%d buffers not returned (%+v), error: %v", outstanding, stats, err)
+			}
+			if stats.Discards != 0 {
+				t.Errorf("%d buffers discarded, want 0", stats.Discards)
+			}
+		})
+	}
+}
+
+// recordingBackoff 记录 MaintainTunnel 对重连策略的调用及得到的延迟
+type recordingBackoff struct {
+	mu     sync.Mutex
+	inner  ExponentialBackoff
+	calls  []string
+	delays []time.Duration // 最近一次 Reset 之后返回的延迟
+}
+
+func (b *recordingBackoff) NextDelay(attempt int) time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	delay := b.inner.NextDelay(attempt)
+	b.calls = append(b.calls, delay.String())
+	b.delays = append(b.delays, delay)
+	return delay
+}
+
+func (b *recordingBackoff) Reset() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.inner.Reset()
+	b.calls = append(b.calls, "reset")
+	b.delays = nil
+}
+
+// scriptedConnector 按顺序返回预设的结果：nil 表示握手成功，连接在 10ms 后断开
+type scriptedConnector struct {
+	mu     sync.Mutex
+	script []error
+}
+
+func (c *scriptedConnector) Connect(ctx context.Context, config ConnectionConfig) (IPConn, func(), error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.script) == 0 {
+		return nil, nil, errors.New("script exhausted")
+	}
+	err := c.script[0]
+	c.script = c.script[1:]
+	if err != nil {
+		return nil, nil, err
+	}
+	conn := newScriptedIPConn()
+	time.AfterFunc(10*time.Millisecond, func() { conn.Close() })
+	return conn, func() { conn.Close() }, nil
+}
+
+func TestMaintainTunnelBackoff(t *testing.T) {
+	noJitter(t)
+	failure := errors.New("handshake failed")
+	tests := []struct {
+		name   string
+		script []error
+		want   []string
+	}{
+		{
+			name:   "failures only",
+			script: []error{failure, failure, failure},
+			want:   []string{"1ms", "2ms"},
+		},
+		{
+			name:   "reset after successful handshake",
+			script: []error{failure, failure, nil, failure, failure, failure},
+			want:   []string{"1ms", "2ms", "reset", "1ms", "2ms", "4ms"},
+		},
+		{
+			name:   "success first",
+			script: []error{nil, failure, failure, failure},
+			want:   []string{"reset", "1ms", "2ms", "4ms"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			backoff := &recordingBackoff{inner: ExponentialBackoff{InitialDelay: time.Millisecond, MaxDelay: time.Second, Factor: 2}}
+			config := ConnectionConfig{
+				Endpoint:          &net.UDPAddr{IP: net.IPv4(162, 159, 198, 1), Port: 443},
+				MTU:               1280,
+				MaxReconnects:     3,
+				StatsInterval:     -1,
+				ReconnectStrategy: backoff,
+				Connector:         &scriptedConnector{script: tt.script},
+				Events:            LogEvents{},
+			}
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+
+			err := MaintainTunnel(ctx, config, &faultyDevice{failAt: 1 << 30})
+			if !errors.Is(err, ErrReconnectLimit) {
+				t.Fatalf("MaintainTunnel returned %v, want ErrReconnectLimit", err)
+			}
+			if got := strings.Join(backoff.calls, " "); got != strings.Join(tt.want, " ") {
+				t.Errorf("backoff calls = %s, want %s", got, strings.Join(tt.want, " "))
+			}
+			// 断开或失败后的延迟不重复，逐次增加
+			for i := 1; i < len(backoff.delays); i++ {
+				if backoff.delays[i] <= backoff.delays[i-1] {
+					t.Errorf("delay #%d after reset is %v, not longer than %v", i+1, backoff.delays[i], backoff.delays[i-1])
+				}
+			}
+		})
+	}
+}
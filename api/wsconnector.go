@@ -0,0 +1,120 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"sync"
+
+	"github.com/HynoR/uscf/internal/logger"
+	"golang.org/x/net/websocket"
+)
+
+// maxWSMessageSize 是从中继接收的单个WebSocket消息的最大字节数
+const maxWSMessageSize = 65535
+
+// WebSocketConnector 通过 WebSocket（ws:// 或 wss://）连接到中继，用于UDP被完全阻断、无法建立QUIC连接的网络
+// 每个二进制消息承载一个IP数据包，方向与 CONNECT-IP 相同，文本消息被忽略
+// 中继负责将数据包转发到 MASQUE 隧道，URL 中可以携带中继要求的认证参数
+type WebSocketConnector struct {
+	URL string
+}
+
+func (c WebSocketConnector) Connect(ctx context.Context, config ConnectionConfig) (IPConn, func(), error) {
+	u, err := url.Parse(c.URL)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid WebSocket URL: %v", err)
+	}
+	origin := "https://" + u.Host
+	if u.Scheme == "ws" {
+		origin = "http://" + u.Host
+	}
+	wsConfig, err := websocket.NewConfig(c.URL, origin)
+	if err != nil {
+		return nil, nil, err
+	}
+	conn, err := wsConfig.DialContext(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	conn.PayloadType = websocket.BinaryFrame
+	conn.MaxPayloadBytes = maxWSMessageSize
+
+	wsConn := &wsIPConn{conn: conn}
+	return wsConn, func() { wsConn.Close() }, nil
+}
+
+// wsIPConn 将 WebSocket 连接适配为 IPConn
+type wsIPConn struct {
+	conn    *websocket.Conn
+	writeMu sync.Mutex
+}
+
+// ReadPacket 读取下一个数据包，超过 b 长度的数据包被丢弃
+func (c *wsIPConn) ReadPacket(b []byte, _ bool) (int, error) {
+	for {
+		var msg []byte
+		if err := websocket.Message.Receive(c.conn, &msg); err != nil {
+			return 0, err
+		}
+		if len(msg) == 0 {
+			continue
+		}
+		if len(msg) > len(b) {
+			logger.Logger.Debugf("Dropping %d byte packet from WebSocket relay: larger than the MTU", len(msg))
+			continue
+		}
+		return copy(b, msg), nil
+	}
+}
+
+// WritePacket 以一个二进制消息发送数据包，不会产生ICMP回复
+func (c *wsIPConn) WritePacket(b []byte) ([]byte, error) {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	_, err := c.conn.Write(b)
+	return nil, err
+}
+
+func (c *wsIPConn) Close() error {
+	return c.conn.Close()
+}
+
+// FallbackConnector 使用 Primary 建立连接，连续失败 After 次后改用 Fallback
+// Fallback 连接失败时回到 Primary 重新计数，因此QUIC恢复可用后会重新使用QUIC
+// Connect 只由 MaintainTunnel 顺序调用，不需要加锁
+type FallbackConnector struct {
+	Primary  Connector
+	Fallback Connector
+	After    int // 切换前 Primary 连续失败的次数，小于等于0时不切换
+
+	failures   int
+	onFallback bool
+}
+
+func (c *FallbackConnector) Connect(ctx context.Context, config ConnectionConfig) (IPConn, func(), error) {
+	if c.onFallback {
+		ipConn, release, err := c.Fallback.Connect(ctx, config)
+		if err != nil && !errors.Is(ctx.Err(), context.Canceled) {
+			c.onFallback = false
+			logger.Logger.Warnf("WebSocket transport failed, trying QUIC again")
+		}
+		return ipConn, release, err
+	}
+
+	ipConn, release, err := c.Primary.Connect(ctx, config)
+	if err == nil {
+		c.failures = 0
+		return ipConn, release, nil
+	}
+	// 握手超时计为失败，调用方取消不计
+	if c.After > 0 && !errors.Is(ctx.Err(), context.Canceled) {
+		if c.failures++; c.failures >= c.After {
+			c.failures = 0
+			c.onFallback = true
+			logger.Logger.Warnf("QUIC connection failed %d times in a row, switching to the WebSocket transport", c.After)
+		}
+	}
+	return nil, nil, err
+}
@@ -0,0 +1,32 @@
+package cmd
+
+import (
+	"net/url"
+
+	"github.com/HynoR/uscf/api"
+	"github.com/HynoR/uscf/config"
+	"github.com/HynoR/uscf/internal/logger"
+	"github.com/spf13/cobra"
+)
+
+// addAPIProxyFlag 为调用注册API的命令添加 --api-proxy 参数
+func addAPIProxyFlag(cmd *cobra.Command) {
+	cmd.Flags().String("api-proxy", "", "Proxy URL (http, https or socks5) for Cloudflare API requests (overrides registration.proxy)")
+}
+
+// useAPIProxy 按命令行参数或配置中的 registration.proxy 设置API请求使用的代理，
+// 并返回生效的代理地址；两者都为空时使用 HTTPS_PROXY 等环境变量
+func useAPIProxy(cmd *cobra.Command) (string, error) {
+	proxy, _ := cmd.Flags().GetString("api-proxy")
+	if proxy == "" {
+		proxy = config.AppConfig.Registration.Proxy
+	}
+	if err := api.SetProxy(proxy); err != nil {
+		return "", err
+	}
+	if u, err := url.Parse(proxy); err == nil && proxy != "" {
+		// 日志中隐藏代理地址里的密码
+		logger.Logger.Infof("Sending API requests through proxy %s", u.Redacted())
+	}
+	return proxy, nil
+}
@@ -0,0 +1,46 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/HynoR/uscf/config"
+	"github.com/spf13/cobra"
+)
+
+// configCmd 是配置相关子命令的父命令
+var configCmd = &cobra.Command{
+	Use:   "config",
+	Short: "Inspect the configuration",
+}
+
+// configShowCmd 打印合并命令行参数与环境变量后的有效配置，密钥与密码已脱敏
+var configShowCmd = &cobra.Command{
+	Use:   "show",
+	Short: "Print the effective config with secrets redacted",
+	Long:  "Prints the config as the proxy command would run it, after applying environment variables and command-line overrides, as JSON. The private key, access token and passwords are replaced by ***, so the output can be shared in bug reports.",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if !config.ConfigLoaded {
+			return fmt.Errorf("no config loaded")
+		}
+
+		cfg := config.AppConfig
+		if _, err := applyEnv(cmd, &cfg); err != nil {
+			return err
+		}
+		applySocksFlags(cmd, &cfg)
+
+		out, err := json.MarshalIndent(cfg.Redacted(), "", "  ")
+		if err != nil {
+			return err
+		}
+		fmt.Fprintln(cmd.OutOrStdout(), string(out))
+		return nil
+	},
+}
+
+func init() {
+	addSocksFlags(configShowCmd)
+	configCmd.AddCommand(configShowCmd)
+	rootCmd.AddCommand(configCmd)
+}
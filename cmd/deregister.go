@@ -0,0 +1,55 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/HynoR/uscf/api"
+	"github.com/HynoR/uscf/config"
+	"github.com/HynoR/uscf/internal/logger"
+	"github.com/spf13/cobra"
+)
+
+// deregisterCmd 从 Cloudflare 删除当前设备并清除配置中的注册信息
+var deregisterCmd = &cobra.Command{
+	Use:   "deregister",
+	Short: "Delete this device from Cloudflare",
+	Long:  "Deletes the registered device using the stored access token and clears the device identity from the config. Proxy and tunnel settings are kept, so the proxy command registers a new device on the next run.",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if !config.ConfigLoaded || !config.AppConfig.Registered() {
+			return fmt.Errorf("no registered device in the config")
+		}
+		configPath, _ := cmd.Flags().GetString("config")
+		if !config.IsLocalSource(configPath) {
+			return fmt.Errorf("cannot deregister with a config from %s: the cleared config could not be saved", configPath)
+		}
+
+		if _, err := useAPIProxy(cmd); err != nil {
+			return err
+		}
+
+		err := retryAPI(cmd.Context(), "Device deletion", func() error {
+			return api.DeleteDevice(config.AppConfig.ID, config.AppConfig.AccessToken)
+		})
+		switch {
+		case errors.Is(err, api.ErrDeviceNotFound):
+			logger.Logger.Infof("Device %s no longer exists, clearing it from the config", config.AppConfig.ID)
+		case err != nil:
+			return err
+		default:
+			logger.Logger.Infof("Device %s deleted", config.AppConfig.ID)
+		}
+
+		config.AppConfig.ClearRegistration()
+		if err := config.AppConfig.SaveConfig(configPath); err != nil {
+			return err
+		}
+		logger.Logger.Infof("Registration cleared from %s", configPath)
+		return nil
+	},
+}
+
+func init() {
+	addAPIProxyFlag(deregisterCmd)
+	rootCmd.AddCommand(deregisterCmd)
+}
@@ -0,0 +1,55 @@
+package cmd
+
+import (
+	"fmt"
+
+	"github.com/HynoR/uscf/config"
+	"github.com/HynoR/uscf/internal/logger"
+	"github.com/spf13/cobra"
+)
+
+// envFlags 将环境变量映射到覆盖同一字段的命令行参数
+var envFlags = map[string]string{
+	"USCF_SOCKS_BIND_ADDRESS": "bind-address",
+	"USCF_SOCKS_PORT":         "port",
+	"USCF_SOCKS_USERNAME":     "username",
+	"USCF_SOCKS_PASSWORD":     "password",
+}
+
+// applyEnv 将 USCF_* 环境变量覆盖到 cfg 上，对应的命令行参数已设置时以命令行参数为准
+// 覆盖结果不写回配置文件
+func applyEnv(cmd *cobra.Command, cfg *config.Config) ([]string, error) {
+	applied := config.ApplyEnv(cfg, func(name string) bool {
+		flag, ok := envFlags[name]
+		if !ok || cmd.Flags().Lookup(flag) == nil {
+			return false
+		}
+		v, _ := cmd.Flags().GetString(flag)
+		return v != ""
+	})
+	if len(applied) == 0 {
+		return nil, nil
+	}
+	if err := cfg.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid config after environment overrides %v:\n%w", applied, err)
+	}
+	return applied, nil
+}
+
+// applyEnvToAppConfig 对全局配置应用环境变量覆盖，并使覆盖的日志级别立即生效
+func applyEnvToAppConfig(cmd *cobra.Command) error {
+	level := config.AppConfig.Logging.Level
+	applied, err := applyEnv(cmd, &config.AppConfig)
+	if err != nil {
+		return err
+	}
+	if len(applied) > 0 {
+		logger.Logger.Infof("Applied environment overrides: %v", applied)
+	}
+	if config.AppConfig.Logging.Level != level {
+		if err := logger.SetLevel(config.AppConfig.Logging.Level); err != nil {
+			logger.Logger.Warnf("Invalid log level %q: %v", config.AppConfig.Logging.Level, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,14 @@
+package cmd
+
+import (
+	"github.com/HynoR/uscf/config"
+	"github.com/HynoR/uscf/internal/pidfile"
+)
+
+// acquirePIDFile 在配置了 pid_file 时写入PID文件，返回的函数在正常退出时删除该文件
+func acquirePIDFile(cfg *config.Config) (func(), error) {
+	if cfg.PIDFile == "" {
+		return func() {}, nil
+	}
+	return pidfile.Acquire(cfg.PIDFile, cfg.PIDFileTakeover)
+}
@@ -0,0 +1,155 @@
+package cmd
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"sort"
+	"text/tabwriter"
+	"time"
+
+	"github.com/HynoR/uscf/api"
+	"github.com/HynoR/uscf/config"
+	"github.com/HynoR/uscf/internal/logger"
+	"github.com/HynoR/uscf/service/tunnel"
+	"github.com/spf13/cobra"
+)
+
+// pingResult 是单个候选端点的探测结果
+type pingResult struct {
+	endpoint *net.UDPAddr
+	min, avg time.Duration
+	ok, sent int
+	err      error
+}
+
+// pingCmd 测量候选端点的QUIC握手延迟，按延迟排序输出，可选将最快的端点写入配置
+var pingCmd = &cobra.Command{
+	Use:   "ping [endpoint...]",
+	Short: "Measure the latency of Warp endpoints",
+	Long:  "Performs QUIC handshakes with the configured endpoint, the failover endpoints in tunnel.endpoints and any endpoints given as arguments (host or host:port), and prints them sorted by handshake latency. With --save the fastest endpoint is written to the config.",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if !config.ConfigLoaded || !config.AppConfig.Registered() {
+			return fmt.Errorf("config is not registered, run register first")
+		}
+		count, _ := cmd.Flags().GetInt("count")
+		timeout, _ := cmd.Flags().GetDuration("timeout")
+		save, _ := cmd.Flags().GetBool("save")
+		if count <= 0 {
+			return fmt.Errorf("--count must be positive")
+		}
+
+		cfg := &config.AppConfig
+		configPath, _ := cmd.Flags().GetString("config")
+		if save && !config.IsLocalSource(configPath) {
+			return fmt.Errorf("cannot save the endpoint to a config from %s", configPath)
+		}
+
+		tlsConfig, err := tunnel.PrepareTLSConfig(cfg)
+		if err != nil {
+			return err
+		}
+		candidates, err := pingCandidates(cfg, args)
+		if err != nil {
+			return err
+		}
+
+		results := make([]pingResult, 0, len(candidates))
+		for _, endpoint := range candidates {
+			results = append(results, pingEndpoint(cmd.Context(), tlsConfig, cfg, endpoint, count, timeout))
+		}
+		// 成功的端点按平均延迟排序，失败的排在最后
+		sort.SliceStable(results, func(i, j int) bool {
+			if (results[i].ok > 0) != (results[j].ok > 0) {
+				return results[i].ok > 0
+			}
+			return results[i].avg < results[j].avg
+		})
+
+		w := tabwriter.NewWriter(cmd.OutOrStdout(), 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "ENDPOINT\tMIN\tAVG\tOK")
+		for _, r := range results {
+			if r.ok == 0 {
+				fmt.Fprintf(w, "%s\t-\t-\t0/%d (%v)\n", r.endpoint, r.sent, r.err)
+				continue
+			}
+			fmt.Fprintf(w, "%s\t%v\t%v\t%d/%d\n", r.endpoint, r.min.Round(time.Millisecond/10), r.avg.Round(time.Millisecond/10), r.ok, r.sent)
+		}
+		w.Flush()
+
+		if !save {
+			return nil
+		}
+		if len(results) == 0 || results[0].ok == 0 {
+			return fmt.Errorf("no endpoint responded, config not changed")
+		}
+		best := results[0].endpoint
+		if best.IP.To4() != nil {
+			cfg.EndpointV4 = best.IP.String()
+		} else {
+			cfg.EndpointV6 = best.IP.String()
+		}
+		cfg.Tunnel.ConnectPort = best.Port
+		if err := cfg.SaveConfig(configPath); err != nil {
+			return err
+		}
+		logger.Logger.Infof("Endpoint %s saved to %s", best, configPath)
+		return nil
+	},
+}
+
+// pingCandidates 返回去重后的候选端点：当前端点、故障转移端点以及命令行参数中的端点
+func pingCandidates(cfg *config.Config, args []string) ([]*net.UDPAddr, error) {
+	endpoint, _, _, err := tunnel.PrepareNetworkConfig(cfg)
+	if err != nil {
+		return nil, err
+	}
+	network := tunnel.EndpointNetwork(endpoint)
+
+	candidates := []*net.UDPAddr{endpoint}
+	seen := map[string]bool{endpoint.String(): true}
+	for _, entry := range append(append([]string{}, cfg.Tunnel.Endpoints...), args...) {
+		addr, err := tunnel.ResolveEndpointEntry(entry, cfg.Tunnel.ConnectPort, network)
+		if err != nil {
+			return nil, fmt.Errorf("endpoint %q: %v", entry, err)
+		}
+		if !seen[addr.String()] {
+			seen[addr.String()] = true
+			candidates = append(candidates, addr)
+		}
+	}
+	return candidates, nil
+}
+
+// pingEndpoint 对端点进行 count 次握手探测并汇总结果
+func pingEndpoint(ctx context.Context, tlsConfig *tls.Config, cfg *config.Config, endpoint *net.UDPAddr, count int, timeout time.Duration) pingResult {
+	r := pingResult{endpoint: endpoint}
+	var total time.Duration
+	for i := 0; i < count && ctx.Err() == nil; i++ {
+		probeCtx, cancel := context.WithTimeout(ctx, timeout)
+		rtt, err := api.ProbeEndpoint(probeCtx, tlsConfig, cfg.Tunnel.InitialPacketSize, endpoint, tunnel.UDPOptions(cfg))
+		cancel()
+		r.sent++
+		if err != nil {
+			r.err = err
+			continue
+		}
+		if r.ok == 0 || rtt < r.min {
+			r.min = rtt
+		}
+		r.ok++
+		total += rtt
+	}
+	if r.ok > 0 {
+		r.avg = total / time.Duration(r.ok)
+	}
+	return r
+}
+
+func init() {
+	pingCmd.Flags().IntP("count", "n", 3, "Handshakes per endpoint")
+	pingCmd.Flags().Duration("timeout", 5*time.Second, "Timeout for each handshake")
+	pingCmd.Flags().Bool("save", false, "Write the fastest endpoint to the config")
+	rootCmd.AddCommand(pingCmd)
+}
@@ -2,12 +2,19 @@ package cmd
 
 import (
 	"encoding/base64"
+	"errors"
 	"fmt"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
 
 	"github.com/HynoR/uscf/api"
 	"github.com/HynoR/uscf/config"
 	"github.com/HynoR/uscf/internal"
 	"github.com/HynoR/uscf/internal/logger"
+	"github.com/HynoR/uscf/models"
 	proxysvc "github.com/HynoR/uscf/service/proxy"
 	"github.com/HynoR/uscf/service/tunnel"
 	"github.com/spf13/cobra"
@@ -18,7 +25,14 @@ var proxyCmd = &cobra.Command{
 	Use:   "proxy",
 	Short: "One-command solution to run SOCKS5 proxy with auto-registration",
 	Long:  "Automatically registers if no config exists, then runs a dual-stack SOCKS5 proxy with optional authentication.",
-	Run:   runProxyCmd,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if dryRun, _ := cmd.Flags().GetBool("dry-run"); dryRun {
+			return runDryRun(cmd)
+		}
+		return runService(cmd, func(cmd *cobra.Command) error {
+			return runProxyCmd(cmd, args)
+		})
+	},
 }
 
 func init() {
@@ -30,15 +44,15 @@ func init() {
 	proxyCmd.Flags().String("name", "", "Device name for registration")
 	proxyCmd.Flags().Bool("accept-tos", true, "Automatically accept Cloudflare TOS")
 	proxyCmd.Flags().String("jwt", "", "Team token for registration")
+	addAPIProxyFlag(proxyCmd)
+	proxyCmd.Flags().String("key-file", "", "Write the private key to this file (mode 0600) on registration instead of embedding it in the config")
 
 	// 添加重置SOCKS5配置的标志
 	proxyCmd.Flags().Bool("reset-config", false, "Reset SOCKS5 configuration to default values")
+	proxyCmd.Flags().Bool("dry-run", false, "Validate the config and perform one MASQUE handshake, then exit without starting the proxy")
 
 	// 添加SOCKS5代理配置的命令行参数
-	proxyCmd.Flags().StringP("bind-address", "b", "", "Bind address for SOCKS5 proxy (overrides config file)")
-	proxyCmd.Flags().StringP("port", "p", "", "Port for SOCKS5 proxy (overrides config file)")
-	proxyCmd.Flags().StringP("username", "u", "", "Username for SOCKS5 proxy authentication (overrides config file)")
-	proxyCmd.Flags().StringP("password", "w", "", "Password for SOCKS5 proxy authentication (overrides config file)")
+	addSocksFlags(proxyCmd)
 
 	// 添加提示，说明SOCKS配置已移至配置文件，但可通过命令行参数覆盖
 	proxyCmd.Long += "\n\nNote: All SOCKS proxy settings are primarily managed through the config file, but can be overridden with command-line flags."
@@ -47,13 +61,57 @@ func init() {
 	rootCmd.AddCommand(proxyCmd)
 }
 
+// addSocksFlags 添加覆盖配置文件中SOCKS5设置的命令行参数
+func addSocksFlags(cmd *cobra.Command) {
+	cmd.Flags().StringP("bind-address", "b", "", "Bind address for SOCKS5 proxy (overrides config file)")
+	cmd.Flags().StringP("port", "p", "", "Port for SOCKS5 proxy (overrides config file)")
+	cmd.Flags().StringP("username", "u", "", "Username for SOCKS5 proxy authentication (overrides config file)")
+	cmd.Flags().StringP("password", "w", "", "Password for SOCKS5 proxy authentication (overrides config file)")
+	cmd.Flags().StringSlice("accounts", nil, "Config files or directories of additional accounts to spread connections across (overrides config file)")
+}
+
+// applySocksFlags 将已设置的SOCKS5命令行参数覆盖到 cfg，返回被覆盖项的说明
+func applySocksFlags(cmd *cobra.Command, cfg *config.Config) []string {
+	var overrides []string
+
+	// 检查绑定地址
+	if bindAddress, _ := cmd.Flags().GetString("bind-address"); bindAddress != "" {
+		cfg.Socks.BindAddress = bindAddress
+		overrides = append(overrides, "bind address: "+bindAddress)
+	}
+
+	// 检查端口
+	if port, _ := cmd.Flags().GetString("port"); port != "" {
+		cfg.Socks.Port = port
+		overrides = append(overrides, "port: "+port)
+	}
+
+	// 检查用户名
+	if username, _ := cmd.Flags().GetString("username"); username != "" {
+		cfg.Socks.Username = username
+		overrides = append(overrides, "username")
+	}
+
+	// 检查密码
+	if password, _ := cmd.Flags().GetString("password"); password != "" {
+		cfg.Socks.Password = password
+		overrides = append(overrides, "password")
+	}
+
+	// 检查其他账户的配置
+	if accounts, _ := cmd.Flags().GetStringSlice("accounts"); len(accounts) > 0 {
+		cfg.Accounts.Configs = accounts
+		overrides = append(overrides, "accounts: "+strings.Join(accounts, ", "))
+	}
+	return overrides
+}
+
 // runProxyCmd 是 proxyCmd 的执行逻辑
-func runProxyCmd(cmd *cobra.Command, args []string) {
+func runProxyCmd(cmd *cobra.Command, args []string) error {
 	// 0. 获取配置文件路径
 	configPath, err := cmd.Flags().GetString("config")
 	if err != nil {
-		cmd.Printf("Failed to get config path: %v\n", err)
-		return
+		return fmt.Errorf("failed to get config path: %w", err)
 	}
 	if configPath == "" {
 		configPath = "config.json"
@@ -62,11 +120,10 @@ func runProxyCmd(cmd *cobra.Command, args []string) {
 	// 检查是否需要重置SOCKS5配置
 	resetConfig, _ := cmd.Flags().GetBool("reset-config")
 
-	// 1. 如有需要，进行自动注册
-	if !config.ConfigLoaded {
+	// 1. 如有需要，进行自动注册（没有配置文件，或设备已注销）
+	if !config.ConfigLoaded || !config.AppConfig.Registered() {
 		if err := handleRegistration(cmd, configPath); err != nil {
-			cmd.Printf("%v\n", err)
-			return
+			return err
 		}
 
 		// 更新一些需要从内部常量获取的配置值
@@ -92,63 +149,94 @@ func runProxyCmd(cmd *cobra.Command, args []string) {
 
 		// 保存更新后的配置
 		if err := config.AppConfig.SaveConfig(configPath); err != nil {
-			logger.Logger.Warnf("Failed to save reset config: %v", err)
-			cmd.Printf("Failed to save reset configuration: %v\n", err)
-			return
+			return fmt.Errorf("failed to save reset configuration: %w", err)
 		}
 		logger.Logger.Infof("SOCKS5 configuration has been reset to default values in %s", configPath)
 	}
 
 	// 检查并应用命令行参数覆盖配置文件的值
-	configChanged := false
+	overrides := applySocksFlags(cmd, &config.AppConfig)
+	for _, o := range overrides {
+		logger.Logger.Infof("Overriding %s from command line", o)
+	}
+	configChanged := len(overrides) > 0
 
-	// 检查绑定地址
-	if bindAddress, _ := cmd.Flags().GetString("bind-address"); bindAddress != "" {
-		logger.Logger.Infof("Overriding bind address from command line: %s", bindAddress)
-		config.AppConfig.Socks.BindAddress = bindAddress
-		configChanged = true
+	// 如果配置有变更，保存到配置文件；来自标准输入或URL的配置只在本次运行中生效
+	if configChanged && config.IsLocalSource(configPath) {
+		logger.Logger.Infof("Saving updated configuration to %s", configPath)
+		if err := config.AppConfig.SaveConfig(configPath); err != nil {
+			logger.Logger.Warnf("Failed to save updated config: %v", err)
+		}
 	}
 
-	// 检查端口
-	if port, _ := cmd.Flags().GetString("port"); port != "" {
-		logger.Logger.Infof("Overriding port from command line: %s", port)
-		config.AppConfig.Socks.Port = port
-		configChanged = true
+	// 环境变量在保存配置之后应用，避免写入配置文件
+	if err := applyEnvToAppConfig(cmd); err != nil {
+		return err
 	}
 
-	// 检查用户名
-	if username, _ := cmd.Flags().GetString("username"); username != "" {
-		logger.Logger.Infof("Overriding username from command line")
-		config.AppConfig.Socks.Username = username
-		configChanged = true
+	release, err := acquirePIDFile(&config.AppConfig)
+	if err != nil {
+		return err
 	}
+	defer release()
 
-	// 检查密码
-	if password, _ := cmd.Flags().GetString("password"); password != "" {
-		logger.Logger.Infof("Overriding password from command line")
-		config.AppConfig.Socks.Password = password
-		configChanged = true
+	// 2. 启动 SOCKS5 代理
+	svc := proxysvc.New(tunnel.DefaultManager{})
+	go watchReload(cmd, svc, configPath)
+	go watchStatsDump(cmd.Context(), svc.Stats)
+	return svc.Run(cmd.Context(), &config.AppConfig)
+}
+
+// runDryRun 校验有效配置并与端点完成一次MASQUE握手后退出
+// 不注册、不写入配置文件，也不启动SOCKS监听，任一步骤失败时返回错误
+func runDryRun(cmd *cobra.Command) error {
+	if !config.ConfigLoaded || !config.AppConfig.Registered() {
+		return fmt.Errorf("dry run: config is not registered, run register first")
 	}
 
-	// 如果配置有变更，保存到配置文件
-	if configChanged {
-		logger.Logger.Infof("Saving updated configuration to %s", configPath)
-		if err := config.AppConfig.SaveConfig(configPath); err != nil {
-			logger.Logger.Warnf("Failed to save updated config: %v", err)
-		}
+	cfg := config.AppConfig
+	if _, err := applyEnv(cmd, &cfg); err != nil {
+		return err
 	}
+	applySocksFlags(cmd, &cfg)
+	if err := cfg.Validate(); err != nil {
+		return fmt.Errorf("dry run: invalid config:\n%w", err)
+	}
+	if _, err := config.ReadAccounts(cfg.Accounts.Configs); err != nil {
+		return fmt.Errorf("dry run: %w", err)
+	}
+	if _, err := config.ReadAccounts(cfg.Accounts.Backups); err != nil {
+		return fmt.Errorf("dry run: backup %w", err)
+	}
+	out := cmd.OutOrStdout()
+	fmt.Fprintln(out, "Config: OK")
 
-	// 2. 启动 SOCKS5 代理
-	svc := proxysvc.New(tunnel.DefaultManager{})
-	if err := svc.Run(cmd.Context(), &config.AppConfig); err != nil {
-		cmd.Printf("%v\n", err)
-		return
+	tlsCfg, err := tunnel.PrepareTLSConfig(&cfg)
+	if err != nil {
+		return fmt.Errorf("dry run: %w", err)
+	}
+	endpoint, _, _, err := tunnel.PrepareNetworkConfig(&cfg)
+	if err != nil {
+		return fmt.Errorf("dry run: %w", err)
+	}
+	rtt, err := tunnel.Handshake(cmd.Context(), tlsCfg, endpoint, &cfg)
+	if err != nil {
+		return fmt.Errorf("dry run: handshake with %s failed: %w", endpoint, err)
 	}
+	fmt.Fprintf(out, "Handshake with %s: OK in %v\n", endpoint, rtt.Round(time.Millisecond))
+
+	if !cfg.Tunnel.NoTunnelIPv4 {
+		fmt.Fprintf(out, "Assigned IPv4: %s\n", cfg.IPv4)
+	}
+	if !cfg.Tunnel.NoTunnelIPv6 {
+		fmt.Fprintf(out, "Assigned IPv6: %s\n", cfg.IPv6)
+	}
+	return nil
 }
 
 // handleRegistration 处理自动注册流程
 func handleRegistration(cmd *cobra.Command, configPath string) error {
-	logger.Logger.Info("Config not loaded. Starting automatic registration...")
+	logger.Logger.Info("No registered device in the config. Starting automatic registration...")
 
 	// 获取注册参数
 	deviceName, _ := cmd.Flags().GetString("name")
@@ -157,10 +245,25 @@ func handleRegistration(cmd *cobra.Command, configPath string) error {
 	acceptTos, _ := cmd.Flags().GetBool("accept-tos")
 	jwt, _ := cmd.Flags().GetString("jwt")
 
+	apiProxy, err := useAPIProxy(cmd)
+	if err != nil {
+		return err
+	}
+
 	logger.Logger.Infof("Registering with locale %s and model %s", locale, model)
 
-	// 注册账户
-	accountData, err := api.Register(model, locale, jwt, acceptTos)
+	// 注册账户，临时性错误时重试
+	var accountData models.AccountData
+	err = retryAPI(cmd.Context(), "Registration", func() error {
+		var err error
+		accountData, err = api.Register(model, locale, jwt, acceptTos)
+		// 服务条款只在第一次尝试时询问，能走到重试说明已经同意
+		acceptTos = true
+		return err
+	})
+	if errors.Is(err, api.ErrTOSRequired) {
+		return fmt.Errorf("Failed to register: %v (pass --accept-tos to accept the Terms of Service non-interactively)", err)
+	}
 	if err != nil {
 		return fmt.Errorf("Failed to register: %v", err)
 	}
@@ -174,25 +277,49 @@ func handleRegistration(cmd *cobra.Command, configPath string) error {
 	logger.Logger.Info("Enrolling device key...")
 
 	// 注册设备密钥
-	updatedAccountData, apiErr, err := api.EnrollKey(accountData, pubKey, deviceName)
+	var updatedAccountData models.AccountData
+	err = retryAPI(cmd.Context(), "Key enrollment", func() error {
+		var err error
+		updatedAccountData, err = api.EnrollKey(accountData, pubKey, deviceName)
+		return err
+	})
 	if err != nil {
-		if apiErr != nil {
-			return fmt.Errorf("Failed to enroll key: %v (API errors: %s)", err, apiErr.ErrorsAsString("; "))
-		}
 		return fmt.Errorf("Failed to enroll key: %v", err)
 	}
 
 	logger.Logger.Info("Registration successful. Saving config...")
 
+	// 指定了密钥文件时，配置中只保存对该文件的引用
+	privateKey := base64.StdEncoding.EncodeToString(privKey)
+	if keyFile, _ := cmd.Flags().GetString("key-file"); keyFile != "" {
+		if privateKey, err = config.WritePrivateKeyFile(keyFile, privateKey); err != nil {
+			return err
+		}
+		logger.Logger.Infof("Private key saved to %s", keyFile)
+	}
+
+	// 端点形如 162.159.198.1:0 与 [2606:4700:103::1]:0，端口不使用，连接端口由 tunnel.connect_port 决定
+	if len(updatedAccountData.Config.Peers) == 0 {
+		return fmt.Errorf("Enrollment response contains no peer")
+	}
+	peer := updatedAccountData.Config.Peers[0]
+	endpointV4, err := internal.ParseEndpoint(peer.Endpoint.V4)
+	if err != nil {
+		return fmt.Errorf("Invalid IPv4 endpoint in enrollment response: %v", err)
+	}
+	endpointV6, err := internal.ParseEndpoint(peer.Endpoint.V6)
+	if err != nil {
+		// 只有 use_ipv6 时才需要IPv6端点
+		logger.Logger.Warnf("Invalid IPv6 endpoint in enrollment response: %v", err)
+	}
+
 	// 保存配置，使用InitNewConfig创建带有默认值的配置
+	previous, keepSettings := config.AppConfig, config.ConfigLoaded
 	config.AppConfig = config.InitNewConfig(
-		base64.StdEncoding.EncodeToString(privKey),
-		// TODO: proper endpoint parsing in utils
-		// strip :0
-		updatedAccountData.Config.Peers[0].Endpoint.V4[:len(updatedAccountData.Config.Peers[0].Endpoint.V4)-2],
-		// strip [ from beginning and ]:0 from end
-		updatedAccountData.Config.Peers[0].Endpoint.V6[1:len(updatedAccountData.Config.Peers[0].Endpoint.V6)-3],
-		updatedAccountData.Config.Peers[0].PublicKey,
+		privateKey,
+		endpointV4.Host,
+		endpointV6.Host,
+		peer.PublicKey,
 		updatedAccountData.Account.License,
 		updatedAccountData.ID,
 		accountData.Token,
@@ -200,6 +327,12 @@ func handleRegistration(cmd *cobra.Command, configPath string) error {
 		updatedAccountData.Config.Interface.Addresses.V6,
 		deviceName,
 	)
+	if keepSettings {
+		// 注销后重新注册时保留原有的代理与隧道设置
+		config.AppConfig.KeepSettings(previous)
+	}
+	// 保存注册时使用的API代理，供之后的 rotate-key 与 deregister 使用
+	config.AppConfig.Registration.Proxy = apiProxy
 
 	err = config.AppConfig.SaveConfig(configPath)
 	if err != nil {
@@ -212,3 +345,40 @@ func handleRegistration(cmd *cobra.Command, configPath string) error {
 	config.ConfigLoaded = true
 	return nil
 }
+
+// watchReload 在收到 SIGHUP 时重新读取配置文件并应用可热更新的部分
+func watchReload(cmd *cobra.Command, svc *proxysvc.Service, configPath string) {
+	ctx := cmd.Context()
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hup:
+			if configPath == config.StdinSource {
+				logger.Logger.Warn("Received SIGHUP, but a config read from stdin cannot be reloaded")
+				continue
+			}
+			logger.Logger.Infof("Received SIGHUP, reloading config from %s", configPath)
+			cfg, err := config.ReadConfig(configPath)
+			if err != nil {
+				logger.Logger.Errorf("Failed to reload config: %v", err)
+				continue
+			}
+			// 来自标准输入或URL的配置不会保存命令行参数，重新加载时需再次应用，否则会回到远程配置中的值
+			applySocksFlags(cmd, &cfg)
+			if err := cfg.Validate(); err != nil {
+				logger.Logger.Errorf("Ignoring invalid config:\n%v", err)
+				continue
+			}
+			if _, err := applyEnv(cmd, &cfg); err != nil {
+				logger.Logger.Errorf("Ignoring invalid config: %v", err)
+				continue
+			}
+			svc.Reload(&cfg)
+		}
+	}
+}
@@ -0,0 +1,39 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/HynoR/uscf/internal/control"
+	"github.com/spf13/cobra"
+)
+
+// reconnectCmd 通过本地控制接口要求正在运行的代理立即重连隧道
+var reconnectCmd = &cobra.Command{
+	Use:   "reconnect",
+	Short: "Make a running proxy reconnect its tunnel now",
+	Long:  "Connects to the control socket of a running proxy or vpn and asks it to drop the current tunnel connection and reconnect immediately, for example after switching networks.",
+	Args:  cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		socketPath, err := controlSocket(cmd)
+		if err != nil {
+			return err
+		}
+
+		raw, err := control.Query(socketPath, "reconnect")
+		if err != nil {
+			return err
+		}
+		var reply control.ReconnectReply
+		if err := json.Unmarshal(raw, &reply); err != nil {
+			return fmt.Errorf("invalid reconnect reply: %w", err)
+		}
+		fmt.Fprintf(cmd.OutOrStdout(), "Reconnecting %d tunnel(s)\n", reply.Tunnels)
+		return nil
+	},
+}
+
+func init() {
+	reconnectCmd.Flags().String("socket", "", "Control socket path (overrides config file)")
+	rootCmd.AddCommand(reconnectCmd)
+}
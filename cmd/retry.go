@@ -0,0 +1,49 @@
+package cmd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/HynoR/uscf/api"
+	"github.com/HynoR/uscf/internal/logger"
+)
+
+// apiMaxAttempts 是注册相关API调用的最大尝试次数
+const apiMaxAttempts = 5
+
+// retryAPI 调用 fn，遇到网络错误或5xx等临时性错误时按指数退避重试，
+// 4xx 或拒绝服务条款等永久性错误立即返回
+func retryAPI(ctx context.Context, name string, fn func() error) error {
+	backoff := &api.ExponentialBackoff{
+		InitialDelay: 2 * time.Second,
+		MaxDelay:     30 * time.Second,
+		Factor:       2,
+	}
+	for attempt := 1; ; attempt++ {
+		err := fn()
+		if err == nil {
+			return nil
+		}
+		if !api.IsRetryable(err) {
+			return err
+		}
+		if attempt == apiMaxAttempts {
+			return fmt.Errorf("%w (gave up after %d attempts)", err, attempt)
+		}
+
+		delay := backoff.NextDelay(attempt)
+		// 被限流时至少等待服务端要求的时间
+		var statusErr *api.StatusError
+		if errors.As(err, &statusErr) && statusErr.RetryAfter > delay {
+			delay = statusErr.RetryAfter
+		}
+		logger.Logger.Warnf("%s attempt %d/%d failed: %v, retrying in %v", name, attempt, apiMaxAttempts, err, delay.Round(time.Millisecond))
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(delay):
+		}
+	}
+}
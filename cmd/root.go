@@ -2,6 +2,8 @@ package cmd
 
 import (
 	"context"
+	"errors"
+	"os"
 
 	"github.com/HynoR/uscf/config"
 	"github.com/HynoR/uscf/internal/logger"
@@ -12,21 +14,40 @@ var rootCmd = &cobra.Command{
 	Use:   "usque",
 	Short: "Usque Warp CLI",
 	Long:  "An unofficial Cloudflare Warp CLI that uses the MASQUE protocol and exposes the tunnel as various different services.",
+	Run: func(cmd *cobra.Command, args []string) {
+		// Without a subcommand the root command only handles --version
+		cmd.Help()
+	},
 	PersistentPreRun: func(cmd *cobra.Command, args []string) {
+		if showVersion, _ := cmd.Flags().GetBool("version"); showVersion {
+			printVersion(cmd.OutOrStdout())
+			os.Exit(0)
+		}
+
 		configPath, err := cmd.Flags().GetString("config")
 		if err != nil {
 			logger.Logger.Fatalf("Failed to get config path: %v", err)
 		}
 
 		if configPath != "" {
-			if err := config.LoadConfig(configPath); err != nil {
+			if err := config.LoadConfig(configPath); errors.Is(err, os.ErrNotExist) {
 				logger.Logger.Infof("Config file not found: %v", err)
 				logger.Logger.Info("You may only use the register command to generate one.")
+			} else if err != nil {
+				// 不能当作缺少配置处理，否则 proxy 命令会重新注册并覆盖该文件
+				logger.Logger.Fatalf("Failed to load config: %v", err)
 			}
 		}
 
 		// Initialize logging after config is loaded
-		if err := logger.Init(config.AppConfig.Logging.OutputPath, config.AppConfig.Logging.Level); err != nil {
+		logCfg := config.AppConfig.Logging
+		rotation := logger.Rotation{
+			MaxSizeMB:  logCfg.MaxSizeMB,
+			MaxBackups: logCfg.MaxBackups,
+			MaxAgeDays: logCfg.MaxAgeDays,
+			Compress:   logCfg.Compress,
+		}
+		if err := logger.Init(logCfg.OutputPath, logCfg.Level, logCfg.Format, rotation); err != nil {
 			logger.Logger.Errorf("Failed to init logger: %v", err)
 		}
 	},
@@ -42,5 +63,6 @@ func ExecuteContext(ctx context.Context) error {
 }
 
 func init() {
-	rootCmd.PersistentFlags().StringP("config", "c", "config.json", "config file (default is config.json)")
+	rootCmd.PersistentFlags().StringP("config", "c", "config.json", "config file, \"-\" for stdin or an http(s) URL (default is config.json)")
+	rootCmd.PersistentFlags().Bool("version", false, "print version information and exit")
 }
@@ -0,0 +1,138 @@
+package cmd
+
+import (
+	"encoding/base64"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/HynoR/uscf/api"
+	"github.com/HynoR/uscf/config"
+	"github.com/HynoR/uscf/internal"
+	"github.com/HynoR/uscf/internal/logger"
+	"github.com/HynoR/uscf/models"
+	"github.com/spf13/cobra"
+)
+
+// rotateKeyCmd 为已注册的设备生成新密钥并重新登记，其余配置保持不变
+var rotateKeyCmd = &cobra.Command{
+	Use:   "rotate-key",
+	Short: "Replace the device key without re-registering",
+	Long:  "Generates a fresh key pair, enrolls it for the existing device using the stored access token and updates the private key and endpoint public key in the config. All other settings are kept and the previous config is backed up next to it.",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if !config.ConfigLoaded || !config.AppConfig.Registered() {
+			return fmt.Errorf("no registered device in the config")
+		}
+		configPath, _ := cmd.Flags().GetString("config")
+		if !config.IsLocalSource(configPath) {
+			return fmt.Errorf("cannot rotate the key of a config from %s: the new key could not be saved", configPath)
+		}
+
+		if _, err := useAPIProxy(cmd); err != nil {
+			return err
+		}
+
+		privKey, pubKey, err := internal.GenerateEcKeyPair()
+		if err != nil {
+			return fmt.Errorf("failed to generate key pair: %v", err)
+		}
+
+		cfg := &config.AppConfig
+		// 登记之前完成备份并把新私钥写入待用文件，登记成功后服务端只认新密钥，
+		// 此后任何一步失败时新私钥都不能只存在于内存中
+		backup, err := backupFile(configPath)
+		if err != nil {
+			return err
+		}
+		logger.Logger.Infof("Previous config backed up to %s", backup)
+
+		keyFile, inKeyFile := strings.CutPrefix(cfg.PrivateKey, config.PrivateKeyFilePrefix)
+		pending := configPath + ".key.pending"
+		if inKeyFile {
+			keyBackup, err := backupFile(keyFile)
+			if err != nil {
+				return err
+			}
+			logger.Logger.Infof("Previous private key backed up to %s", keyBackup)
+			pending = keyFile + ".pending"
+		}
+		privateKey := base64.StdEncoding.EncodeToString(privKey)
+		if _, err := config.WritePrivateKeyFile(pending, privateKey); err != nil {
+			return err
+		}
+
+		logger.Logger.Info("Enrolling new device key...")
+		account := models.AccountData{ID: cfg.ID, Token: cfg.AccessToken}
+		var updated models.AccountData
+		err = retryAPI(cmd.Context(), "Key enrollment", func() error {
+			var err error
+			updated, err = api.EnrollKey(account, pubKey, cfg.Registration.DeviceName)
+			return err
+		})
+		if err != nil {
+			// 无法确定失败的请求是否已在服务端生效，保留待用文件以便恢复
+			return fmt.Errorf("failed to enroll key: %v (the new private key is kept in %s in case the enrollment took effect)", err, pending)
+		}
+		if len(updated.Config.Peers) == 0 {
+			return fmt.Errorf("enrollment response contains no peer (the new private key is kept in %s)", pending)
+		}
+
+		// 新密钥已生效，用待用文件替换旧密钥
+		if inKeyFile {
+			if err := os.Rename(pending, keyFile); err != nil {
+				return fmt.Errorf("failed to replace the private key file: %v (the enrolled key is in %s)", err, pending)
+			}
+		} else {
+			cfg.PrivateKey = privateKey
+		}
+		cfg.EndpointPubKey = updated.Config.Peers[0].PublicKey
+		if err := cfg.SaveConfig(configPath); err != nil {
+			if inKeyFile {
+				return err
+			}
+			return fmt.Errorf("%v (the enrolled key is in %s)", err, pending)
+		}
+		if !inKeyFile {
+			if err := os.Remove(pending); err != nil {
+				logger.Logger.Warnf("Failed to remove %s: %v", pending, err)
+			}
+		}
+		logger.Logger.Infof("Device key rotated, config saved to %s", configPath)
+		return nil
+	},
+}
+
+// backupFile 将 path 复制为带时间戳的备份文件并返回备份路径，权限与原文件相同
+func backupFile(path string) (string, error) {
+	src, err := os.Open(path)
+	if err != nil {
+		return "", fmt.Errorf("failed to back up %s: %v", path, err)
+	}
+	defer src.Close()
+
+	info, err := src.Stat()
+	if err != nil {
+		return "", fmt.Errorf("failed to back up %s: %v", path, err)
+	}
+
+	backup := path + "." + time.Now().Format("20060102-150405") + ".bak"
+	dst, err := os.OpenFile(backup, os.O_CREATE|os.O_WRONLY|os.O_EXCL, info.Mode().Perm())
+	if err != nil {
+		return "", fmt.Errorf("failed to back up %s: %v", path, err)
+	}
+	if _, err := io.Copy(dst, src); err != nil {
+		dst.Close()
+		return "", fmt.Errorf("failed to back up %s: %v", path, err)
+	}
+	if err := dst.Close(); err != nil {
+		return "", fmt.Errorf("failed to back up %s: %v", path, err)
+	}
+	return backup, nil
+}
+
+func init() {
+	addAPIProxyFlag(rotateKeyCmd)
+	rootCmd.AddCommand(rotateKeyCmd)
+}
@@ -0,0 +1,10 @@
+//go:build !windows
+
+package cmd
+
+import "github.com/spf13/cobra"
+
+// runService 直接调用 run，只有 Windows 支持以服务方式运行
+func runService(cmd *cobra.Command, run func(cmd *cobra.Command) error) error {
+	return run(cmd)
+}
@@ -0,0 +1,230 @@
+//go:build windows
+
+package cmd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/HynoR/uscf/config"
+	"github.com/HynoR/uscf/internal/logger"
+	"github.com/spf13/cobra"
+	"golang.org/x/sys/windows"
+	"golang.org/x/sys/windows/svc"
+	"golang.org/x/sys/windows/svc/mgr"
+)
+
+const (
+	// defaultServiceName 是服务的默认名称
+	defaultServiceName = "uscf"
+	// serviceStopTimeout 是 service stop 等待服务停止的时间
+	serviceStopTimeout = 30 * time.Second
+)
+
+// serviceCmd 是管理 Windows 服务的子命令的父命令
+var serviceCmd = &cobra.Command{
+	Use:   "service",
+	Short: "Manage the Windows service that runs the proxy command",
+}
+
+// serviceInstallCmd 将 proxy 命令注册为开机自动启动的服务
+var serviceInstallCmd = &cobra.Command{
+	Use:   "install",
+	Short: "Install the proxy command as a Windows service",
+	Long:  "Registers a service that starts automatically at boot and runs the proxy command with the config file given by --config, resolved to an absolute path. Requires an administrator prompt.",
+	Args:  cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		exe, err := os.Executable()
+		if err != nil {
+			return fmt.Errorf("failed to locate the executable: %w", err)
+		}
+		configPath, _ := cmd.Flags().GetString("config")
+		if configPath == config.StdinSource {
+			return fmt.Errorf("a service cannot read its config from stdin")
+		}
+		// 服务的工作目录是系统目录，相对路径需要转换为绝对路径
+		if config.IsLocalSource(configPath) {
+			if configPath, err = filepath.Abs(configPath); err != nil {
+				return err
+			}
+		}
+
+		name := serviceName(cmd)
+		m, err := mgr.Connect()
+		if err != nil {
+			return fmt.Errorf("failed to connect to the service manager: %w", err)
+		}
+		defer m.Disconnect()
+
+		s, err := m.CreateService(name, exe, mgr.Config{
+			DisplayName: name,
+			Description: "SOCKS5 proxy over a Cloudflare WARP MASQUE tunnel",
+			StartType:   mgr.StartAutomatic,
+		}, "proxy", "--config", configPath)
+		if errors.Is(err, windows.ERROR_SERVICE_EXISTS) {
+			return fmt.Errorf("service %s is already installed", name)
+		}
+		if err != nil {
+			return fmt.Errorf("failed to install service %s: %w", name, err)
+		}
+		defer s.Close()
+		cmd.Printf("Installed service %s running %s proxy --config %s\n", name, exe, configPath)
+		return nil
+	},
+}
+
+// serviceUninstallCmd 删除服务，正在运行的服务在停止后才会被移除
+var serviceUninstallCmd = &cobra.Command{
+	Use:   "uninstall",
+	Short: "Remove the Windows service",
+	Args:  cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return withService(cmd, func(s *mgr.Service) error {
+			if err := s.Delete(); err != nil {
+				return fmt.Errorf("failed to remove service %s: %w", s.Name, err)
+			}
+			cmd.Printf("Removed service %s\n", s.Name)
+			return nil
+		})
+	},
+}
+
+// serviceStartCmd 启动服务
+var serviceStartCmd = &cobra.Command{
+	Use:   "start",
+	Short: "Start the Windows service",
+	Args:  cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return withService(cmd, func(s *mgr.Service) error {
+			if err := s.Start(); err != nil {
+				return fmt.Errorf("failed to start service %s: %w", s.Name, err)
+			}
+			cmd.Printf("Started service %s\n", s.Name)
+			return nil
+		})
+	},
+}
+
+// serviceStopCmd 停止服务并等待其退出
+var serviceStopCmd = &cobra.Command{
+	Use:   "stop",
+	Short: "Stop the Windows service",
+	Args:  cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return withService(cmd, func(s *mgr.Service) error {
+			status, err := s.Control(svc.Stop)
+			if err != nil {
+				return fmt.Errorf("failed to stop service %s: %w", s.Name, err)
+			}
+			deadline := time.Now().Add(serviceStopTimeout)
+			for status.State != svc.Stopped {
+				if time.Now().After(deadline) {
+					return fmt.Errorf("service %s did not stop within %v", s.Name, serviceStopTimeout)
+				}
+				time.Sleep(300 * time.Millisecond)
+				if status, err = s.Query(); err != nil {
+					return fmt.Errorf("failed to query service %s: %w", s.Name, err)
+				}
+			}
+			cmd.Printf("Stopped service %s\n", s.Name)
+			return nil
+		})
+	},
+}
+
+func init() {
+	serviceCmd.PersistentFlags().String("name", defaultServiceName, "Windows service name")
+	serviceCmd.AddCommand(serviceInstallCmd, serviceUninstallCmd, serviceStartCmd, serviceStopCmd)
+	rootCmd.AddCommand(serviceCmd)
+}
+
+// serviceName 返回 --name 指定的服务名称
+func serviceName(cmd *cobra.Command) string {
+	if name, _ := cmd.Flags().GetString("name"); name != "" {
+		return name
+	}
+	return defaultServiceName
+}
+
+// withService 打开 --name 指定的服务并调用 fn
+func withService(cmd *cobra.Command, fn func(s *mgr.Service) error) error {
+	m, err := mgr.Connect()
+	if err != nil {
+		return fmt.Errorf("failed to connect to the service manager: %w", err)
+	}
+	defer m.Disconnect()
+
+	name := serviceName(cmd)
+	s, err := m.OpenService(name)
+	if err != nil {
+		return fmt.Errorf("failed to open service %s: %w", name, err)
+	}
+	defer s.Close()
+	return fn(s)
+}
+
+// runService 在由服务管理器启动时以服务方式运行 run，停止服务时取消命令的上下文
+// 不是服务进程时直接调用 run
+func runService(cmd *cobra.Command, run func(cmd *cobra.Command) error) error {
+	isService, err := svc.IsWindowsService()
+	if err != nil {
+		return fmt.Errorf("failed to detect the service environment: %w", err)
+	}
+	if !isService {
+		return run(cmd)
+	}
+
+	h := &serviceHandler{cmd: cmd, run: run}
+	// 单进程服务不使用这里的名称，服务管理器按安装时的名称管理服务
+	if err := svc.Run(defaultServiceName, h); err != nil {
+		return err
+	}
+	return h.err
+}
+
+// serviceHandler 实现 svc.Handler，在服务中运行命令
+type serviceHandler struct {
+	cmd *cobra.Command
+	run func(cmd *cobra.Command) error
+	err error
+}
+
+// Execute 运行命令直到其返回，收到停止或关机请求时取消命令的上下文并等待其退出
+func (h *serviceHandler) Execute(_ []string, requests <-chan svc.ChangeRequest, status chan<- svc.Status) (bool, uint32) {
+	status <- svc.Status{State: svc.StartPending}
+
+	ctx, cancel := context.WithCancel(h.cmd.Context())
+	defer cancel()
+	h.cmd.SetContext(ctx)
+	done := make(chan error, 1)
+	go func() {
+		done <- h.run(h.cmd)
+	}()
+
+	status <- svc.Status{State: svc.Running, Accepts: svc.AcceptStop | svc.AcceptShutdown}
+	for {
+		select {
+		case err := <-done:
+			status <- svc.Status{State: svc.StopPending}
+			if err != nil {
+				logger.Logger.Errorf("Service stopped: %v", err)
+				h.err = err
+				return true, 1
+			}
+			return false, 0
+		case req := <-requests:
+			switch req.Cmd {
+			case svc.Interrogate:
+				status <- req.CurrentStatus
+			case svc.Stop, svc.Shutdown:
+				logger.Logger.Info("Received service stop request, shutting down")
+				status <- svc.Status{State: svc.StopPending}
+				cancel()
+			}
+		}
+	}
+}
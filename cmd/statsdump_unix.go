@@ -0,0 +1,34 @@
+//go:build !windows
+
+package cmd
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/HynoR/uscf/api"
+	"github.com/HynoR/uscf/internal/logger"
+)
+
+// watchStatsDump 在收到 SIGUSR1 时立即输出当前隧道统计信息
+func watchStatsDump(ctx context.Context, stats func() *api.TunnelStats) {
+	usr1 := make(chan os.Signal, 1)
+	signal.Notify(usr1, syscall.SIGUSR1)
+	defer signal.Stop(usr1)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-usr1:
+			s := stats()
+			if s == nil {
+				logger.Logger.Info("Received SIGUSR1, but there is no shared tunnel to report on")
+				continue
+			}
+			s.LogStats()
+		}
+	}
+}
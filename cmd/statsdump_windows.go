@@ -0,0 +1,12 @@
+//go:build windows
+
+package cmd
+
+import (
+	"context"
+
+	"github.com/HynoR/uscf/api"
+)
+
+// watchStatsDump 在 Windows 上不可用，因为没有 SIGUSR1
+func watchStatsDump(ctx context.Context, stats func() *api.TunnelStats) {}
@@ -0,0 +1,53 @@
+package cmd
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+
+	"github.com/HynoR/uscf/config"
+	"github.com/HynoR/uscf/internal/control"
+	"github.com/spf13/cobra"
+)
+
+// statusCmd 通过本地控制接口查询正在运行的代理的隧道状态
+var statusCmd = &cobra.Command{
+	Use:   "status",
+	Short: "Show the tunnel status of a running proxy",
+	Long:  "Connects to the control socket of a running proxy and prints the tunnel state and statistics as JSON.",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		socketPath, err := controlSocket(cmd)
+		if err != nil {
+			return err
+		}
+
+		reply, err := control.Query(socketPath, "status")
+		if err != nil {
+			return err
+		}
+
+		var out bytes.Buffer
+		if err := json.Indent(&out, reply, "", "  "); err != nil {
+			return err
+		}
+		fmt.Fprintln(cmd.OutOrStdout(), out.String())
+		return nil
+	},
+}
+
+func init() {
+	statusCmd.Flags().String("socket", "", "Control socket path (overrides config file)")
+	rootCmd.AddCommand(statusCmd)
+}
+
+// controlSocket 返回 --socket 指定的控制接口路径，未指定时使用配置中的 control.socket_path
+func controlSocket(cmd *cobra.Command) (string, error) {
+	socketPath, _ := cmd.Flags().GetString("socket")
+	if socketPath == "" {
+		socketPath = config.AppConfig.Control.SocketPath
+	}
+	if socketPath == "" {
+		return "", fmt.Errorf("no control socket configured, set control.socket_path in the config or use --socket")
+	}
+	return socketPath, nil
+}
@@ -2,6 +2,7 @@ package cmd
 
 import (
 	"fmt"
+	"io"
 
 	"github.com/spf13/cobra"
 )
@@ -16,12 +17,19 @@ var versionCmd = &cobra.Command{
 	Use:   "version",
 	Short: "Print the version number of usque",
 	Run: func(cmd *cobra.Command, args []string) {
-		fmt.Printf("usque version: %s\n", version)
-		fmt.Printf("Commit: %s\n", commit)
-		fmt.Printf("Build Date: %s\n", date)
+		printVersion(cmd.OutOrStdout())
 	},
 }
 
+// printVersion writes the build metadata injected via -ldflags -X, e.g.
+//
+//	go build -ldflags "-X github.com/HynoR/uscf/cmd.version=v1.0.0 -X github.com/HynoR/uscf/cmd.commit=$(git rev-parse HEAD)"
+func printVersion(w io.Writer) {
+	fmt.Fprintf(w, "usque version: %s\n", version)
+	fmt.Fprintf(w, "Commit: %s\n", commit)
+	fmt.Fprintf(w, "Build Date: %s\n", date)
+}
+
 func init() {
 	rootCmd.AddCommand(versionCmd)
 }
@@ -0,0 +1,40 @@
+package cmd
+
+import (
+	"fmt"
+
+	"github.com/HynoR/uscf/config"
+	"github.com/HynoR/uscf/service/tunnel"
+	"github.com/HynoR/uscf/service/vpn"
+	"github.com/spf13/cobra"
+)
+
+// vpnCmd 创建系统TUN接口并将流量经MASQUE隧道转发
+var vpnCmd = &cobra.Command{
+	Use:   "vpn",
+	Short: "Route host traffic through the tunnel via a TUN interface",
+	Long:  "Creates an OS TUN interface with the tunnel addresses and routes traffic through the MASQUE tunnel like a VPN. Requires root and is currently supported on Linux only.",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if !vpn.Supported {
+			return vpn.ErrUnsupported
+		}
+		if !config.ConfigLoaded || !config.AppConfig.Registered() {
+			return fmt.Errorf("no config loaded, run the proxy command once to register first")
+		}
+		if err := applyEnvToAppConfig(cmd); err != nil {
+			return err
+		}
+		release, err := acquirePIDFile(&config.AppConfig)
+		if err != nil {
+			return err
+		}
+		defer release()
+		svc := vpn.New(tunnel.DefaultManager{})
+		go watchStatsDump(cmd.Context(), svc.Stats)
+		return svc.Run(cmd.Context(), &config.AppConfig)
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(vpnCmd)
+}
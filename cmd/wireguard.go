@@ -0,0 +1,106 @@
+package cmd
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/HynoR/uscf/config"
+	"github.com/HynoR/uscf/internal"
+	"github.com/spf13/cobra"
+)
+
+// exportWireGuardCmd 将配置中的地址与端点导出为 WireGuard (wgcf 兼容) 配置文件
+// MASQUE 使用 ECDSA P-256 密钥，无法转换为 WireGuard 的 Curve25519 密钥，私钥需另行提供
+var exportWireGuardCmd = &cobra.Command{
+	Use:   "export-wireguard",
+	Short: "Export the config as a WireGuard profile",
+	Long: `Writes a WireGuard .conf profile (the same layout wgcf produces) with the assigned addresses, DNS servers, MTU and endpoint from the config.
+
+The device key cannot be exported: MASQUE uses an ECDSA P-256 key, while WireGuard needs a Curve25519 key, and the device is enrolled with the MASQUE key only. Pass a WireGuard private key with --private-key, otherwise the profile contains a placeholder that must be replaced before use. The key must be enrolled for the device (for example by a wgcf registration) for the profile to connect.`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if !config.ConfigLoaded || !config.AppConfig.Registered() {
+			return fmt.Errorf("config is not registered, run register first")
+		}
+
+		output, _ := cmd.Flags().GetString("output")
+		privKey, _ := cmd.Flags().GetString("private-key")
+		if privKey != "" {
+			if key, err := base64.StdEncoding.DecodeString(privKey); err != nil || len(key) != 32 {
+				return fmt.Errorf("--private-key must be a base64-encoded 32-byte WireGuard key")
+			}
+		}
+
+		profile, err := wireGuardProfile(&config.AppConfig, privKey)
+		if err != nil {
+			return err
+		}
+		if output == "" || output == "-" {
+			_, err = cmd.OutOrStdout().Write(profile)
+			return err
+		}
+		if err := os.WriteFile(output, profile, 0600); err != nil {
+			return fmt.Errorf("failed to write profile: %v", err)
+		}
+		if privKey == "" {
+			cmd.Printf("WireGuard profile written to %s, set PrivateKey before use\n", output)
+		} else {
+			cmd.Printf("WireGuard profile written to %s\n", output)
+		}
+		return nil
+	},
+}
+
+// wireGuardProfile 生成 WireGuard 配置文件内容，privKey 为空时写入占位符
+func wireGuardProfile(cfg *config.Config, privKey string) ([]byte, error) {
+	var addrs []string
+	if cfg.IPv4 != "" && !cfg.Tunnel.NoTunnelIPv4 {
+		addrs = append(addrs, cfg.IPv4+"/32")
+	}
+	if cfg.IPv6 != "" && !cfg.Tunnel.NoTunnelIPv6 {
+		addrs = append(addrs, cfg.IPv6+"/128")
+	}
+	if len(addrs) == 0 {
+		return nil, fmt.Errorf("config has no assigned tunnel address")
+	}
+
+	endpoint := cfg.EndpointV4
+	if (cfg.Tunnel.PreferIPv6Endpoint() && cfg.EndpointV6 != "") || endpoint == "" {
+		endpoint = cfg.EndpointV6
+	}
+	if endpoint == "" {
+		return nil, fmt.Errorf("config has no endpoint")
+	}
+
+	var b bytes.Buffer
+	b.WriteString("# Exported by uscf. The MASQUE ECDSA key has no WireGuard equivalent,\n")
+	b.WriteString("# PrivateKey must be a Curve25519 key enrolled for this device.\n")
+	b.WriteString("[Interface]\n")
+	if privKey == "" {
+		b.WriteString("PrivateKey = <replace with your WireGuard private key>\n")
+	} else {
+		fmt.Fprintf(&b, "PrivateKey = %s\n", privKey)
+	}
+	fmt.Fprintf(&b, "Address = %s\n", strings.Join(addrs, ", "))
+	if len(cfg.Tunnel.DNS) > 0 {
+		fmt.Fprintf(&b, "DNS = %s\n", strings.Join(cfg.Tunnel.DNS, ", "))
+	}
+	if cfg.Tunnel.MTU > 0 {
+		fmt.Fprintf(&b, "MTU = %d\n", cfg.Tunnel.MTU)
+	}
+	b.WriteString("\n[Peer]\n")
+	fmt.Fprintf(&b, "PublicKey = %s\n", internal.WgPeerPublicKey)
+	b.WriteString("AllowedIPs = 0.0.0.0/0, ::/0\n")
+	fmt.Fprintf(&b, "Endpoint = %s\n", net.JoinHostPort(endpoint, strconv.Itoa(internal.WgPort)))
+	return b.Bytes(), nil
+}
+
+func init() {
+	exportWireGuardCmd.Flags().StringP("output", "o", "", "File to write the profile to (default: stdout)")
+	exportWireGuardCmd.Flags().String("private-key", "", "WireGuard private key (base64) to put in the profile")
+	rootCmd.AddCommand(exportWireGuardCmd)
+}
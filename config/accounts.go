@@ -0,0 +1,62 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// ReadAccounts 读取 accounts.configs 列出的账户配置
+// 目录展开为其中按文件名排序的 .json、.yaml 与 .yml 文件，其他来源（如URL）按单个配置读取
+// 每个账户都必须已注册并通过校验
+func ReadAccounts(sources []string) ([]Config, error) {
+	var files []string
+	for _, source := range sources {
+		if !IsLocalSource(source) {
+			files = append(files, source)
+			continue
+		}
+		info, err := os.Stat(source)
+		if err != nil {
+			return nil, fmt.Errorf("account config: %w", err)
+		}
+		if !info.IsDir() {
+			files = append(files, source)
+			continue
+		}
+		entries, err := os.ReadDir(source)
+		if err != nil {
+			return nil, fmt.Errorf("account config: %w", err)
+		}
+		found := false
+		for _, e := range entries {
+			switch strings.ToLower(filepath.Ext(e.Name())) {
+			case ".json", ".yaml", ".yml":
+				if !e.IsDir() {
+					files = append(files, filepath.Join(source, e.Name()))
+					found = true
+				}
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("account config directory %s contains no config files", source)
+		}
+	}
+
+	accounts := make([]Config, 0, len(files))
+	for _, file := range files {
+		cfg, err := ReadConfig(file)
+		if err != nil {
+			return nil, fmt.Errorf("account config %s: %w", file, err)
+		}
+		if !cfg.Registered() {
+			return nil, fmt.Errorf("account config %s is not registered", file)
+		}
+		if err := cfg.Validate(); err != nil {
+			return nil, fmt.Errorf("invalid account config %s:\n%w", file, err)
+		}
+		accounts = append(accounts, cfg)
+	}
+	return accounts, nil
+}
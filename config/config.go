@@ -7,8 +7,15 @@ import (
 	"encoding/json"
 	"encoding/pem"
 	"fmt"
+	"io"
+	"net/url"
 	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
 	"time"
+
+	"gopkg.in/yaml.v3"
 )
 
 // Duration wraps time.Duration to allow human-readable JSON values.
@@ -45,178 +52,691 @@ func (d Duration) MarshalJSON() ([]byte, error) {
 	return json.Marshal(time.Duration(d).String())
 }
 
+// UnmarshalYAML parses either a string duration like "30s" or a number of nanoseconds.
+func (d *Duration) UnmarshalYAML(value *yaml.Node) error {
+	if value.Tag == "!!int" {
+		var n int64
+		if err := value.Decode(&n); err != nil {
+			return err
+		}
+		*d = Duration(time.Duration(n))
+		return nil
+	}
+	var s string
+	if err := value.Decode(&s); err != nil {
+		return err
+	}
+	dur, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(dur)
+	return nil
+}
+
+// MarshalYAML writes the duration as a human-readable string.
+func (d Duration) MarshalYAML() (any, error) {
+	return time.Duration(d).String(), nil
+}
+
 // Duration converts the custom type back to time.Duration.
 func (d Duration) Duration() time.Duration {
 	return time.Duration(d)
 }
 
+// MTU is the tunnel MTU. Besides a number it accepts "auto", which probes the
+// largest working MTU through the tunnel at startup.
+type MTU int
+
+// MTUAuto is the MTU value configured as "auto".
+const MTUAuto MTU = -1
+
+// UnmarshalJSON parses either a number or the string "auto".
+func (m *MTU) UnmarshalJSON(b []byte) error {
+	if len(b) > 0 && b[0] == '"' {
+		var s string
+		if err := json.Unmarshal(b, &s); err != nil {
+			return err
+		}
+		return m.parse(s)
+	}
+	var n int
+	if err := json.Unmarshal(b, &n); err != nil {
+		return err
+	}
+	*m = MTU(n)
+	return nil
+}
+
+// MarshalJSON writes "auto" for MTUAuto and a number otherwise.
+func (m MTU) MarshalJSON() ([]byte, error) {
+	if m == MTUAuto {
+		return json.Marshal("auto")
+	}
+	return json.Marshal(int(m))
+}
+
+// UnmarshalYAML parses either a number or the string "auto".
+func (m *MTU) UnmarshalYAML(value *yaml.Node) error {
+	if value.Tag == "!!int" {
+		var n int
+		if err := value.Decode(&n); err != nil {
+			return err
+		}
+		*m = MTU(n)
+		return nil
+	}
+	var s string
+	if err := value.Decode(&s); err != nil {
+		return err
+	}
+	return m.parse(s)
+}
+
+// MarshalYAML writes "auto" for MTUAuto and a number otherwise.
+func (m MTU) MarshalYAML() (any, error) {
+	if m == MTUAuto {
+		return "auto", nil
+	}
+	return int(m), nil
+}
+
+func (m *MTU) parse(s string) error {
+	if s == "auto" {
+		*m = MTUAuto
+		return nil
+	}
+	n, err := strconv.Atoi(s)
+	if err != nil {
+		return fmt.Errorf("invalid MTU %q: must be a number or auto", s)
+	}
+	*m = MTU(n)
+	return nil
+}
+
 // Config represents the application configuration structure, containing essential details such as keys, endpoints, and access tokens.
 type Config struct {
 	// 连接信息
-	PrivateKey     string `json:"private_key"`      // Base64-encoded ECDSA private key
-	EndpointV4     string `json:"endpoint_v4"`      // IPv4 address of the endpoint
-	EndpointV6     string `json:"endpoint_v6"`      // IPv6 address of the endpoint
-	EndpointPubKey string `json:"endpoint_pub_key"` // PEM-encoded ECDSA public key of the endpoint to verify against
-	License        string `json:"license"`          // Application license key
-	ID             string `json:"id"`               // Device unique identifier
-	AccessToken    string `json:"access_token"`     // Authentication token for API access
-	IPv4           string `json:"ipv4"`             // Assigned IPv4 address
-	IPv6           string `json:"ipv6"`             // Assigned IPv6 address
+	PrivateKey     string `json:"private_key" yaml:"private_key"`           // Base64-encoded ECDSA private key, or "file:<path>" to read it from a file
+	EndpointV4     string `json:"endpoint_v4" yaml:"endpoint_v4"`           // IPv4 address of the endpoint
+	EndpointV6     string `json:"endpoint_v6" yaml:"endpoint_v6"`           // IPv6 address of the endpoint
+	EndpointPubKey string `json:"endpoint_pub_key" yaml:"endpoint_pub_key"` // PEM-encoded ECDSA public key of the endpoint to verify against
+	License        string `json:"license" yaml:"license"`                   // Application license key
+	ID             string `json:"id" yaml:"id"`                             // Device unique identifier
+	AccessToken    string `json:"access_token" yaml:"access_token"`         // Authentication token for API access
+	IPv4           string `json:"ipv4" yaml:"ipv4"`                         // Assigned IPv4 address
+	IPv6           string `json:"ipv6" yaml:"ipv6"`                         // Assigned IPv6 address
 
 	// SOCKS代理配置
-	Socks SocksConfig `json:"socks"` // SOCKS5代理相关配置
+	Socks SocksConfig `json:"socks" yaml:"socks"` // SOCKS5代理相关配置
 
 	// 隧道配置
-	Tunnel TunnelConfig `json:"tunnel"` // MASQUE隧道相关配置
+	Tunnel TunnelConfig `json:"tunnel" yaml:"tunnel"` // MASQUE隧道相关配置
 
 	// 日志配置
-	Logging LoggingConfig `json:"logging"` // 日志相关配置
+	Logging LoggingConfig `json:"logging" yaml:"logging"` // 日志相关配置
+
+	// 监控配置
+	Metrics MetricsConfig `json:"metrics" yaml:"metrics"` // 指标导出相关配置
+
+	// 控制接口配置
+	Control ControlConfig `json:"control" yaml:"control"` // 本地控制接口相关配置
+
+	// 分流配置
+	Routing RoutingConfig `json:"routing" yaml:"routing"` // 直连与隧道分流规则
+
+	// VPN模式配置
+	VPN VPNConfig `json:"vpn" yaml:"vpn"` // 系统级TUN模式相关配置
+
+	// 多账户配置
+	Accounts AccountsConfig `json:"accounts" yaml:"accounts"` // 同时使用的其他账户
+
+	// 进程配置
+	PIDFile         string `json:"pid_file" yaml:"pid_file"`                   // PID文件路径，用于防止同一配置启动多个实例，为空时不使用
+	PIDFileTakeover bool   `json:"pid_file_takeover" yaml:"pid_file_takeover"` // PID文件中的进程仍在运行时，是否结束该进程并接管，否则拒绝启动
 
 	// 注册信息
-	Registration RegistrationInfo `json:"registration"` // 注册相关信息
+	Registration RegistrationInfo `json:"registration" yaml:"registration"` // 注册相关信息
 }
 
 // SocksConfig 包含SOCKS5代理相关的配置，仅涉及代理服务器本身
 type SocksConfig struct {
-	BindAddress string `json:"bind_address"` // 代理绑定的地址
-	Port        string `json:"port"`         // 代理监听的端口
-	Username    string `json:"username"`     // 代理认证的用户名
-	Password    string `json:"password"`     // 代理认证的密码
+	BindAddress     string           `json:"bind_address" yaml:"bind_address"`         // 代理绑定的地址
+	Port            string           `json:"port" yaml:"port"`                         // 代理监听的端口
+	Username        string           `json:"username" yaml:"username"`                 // 代理认证的用户名
+	Password        string           `json:"password" yaml:"password"`                 // 代理认证的密码
+	HTTPPort        string           `json:"http_port" yaml:"http_port"`               // HTTP代理监听的端口，为空时不启用
+	Users           []SocksUser      `json:"users" yaml:"users"`                       // 额外的认证用户，与 username/password 合并使用
+	AllowedCIDRs    []string         `json:"allowed_cidrs" yaml:"allowed_cidrs"`       // 允许连接的客户端地址段，为空时允许所有
+	DeniedCIDRs     []string         `json:"denied_cidrs" yaml:"denied_cidrs"`         // 拒绝连接的客户端地址段，优先于 allowed_cidrs
+	Listeners       []string         `json:"listeners" yaml:"listeners"`               // SOCKS代理监听的多个 host:port 地址，设置后代替 bind_address 与 port
+	UnixSocket      string           `json:"unix_socket" yaml:"unix_socket"`           // SOCKS代理监听的Unix套接字路径，未设置 listeners 时代替TCP端口
+	UnixSocketMode  string           `json:"unix_socket_mode" yaml:"unix_socket_mode"` // Unix套接字文件权限（八进制），默认为0600
+	PACAddress      string           `json:"pac_address" yaml:"pac_address"`           // 提供PAC自动代理配置文件的HTTP监听地址，为空时不启用
+	PACBypass       []string         `json:"pac_bypass" yaml:"pac_bypass"`             // PAC中直连的域名（含子域名），不经过代理
+	ShutdownTimeout Duration         `json:"shutdown_timeout" yaml:"shutdown_timeout"` // 关闭时等待进行中连接结束的最长时间，超时后强制断开，为0时不等待
+	MaxConnections  int              `json:"max_connections" yaml:"max_connections"`   // 同时服务的最大连接数，为0时不限制
+	ConnLimitMode   string           `json:"conn_limit_mode" yaml:"conn_limit_mode"`   // 达到连接上限时的处理方式: reject（拒绝新连接，默认）或 wait（等待空位）
+	UserQuotas      map[string]int64 `json:"user_quotas" yaml:"user_quotas"`           // 每个用户的流量配额（字节，上下行合计），用完后拒绝新请求并断开现有连接，未列出的用户不限制
+	QuotaFile       string           `json:"quota_file" yaml:"quota_file"`             // 保存用户流量统计的文件，重启后继续累计，为空时只在内存中统计
+	QuotaPeriod     string           `json:"quota_period" yaml:"quota_period"`         // 配额周期: 为空时不重置，monthly 时每月1日清零
+	TLSCert         string           `json:"tls_cert" yaml:"tls_cert"`                 // SOCKS TCP监听使用的TLS证书文件（PEM），与 tls_key 同时设置时客户端需先完成TLS握手
+	TLSKey          string           `json:"tls_key" yaml:"tls_key"`                   // TLS证书对应的私钥文件（PEM）
+}
+
+// SocksUser 是一组代理认证凭据
+type SocksUser struct {
+	Username string `json:"username" yaml:"username"`
+	Password string `json:"password" yaml:"password"`
+}
+
+// Credentials 返回所有配置的认证凭据（用户名到密码的映射）
+// 包括 Users 列表与单独的 Username/Password，用户名或密码为空的条目会被忽略
+func (s *SocksConfig) Credentials() map[string]string {
+	creds := make(map[string]string, len(s.Users)+1)
+	for _, u := range s.Users {
+		if u.Username != "" && u.Password != "" {
+			creds[u.Username] = u.Password
+		}
+	}
+	if s.Username != "" && s.Password != "" {
+		creds[s.Username] = s.Password
+	}
+	return creds
 }
 
 // TunnelConfig 包含MASQUE隧道相关配置
 type TunnelConfig struct {
-	ConnectPort       int      `json:"connect_port"`        // MASQUE连接使用的端口
-	DNS               []string `json:"dns"`                 // 在隧道内使用的DNS服务器
-	DNSTimeout        Duration `json:"dns_timeout"`         // DNS查询超时时间
-	UseIPv6           bool     `json:"use_ipv6"`            // 是否使用IPv6进行MASQUE连接
-	NoTunnelIPv4      bool     `json:"no_tunnel_ipv4"`      // 是否在隧道内禁用IPv4
-	NoTunnelIPv6      bool     `json:"no_tunnel_ipv6"`      // 是否在隧道内禁用IPv6
-	SNIAddress        string   `json:"sni_address"`         // MASQUE连接使用的SNI地址
-	KeepalivePeriod   Duration `json:"keepalive_period"`    // 连接心跳周期
-	MTU               int      `json:"mtu"`                 // 隧道MTU
-	InitialPacketSize uint16   `json:"initial_packet_size"` // 初始包大小
-	ReconnectDelay    Duration `json:"reconnect_delay"`     // 重连延迟
-	ConnectionTimeout Duration `json:"connection_timeout"`  // 建立连接超时
-	IdleTimeout       Duration `json:"idle_timeout"`        // 空闲连接超时
-	PerClient         bool     `json:"per_client"`          // 是否为每个SOCKS客户端创建独立隧道
+	ConnectPort          int               `json:"connect_port" yaml:"connect_port"`                     // MASQUE连接使用的端口
+	Endpoints            []string          `json:"endpoints" yaml:"endpoints"`                           // 备用MASQUE端点（host 或 host:port），主端点连续失败后依次切换
+	FailoverAfter        int               `json:"failover_after" yaml:"failover_after"`                 // 连续连接失败多少次后切换端点
+	DNS                  []string          `json:"dns" yaml:"dns"`                                       // 在隧道内使用的DNS服务器
+	DNSTimeout           Duration          `json:"dns_timeout" yaml:"dns_timeout"`                       // DNS查询超时时间
+	DNSMinTTL            Duration          `json:"dns_min_ttl" yaml:"dns_min_ttl"`                       // DNS缓存的最短TTL
+	DNSMaxTTL            Duration          `json:"dns_max_ttl" yaml:"dns_max_ttl"`                       // DNS缓存的最长TTL
+	DNSNegativeTTL       Duration          `json:"dns_negative_ttl" yaml:"dns_negative_ttl"`             // DNS查询失败结果的缓存时间，小于0时禁用
+	DNSCacheSize         int               `json:"dns_cache_size" yaml:"dns_cache_size"`                 // DNS缓存的最大条目数，为0时不限制
+	DNSPrefetch          float64           `json:"dns_prefetch" yaml:"dns_prefetch"`                     // 缓存条目剩余TTL少于该比例时被访问则在后台提前刷新（如0.2），为0时不刷新
+	DNSFallbackSystem    bool              `json:"dns_fallback_system" yaml:"dns_fallback_system"`       // DNS服务器全部失败时改用系统解析器（会向系统配置的DNS泄露域名），仅 udp 模式有效
+	DNSMode              string            `json:"dns_mode" yaml:"dns_mode"`                             // SOCKS域名解析方式: udp 或 doh
+	DoHEndpoint          string            `json:"doh_endpoint" yaml:"doh_endpoint"`                     // DNS-over-HTTPS服务地址
+	DNSBlocklist         string            `json:"dns_blocklist" yaml:"dns_blocklist"`                   // DNS屏蔽列表文件路径（hosts格式或每行一个域名），为空时不启用
+	DNSBlockMode         string            `json:"dns_block_mode" yaml:"dns_block_mode"`                 // 被屏蔽域名的处理方式: sinkhole（解析为0.0.0.0，默认）或 refuse（返回错误）
+	DNSHosts             map[string]string `json:"dns_hosts" yaml:"dns_hosts"`                           // 静态域名到IP的映射，优先于DNS查询
+	UseIPv6              bool              `json:"use_ipv6" yaml:"use_ipv6"`                             // 是否使用IPv6进行MASQUE连接
+	AddressPreference    string            `json:"address_preference" yaml:"address_preference"`         // 地址族偏好: auto（默认）、prefer_ipv4 或 prefer_ipv6，决定端点与SOCKS目标地址优先使用的地址族
+	NoTunnelIPv4         bool              `json:"no_tunnel_ipv4" yaml:"no_tunnel_ipv4"`                 // 是否在隧道内禁用IPv4
+	NoTunnelIPv6         bool              `json:"no_tunnel_ipv6" yaml:"no_tunnel_ipv6"`                 // 是否在隧道内禁用IPv6
+	SNIAddress           string            `json:"sni_address" yaml:"sni_address"`                       // MASQUE连接使用的SNI地址，注册时设为 consumer-masque.cloudflareclient.com
+	ConnectURI           string            `json:"connect_uri" yaml:"connect_uri"`                       // CONNECT-IP 请求的URI，为空时使用内置的 https://cloudflareaccess.com
+	SNIFragment          int               `json:"sni_fragment" yaml:"sni_fragment"`                     // 将握手 Initial 数据包中的 CRYPTO 帧拆分为不超过该字节数的小帧并倒序发送，使SNI不连续出现，为0时不拆分
+	KeepalivePeriod      Duration          `json:"keepalive_period" yaml:"keepalive_period"`             // 连接心跳周期
+	MTU                  MTU               `json:"mtu" yaml:"mtu"`                                       // 隧道MTU，为 auto 时在启动时通过隧道探测
+	InitialPacketSize    uint16            `json:"initial_packet_size" yaml:"initial_packet_size"`       // 初始包大小
+	ReconnectDelay       Duration          `json:"reconnect_delay" yaml:"reconnect_delay"`               // 重连延迟
+	ReconnectStrategy    string            `json:"reconnect_strategy" yaml:"reconnect_strategy"`         // 重连策略: exponential、linear 或 constant
+	ReconnectMaxDelay    Duration          `json:"reconnect_max_delay" yaml:"reconnect_max_delay"`       // 重连延迟上限，适用于 exponential 与 linear
+	ReconnectFactor      float64           `json:"reconnect_factor" yaml:"reconnect_factor"`             // 指数退避的增长倍数
+	ReconnectIncrement   Duration          `json:"reconnect_increment" yaml:"reconnect_increment"`       // 线性退避每次增加的延迟
+	MaxReconnectAttempts int               `json:"max_reconnect_attempts" yaml:"max_reconnect_attempts"` // 连续连接失败多少次后放弃重连并以错误退出，为0时一直重连
+	ConnectionTimeout    Duration          `json:"connection_timeout" yaml:"connection_timeout"`         // 建立连接超时
+	IdleTimeout          Duration          `json:"idle_timeout" yaml:"idle_timeout"`                     // 空闲连接超时
+	ReadIdleTimeout      Duration          `json:"read_idle_timeout" yaml:"read_idle_timeout"`           // SOCKS客户端连接的读空闲超时，为0时使用 idle_timeout
+	WriteIdleTimeout     Duration          `json:"write_idle_timeout" yaml:"write_idle_timeout"`         // SOCKS客户端连接的写空闲超时，为0时使用 idle_timeout
+	MaxConnLifetime      Duration          `json:"max_conn_lifetime" yaml:"max_conn_lifetime"`           // SOCKS客户端连接的最长存活时间，为0时不限制
+	PerClient            bool              `json:"per_client" yaml:"per_client"`                         // 是否为每个SOCKS客户端创建独立隧道
+	PerClientGrace       Duration          `json:"per_client_grace" yaml:"per_client_grace"`             // 单客户端隧道在最后一个连接关闭后保留的时间，为0时立即关闭
+	PerClientInterval    Duration          `json:"per_client_interval" yaml:"per_client_interval"`       // 相邻两个单客户端隧道开始建立连接的最小间隔，为0时不限制
+	PerClientJitter      Duration          `json:"per_client_jitter" yaml:"per_client_jitter"`           // 每个单客户端隧道开始建立连接前额外随机等待的最长时间，为0时不等待
+	MaxPacketRate        float64           `json:"max_packet_rate" yaml:"max_packet_rate"`               // 发往隧道的每秒最大数据包数，为0时不限制
+	MaxBurst             int               `json:"max_burst" yaml:"max_burst"`                           // 限速时允许突发的最大数据包数
+	MaxBandwidthBps      int64             `json:"max_bandwidth_bps" yaml:"max_bandwidth_bps"`           // 每个方向每秒最大字节数，上行与下行分别限速，为0时不限制
+	StatsInterval        Duration          `json:"stats_interval" yaml:"stats_interval"`                 // 统计日志输出间隔，为0时默认300秒，设为-1禁用
+	StatsFile            string            `json:"stats_file" yaml:"stats_file"`                         // 每10秒以JSON格式写入隧道统计信息的文件路径，为空时不写入，单客户端模式下不可用
+	StallTimeout         Duration          `json:"stall_timeout" yaml:"stall_timeout"`                   // 发出数据后无回包超过该时间时强制重连，为0时禁用
+	FwMark               int               `json:"fwmark" yaml:"fwmark"`                                 // 为隧道UDP套接字设置的 SO_MARK，用于在策略路由中排除隧道流量，仅 Linux 有效，为0时不设置
+	LocalAddress         string            `json:"local_address" yaml:"local_address"`                   // 隧道UDP套接字绑定的本地IP地址或网卡名，为空时由系统选择
+	Transport            string            `json:"transport" yaml:"transport"`                           // 隧道传输方式: quic（默认）或 ws（经 WebSocket 中继）
+	WSURL                string            `json:"ws_url" yaml:"ws_url"`                                 // WebSocket 中继的地址（ws:// 或 wss://）
+	WSFallbackAfter      int               `json:"ws_fallback_after" yaml:"ws_fallback_after"`           // 使用 quic 时连续失败多少次后改用 WebSocket 中继，为0时不切换
+}
+
+// ResolverSettings 包含可在运行时热更新的DNS解析相关配置
+type ResolverSettings struct {
+	DNS         []string
+	Timeout     Duration
+	MinTTL      Duration
+	MaxTTL      Duration
+	NegativeTTL Duration
+	CacheSize   int
+	Prefetch    float64
+	Fallback    bool
+	Mode        string
+	DoHEndpoint string
+	Blocklist   string
+	BlockMode   string
+	Hosts       map[string]string
+}
+
+// PreferIPv6Endpoint 返回是否优先使用 endpoint_v6 建立MASQUE连接
+// auto 时由 use_ipv6 决定
+func (t *TunnelConfig) PreferIPv6Endpoint() bool {
+	switch t.AddressPreference {
+	case "prefer_ipv6":
+		return true
+	case "prefer_ipv4":
+		return false
+	}
+	return t.UseIPv6
+}
+
+// PreferIPv6Destination 返回SOCKS目标域名解析出多个地址族时是否优先使用IPv6地址
+// auto 时优先使用隧道内启用的地址族，两者都启用时优先IPv4
+func (t *TunnelConfig) PreferIPv6Destination() bool {
+	switch t.AddressPreference {
+	case "prefer_ipv6":
+		return true
+	case "prefer_ipv4":
+		return false
+	}
+	return t.NoTunnelIPv4 && !t.NoTunnelIPv6
+}
+
+// Resolver 返回隧道配置中与DNS解析相关的部分
+func (t *TunnelConfig) Resolver() ResolverSettings {
+	return ResolverSettings{
+		DNS:         t.DNS,
+		Timeout:     t.DNSTimeout,
+		MinTTL:      t.DNSMinTTL,
+		MaxTTL:      t.DNSMaxTTL,
+		NegativeTTL: t.DNSNegativeTTL,
+		CacheSize:   t.DNSCacheSize,
+		Prefetch:    t.DNSPrefetch,
+		Fallback:    t.DNSFallbackSystem,
+		Mode:        t.DNSMode,
+		DoHEndpoint: t.DoHEndpoint,
+		Blocklist:   t.DNSBlocklist,
+		BlockMode:   t.DNSBlockMode,
+		Hosts:       t.DNSHosts,
+	}
+}
+
+// SetResolver 使用 r 覆盖隧道配置中与DNS解析相关的部分
+func (t *TunnelConfig) SetResolver(r ResolverSettings) {
+	t.DNS = r.DNS
+	t.DNSTimeout = r.Timeout
+	t.DNSMinTTL = r.MinTTL
+	t.DNSMaxTTL = r.MaxTTL
+	t.DNSNegativeTTL = r.NegativeTTL
+	t.DNSCacheSize = r.CacheSize
+	t.DNSPrefetch = r.Prefetch
+	t.DNSFallbackSystem = r.Fallback
+	t.DNSMode = r.Mode
+	t.DoHEndpoint = r.DoHEndpoint
+	t.DNSBlocklist = r.Blocklist
+	t.DNSBlockMode = r.BlockMode
+	t.DNSHosts = r.Hosts
 }
 
 // LoggingConfig contains configuration related to logging output.
 type LoggingConfig struct {
 	// OutputPath specifies the file path to write logs to. If empty, logs are written to stdout.
-	OutputPath string `json:"output_path"`
+	OutputPath string `json:"output_path" yaml:"output_path"`
 	// Level defines the minimum log level (debug, info, warn, error).
-	Level string `json:"level"`
+	Level string `json:"level" yaml:"level"`
+	// Format selects the log format: "text" (default) or "json".
+	Format string `json:"format" yaml:"format"`
+	// MaxSizeMB is the size in megabytes at which the log file is rotated. 0 means 100 MB.
+	MaxSizeMB int `json:"max_size_mb" yaml:"max_size_mb"`
+	// MaxBackups is the number of rotated files to keep. 0 keeps all of them.
+	MaxBackups int `json:"max_backups" yaml:"max_backups"`
+	// MaxAgeDays is the number of days to keep rotated files. 0 disables age-based removal.
+	MaxAgeDays int `json:"max_age_days" yaml:"max_age_days"`
+	// Compress enables gzip compression of rotated files.
+	Compress bool `json:"compress" yaml:"compress"`
+	// AccessLog enables a log line per SOCKS connection with the client, destination, traffic and duration.
+	AccessLog bool `json:"access_log" yaml:"access_log"`
+	// PacketDumpBytes is the number of leading bytes of each tunneled packet hex-dumped at the trace level. 0 means 64.
+	PacketDumpBytes int `json:"packet_dump_bytes" yaml:"packet_dump_bytes"`
+}
+
+// MetricsConfig contains configuration related to the Prometheus metrics endpoint.
+type MetricsConfig struct {
+	// Address is the listen address of the /metrics endpoint. If empty, metrics are disabled.
+	Address string `json:"metrics_address" yaml:"metrics_address"`
+	// PprofAddress is the listen address of the net/http/pprof endpoint. It must be a
+	// loopback address. If empty, profiling is disabled.
+	PprofAddress string `json:"pprof_address" yaml:"pprof_address"`
+	// HealthAddress is the listen address of the /healthz and /readyz endpoints. If empty,
+	// health checks are disabled.
+	HealthAddress string `json:"health_address" yaml:"health_address"`
+}
+
+// ControlConfig contains configuration related to the local control socket.
+type ControlConfig struct {
+	// SocketPath is the Unix socket used by the status command. If empty, the control server is disabled.
+	SocketPath string `json:"socket_path" yaml:"socket_path"`
+}
+
+// RoutingConfig 包含代理出站连接的分流规则
+type RoutingConfig struct {
+	Rules  []string `json:"rules" yaml:"rules"`   // 直接连接（不经过隧道）的域名后缀、IP或网段
+	Invert bool     `json:"invert" yaml:"invert"` // 反转规则：仅匹配的目标经过隧道，其余直接连接
+
+	Upstream      string   `json:"upstream" yaml:"upstream"`             // 隧道出口之后再经过的上游代理（socks5、socks5h 或 http URL），为空时不使用
+	UpstreamRules []string `json:"upstream_rules" yaml:"upstream_rules"` // 经过上游代理的目标，格式同 rules，为空时所有经隧道的TCP连接都经过上游代理
+}
+
+// VPNConfig 包含 vpn 命令使用的系统TUN接口配置
+type VPNConfig struct {
+	InterfaceName string   `json:"interface_name" yaml:"interface_name"` // TUN接口名称，默认为 uscf0
+	Routes        []string `json:"routes" yaml:"routes"`                 // 经隧道转发的网段，为空时转发全部流量
+}
+
+// AccountsConfig 包含同时使用多个已注册账户的配置，每个账户运行独立的隧道，SOCKS连接在各隧道之间分配
+type AccountsConfig struct {
+	Configs []string `json:"configs" yaml:"configs"` // 其他账户的配置文件或目录（读取其中的 .json、.yaml 与 .yml 文件），只使用其中的账户与隧道配置
+	Balance string   `json:"balance" yaml:"balance"` // 连接分配方式: round_robin（默认）或 least_connections
+	Backups []string `json:"backups" yaml:"backups"` // 备用账户的配置文件或目录，某个账户的身份被服务端封禁时按顺序换用
+	// 身份连续多少次被服务端以 401 或 403 拒绝后视为被封禁，为0时默认为3
+	RotateAfter int `json:"rotate_after" yaml:"rotate_after"`
+}
+
+// defaultRotateAfter 是 rotate_after 未设置时判定身份被封禁的连续拒绝次数
+const defaultRotateAfter = 3
+
+// RotateThreshold 返回判定身份被封禁的连续拒绝次数，没有配置备用账户时返回0，即不检测
+func (a *AccountsConfig) RotateThreshold() int {
+	if len(a.Backups) == 0 {
+		return 0
+	}
+	if a.RotateAfter > 0 {
+		return a.RotateAfter
+	}
+	return defaultRotateAfter
 }
 
 // RegistrationInfo 包含注册相关的信息
 type RegistrationInfo struct {
-	DeviceName string `json:"device_name"` // 注册的设备名称
+	DeviceName string `json:"device_name" yaml:"device_name"` // 注册的设备名称
+	Proxy      string `json:"proxy" yaml:"proxy"`             // 访问注册API使用的代理（http、https 或 socks5 URL），为空时使用 HTTPS_PROXY 等环境变量
+}
+
+// Registered 报告配置是否包含设备注册信息，注销后的配置返回 false
+func (c *Config) Registered() bool {
+	return c.ID != "" || c.PrivateKey != ""
 }
 
+// ClearRegistration 清除设备注册得到的身份信息，保留代理与隧道等其他设置
+func (c *Config) ClearRegistration() {
+	c.PrivateKey = ""
+	c.EndpointPubKey = ""
+	c.License = ""
+	c.ID = ""
+	c.AccessToken = ""
+	c.IPv4 = ""
+	c.IPv6 = ""
+}
+
+// redacted 是脱敏后替换密钥与密码的占位符
+const redacted = "***"
+
+// Redacted 返回私钥、访问令牌与各类密码被替换为 *** 的配置副本，可安全地用于问题反馈
+// 引用密钥文件的 private_key 只包含路径，保持不变
+func (c Config) Redacted() Config {
+	if c.PrivateKey != "" && !strings.HasPrefix(c.PrivateKey, PrivateKeyFilePrefix) {
+		c.PrivateKey = redacted
+	}
+	if c.AccessToken != "" {
+		c.AccessToken = redacted
+	}
+	if c.Socks.Password != "" {
+		c.Socks.Password = redacted
+	}
+	if len(c.Socks.Users) > 0 {
+		users := make([]SocksUser, len(c.Socks.Users))
+		for i, u := range c.Socks.Users {
+			if u.Password != "" {
+				u.Password = redacted
+			}
+			users[i] = u
+		}
+		c.Socks.Users = users
+	}
+	if u, err := url.Parse(c.Registration.Proxy); err == nil && u.User != nil {
+		if _, ok := u.User.Password(); ok {
+			u.User = url.UserPassword(u.User.Username(), redacted)
+			c.Registration.Proxy = u.String()
+		}
+	}
+	if u, err := url.Parse(c.Routing.Upstream); err == nil && u.User != nil {
+		if _, ok := u.User.Password(); ok {
+			u.User = url.UserPassword(u.User.Username(), redacted)
+			c.Routing.Upstream = u.String()
+		}
+	}
+	return c
+}
+
+// KeepSettings 从 old 复制除注册身份与端点以外的所有设置
+func (c *Config) KeepSettings(old Config) {
+	c.Socks = old.Socks
+	c.Tunnel = old.Tunnel
+	c.Logging = old.Logging
+	c.Metrics = old.Metrics
+	c.Control = old.Control
+	c.Routing = old.Routing
+	c.VPN = old.VPN
+	c.Accounts = old.Accounts
+	c.PIDFile = old.PIDFile
+	c.PIDFileTakeover = old.PIDFileTakeover
+}
+
+// 隧道MTU的允许范围，576 是IPv4要求的最小值，更大的值已超出任何实际链路
+const (
+	MinMTU = 576
+	MaxMTU = 9000
+)
+
 // AppConfig holds the global application configuration.
 var AppConfig Config
 
 // ConfigLoaded indicates whether the configuration has been successfully loaded.
 var ConfigLoaded bool
 
-// LoadConfig loads the application configuration from a JSON file.
+// LoadConfig loads the application configuration from a JSON or YAML file.
 //
 // Parameters:
-//   - configPath: string - The path to the configuration JSON file.
+//   - configPath: string - The path to the configuration file; .yaml and .yml files are read as YAML, anything else as JSON.
 //
 // Returns:
-//   - error: An error if the configuration file cannot be loaded or parsed.
+//   - error: An error if the configuration file cannot be loaded, parsed or fails validation.
 func LoadConfig(configPath string) error {
-	file, err := os.Open(configPath)
+	cfg, err := ReadConfig(configPath)
 	if err != nil {
-		return fmt.Errorf("failed to open config file: %v", err)
+		return err
 	}
-	defer file.Close()
+	if err := cfg.Validate(); err != nil {
+		return fmt.Errorf("invalid config %s:\n%w", configPath, err)
+	}
+	AppConfig = cfg
+
+	ConfigLoaded = true
+
+	return nil
+}
 
-	decoder := json.NewDecoder(file)
-	if err := decoder.Decode(&AppConfig); err != nil {
-		return fmt.Errorf("failed to decode config file: %v", err)
+// ReadConfig reads a configuration JSON or YAML file and fills in defaults without modifying AppConfig.
+// configPath may also be "-" to read JSON from stdin, or an http:// or https:// URL to fetch it.
+//
+// Parameters:
+//   - configPath: string - The configuration source; .yaml and .yml files are read as YAML, anything else as JSON.
+//
+// Returns:
+//   - Config: The decoded configuration.
+//   - error: An error if the configuration file cannot be loaded or parsed.
+func ReadConfig(configPath string) (Config, error) {
+	r, err := openSource(configPath)
+	if err != nil {
+		return Config{}, err
 	}
+	defer r.Close()
+	return ReadConfigFrom(r, isYAML(sourcePath(configPath)))
+}
 
-	// 如果配置项为空，设置为默认值
-	if AppConfig.Socks.Port == "" && AppConfig.Socks.BindAddress == "" {
-		AppConfig.Socks = GetDefaultSocksConfig()
+// ReadConfigFrom decodes a configuration from r, as YAML when isYAML is set and JSON otherwise,
+// and fills in defaults without modifying AppConfig.
+func ReadConfigFrom(r io.Reader, isYAML bool) (Config, error) {
+	var cfg Config
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return cfg, fmt.Errorf("failed to read config file: %v", err)
 	}
-	if AppConfig.Tunnel.ConnectPort == 0 && len(AppConfig.Tunnel.DNS) == 0 {
-		AppConfig.Tunnel = GetDefaultTunnelConfig()
+	if isYAML {
+		err = yaml.Unmarshal(data, &cfg)
+	} else {
+		err = json.Unmarshal(data, &cfg)
 	}
-	if AppConfig.Logging.OutputPath == "" {
-		AppConfig.Logging.OutputPath = GetDefaultLoggingConfig().OutputPath
+	if err != nil {
+		return cfg, fmt.Errorf("failed to decode config file: %v", err)
 	}
-	if AppConfig.Logging.Level == "" {
-		AppConfig.Logging.Level = GetDefaultLoggingConfig().Level
+	if err := checkTLSFingerprint(data, isYAML); err != nil {
+		return cfg, err
 	}
 
-	ConfigLoaded = true
+	// 如果配置项为空，设置为默认值
+	if cfg.Socks.Port == "" && cfg.Socks.BindAddress == "" && cfg.Socks.UnixSocket == "" && len(cfg.Socks.Listeners) == 0 {
+		cfg.Socks = GetDefaultSocksConfig()
+	}
+	if cfg.Tunnel.ConnectPort == 0 && len(cfg.Tunnel.DNS) == 0 {
+		cfg.Tunnel = GetDefaultTunnelConfig()
+	}
+	if cfg.Logging.OutputPath == "" {
+		cfg.Logging.OutputPath = GetDefaultLoggingConfig().OutputPath
+	}
+	if cfg.Logging.Level == "" {
+		cfg.Logging.Level = GetDefaultLoggingConfig().Level
+	}
+	if cfg.Logging.Format == "" {
+		cfg.Logging.Format = GetDefaultLoggingConfig().Format
+	}
+	// 配置中没有出现的键使用默认值，监听地址仍按上面的规则整体决定
+	present := presentKeys(data, isYAML)
+	fillMissing(&cfg.Socks, GetDefaultSocksConfig(), present["socks"], "bind_address", "port")
+	fillMissing(&cfg.Tunnel, GetDefaultTunnelConfig(), present["tunnel"])
+	fillMissing(&cfg.Logging, GetDefaultLoggingConfig(), present["logging"])
 
-	return nil
+	return cfg, nil
 }
 
 // GetDefaultSocksConfig 返回默认的SOCKS代理配置
 func GetDefaultSocksConfig() SocksConfig {
 	return SocksConfig{
-		BindAddress: "127.0.0.1",
-		Port:        "1080",
-		Username:    "",
-		Password:    "",
+		BindAddress:     "127.0.0.1",
+		Port:            "1080",
+		Username:        "",
+		Password:        "",
+		ShutdownTimeout: Duration(10 * time.Second),
 	}
 }
 
 // GetDefaultTunnelConfig 返回默认的MASQUE隧道配置
 func GetDefaultTunnelConfig() TunnelConfig {
 	return TunnelConfig{
-		ConnectPort:       443,
-		DNS:               []string{"1.1.1.1", "8.8.8.8"},
-		DNSTimeout:        Duration(2 * time.Second),
-		UseIPv6:           false,
-		NoTunnelIPv4:      false,
-		NoTunnelIPv6:      false,
-		SNIAddress:        "",
-		KeepalivePeriod:   Duration(30 * time.Second),
-		MTU:               1280,
-		InitialPacketSize: 1242,
-		ReconnectDelay:    Duration(1 * time.Second),
-		ConnectionTimeout: Duration(30 * time.Second),
-		IdleTimeout:       Duration(5 * time.Minute),
-		PerClient:         false,
+		ConnectPort:        443,
+		FailoverAfter:      3,
+		DNS:                []string{"1.1.1.1", "8.8.8.8"},
+		DNSTimeout:         Duration(2 * time.Second),
+		DNSMinTTL:          Duration(10 * time.Second),
+		DNSMaxTTL:          Duration(10 * time.Minute),
+		DNSNegativeTTL:     Duration(30 * time.Second),
+		DNSCacheSize:       10000,
+		DNSMode:            "udp",
+		DoHEndpoint:        "https://cloudflare-dns.com/dns-query",
+		UseIPv6:            false,
+		AddressPreference:  "auto",
+		NoTunnelIPv4:       false,
+		NoTunnelIPv6:       false,
+		SNIAddress:         "",
+		SNIFragment:        0,
+		Transport:          "quic",
+		KeepalivePeriod:    Duration(30 * time.Second),
+		MTU:                1280,
+		InitialPacketSize:  1242,
+		ReconnectDelay:     Duration(1 * time.Second),
+		ReconnectStrategy:  "exponential",
+		ReconnectMaxDelay:  Duration(5 * time.Minute),
+		ReconnectFactor:    2.0,
+		ReconnectIncrement: Duration(1 * time.Second),
+		ConnectionTimeout:  Duration(30 * time.Second),
+		IdleTimeout:        Duration(5 * time.Minute),
+		PerClient:          false,
+		PerClientGrace:     Duration(30 * time.Second),
+		PerClientInterval:  Duration(100 * time.Millisecond),
+		StatsInterval:      Duration(300 * time.Second),
 	}
 }
 
 // GetDefaultLoggingConfig returns the default logging configuration.
 func GetDefaultLoggingConfig() LoggingConfig {
-	return LoggingConfig{OutputPath: "", Level: "info"}
+	return LoggingConfig{
+		OutputPath: "",
+		Level:      "info",
+		Format:     "text",
+		MaxSizeMB:  100,
+		MaxBackups: 3,
+		MaxAgeDays: 28,
+		Compress:   false,
+	}
 }
 
-// SaveConfig writes the current application configuration to a prettified JSON file.
+// SaveConfig writes the current application configuration to a prettified JSON file,
+// or a YAML file when configPath ends in .yaml or .yml.
 //
 // Parameters:
-//   - configPath: string - The path to save the configuration JSON file.
+//   - configPath: string - The path to save the configuration file.
 //
 // Returns:
-//   - error: An error if the configuration file cannot be written.
+//   - error: An error if the configuration file cannot be written, or configPath is stdin or a URL.
 func (*Config) SaveConfig(configPath string) error {
+	if !IsLocalSource(configPath) {
+		return fmt.Errorf("cannot save config to %s: not a local file", configPath)
+	}
+
 	file, err := os.Create(configPath)
 	if err != nil {
 		return fmt.Errorf("failed to create config file: %v", err)
 	}
 	defer file.Close()
 
-	encoder := json.NewEncoder(file)
-	encoder.SetIndent("", "  ")
-	if err := encoder.Encode(AppConfig); err != nil {
+	if isYAML(configPath) {
+		encoder := yaml.NewEncoder(file)
+		encoder.SetIndent(2)
+		err = encoder.Encode(AppConfig)
+		if err == nil {
+			err = encoder.Close()
+		}
+	} else {
+		encoder := json.NewEncoder(file)
+		encoder.SetIndent("", "  ")
+		err = encoder.Encode(AppConfig)
+	}
+	if err != nil {
 		return fmt.Errorf("failed to encode config file: %v", err)
 	}
 
 	return nil
 }
 
+// isYAML 根据扩展名判断配置文件是否为YAML格式，其他扩展名均按JSON处理
+func isYAML(configPath string) bool {
+	switch strings.ToLower(filepath.Ext(configPath)) {
+	case ".yaml", ".yml":
+		return true
+	}
+	return false
+}
+
 // InitNewConfig initializes a new configuration with default values.
 //
 // Parameters:
@@ -256,13 +776,40 @@ func InitNewConfig(
 	}
 }
 
-// GetEcPrivateKey retrieves the ECDSA private key from the stored Base64-encoded string.
+// PrivateKeyFilePrefix marks a private_key value that refers to a key file instead of
+// holding the Base64-encoded key itself, e.g. "file:/etc/uscf/private.key".
+const PrivateKeyFilePrefix = "file:"
+
+// GetEcPrivateKey retrieves the ECDSA private key from the stored Base64-encoded string,
+// or from the referenced file when the value starts with PrivateKeyFilePrefix.
 //
 // Returns:
 //   - *ecdsa.PrivateKey: The parsed ECDSA private key.
-//   - error: An error if decoding or parsing the private key fails.
-func (*Config) GetEcPrivateKey() (*ecdsa.PrivateKey, error) {
-	privKeyB64, err := base64.StdEncoding.DecodeString(AppConfig.PrivateKey)
+//   - error: An error if reading, decoding or parsing the private key fails.
+func (c *Config) GetEcPrivateKey() (*ecdsa.PrivateKey, error) {
+	return parsePrivateKey(c.PrivateKey)
+}
+
+// parsePrivateKey 解析 private_key 配置值：内联的Base64密钥，或 file: 引用的密钥文件
+// 密钥文件可以是Base64编码的DER，也可以是PEM格式
+func parsePrivateKey(value string) (*ecdsa.PrivateKey, error) {
+	encoded := value
+	if path, ok := strings.CutPrefix(value, PrivateKeyFilePrefix); ok {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read private key file: %v", err)
+		}
+		if block, _ := pem.Decode(data); block != nil {
+			privKey, err := x509.ParseECPrivateKey(block.Bytes)
+			if err != nil {
+				return nil, fmt.Errorf("failed to parse private key: %v", err)
+			}
+			return privKey, nil
+		}
+		encoded = strings.TrimSpace(string(data))
+	}
+
+	privKeyB64, err := base64.StdEncoding.DecodeString(encoded)
 	if err != nil {
 		return nil, fmt.Errorf("failed to decode private key: %v", err)
 	}
@@ -275,13 +822,32 @@ func (*Config) GetEcPrivateKey() (*ecdsa.PrivateKey, error) {
 	return privKey, nil
 }
 
+// WritePrivateKeyFile writes the Base64-encoded private key to path with 0600 permissions
+// and returns the private_key value that refers to it.
+func WritePrivateKeyFile(path, privateKey string) (string, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		return "", fmt.Errorf("failed to create private key file: %v", err)
+	}
+	defer file.Close()
+
+	// 文件已存在时 OpenFile 不会修改其权限
+	if err := file.Chmod(0600); err != nil {
+		return "", fmt.Errorf("failed to set private key file permissions: %v", err)
+	}
+	if _, err := fmt.Fprintln(file, privateKey); err != nil {
+		return "", fmt.Errorf("failed to write private key file: %v", err)
+	}
+	return PrivateKeyFilePrefix + path, nil
+}
+
 // GetEcEndpointPublicKey retrieves the ECDSA public key from the stored PEM-encoded string.
 //
 // Returns:
 //   - *ecdsa.PublicKey: The parsed ECDSA public key.
 //   - error: An error if decoding or parsing the public key fails.
-func (*Config) GetEcEndpointPublicKey() (*ecdsa.PublicKey, error) {
-	endpointPubKeyB64, _ := pem.Decode([]byte(AppConfig.EndpointPubKey))
+func (c *Config) GetEcEndpointPublicKey() (*ecdsa.PublicKey, error) {
+	endpointPubKeyB64, _ := pem.Decode([]byte(c.EndpointPubKey))
 	if endpointPubKeyB64 == nil {
 		return nil, fmt.Errorf("failed to decode endpoint public key")
 	}
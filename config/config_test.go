@@ -0,0 +1,62 @@
+package config
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReadConfigDefaultsMissingKeys(t *testing.T) {
+	// 新增选项之前保存的配置：tunnel 段落存在，但没有后来新增的键
+	const old = `{
+  "socks": {"bind_address": "127.0.0.1", "port": "1080"},
+  "tunnel": {"connect_port": 443, "dns": ["1.1.1.1"], "per_client_grace": "0s"}
+}`
+	cfg, err := ReadConfigFrom(strings.NewReader(old), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	def := GetDefaultTunnelConfig()
+	if cfg.Tunnel.DNSCacheSize != def.DNSCacheSize {
+		t.Errorf("dns_cache_size = %d, want default %d", cfg.Tunnel.DNSCacheSize, def.DNSCacheSize)
+	}
+	if cfg.Tunnel.DNSMinTTL != def.DNSMinTTL || cfg.Tunnel.DNSNegativeTTL != def.DNSNegativeTTL {
+		t.Errorf("dns ttls = %v/%v, want defaults", cfg.Tunnel.DNSMinTTL, cfg.Tunnel.DNSNegativeTTL)
+	}
+	if got := cfg.Socks.ShutdownTimeout.Duration(); got != 10*time.Second {
+		t.Errorf("shutdown_timeout = %v, want 10s", got)
+	}
+	// 显式写出的零值保持不变
+	if cfg.Tunnel.PerClientGrace != 0 {
+		t.Errorf("per_client_grace = %v, want 0", cfg.Tunnel.PerClientGrace.Duration())
+	}
+	if len(cfg.Tunnel.DNS) != 1 {
+		t.Errorf("dns = %v, want the configured server", cfg.Tunnel.DNS)
+	}
+}
+
+func TestReadConfigYAMLDefaultsMissingKeys(t *testing.T) {
+	cfg, err := ReadConfigFrom(strings.NewReader("tunnel:\n  connect_port: 443\n  dns_cache_size: 0\n"), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Tunnel.DNSCacheSize != 0 {
+		t.Errorf("dns_cache_size = %d, want explicit 0", cfg.Tunnel.DNSCacheSize)
+	}
+	if cfg.Tunnel.PerClientGrace != GetDefaultTunnelConfig().PerClientGrace {
+		t.Errorf("per_client_grace = %v, want default", cfg.Tunnel.PerClientGrace.Duration())
+	}
+}
+
+func TestReadConfigRejectsTLSFingerprint(t *testing.T) {
+	for _, fp := range []string{"chrome", "random"} {
+		doc := `{"tunnel": {"connect_port": 443, "tls_fingerprint": "` + fp + `"}}`
+		if _, err := ReadConfigFrom(strings.NewReader(doc), false); err == nil || !strings.Contains(err.Error(), "tls_fingerprint") {
+			t.Errorf("tls_fingerprint %q: error %v, want it rejected", fp, err)
+		}
+	}
+	// 之前版本保存的默认值与实际行为一致
+	if _, err := ReadConfigFrom(strings.NewReader("tunnel:\n  tls_fingerprint: go\n"), true); err != nil {
+		t.Errorf("tls_fingerprint go: %v", err)
+	}
+}
@@ -0,0 +1,68 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"slices"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// presentKeys 返回配置文档中每个顶层段落里出现过的键，用于区分未设置的键与显式写出的零值
+func presentKeys(data []byte, isYAML bool) map[string]map[string]bool {
+	var doc map[string]any
+	if isYAML {
+		_ = yaml.Unmarshal(data, &doc)
+	} else {
+		_ = json.Unmarshal(data, &doc)
+	}
+	keys := make(map[string]map[string]bool, len(doc))
+	for name, section := range doc {
+		fields, ok := section.(map[string]any)
+		if !ok {
+			continue
+		}
+		keys[name] = make(map[string]bool, len(fields))
+		for key := range fields {
+			keys[name][key] = true
+		}
+	}
+	return keys
+}
+
+// fillMissing 将 dst 指向的结构体中键不在 present 里的字段设置为 def 中对应的默认值，skip 中的键除外
+// 旧版本保存的配置缺少后来新增的键，这些键因此使用默认值而不是零值，显式写出的零值保持不变
+func fillMissing(dst, def any, present map[string]bool, skip ...string) {
+	d, v := reflect.ValueOf(dst).Elem(), reflect.ValueOf(def)
+	t := d.Type()
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		key, _, _ := strings.Cut(f.Tag.Get("json"), ",")
+		if !f.IsExported() || key == "" || key == "-" || present[key] || slices.Contains(skip, key) {
+			continue
+		}
+		d.Field(i).Set(v.Field(i))
+	}
+}
+
+// checkTLSFingerprint 拒绝要求模拟其他客户端的 tunnel.tls_fingerprint
+// quic-go 只能使用 crypto/tls 生成的 ClientHello，无法替换为 uTLS 的指纹，因此不提供该选项；
+// 之前版本保存的 "go" 与实际行为一致，予以接受，其他值启动时报错而不是被静默忽略
+func checkTLSFingerprint(data []byte, isYAML bool) error {
+	var doc struct {
+		Tunnel struct {
+			TLSFingerprint string `json:"tls_fingerprint" yaml:"tls_fingerprint"`
+		} `json:"tunnel" yaml:"tunnel"`
+	}
+	if isYAML {
+		_ = yaml.Unmarshal(data, &doc)
+	} else {
+		_ = json.Unmarshal(data, &doc)
+	}
+	if fp := doc.Tunnel.TLSFingerprint; fp != "" && fp != "go" {
+		return fmt.Errorf("tunnel.tls_fingerprint %q is not supported: the MASQUE handshake always uses Go's crypto/tls ClientHello, remove the option", fp)
+	}
+	return nil
+}
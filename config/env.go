@@ -0,0 +1,55 @@
+package config
+
+import (
+	"os"
+	"strings"
+)
+
+// envOverride 描述一个可以覆盖配置字段的环境变量
+type envOverride struct {
+	name  string
+	apply func(cfg *Config, value string)
+}
+
+// envOverrides 是支持的 USCF_* 环境变量，与 README 中的列表保持一致
+var envOverrides = []envOverride{
+	{"USCF_SOCKS_BIND_ADDRESS", func(c *Config, v string) { c.Socks.BindAddress = v }},
+	{"USCF_SOCKS_PORT", func(c *Config, v string) { c.Socks.Port = v }},
+	{"USCF_SOCKS_USERNAME", func(c *Config, v string) { c.Socks.Username = v }},
+	{"USCF_SOCKS_PASSWORD", func(c *Config, v string) { c.Socks.Password = v }},
+	{"USCF_SOCKS_HTTP_PORT", func(c *Config, v string) { c.Socks.HTTPPort = v }},
+	{"USCF_DNS", func(c *Config, v string) { c.Tunnel.DNS = splitList(v) }},
+	{"USCF_DNS_MODE", func(c *Config, v string) { c.Tunnel.DNSMode = v }},
+	{"USCF_DOH_ENDPOINT", func(c *Config, v string) { c.Tunnel.DoHEndpoint = v }},
+	{"USCF_LOG_LEVEL", func(c *Config, v string) { c.Logging.Level = v }},
+	{"USCF_METRICS_ADDRESS", func(c *Config, v string) { c.Metrics.Address = v }},
+}
+
+// ApplyEnv 使用已设置的 USCF_* 环境变量覆盖 cfg 中对应的字段，返回生效的变量名
+// skip 返回 true 的变量被忽略，用于让命令行参数优先于环境变量
+func ApplyEnv(cfg *Config, skip func(name string) bool) []string {
+	var applied []string
+	for _, o := range envOverrides {
+		v, ok := os.LookupEnv(o.name)
+		if !ok || v == "" {
+			continue
+		}
+		if skip != nil && skip(o.name) {
+			continue
+		}
+		o.apply(cfg, v)
+		applied = append(applied, o.name)
+	}
+	return applied
+}
+
+// splitList 拆分以逗号分隔的列表，忽略空白项
+func splitList(v string) []string {
+	var items []string
+	for _, item := range strings.Split(v, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
@@ -0,0 +1,71 @@
+package config
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// StdinSource 表示从标准输入读取配置
+const StdinSource = "-"
+
+// fetchTimeout 是从URL获取配置的超时时间
+const fetchTimeout = 30 * time.Second
+
+// maxRemoteConfigSize 限制远程配置的大小
+const maxRemoteConfigSize = 1 << 20
+
+// IsLocalSource 报告配置来源是否为本地文件，只有本地文件可以保存
+func IsLocalSource(source string) bool {
+	return source != StdinSource && !isURL(source)
+}
+
+func isURL(source string) bool {
+	return strings.HasPrefix(source, "http://") || strings.HasPrefix(source, "https://")
+}
+
+// sourcePath 返回用于判断配置格式的路径，URL取其路径部分
+func sourcePath(source string) string {
+	if isURL(source) {
+		if u, err := url.Parse(source); err == nil {
+			return u.Path
+		}
+	}
+	return source
+}
+
+// openSource 打开配置来源：标准输入、HTTP(S) URL 或本地文件
+func openSource(source string) (io.ReadCloser, error) {
+	switch {
+	case source == StdinSource:
+		return io.NopCloser(os.Stdin), nil
+	case isURL(source):
+		return fetch(source)
+	}
+	file, err := os.Open(source)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open config file: %w", err)
+	}
+	return file, nil
+}
+
+// fetch 通过HTTP(S)获取配置，使用默认的TLS证书校验
+func fetch(source string) (io.ReadCloser, error) {
+	client := &http.Client{Timeout: fetchTimeout}
+	resp, err := client.Get(source)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch config: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("failed to fetch config: %s", resp.Status)
+	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{io.LimitReader(resp.Body, maxRemoteConfigSize), resp.Body}, nil
+}
@@ -0,0 +1,304 @@
+package config
+
+import (
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"net/netip"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// Validate 检查配置中的必填项与各字段格式，返回包含所有问题的合并错误
+func (c *Config) Validate() error {
+	var errs []error
+	check := func(err error) {
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	// 连接信息，未注册（如注销后）的配置不检查
+	if c.Registered() {
+		if c.PrivateKey == "" {
+			check(errors.New("private_key is required"))
+		} else if _, err := parsePrivateKey(c.PrivateKey); err != nil {
+			check(fmt.Errorf("private_key is invalid: %v", err))
+		}
+		if c.EndpointPubKey == "" {
+			check(errors.New("endpoint_pub_key is required"))
+		} else if block, _ := pem.Decode([]byte(c.EndpointPubKey)); block == nil {
+			check(errors.New("endpoint_pub_key is not PEM-encoded"))
+		}
+		switch {
+		case c.Tunnel.AddressPreference == "prefer_ipv4" || c.Tunnel.AddressPreference == "prefer_ipv6":
+			// 偏好的地址族没有端点时使用另一个
+			if c.EndpointV4 == "" && c.EndpointV6 == "" {
+				check(errors.New("endpoint_v4 or endpoint_v6 is required"))
+			}
+		case c.Tunnel.UseIPv6 && c.EndpointV6 == "":
+			check(errors.New("endpoint_v6 is required when use_ipv6 is set"))
+		case !c.Tunnel.UseIPv6 && c.EndpointV4 == "":
+			check(errors.New("endpoint_v4 is required"))
+		}
+		check(validateEndpoint("endpoint_v4", c.EndpointV4, false))
+		check(validateEndpoint("endpoint_v6", c.EndpointV6, true))
+		if !c.Tunnel.NoTunnelIPv4 {
+			check(validateAddr("ipv4", c.IPv4))
+		}
+		if !c.Tunnel.NoTunnelIPv6 {
+			check(validateAddr("ipv6", c.IPv6))
+		}
+	}
+
+	// SOCKS代理
+	s := c.Socks
+	check(validatePort("socks.port", s.Port))
+	check(validatePort("socks.http_port", s.HTTPPort))
+	for _, addr := range s.Listeners {
+		check(validateHostPort("socks.listeners", addr))
+	}
+	check(validateCIDRs("socks.allowed_cidrs", s.AllowedCIDRs))
+	check(validateCIDRs("socks.denied_cidrs", s.DeniedCIDRs))
+	if s.UnixSocketMode != "" {
+		if _, err := strconv.ParseUint(s.UnixSocketMode, 8, 32); err != nil {
+			check(fmt.Errorf("socks.unix_socket_mode %q is not an octal file mode", s.UnixSocketMode))
+		}
+	}
+	if s.PACAddress != "" {
+		check(validateHostPort("socks.pac_address", s.PACAddress))
+	}
+	check(validateNonNegative("socks.shutdown_timeout", s.ShutdownTimeout))
+	if s.MaxConnections < 0 {
+		check(fmt.Errorf("socks.max_connections must not be negative"))
+	}
+	check(validateOneOf("socks.conn_limit_mode", s.ConnLimitMode, "", "reject", "wait"))
+	for user, quota := range s.UserQuotas {
+		if quota < 0 {
+			check(fmt.Errorf("socks.user_quotas for %s must not be negative", user))
+		}
+	}
+	check(validateOneOf("socks.quota_period", s.QuotaPeriod, "", "monthly"))
+	if (s.TLSCert == "") != (s.TLSKey == "") {
+		check(fmt.Errorf("socks.tls_cert and socks.tls_key must be set together"))
+	}
+
+	// 隧道
+	t := c.Tunnel
+	if t.ConnectPort < 0 || t.ConnectPort > 65535 {
+		check(fmt.Errorf("tunnel.connect_port %d is out of range", t.ConnectPort))
+	}
+	for _, dns := range t.DNS {
+		if _, err := netip.ParseAddr(dns); err != nil {
+			check(fmt.Errorf("tunnel.dns entry %q is not an IP address", dns))
+		}
+	}
+	for name, ip := range t.DNSHosts {
+		if net.ParseIP(ip) == nil {
+			check(fmt.Errorf("tunnel.dns_hosts entry %q has invalid address %q", name, ip))
+		}
+	}
+	check(validateOneOf("tunnel.dns_mode", t.DNSMode, "", "udp", "doh"))
+	if t.DNSPrefetch < 0 || t.DNSPrefetch >= 1 {
+		check(fmt.Errorf("tunnel.dns_prefetch must be at least 0 and less than 1"))
+	}
+	check(validateOneOf("tunnel.dns_block_mode", t.DNSBlockMode, "", "sinkhole", "refuse"))
+	check(validateOneOf("tunnel.address_preference", t.AddressPreference, "", "auto", "prefer_ipv4", "prefer_ipv6"))
+	check(validateOneOf("tunnel.reconnect_strategy", t.ReconnectStrategy, "", "exponential", "linear", "constant"))
+	if t.MTU != MTUAuto && (t.MTU < MinMTU || t.MTU > MaxMTU) {
+		check(fmt.Errorf("tunnel.mtu %d must be between %d and %d", t.MTU, MinMTU, MaxMTU))
+	}
+	check(validateNonNegative("tunnel.connection_timeout", t.ConnectionTimeout))
+	check(validateNonNegative("tunnel.idle_timeout", t.IdleTimeout))
+	check(validateNonNegative("tunnel.read_idle_timeout", t.ReadIdleTimeout))
+	check(validateNonNegative("tunnel.write_idle_timeout", t.WriteIdleTimeout))
+	check(validateNonNegative("tunnel.max_conn_lifetime", t.MaxConnLifetime))
+	check(validateNonNegative("tunnel.reconnect_delay", t.ReconnectDelay))
+	check(validateNonNegative("tunnel.stall_timeout", t.StallTimeout))
+	check(validateNonNegative("tunnel.per_client_grace", t.PerClientGrace))
+	check(validateNonNegative("tunnel.per_client_interval", t.PerClientInterval))
+	check(validateNonNegative("tunnel.per_client_jitter", t.PerClientJitter))
+	if t.FwMark < 0 || t.FwMark > math.MaxUint32 {
+		check(fmt.Errorf("tunnel.fwmark %d is out of range", t.FwMark))
+	}
+	if t.SNIFragment < 0 {
+		check(fmt.Errorf("tunnel.sni_fragment must not be negative"))
+	}
+	check(validateOneOf("tunnel.transport", t.Transport, "", "quic", "ws"))
+	if t.WSURL != "" {
+		if u, err := url.Parse(t.WSURL); err != nil || u.Host == "" {
+			check(fmt.Errorf("tunnel.ws_url %q is not a WebSocket URL", t.WSURL))
+		} else {
+			check(validateOneOf("tunnel.ws_url scheme", u.Scheme, "ws", "wss"))
+		}
+	} else if t.Transport == "ws" || t.WSFallbackAfter > 0 {
+		check(fmt.Errorf("tunnel.ws_url is required for the WebSocket transport"))
+	}
+	if t.ConnectURI != "" {
+		if u, err := url.Parse(t.ConnectURI); err != nil || u.Host == "" || u.Scheme != "https" {
+			check(fmt.Errorf("tunnel.connect_uri %q is not an https URL", t.ConnectURI))
+		}
+	}
+	if t.MaxReconnectAttempts < 0 {
+		check(fmt.Errorf("tunnel.max_reconnect_attempts must not be negative"))
+	}
+	if t.WSFallbackAfter < 0 {
+		check(fmt.Errorf("tunnel.ws_fallback_after must not be negative"))
+	}
+	if t.MaxPacketRate < 0 {
+		check(fmt.Errorf("tunnel.max_packet_rate must not be negative"))
+	}
+	if t.MaxBandwidthBps < 0 {
+		check(fmt.Errorf("tunnel.max_bandwidth_bps must not be negative"))
+	}
+
+	// 多账户
+	check(validateOneOf("accounts.balance", c.Accounts.Balance, "", "round_robin", "least_connections"))
+	if len(c.Accounts.Configs) > 0 && t.PerClient {
+		check(fmt.Errorf("accounts.configs is not supported with tunnel.per_client"))
+	}
+	if len(c.Accounts.Backups) > 0 && t.PerClient {
+		check(fmt.Errorf("accounts.backups is not supported with tunnel.per_client"))
+	}
+	if c.Accounts.RotateAfter < 0 {
+		check(fmt.Errorf("accounts.rotate_after must not be negative"))
+	}
+
+	// 日志
+	check(validateOneOf("logging.level", strings.ToLower(c.Logging.Level),
+		"", "panic", "fatal", "error", "warn", "warning", "info", "debug", "trace"))
+	check(validateOneOf("logging.format", c.Logging.Format, "", "text", "json"))
+	if c.Logging.PacketDumpBytes < 0 {
+		check(fmt.Errorf("logging.packet_dump_bytes must not be negative"))
+	}
+
+	if p := c.Registration.Proxy; p != "" {
+		if u, err := url.Parse(p); err != nil || u.Host == "" {
+			check(fmt.Errorf("registration.proxy %q is not a proxy URL", p))
+		} else {
+			check(validateOneOf("registration.proxy scheme", u.Scheme, "http", "https", "socks5", "socks5h"))
+		}
+	}
+
+	if p := c.Routing.Upstream; p != "" {
+		if u, err := url.Parse(p); err != nil || u.Host == "" {
+			check(fmt.Errorf("routing.upstream %q is not a proxy URL", p))
+		} else {
+			check(validateOneOf("routing.upstream scheme", u.Scheme, "http", "socks5", "socks5h"))
+		}
+	}
+
+	if c.Metrics.Address != "" {
+		check(validateHostPort("metrics.metrics_address", c.Metrics.Address))
+	}
+
+	if c.Metrics.HealthAddress != "" {
+		check(validateHostPort("metrics.health_address", c.Metrics.HealthAddress))
+	}
+	if addr := c.Metrics.PprofAddress; addr != "" {
+		if host, _, err := net.SplitHostPort(addr); err != nil {
+			check(fmt.Errorf("metrics.pprof_address %q is not a host:port address", addr))
+		} else if ip := net.ParseIP(host); host != "localhost" && (ip == nil || !ip.IsLoopback()) {
+			check(fmt.Errorf("metrics.pprof_address %q must be a loopback address", addr))
+		}
+	}
+
+	if len(errs) == 0 {
+		return nil
+	}
+	return errors.Join(errs...)
+}
+
+// validateEndpoint 检查端点是否为对应协议族的IP地址或主机名，为空时不检查
+func validateEndpoint(field, value string, v6 bool) error {
+	if value == "" {
+		return nil
+	}
+	if addr, err := netip.ParseAddr(value); err == nil {
+		if v6 && addr.Is4() {
+			return fmt.Errorf("%s %q is not an IPv6 address", field, value)
+		}
+		if !v6 && !addr.Is4() {
+			return fmt.Errorf("%s %q is not an IPv4 address", field, value)
+		}
+		return nil
+	}
+	// 全部由数字组成的值只可能是写错的IPv4地址
+	if strings.Trim(value, "0123456789.") == "" {
+		return fmt.Errorf("%s %q is not a valid IP address", field, value)
+	}
+	for _, label := range strings.Split(strings.TrimSuffix(value, "."), ".") {
+		if label == "" || strings.Trim(label, "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789-") != "" {
+			return fmt.Errorf("%s %q is neither an IP address nor a host name", field, value)
+		}
+	}
+	return nil
+}
+
+func validateAddr(field, value string) error {
+	if value == "" {
+		return fmt.Errorf("%s is required", field)
+	}
+	if _, err := netip.ParseAddr(value); err != nil {
+		return fmt.Errorf("%s %q is not an IP address", field, value)
+	}
+	return nil
+}
+
+// validatePort 检查端口号，为空时不检查
+func validatePort(field, value string) error {
+	if value == "" {
+		return nil
+	}
+	if n, err := strconv.Atoi(value); err != nil || n < 0 || n > 65535 {
+		return fmt.Errorf("%s %q is not a valid port", field, value)
+	}
+	return nil
+}
+
+func validateHostPort(field, value string) error {
+	_, port, err := net.SplitHostPort(value)
+	if err != nil {
+		return fmt.Errorf("%s %q is not a host:port address", field, value)
+	}
+	return validatePort(field, port)
+}
+
+// validateCIDRs 检查每一项是否为网段或单个IP地址
+func validateCIDRs(field string, values []string) error {
+	for _, v := range values {
+		v = strings.TrimSpace(v)
+		if _, err := netip.ParsePrefix(v); err == nil {
+			continue
+		}
+		if _, err := netip.ParseAddr(v); err != nil {
+			return fmt.Errorf("%s entry %q is neither a CIDR nor an IP address", field, v)
+		}
+	}
+	return nil
+}
+
+func validateNonNegative(field string, d Duration) error {
+	if d < 0 {
+		return fmt.Errorf("%s must not be negative", field)
+	}
+	return nil
+}
+
+func validateOneOf(field, value string, allowed ...string) error {
+	for _, a := range allowed {
+		if value == a {
+			return nil
+		}
+	}
+	var names []string
+	for _, a := range allowed {
+		if a != "" {
+			names = append(names, a)
+		}
+	}
+	return fmt.Errorf("%s %q must be one of %s", field, value, strings.Join(names, ", "))
+}
@@ -13,6 +13,9 @@ const (
 	KeyTypeMasque = "secp256r1"
 	TunTypeMasque = "masque"
 	DefaultLocale = "en_US"
+	// WireGuard peer of the Warp service, used only when exporting a WireGuard profile
+	WgPeerPublicKey = "bmXOC+F1FxEMF9dyiK2H5/1SUtzH0JuVo51h2wPfgyo="
+	WgPort          = 2408
 )
 
 var Headers = map[string]string{
@@ -0,0 +1,149 @@
+package control
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/HynoR/uscf/api"
+	"github.com/HynoR/uscf/internal/logger"
+)
+
+// ioTimeout bounds how long a single control request may take.
+const ioTimeout = 5 * time.Second
+
+// Handler answers a control command. The result is encoded as JSON.
+type Handler func() (any, error)
+
+// Server answers commands on a local Unix socket.
+// Each connection carries a single newline-terminated command and receives a single JSON reply.
+type Server struct {
+	handlers map[string]Handler
+}
+
+// NewServer creates a Server that reports the given tunnel statistics for the "status" command.
+func NewServer(stats *api.TunnelStats) *Server {
+	s := &Server{handlers: make(map[string]Handler)}
+	s.Handle("status", func() (any, error) {
+		return stats.Snapshot(), nil
+	})
+	return s
+}
+
+// ReconnectReply is the reply to the "reconnect" command.
+type ReconnectReply struct {
+	Tunnels int `json:"tunnels"` // number of tunnels asked to reconnect
+}
+
+// HandleReconnect registers the "reconnect" command, which asks each of tunnels to drop
+// its current connection and reconnect immediately.
+// It must not be called after Run.
+func (s *Server) HandleReconnect(tunnels ...*api.Reconnector) {
+	s.Handle("reconnect", func() (any, error) {
+		for _, r := range tunnels {
+			r.Reconnect()
+		}
+		logger.Logger.Infof("Reconnect of %d tunnel(s) requested via the control socket", len(tunnels))
+		return ReconnectReply{Tunnels: len(tunnels)}, nil
+	})
+}
+
+// Handle registers h for the named command, replacing any existing handler.
+// It must not be called after Run.
+func (s *Server) Handle(command string, h Handler) {
+	s.handlers[command] = h
+}
+
+// Run listens on the Unix socket at path until ctx is canceled.
+// A stale socket file left by a previous run is removed first.
+func (s *Server) Run(ctx context.Context, path string) error {
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to remove stale control socket: %w", err)
+	}
+
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return fmt.Errorf("failed to start control server: %w", err)
+	}
+	if err := os.Chmod(path, 0600); err != nil {
+		l.Close()
+		return fmt.Errorf("failed to set control socket permissions: %w", err)
+	}
+	logger.Logger.Infof("Control server listening on %s", path)
+
+	go func() {
+		<-ctx.Done()
+		l.Close()
+	}()
+
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return fmt.Errorf("control server stopped: %w", err)
+		}
+		go s.serve(conn)
+	}
+}
+
+func (s *Server) serve(conn net.Conn) {
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(ioTimeout))
+
+	line, err := bufio.NewReader(io.LimitReader(conn, 1024)).ReadString('\n')
+	if err != nil && line == "" {
+		logger.Logger.Debugf("Control request error: %v", err)
+		return
+	}
+	command := strings.TrimSpace(line)
+
+	var reply any
+	if h, ok := s.handlers[command]; !ok {
+		reply = errorReply{Error: fmt.Sprintf("unknown command %q", command)}
+	} else if result, err := h(); err != nil {
+		reply = errorReply{Error: err.Error()}
+	} else {
+		reply = result
+	}
+
+	if err := json.NewEncoder(conn).Encode(reply); err != nil {
+		logger.Logger.Debugf("Control reply error: %v", err)
+	}
+}
+
+type errorReply struct {
+	Error string `json:"error"`
+}
+
+// Query sends command to the control socket at path and returns the raw JSON reply.
+func Query(path, command string) (json.RawMessage, error) {
+	conn, err := net.DialTimeout("unix", path, ioTimeout)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to control socket: %w", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(ioTimeout))
+
+	if _, err := fmt.Fprintf(conn, "%s\n", command); err != nil {
+		return nil, err
+	}
+
+	var reply json.RawMessage
+	if err := json.NewDecoder(conn).Decode(&reply); err != nil {
+		return nil, fmt.Errorf("failed to read control reply: %w", err)
+	}
+
+	var e errorReply
+	if json.Unmarshal(reply, &e) == nil && e.Error != "" {
+		return nil, fmt.Errorf("control command failed: %s", e.Error)
+	}
+	return reply, nil
+}
@@ -6,31 +6,55 @@ import (
 	"os"
 
 	"github.com/sirupsen/logrus"
+	"gopkg.in/natefinch/lumberjack.v2"
 )
 
 var (
-	logFile *os.File
+	logFile *lumberjack.Logger
 	// Logger is the central logger used across the application.
 	Logger = logrus.New()
 )
 
-// Init configures the logger with the given output path and level.
-// If path is empty, logs are written only to stdout.
-func Init(path, level string) error {
+// Rotation controls size-based rotation of the log file.
+// Zero values use the lumberjack defaults: 100 MB per file, keep all backups forever.
+type Rotation struct {
+	MaxSizeMB  int
+	MaxBackups int
+	MaxAgeDays int
+	Compress   bool
+}
+
+// Init configures the logger with the given output path, level and format.
+// If path is empty, logs are written only to stdout. Format is either "text"
+// (the default) or "json". The log file is rotated according to rot.
+func Init(path, level, format string, rot Rotation) error {
 	var writers []io.Writer
 	if path != "" {
+		// Make sure the file can be opened so a bad path is reported at startup
 		f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
 		if err != nil {
 			return err
 		}
-		logFile = f
-		writers = append(writers, f)
+		f.Close()
+
+		logFile = &lumberjack.Logger{
+			Filename:   path,
+			MaxSize:    rot.MaxSizeMB,
+			MaxBackups: rot.MaxBackups,
+			MaxAge:     rot.MaxAgeDays,
+			Compress:   rot.Compress,
+		}
+		writers = append(writers, logFile)
 	}
 	writers = append(writers, os.Stdout)
 	mw := io.MultiWriter(writers...)
 
 	Logger.SetOutput(mw)
-	Logger.SetFormatter(&logrus.TextFormatter{FullTimestamp: true})
+	if format == "json" {
+		Logger.SetFormatter(&logrus.JSONFormatter{})
+	} else {
+		Logger.SetFormatter(&logrus.TextFormatter{FullTimestamp: true})
+	}
 
 	if lvl, err := logrus.ParseLevel(level); err == nil {
 		Logger.SetLevel(lvl)
@@ -43,6 +67,17 @@ func Init(path, level string) error {
 	return nil
 }
 
+// SetLevel parses level and applies it to Logger.
+// The current level is kept if level is invalid.
+func SetLevel(level string) error {
+	lvl, err := logrus.ParseLevel(level)
+	if err != nil {
+		return err
+	}
+	Logger.SetLevel(lvl)
+	return nil
+}
+
 // Close closes the log file if it was opened.
 func Close() {
 	if logFile != nil {
@@ -0,0 +1,58 @@
+package metrics
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/HynoR/uscf/api"
+	"github.com/HynoR/uscf/internal/logger"
+)
+
+// RunHealth serves health checks for the tunnel on addr until ctx is canceled.
+// /healthz answers 200 while the tunnel is connected and 503 otherwise; /readyz
+// answers 503 until the first successful handshake and 200 from then on.
+func RunHealth(ctx context.Context, addr string, stats *api.TunnelStats) error {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		writeHealth(w, stats.Connected(), "tunnel disconnected")
+	})
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		ready := false
+		select {
+		case <-stats.Ready():
+			ready = true
+		default:
+		}
+		writeHealth(w, ready, "tunnel not established yet")
+	})
+
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("failed to start health server: %w", err)
+	}
+	logger.Logger.Infof("Health server listening on %s", addr)
+
+	srv := &http.Server{Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+	go func() {
+		<-ctx.Done()
+		srv.Close()
+	}()
+
+	if err := srv.Serve(l); err != nil && err != http.ErrServerClosed {
+		return fmt.Errorf("health server stopped: %w", err)
+	}
+	return nil
+}
+
+func writeHealth(w http.ResponseWriter, ok bool, reason string) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	if !ok {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		fmt.Fprintln(w, reason)
+		return
+	}
+	fmt.Fprintln(w, "ok")
+}
@@ -0,0 +1,114 @@
+package metrics
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/HynoR/uscf/api"
+	"github.com/HynoR/uscf/internal/logger"
+)
+
+// Kind is the Prometheus metric type.
+type Kind string
+
+const (
+	Counter Kind = "counter"
+	Gauge   Kind = "gauge"
+)
+
+type metric struct {
+	name  string
+	help  string
+	kind  Kind
+	value func() float64
+}
+
+// Registry holds metrics and renders them in the Prometheus text exposition format.
+// Values are read lazily on every scrape, so callbacks should be cheap and concurrency-safe.
+type Registry struct {
+	mu      sync.RWMutex
+	metrics []metric
+}
+
+// NewRegistry creates an empty Registry.
+func NewRegistry() *Registry {
+	return &Registry{}
+}
+
+// Register adds a metric whose value is computed by value at scrape time.
+func (r *Registry) Register(name, help string, kind Kind, value func() float64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.metrics = append(r.metrics, metric{name: name, help: help, kind: kind, value: value})
+}
+
+// ServeHTTP implements http.Handler.
+func (r *Registry) ServeHTTP(w http.ResponseWriter, _ *http.Request) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	for _, m := range r.metrics {
+		fmt.Fprintf(w, "# HELP %s %s\n", m.name, m.help)
+		fmt.Fprintf(w, "# TYPE %s %s\n", m.name, m.kind)
+		fmt.Fprintf(w, "%s %s\n", m.name, strconv.FormatFloat(m.value(), 'g', -1, 64))
+	}
+}
+
+// RegisterTunnelStats registers counters and gauges backed by the live tunnel statistics.
+func RegisterTunnelStats(r *Registry, stats *api.TunnelStats) {
+	counter := func(name, help string, field func(api.StatsSnapshot) uint64) {
+		r.Register(name, help, Counter, func() float64 {
+			return float64(field(stats.Snapshot()))
+		})
+	}
+
+	counter("uscf_packets_in_total", "Packets received from the tunnel.", func(s api.StatsSnapshot) uint64 { return s.PacketsIn })
+	counter("uscf_packets_out_total", "Packets sent into the tunnel.", func(s api.StatsSnapshot) uint64 { return s.PacketsOut })
+	counter("uscf_bytes_in_total", "Bytes received from the tunnel.", func(s api.StatsSnapshot) uint64 { return s.BytesIn })
+	counter("uscf_bytes_out_total", "Bytes sent into the tunnel.", func(s api.StatsSnapshot) uint64 { return s.BytesOut })
+	counter("uscf_errors_total", "Tunnel errors.", func(s api.StatsSnapshot) uint64 { return s.Errors })
+	counter("uscf_handshakes_total", "Successful MASQUE handshakes.", func(s api.StatsSnapshot) uint64 { return s.HandShake })
+	counter("uscf_reconnects_total", "Tunnel reconnect attempts.", func(s api.StatsSnapshot) uint64 { return s.Reconnects })
+
+	r.Register("uscf_connected", "Whether the tunnel is currently connected (1) or not (0).", Gauge, func() float64 {
+		if stats.Connected() {
+			return 1
+		}
+		return 0
+	})
+	r.Register("uscf_handshake_seconds", "Duration of the most recent MASQUE connection setup.", Gauge, func() float64 {
+		return stats.Snapshot().HandshakeTime.Seconds()
+	})
+	r.Register("uscf_handshake_avg_seconds", "Moving average of the MASQUE connection setup duration.", Gauge, func() float64 {
+		return stats.Snapshot().AvgHandshakeTime.Seconds()
+	})
+}
+
+// Run serves the registry on addr under /metrics until ctx is canceled.
+func Run(ctx context.Context, addr string, r *Registry) error {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", r)
+
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("failed to start metrics server: %w", err)
+	}
+	logger.Logger.Infof("Metrics server listening on %s", addr)
+
+	srv := &http.Server{Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+	go func() {
+		<-ctx.Done()
+		srv.Close()
+	}()
+
+	if err := srv.Serve(l); err != nil && err != http.ErrServerClosed {
+		return fmt.Errorf("metrics server stopped: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,44 @@
+package metrics
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/pprof"
+	"time"
+
+	"github.com/HynoR/uscf/internal/logger"
+)
+
+// RunPprof serves the net/http/pprof handlers on addr until ctx is canceled.
+// Profiles expose internals of the process, so only loopback addresses are accepted.
+func RunPprof(ctx context.Context, addr string) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("failed to start pprof server: %w", err)
+	}
+	if tcpAddr, ok := l.Addr().(*net.TCPAddr); !ok || !tcpAddr.IP.IsLoopback() {
+		l.Close()
+		return fmt.Errorf("refusing to serve pprof on non-loopback address %s", l.Addr())
+	}
+	logger.Logger.Infof("pprof server listening on %s", l.Addr())
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+
+	srv := &http.Server{Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+	go func() {
+		<-ctx.Done()
+		srv.Close()
+	}()
+
+	if err := srv.Serve(l); err != nil && err != http.ErrServerClosed {
+		return fmt.Errorf("pprof server stopped: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,116 @@
+// Package pidfile manages a PID file that keeps two instances from running with
+// the same configuration.
+package pidfile
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/HynoR/uscf/internal/logger"
+)
+
+// takeoverTimeout bounds how long Acquire waits for a previous instance to exit.
+const takeoverTimeout = 10 * time.Second
+
+// ErrRunning is returned by Acquire when the PID file names a live process.
+var ErrRunning = errors.New("another instance is running")
+
+// Acquire writes the current PID to path and returns a function that removes it.
+// A file naming a process that no longer exists is replaced. If the process is
+// still alive, Acquire fails with ErrRunning, or with takeover asks that process
+// to exit and waits for it first.
+func Acquire(path string, takeover bool) (func(), error) {
+	for attempt := 0; attempt < 2; attempt++ {
+		f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+		if err == nil {
+			_, err = fmt.Fprintf(f, "%d\n", os.Getpid())
+			if cerr := f.Close(); err == nil {
+				err = cerr
+			}
+			if err != nil {
+				os.Remove(path)
+				return nil, fmt.Errorf("failed to write PID file: %w", err)
+			}
+			return func() { release(path) }, nil
+		}
+		if !os.IsExist(err) {
+			return nil, fmt.Errorf("failed to create PID file: %w", err)
+		}
+
+		pid, err := read(path)
+		if err == nil && pid != os.Getpid() && alive(pid) && isInstance(pid) {
+			if !takeover {
+				return nil, fmt.Errorf("%w with PID %d (%s)", ErrRunning, pid, path)
+			}
+			logger.Logger.Infof("Stopping previous instance with PID %d", pid)
+			if err := stop(pid); err != nil {
+				return nil, fmt.Errorf("failed to stop previous instance %d: %w", pid, err)
+			}
+		} else {
+			logger.Logger.Infof("Removing stale PID file %s", path)
+		}
+		// The previous instance may have removed the file itself on exit.
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return nil, fmt.Errorf("failed to remove stale PID file: %w", err)
+		}
+	}
+	return nil, fmt.Errorf("failed to create PID file %s: it keeps being recreated", path)
+}
+
+// isInstance reports whether pid runs the same program as the current process, judged
+// by the name of its executable. After a reboot the PID in a stale file may belong to
+// an unrelated process, which must be neither waited for nor stopped; a process whose
+// executable cannot be determined is treated the same way.
+func isInstance(pid int) bool {
+	self, err := os.Executable()
+	if err != nil {
+		return true
+	}
+	name, err := executableName(pid)
+	if err != nil {
+		logger.Logger.Debugf("Cannot determine the executable of PID %d: %v", pid, err)
+		return false
+	}
+	if !sameExecutable(filepath.Base(self), name) {
+		logger.Logger.Infof("PID %d belongs to %s, not this program", pid, name)
+		return false
+	}
+	return true
+}
+
+// stop asks pid to exit and waits until it is gone.
+func stop(pid int) error {
+	if err := terminate(pid); err != nil {
+		return err
+	}
+	deadline := time.Now().Add(takeoverTimeout)
+	for alive(pid) {
+		if time.Now().After(deadline) {
+			return fmt.Errorf("still running after %v", takeoverTimeout)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	return nil
+}
+
+// release removes the PID file if it still holds the current PID.
+func release(path string) {
+	if pid, err := read(path); err == nil && pid == os.Getpid() {
+		if err := os.Remove(path); err != nil {
+			logger.Logger.Warnf("Failed to remove PID file: %v", err)
+		}
+	}
+}
+
+func read(path string) (int, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(strings.TrimSpace(string(data)))
+}
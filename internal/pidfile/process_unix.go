@@ -0,0 +1,56 @@
+//go:build !windows
+
+package pidfile
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// alive reports whether a process with the given PID exists.
+func alive(pid int) bool {
+	err := syscall.Kill(pid, 0)
+	return err == nil || errors.Is(err, syscall.EPERM)
+}
+
+// terminate asks the process to shut down gracefully.
+func terminate(pid int) error {
+	return syscall.Kill(pid, syscall.SIGTERM)
+}
+
+// executableName returns the file name of the executable that pid runs. It reads
+// /proc where available and falls back to ps on systems without it.
+func executableName(pid int) (string, error) {
+	proc := "/proc/" + strconv.Itoa(pid)
+	// A binary replaced by an upgrade shows up as "<path> (deleted)".
+	if exe, err := os.Readlink(proc + "/exe"); err == nil {
+		return filepath.Base(strings.TrimSuffix(exe, " (deleted)")), nil
+	}
+	// cmdline stays readable for processes of other users, unlike exe.
+	if cmdline, err := os.ReadFile(proc + "/cmdline"); err == nil {
+		if argv0, _, _ := bytes.Cut(cmdline, []byte{0}); len(argv0) > 0 {
+			return filepath.Base(string(argv0)), nil
+		}
+	}
+	out, err := exec.Command("ps", "-p", strconv.Itoa(pid), "-o", "comm=").Output()
+	if err != nil {
+		return "", fmt.Errorf("ps: %w", err)
+	}
+	name := strings.TrimSpace(string(out))
+	if name == "" {
+		return "", fmt.Errorf("no such process")
+	}
+	return filepath.Base(name), nil
+}
+
+// sameExecutable reports whether two executable file names are the same.
+func sameExecutable(a, b string) bool {
+	return a == b
+}
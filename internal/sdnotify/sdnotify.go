@@ -0,0 +1,105 @@
+// Package sdnotify implements the systemd service notification protocol, so uscf
+// can run as a Type=notify unit with an optional watchdog.
+package sdnotify
+
+import (
+	"context"
+	"net"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/HynoR/uscf/api"
+	"github.com/HynoR/uscf/internal/logger"
+)
+
+// statusInterval is how often the tunnel state is checked for STATUS updates.
+// The watchdog is fed on the same ticks, so a shorter watchdog interval wins.
+const statusInterval = 5 * time.Second
+
+// Enabled reports whether the process was started by a service manager that
+// expects notifications.
+func Enabled() bool {
+	return os.Getenv("NOTIFY_SOCKET") != ""
+}
+
+// Notify sends state, e.g. "READY=1", to the service manager.
+// It is a no-op when NOTIFY_SOCKET is not set.
+func Notify(state string) error {
+	socket := os.Getenv("NOTIFY_SOCKET")
+	if socket == "" {
+		return nil
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	_, err = conn.Write([]byte(state))
+	return err
+}
+
+// WatchdogInterval returns how often WATCHDOG=1 should be sent, half the timeout
+// configured with WatchdogSec, or 0 when the watchdog is not enabled for this process.
+func WatchdogInterval() time.Duration {
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return 0
+	}
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return 0
+	}
+	return time.Duration(usec) * time.Microsecond / 2
+}
+
+// Run reports readiness once the tunnel has completed its first handshake, keeps
+// the watchdog fed and updates STATUS when the tunnel connects or disconnects.
+// STOPPING=1 is sent when ctx is canceled. It returns immediately when
+// NOTIFY_SOCKET is not set.
+func Run(ctx context.Context, stats *api.TunnelStats) {
+	if !Enabled() {
+		return
+	}
+	notify := func(state string) {
+		if err := Notify(state); err != nil {
+			logger.Logger.Warnf("Failed to notify service manager: %v", err)
+		}
+	}
+
+	watchdog := WatchdogInterval()
+	interval := statusInterval
+	if watchdog > 0 && watchdog < interval {
+		interval = watchdog
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	notify("STATUS=Connecting tunnel")
+	ready := stats.Ready()
+	connected := false
+	for {
+		select {
+		case <-ctx.Done():
+			notify("STOPPING=1")
+			return
+		case <-ready:
+			ready = nil
+			connected = true
+			notify("READY=1\nSTATUS=Tunnel connected")
+			continue
+		case <-ticker.C:
+		}
+
+		if watchdog > 0 {
+			notify("WATCHDOG=1")
+		}
+		if ready == nil && stats.Connected() != connected {
+			connected = !connected
+			if connected {
+				notify("STATUS=Tunnel connected")
+			} else {
+				notify("STATUS=Tunnel disconnected, reconnecting")
+			}
+		}
+	}
+}
@@ -8,8 +8,12 @@ import (
 	"encoding/base64"
 	"encoding/hex"
 	"errors"
+	"fmt"
 	"math/big"
 	"net"
+	"net/netip"
+	"os"
+	"path/filepath"
 	"regexp"
 	"strconv"
 	"strings"
@@ -121,12 +125,14 @@ func GenerateCert(privKey *ecdsa.PrivateKey, pubKey *ecdsa.PublicKey) ([][]byte,
 // DefaultQuicConfig returns a MASQUE compatible default QUIC configuration with specified keep-alive period and initial packet size.
 //
 // Parameters:
-//   - keepalivePeriod: time.Duration - The duration for sending QUIC keep-alive packets.
+//   - keepalivePeriod: time.Duration - The duration for sending QUIC keep-alive packets. Zero or negative disables keep-alives.
 //   - initialPacketSize: uint16 - The initial size of QUIC packets. (1242 seems used by the original implementation)
 //
 // Returns:
 //   - *quic.Config: A pointer to a configured QUIC configuration object.
 func DefaultQuicConfig(keepalivePeriod time.Duration, initialPacketSize uint16) *quic.Config {
+	// quic-go only disables keep-alives for exactly zero
+	keepalivePeriod = max(keepalivePeriod, 0)
 	return &quic.Config{
 		EnableDatagrams:   true,
 		InitialPacketSize: initialPacketSize,
@@ -229,6 +235,54 @@ func ParsePortMapping(port string) (PortMapping, error) {
 	}, nil
 }
 
+// Endpoint is a host and port parsed from an endpoint string.
+type Endpoint struct {
+	Host string // IP address without brackets, or host name
+	Port int    // 0 if the string has no port
+}
+
+// ParseEndpoint parses an endpoint such as those returned by the registration API.
+//
+// Accepted forms are `host:port`, `[ipv6]:port`, `[ipv6]`, a bare IPv6 address and a bare host.
+//
+// Parameters:
+//   - endpoint: string - The endpoint string.
+//
+// Returns:
+//   - Endpoint: The host and port of the endpoint.
+//   - error:    An error if the host or port is invalid.
+func ParseEndpoint(endpoint string) (Endpoint, error) {
+	endpoint = strings.TrimSpace(endpoint)
+	if endpoint == "" {
+		return Endpoint{}, errors.New("empty endpoint")
+	}
+
+	host, portStr, err := net.SplitHostPort(endpoint)
+	if err != nil {
+		// No port: "[ipv6]", a bare IPv6 address or a bare host
+		host, portStr = endpoint, ""
+		if strings.HasPrefix(host, "[") && strings.HasSuffix(host, "]") {
+			host = host[1 : len(host)-1]
+		}
+	}
+
+	var port int
+	if portStr != "" {
+		port, err = strconv.Atoi(portStr)
+		if err != nil || port < 0 || port > 65535 {
+			return Endpoint{}, errors.New("invalid port in endpoint " + strconv.Quote(endpoint))
+		}
+	}
+
+	if addr, err := netip.ParseAddr(host); err == nil {
+		return Endpoint{Host: addr.String(), Port: port}, nil
+	}
+	if !isValidHostname(host) {
+		return Endpoint{}, errors.New("invalid host in endpoint " + strconv.Quote(endpoint))
+	}
+	return Endpoint{Host: host, Port: port}, nil
+}
+
 // resolveBindAddress resolves a hostname or IP to its string representation.
 //
 // Parameters:
@@ -275,3 +329,31 @@ func isValidHostname(hostname string) bool {
 func LoginToBase64(username, password string) string {
 	return base64.StdEncoding.EncodeToString([]byte(username + ":" + password))
 }
+
+// WriteFileAtomic writes data to a temporary file in the directory of path and renames
+// it to path, so readers never see a partially written file.
+//
+// Parameters:
+//   - path: string - The file to create or replace.
+//   - data: []byte - The new contents of the file.
+//
+// Returns:
+//   - error: An error if the file cannot be written or replaced.
+func WriteFileAtomic(path string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return fmt.Errorf("failed to replace %s: %w", path, err)
+	}
+	return nil
+}
@@ -0,0 +1,39 @@
+package internal
+
+import "testing"
+
+func TestParseEndpoint(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    Endpoint
+		wantErr bool
+	}{
+		// Shapes seen in the peer endpoints of enrollment responses
+		{in: "162.159.198.1:0", want: Endpoint{Host: "162.159.198.1"}},
+		{in: "162.159.198.1:443", want: Endpoint{Host: "162.159.198.1", Port: 443}},
+		{in: "[2606:4700:103::1]:0", want: Endpoint{Host: "2606:4700:103::1"}},
+		{in: "[2606:4700:103::1]:443", want: Endpoint{Host: "2606:4700:103::1", Port: 443}},
+		{in: "162.159.198.1", want: Endpoint{Host: "162.159.198.1"}},
+		{in: "[2606:4700:103::1]", want: Endpoint{Host: "2606:4700:103::1"}},
+		{in: "2606:4700:103::1", want: Endpoint{Host: "2606:4700:103::1"}},
+		{in: "engage.cloudflareclient.com:2408", want: Endpoint{Host: "engage.cloudflareclient.com", Port: 2408}},
+		{in: " 162.159.198.1:443\n", want: Endpoint{Host: "162.159.198.1", Port: 443}},
+
+		{in: "", wantErr: true},
+		{in: "162.159.198.1:65536", wantErr: true},
+		{in: "162.159.198.1:port", wantErr: true},
+		{in: "bad host:443", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := ParseEndpoint(tt.in)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("ParseEndpoint(%q) = %+v, want error", tt.in, got)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("ParseEndpoint(%q) = %+v, %v, want %+v", tt.in, got, err, tt.want)
+		}
+	}
+}
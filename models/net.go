@@ -1,32 +1,118 @@
 package models
 
 import (
+	"errors"
 	"net"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
+// ErrMaxLifetimeExceeded 表示连接已超过 MaxLifetime 允许的总存活时间
+var ErrMaxLifetimeExceeded = errors.New("connection exceeded maximum lifetime")
+
 // 超时管理的连接包装器
+// ReadIdleTimeout 与 WriteIdleTimeout 为0时使用 IdleTimeout
+// MaxLifetime 从首次读写开始计算，为0时不限制
 type TimeoutConn struct {
 	net.Conn
-	IdleTimeout time.Duration
+	IdleTimeout      time.Duration
+	ReadIdleTimeout  time.Duration // 读空闲超时
+	WriteIdleTimeout time.Duration // 写空闲超时
+	MaxLifetime      time.Duration // 连接最长存活时间，与是否空闲无关
+
+	startOnce sync.Once
+	start     time.Time
+
+	bytesRead    atomic.Uint64
+	bytesWritten atomic.Uint64
 }
 
 func (c *TimeoutConn) Read(b []byte) (int, error) {
-	if c.IdleTimeout > 0 {
-		err := c.Conn.SetReadDeadline(time.Now().Add(c.IdleTimeout))
-		if err != nil {
+	deadline, err := c.deadline(c.readTimeout())
+	if err != nil {
+		return 0, err
+	}
+	if !deadline.IsZero() {
+		if err := c.Conn.SetReadDeadline(deadline); err != nil {
 			return 0, err
 		}
 	}
-	return c.Conn.Read(b)
+	n, err := c.Conn.Read(b)
+	c.bytesRead.Add(uint64(n))
+	return n, c.checkLifetime(err)
 }
 
 func (c *TimeoutConn) Write(b []byte) (int, error) {
-	if c.IdleTimeout > 0 {
-		err := c.Conn.SetWriteDeadline(time.Now().Add(c.IdleTimeout))
-		if err != nil {
+	deadline, err := c.deadline(c.writeTimeout())
+	if err != nil {
+		return 0, err
+	}
+	if !deadline.IsZero() {
+		if err := c.Conn.SetWriteDeadline(deadline); err != nil {
 			return 0, err
 		}
 	}
-	return c.Conn.Write(b)
+	n, err := c.Conn.Write(b)
+	c.bytesWritten.Add(uint64(n))
+	return n, c.checkLifetime(err)
+}
+
+// BytesRead 返回从连接读取的总字节数
+func (c *TimeoutConn) BytesRead() uint64 {
+	return c.bytesRead.Load()
+}
+
+// BytesWritten 返回写入连接的总字节数
+func (c *TimeoutConn) BytesWritten() uint64 {
+	return c.bytesWritten.Load()
+}
+
+func (c *TimeoutConn) readTimeout() time.Duration {
+	if c.ReadIdleTimeout > 0 {
+		return c.ReadIdleTimeout
+	}
+	return c.IdleTimeout
+}
+
+func (c *TimeoutConn) writeTimeout() time.Duration {
+	if c.WriteIdleTimeout > 0 {
+		return c.WriteIdleTimeout
+	}
+	return c.IdleTimeout
+}
+
+// deadline 计算下一次读写的截止时间，取空闲超时与剩余存活时间中较早者
+// 未设置任何超时时返回零值
+func (c *TimeoutConn) deadline(idle time.Duration) (time.Time, error) {
+	now := time.Now()
+
+	var deadline time.Time
+	if idle > 0 {
+		deadline = now.Add(idle)
+	}
+
+	if c.MaxLifetime > 0 {
+		c.startOnce.Do(func() { c.start = now })
+		end := c.start.Add(c.MaxLifetime)
+		if !now.Before(end) {
+			return time.Time{}, ErrMaxLifetimeExceeded
+		}
+		if deadline.IsZero() || end.Before(deadline) {
+			deadline = end
+		}
+	}
+	return deadline, nil
+}
+
+// checkLifetime 将因存活时间到期导致的超时错误转换为 ErrMaxLifetimeExceeded
+func (c *TimeoutConn) checkLifetime(err error) error {
+	if err == nil || c.MaxLifetime <= 0 {
+		return err
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() && !time.Now().Before(c.start.Add(c.MaxLifetime)) {
+		return ErrMaxLifetimeExceeded
+	}
+	return err
 }
@@ -0,0 +1,207 @@
+package httpproxy
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/HynoR/uscf/config"
+	"github.com/HynoR/uscf/internal/logger"
+	"github.com/HynoR/uscf/models"
+	"github.com/HynoR/uscf/service/tunnel"
+)
+
+// Access provides the client access settings shared with the SOCKS proxy, so that a
+// config reload applies to both proxies. *socks.Server implements it.
+type Access interface {
+	// Credentials returns the accepted user names and passwords, empty when no
+	// authentication is required. The map must not be modified.
+	Credentials() map[string]string
+	// PermitsClient reports whether the client filters accept connections from addr.
+	PermitsClient(addr net.Addr) bool
+	// TrackUser counts the traffic of conn towards the quota of user and closes conn once
+	// the quota is used up. It returns false without tracking conn when the quota is already
+	// used up; otherwise untrack must be called when conn is closed.
+	TrackUser(conn *models.TimeoutConn, user string) (untrack func(), ok bool)
+}
+
+// Run starts an HTTP proxy that tunnels CONNECT requests through dial.
+// Plain forward-proxy requests are rejected with 405.
+func Run(ctx context.Context, cfg *config.Config, access Access, dial tunnel.DialFunc, idleTimeout time.Duration) error {
+	bindAddr := net.JoinHostPort(cfg.Socks.BindAddress, cfg.Socks.HTTPPort)
+	logger.Logger.Infof("HTTP proxy listening on %s", bindAddr)
+
+	l, err := net.Listen("tcp", bindAddr)
+	if err != nil {
+		return fmt.Errorf("failed to start HTTP proxy: %w", err)
+	}
+
+	l = &filteredListener{Listener: l, access: access}
+
+	srv := &http.Server{
+		Handler: &handler{
+			access:      access,
+			dial:        dial,
+			idleTimeout: idleTimeout,
+		},
+		ReadHeaderTimeout: 30 * time.Second,
+		BaseContext:       func(net.Listener) context.Context { return ctx },
+	}
+
+	go func() {
+		<-ctx.Done()
+		srv.Close()
+	}()
+
+	if err := srv.Serve(l); err != nil && err != http.ErrServerClosed {
+		return fmt.Errorf("HTTP proxy stopped: %w", err)
+	}
+	return nil
+}
+
+// filteredListener closes connections from clients rejected by the client filters.
+type filteredListener struct {
+	net.Listener
+	access Access
+}
+
+func (l *filteredListener) Accept() (net.Conn, error) {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+		if l.access.PermitsClient(conn.RemoteAddr()) {
+			return conn, nil
+		}
+		logger.Logger.Debugf("Rejected HTTP proxy connection from %s", conn.RemoteAddr())
+		conn.Close()
+	}
+}
+
+type handler struct {
+	access      Access
+	dial        tunnel.DialFunc
+	idleTimeout time.Duration
+}
+
+func (h *handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	user, ok := h.authorized(r)
+	if !ok {
+		w.Header().Set("Proxy-Authenticate", `Basic realm="uscf"`)
+		http.Error(w, "proxy authentication required", http.StatusProxyAuthRequired)
+		return
+	}
+
+	if r.Method != http.MethodConnect {
+		http.Error(w, "only CONNECT is supported", http.StatusMethodNotAllowed)
+		return
+	}
+
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "hijacking not supported", http.StatusInternalServerError)
+		return
+	}
+	conn, rw, err := hj.Hijack()
+	if err != nil {
+		logger.Logger.Warnf("HTTP proxy failed to hijack connection: %v", err)
+		return
+	}
+	defer conn.Close()
+
+	client := &models.TimeoutConn{Conn: conn, IdleTimeout: h.idleTimeout}
+
+	// 与SOCKS连接一样计入用户的流量配额，配额用完的用户不再建立连接
+	if user != "" {
+		untrack, ok := h.access.TrackUser(client, user)
+		if !ok {
+			writeStatus(conn, http.StatusForbidden)
+			return
+		}
+		defer untrack()
+	}
+
+	target, err := h.dial(r.Context(), "tcp", r.Host)
+	if err != nil {
+		logger.Logger.Debugf("HTTP proxy failed to dial %s: %v", r.Host, err)
+		writeStatus(conn, http.StatusBadGateway)
+		return
+	}
+	defer target.Close()
+
+	if _, err := io.WriteString(conn, "HTTP/1.1 200 Connection Established\r\n\r\n"); err != nil {
+		return
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		// 先转发客户端在握手期间已缓冲的数据
+		if n := rw.Reader.Buffered(); n > 0 {
+			buffered, _ := rw.Reader.Peek(n)
+			if _, err := target.Write(buffered); err != nil {
+				target.Close()
+				return
+			}
+		}
+		io.Copy(target, client)
+		closeWrite(target)
+	}()
+	io.Copy(client, target)
+	closeWrite(conn)
+	wg.Wait()
+}
+
+// authorized checks the Proxy-Authorization header against the current credentials and
+// returns the authenticated user, which is empty when no authentication is required.
+func (h *handler) authorized(r *http.Request) (string, bool) {
+	credentials := h.access.Credentials()
+	if len(credentials) == 0 {
+		return "", true
+	}
+
+	auth := r.Header.Get("Proxy-Authorization")
+	const prefix = "Basic "
+	if len(auth) < len(prefix) || !strings.EqualFold(auth[:len(prefix)], prefix) {
+		return "", false
+	}
+	decoded, err := base64.StdEncoding.DecodeString(auth[len(prefix):])
+	if err != nil {
+		return "", false
+	}
+	user, pass, ok := strings.Cut(string(decoded), ":")
+	if !ok {
+		return "", false
+	}
+	want, ok := credentials[user]
+	if !ok {
+		return "", false
+	}
+	return user, subtle.ConstantTimeCompare([]byte(pass), []byte(want)) == 1
+}
+
+// writeStatus sends a response without a body on a hijacked connection.
+func writeStatus(conn net.Conn, code int) {
+	fmt.Fprintf(conn, "HTTP/1.1 %d %s\r\nContent-Length: 0\r\n\r\n", code, http.StatusText(code))
+}
+
+// closeWrite half-closes the connection if supported, otherwise closes it.
+func closeWrite(c net.Conn) {
+	if tc, ok := c.(*models.TimeoutConn); ok {
+		c = tc.Conn
+	}
+	if cw, ok := c.(interface{ CloseWrite() error }); ok {
+		cw.CloseWrite()
+		return
+	}
+	c.Close()
+}
@@ -0,0 +1,159 @@
+package httpproxy
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/HynoR/uscf/config"
+	"github.com/HynoR/uscf/service/socks"
+)
+
+// pipeDial connects every request to a destination that closes right away.
+func pipeDial(ctx context.Context, network, addr string) (net.Conn, error) {
+	client, server := net.Pipe()
+	server.Close()
+	return client, nil
+}
+
+func testConfig(user, pass string) *config.Config {
+	return &config.Config{
+		Socks:   config.SocksConfig{Username: user, Password: pass},
+		Tunnel:  config.GetDefaultTunnelConfig(),
+		Logging: config.GetDefaultLoggingConfig(),
+	}
+}
+
+// connect sends a CONNECT request with the given credentials and returns the status code.
+func connect(t *testing.T, addr, user, pass string) int {
+	t.Helper()
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	auth := base64.StdEncoding.EncodeToString([]byte(user + ":" + pass))
+	fmt.Fprintf(conn, "CONNECT example.com:443 HTTP/1.1\r\nHost: example.com:443\r\nProxy-Authorization: Basic %s\r\n\r\n", auth)
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	return resp.StatusCode
+}
+
+func TestReloadedCredentials(t *testing.T) {
+	srv := socks.New(testConfig("alice", "old"), pipeDial, time.Second, time.Minute)
+	ts := httptest.NewServer(&handler{access: srv, dial: pipeDial, idleTimeout: time.Minute})
+	defer ts.Close()
+	addr := ts.Listener.Addr().String()
+
+	if code := connect(t, addr, "alice", "old"); code != http.StatusOK {
+		t.Fatalf("CONNECT with the configured password: status %d, want 200", code)
+	}
+
+	srv.Reload(testConfig("alice", "new"))
+
+	if code := connect(t, addr, "alice", "old"); code != http.StatusProxyAuthRequired {
+		t.Errorf("CONNECT with the old password after reload: status %d, want 407", code)
+	}
+	if code := connect(t, addr, "alice", "new"); code != http.StatusOK {
+		t.Errorf("CONNECT with the new password after reload: status %d, want 200", code)
+	}
+}
+
+func TestClientFilter(t *testing.T) {
+	cfg := testConfig("", "")
+	cfg.Socks.DeniedCIDRs = []string{"127.0.0.1"}
+	srv := socks.New(cfg, pipeDial, time.Second, time.Minute)
+
+	ts := httptest.NewUnstartedServer(&handler{access: srv, dial: pipeDial, idleTimeout: time.Minute})
+	ts.Listener = &filteredListener{Listener: ts.Listener, access: srv}
+	ts.Start()
+	defer ts.Close()
+	addr := ts.Listener.Addr().String()
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	fmt.Fprintf(conn, "CONNECT example.com:443 HTTP/1.1\r\nHost: example.com:443\r\n\r\n")
+	if resp, err := http.ReadResponse(bufio.NewReader(conn), nil); err == nil {
+		resp.Body.Close()
+		t.Fatalf("denied client got status %d, want the connection closed", resp.StatusCode)
+	}
+
+	// Reloaded filters apply to the HTTP proxy as well.
+	srv.Reload(testConfig("", ""))
+	if code := connect(t, addr, "", ""); code != http.StatusOK {
+		t.Errorf("CONNECT after removing the deny rule: status %d, want 200", code)
+	}
+}
+
+// echoDial connects every request to a destination that echoes what it receives.
+func echoDial(ctx context.Context, network, addr string) (net.Conn, error) {
+	client, server := net.Pipe()
+	go func() {
+		io.Copy(server, server)
+		server.Close()
+	}()
+	return client, nil
+}
+
+func TestUserQuota(t *testing.T) {
+	cfg := testConfig("alice", "secret")
+	cfg.Socks.UserQuotas = map[string]int64{"alice": 100}
+	srv := socks.New(cfg, echoDial, time.Second, time.Minute)
+	ts := httptest.NewServer(&handler{access: srv, dial: echoDial, idleTimeout: time.Minute})
+	defer ts.Close()
+	addr := ts.Listener.Addr().String()
+
+	// Move more than the quota through one tunnel.
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	auth := base64.StdEncoding.EncodeToString([]byte("alice:secret"))
+	fmt.Fprintf(conn, "CONNECT example.com:443 HTTP/1.1\r\nHost: example.com:443\r\nProxy-Authorization: Basic %s\r\n\r\n", auth)
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("first CONNECT: status %d, want 200", resp.StatusCode)
+	}
+	payload := make([]byte, 200)
+	if _, err := conn.Write(payload); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadFull(br, payload); err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+
+	// The traffic is counted once the tunnel closes; later requests are refused.
+	deadline := time.Now().Add(time.Second)
+	for {
+		code := connect(t, addr, "alice", "secret")
+		if code == http.StatusForbidden {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("CONNECT after using up the quota: status %d, want 403", code)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
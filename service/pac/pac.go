@@ -0,0 +1,99 @@
+package pac
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/HynoR/uscf/config"
+	"github.com/HynoR/uscf/internal/logger"
+)
+
+// Run serves a proxy auto-config file at cfg.Socks.PACAddress until ctx is canceled.
+// The script is served at every path so browsers can point at the bare address.
+func Run(ctx context.Context, cfg *config.Config) error {
+	if len(cfg.Socks.Listeners) == 0 && cfg.Socks.Port == "" {
+		return fmt.Errorf("PAC server requires a TCP SOCKS listener")
+	}
+	h := &handler{socks: cfg.Socks, bypass: cfg.Socks.PACBypass}
+
+	l, err := net.Listen("tcp", cfg.Socks.PACAddress)
+	if err != nil {
+		return fmt.Errorf("failed to start PAC server: %w", err)
+	}
+	logger.Logger.Infof("PAC server listening on %s", cfg.Socks.PACAddress)
+
+	srv := &http.Server{Handler: h, ReadHeaderTimeout: 10 * time.Second}
+	go func() {
+		<-ctx.Done()
+		srv.Close()
+	}()
+
+	if err := srv.Serve(l); err != nil && err != http.ErrServerClosed {
+		return fmt.Errorf("PAC server stopped: %w", err)
+	}
+	return nil
+}
+
+type handler struct {
+	socks  config.SocksConfig
+	bypass []string
+}
+
+func (h *handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	// An unspecified bind address is not reachable as is, so fall back to the
+	// host the client used to fetch the PAC file.
+	requestHost := r.Host
+	if host, _, err := net.SplitHostPort(r.Host); err == nil {
+		requestHost = host
+	}
+
+	w.Header().Set("Content-Type", "application/x-ns-proxy-autoconfig")
+	w.Header().Set("Cache-Control", "no-cache")
+	fmt.Fprint(w, Script(h.socks, h.bypass, requestHost))
+}
+
+// Script returns a FindProxyForURL script that sends traffic to the SOCKS proxy,
+// then to the HTTP proxy when http_port is set. Hosts matching bypass, either
+// exactly or as a subdomain, go DIRECT. A leading "*." on a bypass entry is ignored.
+// fallbackHost replaces an empty or unspecified bind address.
+func Script(socks config.SocksConfig, bypass []string, fallbackHost string) string {
+	host, port := socks.BindAddress, socks.Port
+	if len(socks.Listeners) > 0 {
+		if h, p, err := net.SplitHostPort(socks.Listeners[0]); err == nil {
+			host, port = h, p
+		}
+	}
+	if ip := net.ParseIP(host); host == "" || ip != nil && ip.IsUnspecified() {
+		host = fallbackHost
+	}
+
+	socksAddr := net.JoinHostPort(host, port)
+	proxies := []string{"SOCKS5 " + socksAddr, "SOCKS " + socksAddr}
+	if socks.HTTPPort != "" {
+		proxies = append(proxies, "PROXY "+net.JoinHostPort(host, socks.HTTPPort))
+	}
+
+	var b strings.Builder
+	b.WriteString("function FindProxyForURL(url, host) {\n")
+	for _, domain := range bypass {
+		domain = strings.ToLower(strings.TrimPrefix(strings.TrimSpace(domain), "*."))
+		if domain == "" {
+			continue
+		}
+		fmt.Fprintf(&b, "  if (host == %s || dnsDomainIs(host, %s)) return \"DIRECT\";\n",
+			strconv.Quote(domain), strconv.Quote("."+domain))
+	}
+	fmt.Fprintf(&b, "  return %s;\n", strconv.Quote(strings.Join(proxies, "; ")))
+	b.WriteString("}\n")
+	return b.String()
+}
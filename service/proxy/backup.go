@@ -0,0 +1,118 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+
+	"github.com/HynoR/uscf/api"
+	"github.com/HynoR/uscf/config"
+	"github.com/HynoR/uscf/internal/logger"
+)
+
+// tunnelSlot holds the tunnel of one account. When the server keeps rejecting the
+// account's identity, the tunnel is replaced by one for a backup account, which
+// continues the same statistics and reconnector.
+type tunnelSlot struct {
+	stats     *api.TunnelStats
+	reconnect *api.Reconnector
+
+	mu     sync.Mutex
+	tunnel *sharedTunnel
+	closed bool
+}
+
+// newTunnelSlot returns an empty slot; the caller sets its first tunnel before sharing it.
+func newTunnelSlot() *tunnelSlot {
+	return &tunnelSlot{stats: &api.TunnelStats{}, reconnect: api.NewReconnector()}
+}
+
+// get returns the current tunnel of the slot.
+func (s *tunnelSlot) get() *sharedTunnel {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.tunnel
+}
+
+// replace makes t the tunnel of the slot and stops the previous one. It returns false
+// without taking t when the slot has been closed.
+func (s *tunnelSlot) replace(t *sharedTunnel) bool {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return false
+	}
+	old := s.tunnel
+	s.tunnel = t
+	s.mu.Unlock()
+	old.close()
+	return true
+}
+
+// close stops the current tunnel; later replacements are refused.
+func (s *tunnelSlot) close() {
+	s.mu.Lock()
+	s.closed = true
+	t := s.tunnel
+	s.mu.Unlock()
+	t.close()
+}
+
+// dial dials through the current tunnel of the slot.
+func (s *tunnelSlot) dial(ctx context.Context, network, addr string) (net.Conn, error) {
+	return s.get().netTun.DialContext(ctx, network, addr)
+}
+
+// backupAccounts hands out the accounts from accounts.backups in order, each at most once.
+type backupAccounts struct {
+	mu       sync.Mutex
+	accounts []config.Config
+}
+
+// next returns the next unused backup account, or false when none is left.
+func (b *backupAccounts) next() (*config.Config, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if len(b.accounts) == 0 {
+		return nil, false
+	}
+	acct := &b.accounts[0]
+	b.accounts = b.accounts[1:]
+	return acct, true
+}
+
+// watchSlot waits for the tunnel of slot to stop. When its identity was rejected it
+// switches the slot to the next backup account that starts, otherwise, and when no
+// backup is left, it hands the error to giveUp.
+func (s *Service) watchSlot(ctx context.Context, slot *tunnelSlot, backups *backupAccounts, maxRejections int, giveUp context.CancelCauseFunc) {
+	for {
+		err := <-slot.get().done
+		if err == nil {
+			return
+		}
+		if !errors.Is(err, api.ErrIdentityRejected) {
+			giveUp(err)
+			return
+		}
+		for {
+			acct, ok := backups.next()
+			if !ok {
+				giveUp(fmt.Errorf("no backup account left: %w", err))
+				return
+			}
+			logger.Logger.Warnf("Switching to backup account %s", acct.ID)
+			t, startErr := s.startAccount(ctx, acct, slot, maxRejections)
+			if startErr != nil {
+				logger.Logger.Errorf("Failed to start backup account %s: %v", acct.ID, startErr)
+				continue
+			}
+			if !slot.replace(t) {
+				t.close()
+				return
+			}
+			break
+		}
+	}
+}
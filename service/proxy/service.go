@@ -2,15 +2,37 @@ package proxy
 
 import (
 	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"reflect"
+	"slices"
+	"sync"
+	"time"
 
+	"github.com/HynoR/uscf/api"
 	"github.com/HynoR/uscf/config"
+	"github.com/HynoR/uscf/internal/control"
+	"github.com/HynoR/uscf/internal/logger"
+	"github.com/HynoR/uscf/internal/metrics"
+	"github.com/HynoR/uscf/internal/sdnotify"
+	"github.com/HynoR/uscf/service/httpproxy"
+	"github.com/HynoR/uscf/service/pac"
 	"github.com/HynoR/uscf/service/socks"
 	"github.com/HynoR/uscf/service/tunnel"
+	"golang.zx2c4.com/wireguard/tun/netstack"
 )
 
 // Service coordinates the SOCKS proxy and MASQUE tunnel.
 type Service struct {
 	Tunnel tunnel.Manager
+
+	mu      sync.Mutex
+	current config.Config
+	socks   *socks.Server
+	stats   *api.TunnelStats
 }
 
 // New creates a Service with the given tunnel manager.
@@ -32,16 +54,317 @@ func (s *Service) Run(ctx context.Context, cfg *config.Config) error {
 
 	connTimeout, idleTimeout := tunnel.TimeoutSettings(cfg)
 
+	s.mu.Lock()
+	s.current = *cfg
+	s.mu.Unlock()
+	// 探测得到的MTU只用于本次运行，s.current 保留配置中的 auto 以便比较重新加载的配置
+	cfg = tunnel.ResolveMTU(ctx, tlsCfg, endpoint, cfg)
+
+	registry := metrics.NewRegistry()
+	if cfg.Metrics.Address != "" {
+		go func() {
+			if err := metrics.Run(ctx, cfg.Metrics.Address, registry); err != nil {
+				logger.Logger.Errorf("%v", err)
+			}
+		}()
+	}
+
+	if cfg.Metrics.PprofAddress != "" {
+		go func() {
+			if err := metrics.RunPprof(ctx, cfg.Metrics.PprofAddress); err != nil {
+				logger.Logger.Errorf("%v", err)
+			}
+		}()
+	}
+	if cfg.Socks.PACAddress != "" {
+		go func() {
+			if err := pac.Run(ctx, cfg); err != nil {
+				logger.Logger.Errorf("%v", err)
+			}
+		}()
+	}
+
 	if cfg.Tunnel.PerClient {
-		return socks.Run(ctx, cfg, nil, connTimeout, idleTimeout)
+		if cfg.Socks.HTTPPort != "" {
+			logger.Logger.Warn("HTTP proxy is not supported in per-client mode, ignoring http_port")
+		}
+		if cfg.Control.SocketPath != "" {
+			logger.Logger.Warn("Control socket is not supported in per-client mode, ignoring socket_path")
+		}
+		if cfg.Metrics.HealthAddress != "" {
+			logger.Logger.Warn("Health checks are not supported in per-client mode, ignoring health_address")
+		}
+		if cfg.Tunnel.StatsFile != "" {
+			logger.Logger.Warn("The stats file is not supported in per-client mode, ignoring stats_file")
+		}
+		srv := s.newSocks(cfg, nil, connTimeout, idleTimeout)
+		registry.Register("uscf_client_tunnels", "Live per-client tunnels.", metrics.Gauge, func() float64 {
+			return float64(srv.ClientTunnels())
+		})
+		// 单客户端模式在有客户端连接前不建立隧道，启动后即视为就绪
+		if err := sdnotify.Notify("READY=1\nSTATUS=Waiting for clients"); err != nil {
+			logger.Logger.Warnf("Failed to notify service manager: %v", err)
+		}
+		return srv.Run(ctx)
 	}
 
-	dev, netTun, err := tunnel.CreateTun(locals, dnsAddrs, cfg)
+	accounts, err := config.ReadAccounts(cfg.Accounts.Configs)
 	if err != nil {
 		return err
 	}
-	defer dev.Close()
+	backupConfigs, err := config.ReadAccounts(cfg.Accounts.Backups)
+	if err != nil {
+		return err
+	}
+	backups := &backupAccounts{accounts: backupConfigs}
+	maxRejections := cfg.Accounts.RotateThreshold()
+
+	primary := newTunnelSlot()
+	if primary.tunnel, err = s.startShared(ctx, cfg, tlsCfg, endpoint, locals, dnsAddrs, primary, maxRejections); err != nil {
+		return err
+	}
+	defer primary.close()
+	slots := []*tunnelSlot{primary}
+	for i := range accounts {
+		acct := &accounts[i]
+		if acct.ID == cfg.ID {
+			logger.Logger.Warnf("Skipping account config for device %s, it is the main config's device", acct.ID)
+			continue
+		}
+		slot := newTunnelSlot()
+		if slot.tunnel, err = s.startAccount(ctx, acct, slot, maxRejections); err != nil {
+			return fmt.Errorf("account %s: %w", acct.ID, err)
+		}
+		defer slot.close()
+		slots = append(slots, slot)
+	}
+
+	// 任一隧道放弃重连或没有备用账户可换时停止代理，Run 返回隧道的错误
+	ctx, giveUp := context.WithCancelCause(ctx)
+	defer giveUp(nil)
+	for _, slot := range slots {
+		go s.watchSlot(ctx, slot, backups, maxRejections, giveUp)
+	}
+
+	tunDial := tunnel.NewDialer(primary.tunnel.netTun, connTimeout, idleTimeout)
+	if len(slots) > 1 || len(backupConfigs) > 0 {
+		// 隧道可能换用备用账户，连接总是通过账户位置上当前的隧道建立
+		members := make([]tunnel.Member, len(slots))
+		for i, slot := range slots {
+			members[i] = tunnel.Member{Dial: slot.dial, Stats: slot.stats}
+		}
+		tunDial = tunnel.NewBalancedDialer(members, cfg.Accounts.Balance, connTimeout, idleTimeout)
+		if len(slots) > 1 {
+			logger.Logger.Infof("Spreading connections across %d accounts", len(slots))
+		}
+	}
+
+	// 状态、指标与健康检查只反映主账户位置的隧道，换用备用账户后继续累计
+	stats := primary.stats
+	reconnectors := make([]*api.Reconnector, len(slots))
+	for i, slot := range slots {
+		reconnectors[i] = slot.reconnect
+	}
+	metrics.RegisterTunnelStats(registry, stats)
+	s.mu.Lock()
+	s.stats = stats
+	s.mu.Unlock()
+	go sdnotify.Run(ctx, stats)
+	if cfg.Metrics.HealthAddress != "" {
+		go func() {
+			if err := metrics.RunHealth(ctx, cfg.Metrics.HealthAddress, stats); err != nil {
+				logger.Logger.Errorf("%v", err)
+			}
+		}()
+	}
+	if cfg.Control.SocketPath != "" {
+		go func() {
+			srv := control.NewServer(stats)
+			srv.HandleReconnect(reconnectors...)
+			if err := srv.Run(ctx, cfg.Control.SocketPath); err != nil {
+				logger.Logger.Errorf("%v", err)
+			}
+		}()
+	}
+
+	socksSrv := s.newSocks(cfg, tunDial, connTimeout, idleTimeout)
+	if cfg.Socks.HTTPPort == "" {
+		return tunnelFailure(ctx, socksSrv.Run(ctx))
+	}
+
+	// 同时运行SOCKS与HTTP代理，任意一个退出时关闭另一个
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	errCh := make(chan error, 2)
+	go func() {
+		errCh <- socksSrv.Run(ctx)
+	}()
+	go func() {
+		router := tunnel.NewRouter(cfg.Routing, connTimeout, idleTimeout)
+		upstream := tunnel.NewUpstream(cfg.Routing)
+		dial := router.Wrap(upstream.Wrap(tunDial))
+		errCh <- httpproxy.Run(ctx, cfg, socksSrv, dial, idleTimeout)
+	}()
+
+	err = <-errCh
+	cancel()
+	if err2 := <-errCh; err == nil {
+		err = err2
+	}
+	return tunnelFailure(ctx, err)
+}
+
+// tunnelFailure returns the error of a tunnel that gave up reconnecting, or whose
+// identity was rejected with no backup account left, in place of err,
+// as the proxies stop without an error when the tunnel cancels ctx.
+func tunnelFailure(ctx context.Context, err error) error {
+	if cause := context.Cause(ctx); errors.Is(cause, api.ErrReconnectLimit) || errors.Is(cause, api.ErrIdentityRejected) {
+		return cause
+	}
+	return err
+}
+
+// Stats returns the live statistics of the shared tunnel, or nil before the tunnel
+// is started and in per-client mode.
+func (s *Service) Stats() *api.TunnelStats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.stats
+}
+
+// sharedTunnel is the tunnel of one account, shared by all SOCKS connections routed to it.
+type sharedTunnel struct {
+	netTun *netstack.Net
+	stats  *api.TunnelStats
+	done   <-chan error
+	close  func()
+}
+
+// startShared creates the network stack for cfg and starts its tunnel for slot, recording
+// into the slot's statistics and taking reconnect requests from its reconnector. The
+// tunnel stops with api.ErrIdentityRejected after maxRejections rejections in a row.
+// It outlives ctx so that it can serve draining SOCKS connections; close stops it and
+// releases the device.
+func (s *Service) startShared(ctx context.Context, cfg *config.Config, tlsCfg *tls.Config, endpoint *net.UDPAddr, locals, dnsAddrs []netip.Addr, slot *tunnelSlot, maxRejections int) (*sharedTunnel, error) {
+	dev, netTun, err := tunnel.CreateTun(locals, dnsAddrs, cfg)
+	if err != nil {
+		return nil, err
+	}
+	conf := tunnel.NewConnectionConfig(tlsCfg, endpoint, cfg)
+	conf.Stats = slot.stats
+	conf.Reconnector = slot.reconnect
+	conf.MaxRejections = maxRejections
+	tunnelCtx, stop := context.WithCancel(context.WithoutCancel(ctx))
+	_, done := tunnel.StartTunnelWithConfig(tunnelCtx, s.Tunnel, conf, dev)
+	return &sharedTunnel{netTun: netTun, stats: slot.stats, done: done, close: func() {
+		stop()
+		tunnel.WaitStopped(done)
+		dev.Close()
+	}}, nil
+}
+
+// startAccount starts the tunnel of an account from accounts.configs or accounts.backups,
+// using the identity and tunnel settings of its config.
+func (s *Service) startAccount(ctx context.Context, acct *config.Config, slot *tunnelSlot, maxRejections int) (*sharedTunnel, error) {
+	tlsCfg, err := tunnel.PrepareTLSConfig(acct)
+	if err != nil {
+		return nil, err
+	}
+	endpoint, locals, dnsAddrs, err := tunnel.PrepareNetworkConfig(acct)
+	if err != nil {
+		return nil, err
+	}
+	// 统计文件只反映主账户，避免多个隧道写入同一个文件
+	acct.Tunnel.StatsFile = ""
+	acct = tunnel.ResolveMTU(ctx, tlsCfg, endpoint, acct)
+	return s.startShared(ctx, acct, tlsCfg, endpoint, locals, dnsAddrs, slot, maxRejections)
+}
+
+// newSocks creates the SOCKS server and keeps a handle to it for live reloads.
+func (s *Service) newSocks(cfg *config.Config, tunDial tunnel.DialFunc, connTimeout, idleTimeout time.Duration) *socks.Server {
+	srv := socks.New(cfg, tunDial, connTimeout, idleTimeout)
+	s.mu.Lock()
+	s.socks = srv
+	s.mu.Unlock()
+	return srv
+}
+
+// Reload applies the settings from cfg that are safe to change without tearing down
+// the tunnel: proxy credentials (shared by the SOCKS and HTTP proxies), client filters and shutdown timeout, DNS servers and
+// blocklist, the log level and the access log switch.
+// Other changes are reported as requiring a restart and ignored.
+func (s *Service) Reload(cfg *config.Config) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, name := range restartRequired(&s.current, cfg) {
+		logger.Logger.Warnf("Config change to %s requires restart, ignoring", name)
+	}
+
+	if cfg.Logging.Level != s.current.Logging.Level {
+		if err := logger.SetLevel(cfg.Logging.Level); err != nil {
+			logger.Logger.Warnf("Invalid log level %q: %v", cfg.Logging.Level, err)
+		} else {
+			logger.Logger.Infof("Log level set to %s", cfg.Logging.Level)
+		}
+	}
+
+	if s.socks != nil {
+		s.socks.Reload(cfg)
+	}
+
+	s.current.Socks.Username = cfg.Socks.Username
+	s.current.Socks.Password = cfg.Socks.Password
+	s.current.Socks.Users = cfg.Socks.Users
+	s.current.Socks.AllowedCIDRs = cfg.Socks.AllowedCIDRs
+	s.current.Socks.DeniedCIDRs = cfg.Socks.DeniedCIDRs
+	s.current.Socks.UserQuotas = cfg.Socks.UserQuotas
+	s.current.Tunnel.SetResolver(cfg.Tunnel.Resolver())
+	s.current.Socks.ShutdownTimeout = cfg.Socks.ShutdownTimeout
+	s.current.Logging.Level = cfg.Logging.Level
+	s.current.Logging.AccessLog = cfg.Logging.AccessLog
+}
+
+// restartRequired returns the names of changed settings that cannot be applied live.
+func restartRequired(old, cfg *config.Config) []string {
+	var changed []string
+	check := func(name string, differs bool) {
+		if differs {
+			changed = append(changed, name)
+		}
+	}
+
+	check("endpoint", old.EndpointV4 != cfg.EndpointV4 || old.EndpointV6 != cfg.EndpointV6)
+	check("keys", old.PrivateKey != cfg.PrivateKey || old.EndpointPubKey != cfg.EndpointPubKey)
+	check("tunnel addresses", old.IPv4 != cfg.IPv4 || old.IPv6 != cfg.IPv6)
+	check("mtu", old.Tunnel.MTU != cfg.Tunnel.MTU)
+
+	oldTunnel, newTunnel := old.Tunnel, cfg.Tunnel
+	oldTunnel.SetResolver(config.ResolverSettings{})
+	newTunnel.SetResolver(config.ResolverSettings{})
+	oldTunnel.MTU, newTunnel.MTU = 0, 0
+	check("tunnel settings", !reflect.DeepEqual(oldTunnel, newTunnel))
+
+	check("listen address", old.Socks.BindAddress != cfg.Socks.BindAddress ||
+		old.Socks.Port != cfg.Socks.Port || old.Socks.HTTPPort != cfg.Socks.HTTPPort ||
+		old.Socks.UnixSocket != cfg.Socks.UnixSocket || old.Socks.UnixSocketMode != cfg.Socks.UnixSocketMode ||
+		old.Socks.TLSCert != cfg.Socks.TLSCert || old.Socks.TLSKey != cfg.Socks.TLSKey ||
+		!slices.Equal(old.Socks.Listeners, cfg.Socks.Listeners))
 
-	tunnel.StartTunnel(ctx, s.Tunnel, tlsCfg, endpoint, cfg, dev)
-	return socks.Run(ctx, cfg, netTun, connTimeout, idleTimeout)
+	oldLogging, newLogging := old.Logging, cfg.Logging
+	oldLogging.Level, newLogging.Level = "", ""
+	oldLogging.AccessLog, newLogging.AccessLog = false, false
+	check("log output", oldLogging != newLogging)
+	check("routing", !slices.Equal(old.Routing.Rules, cfg.Routing.Rules) || old.Routing.Invert != cfg.Routing.Invert ||
+		old.Routing.Upstream != cfg.Routing.Upstream || !slices.Equal(old.Routing.UpstreamRules, cfg.Routing.UpstreamRules))
+	check("connection limit", old.Socks.MaxConnections != cfg.Socks.MaxConnections || old.Socks.ConnLimitMode != cfg.Socks.ConnLimitMode)
+	check("user quota", old.Socks.QuotaFile != cfg.Socks.QuotaFile || old.Socks.QuotaPeriod != cfg.Socks.QuotaPeriod)
+	check("pac", old.Socks.PACAddress != cfg.Socks.PACAddress || !slices.Equal(old.Socks.PACBypass, cfg.Socks.PACBypass))
+	check("metrics", old.Metrics != cfg.Metrics)
+	check("control socket", old.Control != cfg.Control)
+	check("pid file", old.PIDFile != cfg.PIDFile || old.PIDFileTakeover != cfg.PIDFileTakeover)
+	check("accounts", !slices.Equal(old.Accounts.Configs, cfg.Accounts.Configs) || old.Accounts.Balance != cfg.Accounts.Balance ||
+		!slices.Equal(old.Accounts.Backups, cfg.Accounts.Backups) || old.Accounts.RotateAfter != cfg.Accounts.RotateAfter)
+	return changed
 }
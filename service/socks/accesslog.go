@@ -0,0 +1,99 @@
+package socks
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/HynoR/uscf/internal/logger"
+	"github.com/HynoR/uscf/models"
+	"github.com/sirupsen/logrus"
+	"github.com/things-go/go-socks5"
+	"github.com/things-go/go-socks5/statute"
+)
+
+// accessTarget 是客户端请求的目标地址
+type accessTarget struct {
+	command string
+	user    string // 通过认证的用户名，未认证时为空
+	host    string // 客户端请求的域名或IP
+	ip      net.IP // 实际连接的IP
+	port    int
+}
+
+// targetRecorder 以客户端地址为键记录每个连接请求的目标，连接关闭时取出用于访问日志
+// 同时实现 socks5.RuleSet，在SOCKS5请求通过规则检查时记录目标，且不拒绝任何请求
+type targetRecorder struct {
+	targets sync.Map // map[string]accessTarget
+}
+
+// Allow 实现 socks5.RuleSet
+func (t *targetRecorder) Allow(ctx context.Context, req *socks5.Request) (context.Context, bool) {
+	if req.RemoteAddr == nil {
+		return ctx, true
+	}
+	target := accessTarget{command: commandName(req.Command)}
+	if req.AuthContext != nil {
+		target.user = req.AuthContext.Payload["username"]
+	}
+	if req.RawDestAddr != nil {
+		target.host = req.RawDestAddr.FQDN
+		if target.host == "" {
+			target.host = req.RawDestAddr.IP.String()
+		}
+	}
+	if req.DestAddr != nil {
+		target.ip = req.DestAddr.IP
+		target.port = req.DestAddr.Port
+	}
+	t.record(req.RemoteAddr, target)
+	return ctx, true
+}
+
+func (t *targetRecorder) record(client net.Addr, target accessTarget) {
+	t.targets.Store(client.String(), target)
+}
+
+// take 取出并删除客户端连接的目标记录
+func (t *targetRecorder) take(client net.Addr) (accessTarget, bool) {
+	v, ok := t.targets.LoadAndDelete(client.String())
+	if !ok {
+		return accessTarget{}, false
+	}
+	return v.(accessTarget), true
+}
+
+func commandName(cmd byte) string {
+	switch cmd {
+	case statute.CommandConnect:
+		return "connect"
+	case statute.CommandBind:
+		return "bind"
+	case statute.CommandAssociate:
+		return "associate"
+	}
+	return strconv.Itoa(int(cmd))
+}
+
+// logAccess 输出一条访问日志，记录客户端到目标的映射、流量与持续时间
+func logAccess(conn *models.TimeoutConn, target accessTarget, ok bool, start time.Time) {
+	fields := logrus.Fields{
+		"client":    conn.RemoteAddr().String(),
+		"bytes_in":  conn.BytesRead(),
+		"bytes_out": conn.BytesWritten(),
+		"duration":  time.Since(start).Round(time.Millisecond).String(),
+	}
+	if ok {
+		fields["command"] = target.command
+		if target.user != "" {
+			fields["user"] = target.user
+		}
+		fields["destination"] = net.JoinHostPort(target.host, strconv.Itoa(target.port))
+		if target.ip != nil {
+			fields["resolved_ip"] = target.ip.String()
+		}
+	}
+	logger.Logger.WithFields(fields).Info("SOCKS access")
+}
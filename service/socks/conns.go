@@ -0,0 +1,141 @@
+package socks
+
+import (
+	"context"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/HynoR/uscf/internal/logger"
+)
+
+// connTracker 记录正在服务的客户端连接，关闭时用于等待连接结束或强制断开
+type connTracker struct {
+	wg    sync.WaitGroup
+	mu    sync.Mutex
+	conns map[net.Conn]struct{}
+}
+
+func (t *connTracker) add(conn net.Conn) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.conns == nil {
+		t.conns = make(map[net.Conn]struct{})
+	}
+	t.conns[conn] = struct{}{}
+	t.wg.Add(1)
+}
+
+func (t *connTracker) done(conn net.Conn) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if _, ok := t.conns[conn]; ok {
+		delete(t.conns, conn)
+		t.wg.Done()
+	}
+}
+
+// closeWait 是强制关闭连接后等待其处理结束的最长时间，处理结束时连接的流量才计入用户统计
+const closeWait = 2 * time.Second
+
+// drain 等待所有连接结束，超过 timeout 后关闭仍未结束的连接，并在 closeWait 内等待其处理结束
+// timeout 为0时不等待，直接关闭所有连接
+func (t *connTracker) drain(timeout time.Duration) {
+	t.mu.Lock()
+	n := len(t.conns)
+	t.mu.Unlock()
+	if n == 0 {
+		return
+	}
+
+	if timeout > 0 {
+		logger.Logger.Infof("Waiting up to %v for %d SOCKS connection(s) to finish", timeout, n)
+		if t.wait(timeout) {
+			return
+		}
+	}
+
+	t.mu.Lock()
+	if len(t.conns) > 0 {
+		logger.Logger.Warnf("Closing %d SOCKS connection(s) still active at shutdown", len(t.conns))
+	}
+	for conn := range t.conns {
+		conn.Close()
+	}
+	t.mu.Unlock()
+
+	if !t.wait(closeWait) {
+		logger.Logger.Warnf("SOCKS connection(s) still being handled %v after closing them", closeWait)
+	}
+}
+
+// wait 等待所有连接的处理结束，超过 timeout 时返回 false
+func (t *connTracker) wait(timeout time.Duration) bool {
+	done := make(chan struct{})
+	go func() {
+		t.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
+
+// connLimiter 限制同时服务的连接数，达到上限时拒绝新连接或等待空位
+type connLimiter struct {
+	sem    chan struct{}
+	wait   bool
+	active atomic.Int64
+}
+
+// newConnLimiter 创建连接数限制，max 不大于0时返回 nil 表示不限制
+// mode 为 wait 时等待空位，为空或 reject 时拒绝新连接
+func newConnLimiter(max int, mode string) *connLimiter {
+	if max <= 0 {
+		return nil
+	}
+	l := &connLimiter{sem: make(chan struct{}, max)}
+	switch mode {
+	case "", "reject":
+	case "wait":
+		l.wait = true
+	default:
+		logger.Logger.Warnf("Unknown connection limit mode %q, rejecting connections over the limit", mode)
+	}
+	return l
+}
+
+// acquire 占用一个连接名额，拒绝或 ctx 取消时返回 false
+func (l *connLimiter) acquire(ctx context.Context) bool {
+	if l == nil {
+		return true
+	}
+	if l.wait {
+		select {
+		case l.sem <- struct{}{}:
+		case <-ctx.Done():
+			return false
+		}
+	} else {
+		select {
+		case l.sem <- struct{}{}:
+		default:
+			return false
+		}
+	}
+	l.active.Add(1)
+	return true
+}
+
+// release 释放 acquire 占用的名额
+func (l *connLimiter) release() {
+	if l == nil {
+		return
+	}
+	l.active.Add(-1)
+	<-l.sem
+}
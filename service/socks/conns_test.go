@@ -0,0 +1,32 @@
+package socks
+
+import (
+	"io"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestDrainWaitsForClosedConns(t *testing.T) {
+	for _, timeout := range []time.Duration{0, 20 * time.Millisecond} {
+		var tracker connTracker
+		var finished atomic.Bool
+		client, server := net.Pipe()
+		defer client.Close()
+
+		tracker.add(server)
+		go func() {
+			// 连接被强制关闭后处理仍需一段时间才能结束，例如计入用户流量
+			io.Copy(io.Discard, server)
+			time.Sleep(50 * time.Millisecond)
+			finished.Store(true)
+			tracker.done(server)
+		}()
+
+		tracker.drain(timeout)
+		if !finished.Load() {
+			t.Errorf("drain(%v) returned before the closed connection was handled", timeout)
+		}
+	}
+}
@@ -0,0 +1,80 @@
+package socks
+
+import (
+	"fmt"
+	"net"
+	"net/netip"
+	"strings"
+)
+
+// ipFilter 根据客户端源地址决定是否接受连接，拒绝列表优先于允许列表
+type ipFilter struct {
+	allowed []netip.Prefix
+	denied  []netip.Prefix
+}
+
+// newIPFilter 解析允许与拒绝的CIDR列表，单个IP地址视为仅包含该地址的前缀
+func newIPFilter(allowed, denied []string) (*ipFilter, error) {
+	f := &ipFilter{}
+	var err error
+	if f.allowed, err = parsePrefixes(allowed); err != nil {
+		return nil, fmt.Errorf("invalid allowed_cidrs: %w", err)
+	}
+	if f.denied, err = parsePrefixes(denied); err != nil {
+		return nil, fmt.Errorf("invalid denied_cidrs: %w", err)
+	}
+	return f, nil
+}
+
+func parsePrefixes(values []string) ([]netip.Prefix, error) {
+	prefixes := make([]netip.Prefix, 0, len(values))
+	for _, v := range values {
+		v = strings.TrimSpace(v)
+		if !strings.Contains(v, "/") {
+			addr, err := netip.ParseAddr(v)
+			if err != nil {
+				return nil, err
+			}
+			addr = addr.Unmap()
+			prefixes = append(prefixes, netip.PrefixFrom(addr, addr.BitLen()))
+			continue
+		}
+		p, err := netip.ParsePrefix(v)
+		if err != nil {
+			return nil, err
+		}
+		prefixes = append(prefixes, p.Masked())
+	}
+	return prefixes, nil
+}
+
+// permits 报告来自 addr 的连接是否被允许
+// 未配置允许列表时接受所有未被拒绝的地址，Unix套接字连接不受限制
+func (f *ipFilter) permits(addr net.Addr) bool {
+	if f == nil || (len(f.allowed) == 0 && len(f.denied) == 0) {
+		return true
+	}
+	if _, ok := addr.(*net.UnixAddr); ok {
+		return true
+	}
+	ap, err := netip.ParseAddrPort(addr.String())
+	if err != nil {
+		return false
+	}
+	ip := ap.Addr().Unmap()
+
+	for _, p := range f.denied {
+		if p.Contains(ip) {
+			return false
+		}
+	}
+	if len(f.allowed) == 0 {
+		return true
+	}
+	for _, p := range f.allowed {
+		if p.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,199 @@
+package socks
+
+import (
+	"context"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/HynoR/uscf/api"
+	"github.com/HynoR/uscf/internal/logger"
+	"github.com/HynoR/uscf/service/tunnel"
+)
+
+// clientTunnel 是单客户端模式下某个客户端独占的隧道
+type clientTunnel struct {
+	key       string
+	dial      tunnel.DialFunc
+	refs      int         // 正在使用该隧道的连接数
+	timer     *time.Timer // 最后一个连接释放后的回收定时器
+	dead      bool        // 隧道协程已退出（如空闲关闭）
+	closeOnce sync.Once
+	close     func()
+}
+
+func (t *clientTunnel) shutdown() {
+	t.closeOnce.Do(t.close)
+}
+
+// tunnelPool 按客户端标识复用单客户端模式下的隧道
+// 同一客户端的并发与后续连接共用一条隧道，最后一个连接关闭后隧道保留 grace 时间再回收
+type tunnelPool struct {
+	grace time.Duration
+	open  func(ctx context.Context, exited func()) (tunnel.DialFunc, func(), error)
+
+	mu      sync.Mutex
+	tunnels map[string]*clientTunnel
+}
+
+// newTunnelPool 创建隧道池，open 负责创建隧道并在隧道协程退出时调用 exited
+// open 返回的关闭函数取消隧道并释放设备
+func newTunnelPool(grace time.Duration, open func(ctx context.Context, exited func()) (tunnel.DialFunc, func(), error)) *tunnelPool {
+	return &tunnelPool{
+		grace:   grace,
+		open:    open,
+		tunnels: make(map[string]*clientTunnel),
+	}
+}
+
+// clientKey 返回用于区分客户端的标识，TCP客户端使用其IP地址
+func clientKey(addr net.Addr) string {
+	if tcp, ok := addr.(*net.TCPAddr); ok {
+		return tcp.IP.String()
+	}
+	return addr.String()
+}
+
+// acquire 返回客户端的隧道并增加引用计数，不存在时创建新隧道
+func (p *tunnelPool) acquire(ctx context.Context, key string) (*clientTunnel, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if t, ok := p.tunnels[key]; ok {
+		if t.timer != nil {
+			t.timer.Stop()
+			t.timer = nil
+		}
+		t.refs++
+		return t, nil
+	}
+
+	t := &clientTunnel{key: key, refs: 1}
+	dial, closeFn, err := p.open(ctx, func() { p.exited(t) })
+	if err != nil {
+		return nil, err
+	}
+	t.dial, t.close = dial, closeFn
+	p.tunnels[key] = t
+	return t, nil
+}
+
+// release 减少隧道的引用计数，没有连接使用时在 grace 之后回收
+func (p *tunnelPool) release(t *clientTunnel) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	t.refs--
+	if t.refs > 0 {
+		return
+	}
+	if t.dead || p.grace <= 0 {
+		p.remove(t)
+		return
+	}
+
+	var timer *time.Timer
+	timer = time.AfterFunc(p.grace, func() {
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		// 定时器被替换或隧道重新被使用时不回收
+		if t.timer == timer && t.refs == 0 {
+			p.remove(t)
+		}
+	})
+	t.timer = timer
+}
+
+// exited 在隧道协程退出后调用，之后的连接将创建新隧道
+func (p *tunnelPool) exited(t *clientTunnel) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	t.dead = true
+	if p.tunnels[t.key] == t {
+		delete(p.tunnels, t.key)
+	}
+	if t.refs == 0 {
+		p.remove(t)
+	}
+}
+
+// remove 将隧道移出池并关闭，调用方需持有 p.mu
+func (p *tunnelPool) remove(t *clientTunnel) {
+	if t.timer != nil {
+		t.timer.Stop()
+		t.timer = nil
+	}
+	if p.tunnels[t.key] == t {
+		delete(p.tunnels, t.key)
+	}
+	// 关闭设备可能阻塞，不在持锁时执行
+	go t.shutdown()
+}
+
+// exitNotifier 在 MaintainTunnel 返回后调用 exited
+type exitNotifier struct {
+	tunnel.Manager
+	exited func()
+}
+
+// MaintainTunnel 实现 tunnel.Manager
+func (m exitNotifier) MaintainTunnel(ctx context.Context, cfg api.ConnectionConfig, dev api.TunnelDevice) error {
+	err := m.Manager.MaintainTunnel(ctx, cfg, dev)
+	m.exited()
+	return err
+}
+
+// startGate 错开单客户端隧道的建立，避免大量客户端同时连接时一齐握手
+// 相邻两个隧道开始建立连接至少间隔 interval，每个隧道再随机推迟不超过 jitter 的时间
+type startGate struct {
+	interval time.Duration
+	jitter   time.Duration
+
+	mu   sync.Mutex
+	next time.Time // 下一个隧道最早可以开始的时间
+}
+
+// wait 等待轮到当前隧道开始建立连接，ctx 先取消时返回 false
+func (g *startGate) wait(ctx context.Context) bool {
+	g.mu.Lock()
+	now := time.Now()
+	at := g.next
+	if at.Before(now) {
+		at = now
+	}
+	g.next = at.Add(g.interval)
+	g.mu.Unlock()
+
+	if g.jitter > 0 {
+		at = at.Add(time.Duration(rand.Int63n(int64(g.jitter))))
+	}
+	delay := time.Until(at)
+	if delay <= 0 {
+		return true
+	}
+	logger.Logger.Debugf("Delaying per-client tunnel start by %v", delay.Round(time.Millisecond))
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return false
+	case <-timer.C:
+		return true
+	}
+}
+
+// staggeredManager 在建立隧道前等待 startGate
+type staggeredManager struct {
+	tunnel.Manager
+	gate *startGate
+}
+
+// MaintainTunnel 实现 tunnel.Manager，等待期间 ctx 取消时直接返回
+func (m staggeredManager) MaintainTunnel(ctx context.Context, cfg api.ConnectionConfig, dev api.TunnelDevice) error {
+	if !m.gate.wait(ctx) {
+		return nil
+	}
+	return m.Manager.MaintainTunnel(ctx, cfg, dev)
+}
@@ -0,0 +1,272 @@
+package socks
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"maps"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/HynoR/uscf/config"
+	"github.com/HynoR/uscf/internal"
+	"github.com/HynoR/uscf/internal/logger"
+	"github.com/HynoR/uscf/models"
+	"github.com/things-go/go-socks5"
+)
+
+const (
+	// quotaCheckInterval 是汇总连接流量并检查配额的间隔，超出配额的连接最多在该间隔后断开
+	quotaCheckInterval = 5 * time.Second
+	// quotaSaveInterval 是将流量统计写入文件的间隔
+	quotaSaveInterval = time.Minute
+)
+
+// userConn 是一个已认证用户的客户端连接
+type userConn struct {
+	conn    *models.TimeoutConn
+	user    string
+	counted uint64 // 已计入用户总量的字节数
+}
+
+// quotaState 是写入统计文件的内容
+type quotaState struct {
+	Period string            `json:"period,omitempty"`
+	Usage  map[string]uint64 `json:"usage"`
+}
+
+// userAccounting 按SOCKS用户名汇总客户端连接的流量（上下行合计），并执行每个用户的流量配额
+// 同一用户通过HTTP代理的连接也计入其中
+// 只统计TCP连接上的数据，UDP ASSOCIATE 转发的数据报不计入
+type userAccounting struct {
+	mu      sync.Mutex
+	limits  map[string]int64
+	usage   map[string]uint64
+	period  string // 按月重置时为当前月份 "2006-01"，否则为空
+	monthly bool
+	file    string
+	dirty   bool
+	conns   map[string]*userConn // 以客户端地址为键
+}
+
+// newUserAccounting 创建流量统计，设置了 quota_file 时从文件恢复之前的统计
+func newUserAccounting(cfg *config.SocksConfig) *userAccounting {
+	a := &userAccounting{
+		limits:  cfg.UserQuotas,
+		usage:   make(map[string]uint64),
+		monthly: cfg.QuotaPeriod == "monthly",
+		file:    cfg.QuotaFile,
+		conns:   make(map[string]*userConn),
+	}
+	if a.monthly {
+		a.period = time.Now().Format("2006-01")
+	}
+	if a.file != "" {
+		if err := a.load(); err != nil {
+			logger.Logger.Warnf("Failed to load SOCKS user usage from %s, starting from zero: %v", a.file, err)
+		}
+	}
+	return a
+}
+
+// load 读取统计文件，文件不存在时不做处理，统计周期已过时丢弃旧数据
+func (a *userAccounting) load() error {
+	data, err := os.ReadFile(a.file)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var state quotaState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return err
+	}
+	if state.Period != a.period {
+		logger.Logger.Infof("SOCKS user usage in %s is from period %q, starting period %q", a.file, state.Period, a.period)
+		return nil
+	}
+	if state.Usage != nil {
+		a.usage = state.Usage
+	}
+	return nil
+}
+
+// setLimits 替换每个用户的配额
+func (a *userAccounting) setLimits(limits map[string]int64) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if !maps.Equal(a.limits, limits) {
+		a.limits = limits
+		logger.Logger.Infof("SOCKS user quotas updated: %d user(s)", len(limits))
+	}
+}
+
+// exceeded 返回用户是否已用完配额，调用方需持有 mu
+func (a *userAccounting) exceeded(user string) (int64, bool) {
+	limit, ok := a.limits[user]
+	return limit, ok && limit > 0 && a.usage[user] >= uint64(limit)
+}
+
+// rollover 在进入新的统计周期时清零统计，调用方需持有 mu
+func (a *userAccounting) rollover() {
+	if !a.monthly {
+		return
+	}
+	if period := time.Now().Format("2006-01"); period != a.period {
+		logger.Logger.Infof("SOCKS user quotas reset for %s", period)
+		a.period = period
+		a.usage = make(map[string]uint64)
+		for _, uc := range a.conns {
+			uc.counted = uc.conn.BytesRead() + uc.conn.BytesWritten()
+		}
+		a.dirty = true
+	}
+}
+
+// track 开始统计客户端连接，用户名在请求通过认证后由 Allow 设置
+func (a *userAccounting) track(conn *models.TimeoutConn) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.conns[conn.RemoteAddr().String()] = &userConn{conn: conn}
+}
+
+// trackUser 开始统计已在SOCKS握手之外完成认证的连接（如HTTP代理），不经过 Allow
+// 用户已用完配额时不统计并返回 false
+func (a *userAccounting) trackUser(conn *models.TimeoutConn, user string) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.rollover()
+	if limit, ok := a.exceeded(user); ok {
+		logger.Logger.Warnf("Rejected HTTP proxy request from %s: user %s has used up the quota of %d bytes",
+			conn.RemoteAddr(), user, limit)
+		return false
+	}
+	a.conns[conn.RemoteAddr().String()] = &userConn{conn: conn, user: user, counted: conn.BytesRead() + conn.BytesWritten()}
+	return true
+}
+
+// untrack 将连接剩余的流量计入用户总量并停止统计
+func (a *userAccounting) untrack(conn *models.TimeoutConn) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	key := conn.RemoteAddr().String()
+	if uc, ok := a.conns[key]; ok && uc.conn == conn {
+		a.count(uc)
+		delete(a.conns, key)
+	}
+}
+
+// count 将连接自上次统计以来的流量计入用户总量，调用方需持有 mu
+func (a *userAccounting) count(uc *userConn) {
+	if uc.user == "" {
+		return
+	}
+	total := uc.conn.BytesRead() + uc.conn.BytesWritten()
+	if total > uc.counted {
+		a.usage[uc.user] += total - uc.counted
+		uc.counted = total
+		a.dirty = true
+	}
+}
+
+// Allow 实现 socks5.RuleSet，记录连接所属的用户，用户已用完配额时拒绝请求
+func (a *userAccounting) Allow(ctx context.Context, req *socks5.Request) (context.Context, bool) {
+	if req.AuthContext == nil || req.RemoteAddr == nil {
+		return ctx, true
+	}
+	user := req.AuthContext.Payload["username"]
+	if user == "" {
+		return ctx, true
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.rollover()
+	if uc, ok := a.conns[req.RemoteAddr.String()]; ok {
+		uc.user = user
+		uc.counted = uc.conn.BytesRead() + uc.conn.BytesWritten()
+	}
+	if limit, ok := a.exceeded(user); ok {
+		logger.Logger.Warnf("Rejected SOCKS request from %s: user %s has used up the quota of %d bytes",
+			req.RemoteAddr, user, limit)
+		return ctx, false
+	}
+	return ctx, true
+}
+
+// run 定期汇总流量并断开已用完配额的用户的连接，同时保存统计文件，直到 ctx 取消
+func (a *userAccounting) run(ctx context.Context) {
+	check := time.NewTicker(quotaCheckInterval)
+	defer check.Stop()
+	save := time.NewTicker(quotaSaveInterval)
+	defer save.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-check.C:
+			a.enforce()
+		case <-save.C:
+			a.save()
+		}
+	}
+}
+
+// enforce 汇总所有连接的流量，关闭超出配额的用户的连接
+func (a *userAccounting) enforce() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.rollover()
+
+	closed := make(map[string]int)
+	for _, uc := range a.conns {
+		a.count(uc)
+	}
+	for _, uc := range a.conns {
+		if uc.user == "" {
+			continue
+		}
+		if _, ok := a.exceeded(uc.user); ok {
+			uc.conn.Close()
+			closed[uc.user]++
+		}
+	}
+	for user, n := range closed {
+		logger.Logger.Warnf("Closing %d proxy connection(s) of user %s: quota of %d bytes used up", n, user, a.limits[user])
+	}
+}
+
+// save 在统计有变化时写入统计文件，先写入临时文件再重命名，避免留下不完整的文件
+func (a *userAccounting) save() {
+	a.mu.Lock()
+	if a.file == "" || !a.dirty {
+		a.mu.Unlock()
+		return
+	}
+	data, err := json.MarshalIndent(quotaState{Period: a.period, Usage: a.usage}, "", "  ")
+	a.dirty = false
+	a.mu.Unlock()
+	if err == nil {
+		err = internal.WriteFileAtomic(a.file, data)
+	}
+	if err != nil {
+		logger.Logger.Warnf("Failed to save SOCKS user usage: %v", err)
+	}
+}
+
+// ruleChain 依次检查多个规则，任一规则拒绝时拒绝请求
+type ruleChain []socks5.RuleSet
+
+// Allow 实现 socks5.RuleSet
+func (r ruleChain) Allow(ctx context.Context, req *socks5.Request) (context.Context, bool) {
+	for _, rule := range r {
+		var ok bool
+		if ctx, ok = rule.Allow(ctx, req); !ok {
+			return ctx, false
+		}
+	}
+	return ctx, true
+}
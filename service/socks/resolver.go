@@ -0,0 +1,56 @@
+package socks
+
+import (
+	"context"
+	"net"
+
+	"github.com/HynoR/uscf/service/tunnel"
+	"github.com/things-go/go-socks5"
+)
+
+// tunnelResolver 包装SOCKS使用的解析器，将域名与全部解析结果记录到上下文中供拨号使用
+// 拨号因此能按域名而不是解析后的IP分流，并在首个地址无响应时并行尝试其他地址
+// 分流规则中直连的域名不经隧道DNS解析，留给直连拨号时由系统解析
+type tunnelResolver struct {
+	base     dnsResolver
+	router   *tunnel.Router
+	preferV6 bool // 优先使用IPv6地址，见 address_preference
+}
+
+// newTunnelResolver 返回包装 base 的解析器
+func newTunnelResolver(base dnsResolver, router *tunnel.Router, preferV6 bool) socks5.NameResolver {
+	return tunnelResolver{base: base, router: router, preferV6: preferV6}
+}
+
+// Resolve 实现 socks5.NameResolver，直连的域名返回空IP
+func (r tunnelResolver) Resolve(ctx context.Context, name string) (context.Context, net.IP, error) {
+	ctx = tunnel.WithHost(ctx, name)
+	if r.router.Direct(name) {
+		return ctx, nil, nil
+	}
+	ips, err := r.base.ResolveAll(ctx, name)
+	if err != nil {
+		return ctx, nil, err
+	}
+	if r.preferV6 {
+		ips = preferIPv6(ips)
+	}
+	return tunnel.WithAddrs(ctx, ips), ips[0], nil
+}
+
+// preferIPv6 返回IPv6地址在前的副本，同族地址保持原有顺序
+// ips 来自解析器缓存，不能原地修改
+func preferIPv6(ips []net.IP) []net.IP {
+	sorted := make([]net.IP, 0, len(ips))
+	for _, ip := range ips {
+		if ip.To4() == nil {
+			sorted = append(sorted, ip)
+		}
+	}
+	for _, ip := range ips {
+		if ip.To4() != nil {
+			sorted = append(sorted, ip)
+		}
+	}
+	return sorted
+}
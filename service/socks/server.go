@@ -2,9 +2,15 @@ package socks
 
 import (
 	"context"
+	"crypto/tls"
 	"fmt"
 	"log"
 	"net"
+	"os"
+	"reflect"
+	"strconv"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/HynoR/uscf/api"
@@ -13,14 +19,138 @@ import (
 	"github.com/HynoR/uscf/models"
 	"github.com/HynoR/uscf/service/tunnel"
 	"github.com/things-go/go-socks5"
-	"golang.zx2c4.com/wireguard/tun"
-	"golang.zx2c4.com/wireguard/tun/netstack"
 )
 
-// Run starts a SOCKS5 server using the provided tunnel network stack.
-func Run(ctx context.Context, cfg *config.Config, tunNet *netstack.Net, connectionTimeout, idleTimeout time.Duration) error {
-	dnsTimeoutSec := int(cfg.Tunnel.DNSTimeout.Duration().Seconds())
-	resolver := api.NewCachingDNSResolver("", dnsTimeoutSec)
+// Server is a SOCKS proxy whose credentials and resolver can be replaced while it is running.
+// Changes only affect connections accepted after the update.
+type Server struct {
+	cfg               *config.Config
+	connectionTimeout time.Duration
+	idleTimeout       time.Duration
+
+	targets targetRecorder
+	router  *tunnel.Router
+	egress  *tunnel.Upstream
+	tunnels atomic.Int64 // 单客户端模式下存活的隧道数
+	conns   connTracker
+	usage   *userAccounting
+
+	mu        sync.RWMutex
+	creds     map[string]string
+	filter    *ipFilter
+	accessLog bool
+	drainTime time.Duration
+	dns       config.ResolverSettings
+	resolver  socks5.NameResolver
+	base      dnsResolver
+	dial      tunnel.DialFunc
+	server    *socks5.Server
+}
+
+// New creates a SOCKS server that connects to destinations with tunDial, usually a
+// dialer from tunnel.NewDialer. In per-client mode tunDial may be nil, as each
+// connection gets its own tunnel.
+func New(cfg *config.Config, tunDial tunnel.DialFunc, connectionTimeout, idleTimeout time.Duration) *Server {
+	s := &Server{
+		cfg:               cfg,
+		connectionTimeout: connectionTimeout,
+		idleTimeout:       idleTimeout,
+		creds:             cfg.Socks.Credentials(),
+		accessLog:         cfg.Logging.AccessLog,
+		drainTime:         cfg.Socks.ShutdownTimeout.Duration(),
+		dns:               cfg.Tunnel.Resolver(),
+		router:            tunnel.NewRouter(cfg.Routing, connectionTimeout, idleTimeout),
+		egress:            tunnel.NewUpstream(cfg.Routing),
+		usage:             newUserAccounting(&cfg.Socks),
+	}
+	if !cfg.Tunnel.PerClient {
+		s.dial = s.router.Wrap(s.egress.Wrap(tunDial))
+	}
+	// 无效的地址段由 Run 报告，HTTP代理在 Run 之前也会检查客户端地址
+	if filter, err := newIPFilter(cfg.Socks.AllowedCIDRs, cfg.Socks.DeniedCIDRs); err == nil {
+		s.filter = filter
+	}
+	s.setResolver(s.dns)
+	if s.dial != nil {
+		s.server = createServer(s.creds, s.dial, s.resolver, s.idleTimeout, s.rules())
+	}
+	return s
+}
+
+// Run starts a SOCKS5 server that connects to destinations with tunDial.
+func Run(ctx context.Context, cfg *config.Config, tunDial tunnel.DialFunc, connectionTimeout, idleTimeout time.Duration) error {
+	return New(cfg, tunDial, connectionTimeout, idleTimeout).Run(ctx)
+}
+
+// Reload applies the live-reloadable parts of cfg: credentials, user quotas, client address filters,
+// DNS servers, the DNS blocklist, the shutdown timeout and the access log switch. The blocklist file is read
+// again even if its path is unchanged.
+func (s *Server) Reload(cfg *config.Config) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if creds := cfg.Socks.Credentials(); !reflect.DeepEqual(creds, s.creds) {
+		s.creds = creds
+		logger.Logger.Infof("SOCKS credentials updated: %d user(s)", len(creds))
+	}
+	s.usage.setLimits(cfg.Socks.UserQuotas)
+	if filter, err := newIPFilter(cfg.Socks.AllowedCIDRs, cfg.Socks.DeniedCIDRs); err != nil {
+		logger.Logger.Warnf("Ignoring SOCKS client filter update: %v", err)
+	} else {
+		s.filter = filter
+	}
+	s.drainTime = cfg.Socks.ShutdownTimeout.Duration()
+	if cfg.Logging.AccessLog != s.accessLog {
+		s.accessLog = cfg.Logging.AccessLog
+		logger.Logger.Infof("SOCKS access log enabled: %v", s.accessLog)
+	}
+	if dns := cfg.Tunnel.Resolver(); !reflect.DeepEqual(dns, s.dns) {
+		s.dns = dns
+		s.setResolver(dns)
+		logger.Logger.Infof("DNS settings updated: mode %s, servers %v", dns.Mode, dns.DNS)
+	} else if dns.Blocklist != "" {
+		// 列表文件内容可能已变化，重新加载；失败时保留当前列表
+		if list, err := loadBlocklist(dns); err != nil {
+			logger.Logger.Warnf("Keeping current DNS blocklist: %v", err)
+		} else {
+			s.base.SetBlocklist(list)
+		}
+	}
+	if s.dial != nil {
+		s.server = createServer(s.creds, s.dial, s.resolver, s.idleTimeout, s.rules())
+	}
+}
+
+// Credentials returns the current user names and passwords, empty when no authentication
+// is required. Reload replaces the map rather than modifying it, so callers may keep reading
+// the returned map but must not modify it.
+func (s *Server) Credentials() map[string]string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.creds
+}
+
+// PermitsClient reports whether the current client filters accept connections from addr.
+func (s *Server) PermitsClient(addr net.Addr) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.filter.permits(addr)
+}
+
+// TrackUser counts the traffic of conn, on which user authenticated outside the SOCKS
+// handshake, towards the user's quota. It returns false without tracking conn when the
+// quota is used up; otherwise the returned function must be called once conn is closed.
+func (s *Server) TrackUser(conn *models.TimeoutConn, user string) (func(), bool) {
+	if !s.usage.trackUser(conn, user) {
+		return nil, false
+	}
+	return func() { s.usage.untrack(conn) }, true
+}
+
+// Run accepts connections until ctx is canceled.
+func (s *Server) Run(ctx context.Context) error {
+	cfg := s.cfg
+	connectionTimeout, idleTimeout := s.connectionTimeout, s.idleTimeout
 
 	tlsCfg, err := tunnel.PrepareTLSConfig(cfg)
 	if err != nil {
@@ -32,73 +162,404 @@ func Run(ctx context.Context, cfg *config.Config, tunNet *netstack.Net, connecti
 		return err
 	}
 
-	dialFunc := func(netTun *netstack.Net) func(ctx context.Context, network, addr string) (net.Conn, error) {
-		return func(ctx context.Context, network, addr string) (net.Conn, error) {
-			dctx, cancel := context.WithTimeout(ctx, connectionTimeout)
-			defer cancel()
+	if _, err := newIPFilter(cfg.Socks.AllowedCIDRs, cfg.Socks.DeniedCIDRs); err != nil {
+		return err
+	}
 
-			conn, err := netTun.DialContext(dctx, network, addr)
+	listeners, err := listen(&cfg.Socks)
+	if err != nil {
+		return fmt.Errorf("failed to start SOCKS proxy: %w", err)
+	}
+
+	go func() {
+		<-ctx.Done()
+		for _, l := range listeners {
+			l.Close()
+		}
+	}()
+
+	// 单客户端模式下按客户端复用隧道
+	// 隧道在连接排空之后才关闭，因此不随 ctx 取消
+	tunnelCtx, stopTunnels := context.WithCancel(context.WithoutCancel(ctx))
+	defer stopTunnels()
+	var pool *tunnelPool
+	if cfg.Tunnel.PerClient {
+		gate := &startGate{interval: cfg.Tunnel.PerClientInterval.Duration(), jitter: cfg.Tunnel.PerClientJitter.Duration()}
+		pool = newTunnelPool(cfg.Tunnel.PerClientGrace.Duration(), func(ctx context.Context, exited func()) (tunnel.DialFunc, func(), error) {
+			dev, netTun, err := tunnel.CreateTun(locals, dnsAddrs, cfg)
 			if err != nil {
-				return nil, err
+				return nil, nil, err
 			}
-			return &models.TimeoutConn{Conn: conn, IdleTimeout: idleTimeout}, nil
+			tctx, cancel := context.WithCancel(ctx)
+			m := exitNotifier{staggeredManager{tunnel.DefaultManager{}, gate}, exited}
+			_, done := tunnel.StartTunnel(tctx, m, tlsCfg, endpoint, cfg, dev)
+			s.tunnels.Add(1)
+			dial := s.router.Wrap(s.egress.Wrap(tunnel.NewDialer(netTun, connectionTimeout, idleTimeout)))
+			return dial, func() {
+				cancel()
+				tunnel.WaitStopped(done)
+				dev.Close()
+				s.tunnels.Add(-1)
+			}, nil
+		})
+		go s.logClientTunnels(ctx, cfg.Tunnel.StatsInterval.Duration())
+	}
+
+	limiter := newConnLimiter(cfg.Socks.MaxConnections, cfg.Socks.ConnLimitMode)
+	go s.usage.run(ctx)
+
+	handle := func(conn net.Conn) {
+		s.mu.RLock()
+		creds, filter, resolver, server := s.creds, s.filter, s.resolver, s.server
+		s.mu.RUnlock()
+
+		if !filter.permits(conn.RemoteAddr()) {
+			logger.Logger.Debugf("Rejected SOCKS connection from %s", conn.RemoteAddr())
+			conn.Close()
+			return
+		}
+		authRequired := len(creds) > 0
+
+		// 等待模式下在此阻塞，暂停接受新连接
+		if !limiter.acquire(ctx) {
+			if ctx.Err() == nil {
+				logger.Logger.Warnf("Rejected SOCKS connection from %s: %d of %d connections in use",
+					conn.RemoteAddr(), limiter.active.Load(), cfg.Socks.MaxConnections)
+			}
+			conn.Close()
+			return
+		}
+
+		if pool != nil {
+			t, err := pool.acquire(tunnelCtx, clientKey(conn.RemoteAddr()))
+			if err != nil {
+				logger.Logger.Warnf("Failed to create tun device: %v", err)
+				limiter.release()
+				conn.Close()
+				return
+			}
+			svr := createServer(creds, t.dial, resolver, idleTimeout, s.rules())
+
+			s.conns.add(conn)
+			go func(c net.Conn) {
+				defer limiter.release()
+				defer s.conns.done(c)
+				defer pool.release(t)
+				s.serve(s.wrapConn(c), svr, t.dial, resolver, authRequired)
+			}(conn)
+			return
 		}
+
+		s.conns.add(conn)
+		go func(c net.Conn) {
+			defer limiter.release()
+			defer s.conns.done(c)
+			s.serve(s.wrapConn(c), server, s.dial, resolver, authRequired)
+		}(conn)
 	}
 
-	var server *socks5.Server
-	if !cfg.Tunnel.PerClient {
-		server = createServer(cfg.Socks.Username, cfg.Socks.Password, dialFunc(tunNet), resolver)
+	// 每个监听地址使用独立的accept循环，共享同一个服务器与拨号器
+	var wg sync.WaitGroup
+	for _, l := range listeners {
+		wg.Add(1)
+		go func(l net.Listener) {
+			defer wg.Done()
+			acceptLoop(ctx, l, handle)
+		}(l)
 	}
-	bindAddr := net.JoinHostPort(cfg.Socks.BindAddress, cfg.Socks.Port)
-	logger.Logger.Infof("SOCKS proxy listening on %s", bindAddr)
+	wg.Wait()
 
-	l, err := net.Listen("tcp", bindAddr)
-	if err != nil {
-		return fmt.Errorf("failed to start SOCKS proxy: %w", err)
+	// 停止接受新连接后等待进行中的连接结束
+	s.mu.RLock()
+	drainTime := s.drainTime
+	s.mu.RUnlock()
+	s.conns.drain(drainTime)
+	s.usage.save()
+	return nil
+}
+
+// rules returns the SOCKS5 rule set: it records request targets for the access log and
+// enforces user quotas.
+func (s *Server) rules() socks5.RuleSet {
+	return ruleChain{&s.targets, s.usage}
+}
+
+// ClientTunnels returns the number of live per-client tunnels.
+func (s *Server) ClientTunnels() int64 {
+	return s.tunnels.Load()
+}
+
+// logClientTunnels periodically logs the number of live per-client tunnels.
+// It follows the tunnel stats interval: zero selects the default and a negative value disables it.
+func (s *Server) logClientTunnels(ctx context.Context, interval time.Duration) {
+	if interval < 0 {
+		return
+	}
+	if interval == 0 {
+		interval = api.DefaultStatsInterval
 	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
 
-	go func() {
-		<-ctx.Done()
-		l.Close()
-	}()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			logger.Logger.Infof("Per-client tunnels: %d active", s.tunnels.Load())
+		}
+	}
+}
 
+// acceptLoop passes every connection accepted on l to handle until ctx is canceled.
+func acceptLoop(ctx context.Context, l net.Listener, handle func(net.Conn)) {
 	for {
 		conn, err := l.Accept()
 		if err != nil {
 			if ctx.Err() != nil {
-				return nil
+				return
 			}
 			logger.Logger.Warnf("Failed to accept connection: %v", err)
 			continue
 		}
+		handle(conn)
+	}
+}
 
-		if cfg.Tunnel.PerClient {
-			dev, netTun, err := tunnel.CreateTun(locals, dnsAddrs, cfg)
-			if err != nil {
-				logger.Logger.Warnf("Failed to create tun device: %v", err)
-				conn.Close()
-				continue
-			}
+// serve handles a single client connection and logs how much data it moved once it closes.
+func (s *Server) serve(conn *models.TimeoutConn, svr *socks5.Server, dial tunnel.DialFunc, resolver socks5.NameResolver, authRequired bool) {
+	defer conn.Close()
+	start := time.Now()
+	s.usage.track(conn)
+	if err := serveConn(conn, svr, dial, resolver, authRequired, &s.targets); err != nil {
+		logger.Logger.Debugf("SOCKS connection error: %v", err)
+	}
+	s.usage.untrack(conn)
 
-			cctx, cancel := context.WithCancel(ctx)
-			tunnel.StartTunnel(cctx, tunnel.DefaultManager{}, tlsCfg, endpoint, cfg, dev)
-			svr := createServer(cfg.Socks.Username, cfg.Socks.Password, dialFunc(netTun), resolver)
+	target, ok := s.targets.take(conn.RemoteAddr())
+	s.mu.RLock()
+	accessLog := s.accessLog
+	s.mu.RUnlock()
+	if accessLog {
+		logAccess(conn, target, ok, start)
+	}
+	logger.Logger.Debugf("SOCKS connection from %s closed: %d bytes received, %d bytes sent",
+		conn.RemoteAddr(), conn.BytesRead(), conn.BytesWritten())
+}
 
-			go func(c net.Conn, cancel context.CancelFunc, dev tun.Device) {
-				timeoutConn := &models.TimeoutConn{Conn: c, IdleTimeout: idleTimeout}
-				svr.ServeConn(timeoutConn)
-				cancel()
-				dev.Close()
-			}(conn, cancel, dev)
+// listen opens the SOCKS listeners: one per entry in listeners, or bind_address:port when
+// the list is empty, plus a Unix domain socket when unix_socket is set. When only
+// unix_socket is set, no TCP listener is opened. With tls_cert and tls_key set, the TCP
+// listeners expect a TLS handshake before the SOCKS handshake.
+func listen(cfg *config.SocksConfig) ([]net.Listener, error) {
+	addrs := cfg.Listeners
+	if len(addrs) == 0 && cfg.UnixSocket == "" {
+		addrs = []string{net.JoinHostPort(cfg.BindAddress, cfg.Port)}
+	}
+
+	tlsConfig, err := listenerTLSConfig(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	var listeners []net.Listener
+	closeAll := func() {
+		for _, l := range listeners {
+			l.Close()
+		}
+	}
+	for _, addr := range addrs {
+		l, err := net.Listen("tcp", addr)
+		if err != nil {
+			closeAll()
+			return nil, err
+		}
+		if tlsConfig != nil {
+			l = tls.NewListener(l, tlsConfig)
+			logger.Logger.Infof("SOCKS proxy listening on %s (TLS)", addr)
+		} else {
+			logger.Logger.Infof("SOCKS proxy listening on %s", addr)
+		}
+		listeners = append(listeners, l)
+	}
+
+	if cfg.UnixSocket != "" {
+		l, err := listenUnix(cfg)
+		if err != nil {
+			closeAll()
+			return nil, err
+		}
+		listeners = append(listeners, l)
+	}
+	return listeners, nil
+}
+
+// listenerTLSConfig loads the certificate for the TCP listeners. It returns nil when TLS is
+// not configured.
+func listenerTLSConfig(cfg *config.SocksConfig) (*tls.Config, error) {
+	if cfg.TLSCert == "" && cfg.TLSKey == "" {
+		return nil, nil
+	}
+	cert, err := tls.LoadX509KeyPair(cfg.TLSCert, cfg.TLSKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load SOCKS TLS certificate: %w", err)
+	}
+	return &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}, nil
+}
+
+// listenUnix opens the Unix domain socket listener, replacing a stale socket file.
+func listenUnix(cfg *config.SocksConfig) (net.Listener, error) {
+	mode := os.FileMode(0600)
+	if cfg.UnixSocketMode != "" {
+		m, err := strconv.ParseUint(cfg.UnixSocketMode, 8, 32)
+		if err != nil {
+			return nil, fmt.Errorf("invalid unix_socket_mode %q: %w", cfg.UnixSocketMode, err)
+		}
+		mode = os.FileMode(m)
+	}
+
+	// 删除上次运行遗留的套接字文件
+	if err := os.Remove(cfg.UnixSocket); err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("failed to remove stale socket: %w", err)
+	}
+	// UnixListener 在 Close 时会自动删除套接字文件
+	l, err := net.Listen("unix", cfg.UnixSocket)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(cfg.UnixSocket, mode); err != nil {
+		l.Close()
+		return nil, fmt.Errorf("failed to set socket permissions: %w", err)
+	}
+	logger.Logger.Infof("SOCKS proxy listening on unix socket %s", cfg.UnixSocket)
+	return &unixListener{Listener: l}, nil
+}
+
+// unixListener gives every accepted connection a distinct remote address.
+// Unix socket peers are usually unnamed, which would make clients indistinguishable
+// in logs and in the per-connection target records.
+type unixListener struct {
+	net.Listener
+	seq atomic.Uint64
+}
+
+func (l *unixListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	name := fmt.Sprintf("%s#%d", l.Addr().String(), l.seq.Add(1))
+	return &unixConn{Conn: conn, remote: &net.UnixAddr{Name: name, Net: "unix"}}, nil
+}
+
+type unixConn struct {
+	net.Conn
+	remote net.Addr
+}
+
+func (c *unixConn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+// wrapConn applies the configured idle timeouts and lifetime limit to an accepted client connection.
+func (s *Server) wrapConn(conn net.Conn) *models.TimeoutConn {
+	return &models.TimeoutConn{
+		Conn:             conn,
+		IdleTimeout:      s.idleTimeout,
+		ReadIdleTimeout:  s.cfg.Tunnel.ReadIdleTimeout.Duration(),
+		WriteIdleTimeout: s.cfg.Tunnel.WriteIdleTimeout.Duration(),
+		MaxLifetime:      s.cfg.Tunnel.MaxConnLifetime.Duration(),
+	}
+}
+
+// dnsResolver is a SOCKS name resolver that can return all addresses of a name and has
+// a replaceable blocklist.
+type dnsResolver interface {
+	socks5.NameResolver
+	ResolveAll(ctx context.Context, name string) ([]net.IP, error)
+	SetBlocklist(list *api.Blocklist)
+	SetHosts(hosts map[string]net.IP)
+}
+
+// setResolver replaces the resolver with one built from dns, including its blocklist.
+func (s *Server) setResolver(dns config.ResolverSettings) {
+	base := newResolver(dns, s.dial)
+	base.SetHosts(parseHosts(dns.Hosts))
+	if dns.Blocklist != "" {
+		if list, err := loadBlocklist(dns); err != nil {
+			logger.Logger.Warnf("DNS blocklist disabled: %v", err)
+		} else {
+			base.SetBlocklist(list)
+		}
+	}
+	s.base = base
+	s.resolver = newTunnelResolver(base, s.router, s.cfg.Tunnel.PreferIPv6Destination())
+}
+
+// parseHosts converts the configured static host entries, skipping invalid addresses.
+func parseHosts(entries map[string]string) map[string]net.IP {
+	hosts := make(map[string]net.IP, len(entries))
+	for name, addr := range entries {
+		ip := net.ParseIP(addr)
+		if ip == nil {
+			logger.Logger.Warnf("Ignoring dns_hosts entry %s: invalid address %q", name, addr)
 			continue
 		}
+		hosts[name] = ip
+	}
+	return hosts
+}
 
-		timeoutConn := &models.TimeoutConn{Conn: conn, IdleTimeout: idleTimeout}
-		go server.ServeConn(timeoutConn)
+// loadBlocklist reads the blocklist file named in dns.
+func loadBlocklist(dns config.ResolverSettings) (*api.Blocklist, error) {
+	sinkhole := true
+	switch dns.BlockMode {
+	case "", "sinkhole":
+	case "refuse":
+		sinkhole = false
+	default:
+		logger.Logger.Warnf("Unknown dns_block_mode %q, using sinkhole", dns.BlockMode)
 	}
+
+	list, err := api.LoadBlocklist(dns.Blocklist, sinkhole)
+	if err != nil {
+		return nil, err
+	}
+	logger.Logger.Infof("Loaded DNS blocklist %s: %d entries", dns.Blocklist, list.Len())
+	return list, nil
+}
+
+// newResolver creates the DNS resolver used for SOCKS name resolution.
+// DoH queries are sent through dial so they stay inside the tunnel; without a
+// shared tunnel (per-client mode) it falls back to plain UDP.
+func newResolver(dns config.ResolverSettings, dial tunnel.DialFunc) dnsResolver {
+	if dns.Mode == "doh" {
+		if dial != nil {
+			resolver := api.NewDoHResolver(dns.DoHEndpoint, dial, dns.Timeout.Duration(), 0)
+			resolver.MinTTL = dns.MinTTL.Duration()
+			resolver.MaxTTL = dns.MaxTTL.Duration()
+			resolver.NegativeTTL = dns.NegativeTTL.Duration()
+			resolver.MaxEntries = dns.CacheSize
+			resolver.PrefetchWindow = dns.Prefetch
+			return resolver
+		}
+		logger.Logger.Warn("DNS-over-HTTPS is not supported in per-client mode, using UDP")
+	}
+
+	resolver := api.NewCachingDNSResolver(dns.DNS, dns.Timeout.Duration(), 0)
+	resolver.MinTTL = dns.MinTTL.Duration()
+	resolver.MaxTTL = dns.MaxTTL.Duration()
+	resolver.NegativeTTL = dns.NegativeTTL.Duration()
+	resolver.MaxEntries = dns.CacheSize
+	resolver.PrefetchWindow = dns.Prefetch
+	resolver.FallbackSystem = dns.Fallback
+	return resolver
 }
 
-func createServer(username, password string, dial func(ctx context.Context, network, addr string) (net.Conn, error), resolver socks5.NameResolver) *socks5.Server {
+func createServer(creds map[string]string, dial tunnel.DialFunc, resolver socks5.NameResolver, idleTimeout time.Duration, rule socks5.RuleSet) *socks5.Server {
 	buf := api.NewNetBuffer(32 * 1024)
 	if buf == nil {
 		logger.Logger.Error("Failed to create buffer")
@@ -110,10 +571,12 @@ func createServer(username, password string, dial func(ctx context.Context, netw
 		socks5.WithDial(dial),
 		socks5.WithResolver(resolver),
 		socks5.WithBufferPool(buf),
+		socks5.WithAssociateHandle(newAssociateHandler(dial, resolver, idleTimeout)),
+		socks5.WithRule(rule),
 	}
-	if username != "" && password != "" {
+	if len(creds) > 0 {
 		opts = append(opts, socks5.WithAuthMethods([]socks5.Authenticator{
-			socks5.UserPassAuthenticator{Credentials: socks5.StaticCredentials{username: password}},
+			socks5.UserPassAuthenticator{Credentials: socks5.StaticCredentials(creds)},
 		}))
 	}
 	return socks5.NewServer(opts...)
@@ -0,0 +1,148 @@
+package socks
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+
+	"github.com/HynoR/uscf/service/tunnel"
+	"github.com/things-go/go-socks5"
+)
+
+const (
+	socks4Version = 0x04
+
+	socks4CmdConnect = 0x01
+
+	socks4Granted  = 0x5a
+	socks4Rejected = 0x5b
+
+	// maxSocks4Field 限制USERID与域名字段的长度，防止恶意客户端无限发送
+	maxSocks4Field = 255
+)
+
+// peekConn 允许在不丢失数据的情况下预读连接中的首字节
+type peekConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *peekConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+// serveConn 根据首字节的协议版本将连接分发给SOCKS4或SOCKS5处理器
+func serveConn(conn net.Conn, svr *socks5.Server, dial tunnel.DialFunc, resolver socks5.NameResolver, authRequired bool, rec *targetRecorder) error {
+	pc := &peekConn{Conn: conn, r: bufio.NewReader(conn)}
+	version, err := pc.r.Peek(1)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+
+	if version[0] == socks4Version {
+		defer conn.Close()
+		if authRequired {
+			// SOCKS4仅支持ident字符串，无法满足用户名/密码认证
+			writeSocks4Reply(conn, socks4Rejected)
+			return errors.New("socks4 rejected: username/password authentication is required")
+		}
+		return serveSocks4(pc, dial, resolver, rec)
+	}
+
+	return svr.ServeConn(pc)
+}
+
+// serveSocks4 处理SOCKS4/4a的CONNECT请求
+func serveSocks4(conn *peekConn, dial tunnel.DialFunc, resolver socks5.NameResolver, rec *targetRecorder) error {
+	// VN(1) CD(1) DSTPORT(2) DSTIP(4)
+	header := make([]byte, 8)
+	if _, err := io.ReadFull(conn.r, header); err != nil {
+		return fmt.Errorf("failed to read socks4 header: %w", err)
+	}
+	if header[1] != socks4CmdConnect {
+		writeSocks4Reply(conn, socks4Rejected)
+		return fmt.Errorf("unsupported socks4 command: %d", header[1])
+	}
+	port := binary.BigEndian.Uint16(header[2:4])
+	ip := net.IP(header[4:8])
+
+	// USERID 仅作为ident字符串读取并忽略
+	if _, err := readNullTerminated(conn.r); err != nil {
+		return fmt.Errorf("failed to read socks4 user id: %w", err)
+	}
+
+	ctx := context.Background()
+	host := ip.String()
+
+	// SOCKS4a: 0.0.0.x (x != 0) 表示其后跟随需要代理解析的域名
+	if ip[0] == 0 && ip[1] == 0 && ip[2] == 0 && ip[3] != 0 {
+		var err error
+		host, err = readNullTerminated(conn.r)
+		if err != nil {
+			return fmt.Errorf("failed to read socks4a host: %w", err)
+		}
+		ctx, ip, err = resolver.Resolve(ctx, host)
+		if err != nil {
+			writeSocks4Reply(conn, socks4Rejected)
+			return fmt.Errorf("failed to resolve %s: %w", host, err)
+		}
+	}
+	rec.record(conn.RemoteAddr(), accessTarget{command: "connect", host: host, ip: ip, port: int(port)})
+
+	// 分流规则中直连的域名不会被解析，直接按域名拨号
+	dialHost := host
+	if ip != nil {
+		dialHost = ip.String()
+	}
+	target, err := dial(ctx, "tcp", net.JoinHostPort(dialHost, strconv.Itoa(int(port))))
+	if err != nil {
+		writeSocks4Reply(conn, socks4Rejected)
+		return fmt.Errorf("failed to dial %s:%d: %w", dialHost, port, err)
+	}
+	defer target.Close()
+
+	if err := writeSocks4Reply(conn, socks4Granted); err != nil {
+		return err
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		io.Copy(target, conn)
+		target.Close()
+	}()
+	io.Copy(conn, target)
+	conn.Close()
+	wg.Wait()
+	return nil
+}
+
+// readNullTerminated 读取以0结尾的字符串
+func readNullTerminated(r *bufio.Reader) (string, error) {
+	var b []byte
+	for len(b) <= maxSocks4Field {
+		c, err := r.ReadByte()
+		if err != nil {
+			return "", err
+		}
+		if c == 0 {
+			return string(b), nil
+		}
+		b = append(b, c)
+	}
+	return "", errors.New("field too long")
+}
+
+// writeSocks4Reply 写入SOCKS4响应，DSTPORT与DSTIP字段会被客户端忽略
+func writeSocks4Reply(w io.Writer, code byte) error {
+	_, err := w.Write([]byte{0x00, code, 0, 0, 0, 0, 0, 0})
+	return err
+}
@@ -0,0 +1,260 @@
+package socks
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/HynoR/uscf/internal/logger"
+	"github.com/HynoR/uscf/service/tunnel"
+	"github.com/things-go/go-socks5"
+	"github.com/things-go/go-socks5/statute"
+)
+
+// maxUDPPacketSize 是单个UDP数据报的最大长度
+const maxUDPPacketSize = 64 * 1024
+
+// udpAssociation 负责单个UDP ASSOCIATE请求的数据报中继
+// 中继的生命周期与发起请求的TCP控制连接绑定，控制连接关闭时所有UDP流一并关闭
+type udpAssociation struct {
+	ctx         context.Context
+	dial        tunnel.DialFunc
+	resolver    socks5.NameResolver
+	idleTimeout time.Duration
+	clientIP    net.IP
+	clientPort  int
+
+	relay      *net.UDPConn
+	lastActive atomic.Int64 // 最近一次收发数据报的时间（UnixNano）
+
+	mu      sync.Mutex
+	client  *net.UDPAddr        // 客户端实际发送数据报的地址
+	targets map[string]net.Conn // 按目标地址区分的隧道内UDP连接
+}
+
+// newAssociateHandler 返回通过隧道转发UDP数据报的 UDP ASSOCIATE 处理器
+func newAssociateHandler(dial tunnel.DialFunc, resolver socks5.NameResolver, idleTimeout time.Duration) func(ctx context.Context, writer io.Writer, request *socks5.Request) error {
+	return func(ctx context.Context, writer io.Writer, request *socks5.Request) error {
+		// 在客户端连接的本地地址上监听，使返回的BND.ADDR可被客户端直接使用
+		var bindIP net.IP
+		if local, ok := request.LocalAddr.(*net.TCPAddr); ok {
+			bindIP = local.IP
+		}
+		relay, err := net.ListenUDP("udp", &net.UDPAddr{IP: bindIP})
+		if err != nil {
+			if err := socks5.SendReply(writer, statute.RepServerFailure, nil); err != nil {
+				return fmt.Errorf("failed to send reply: %w", err)
+			}
+			return fmt.Errorf("failed to listen udp: %w", err)
+		}
+		defer relay.Close()
+
+		if err := socks5.SendReply(writer, statute.RepSuccess, relay.LocalAddr()); err != nil {
+			return fmt.Errorf("failed to send reply: %w", err)
+		}
+
+		ctx, cancel := context.WithCancel(ctx)
+		defer cancel()
+
+		a := &udpAssociation{
+			ctx:         ctx,
+			dial:        dial,
+			resolver:    resolver,
+			idleTimeout: idleTimeout,
+			relay:       relay,
+			targets:     make(map[string]net.Conn),
+		}
+		if remote, ok := request.RemoteAddr.(*net.TCPAddr); ok {
+			a.clientIP = remote.IP
+		}
+		if request.DestAddr != nil {
+			// 客户端声明了发送端口时只接受来自该端口的数据报
+			a.clientPort = request.DestAddr.Port
+		}
+		a.touch()
+		defer a.closeTargets()
+
+		go func() {
+			a.serve()
+			cancel()
+		}()
+
+		return a.waitControl(request.Reader)
+	}
+}
+
+// waitControl 阻塞直到TCP控制连接关闭或中继结束
+// 控制连接上的空闲超时在UDP仍有流量时被忽略
+func (a *udpAssociation) waitControl(r io.Reader) error {
+	done := make(chan error, 1)
+	go func() {
+		buf := make([]byte, 512)
+		for {
+			if _, err := r.Read(buf); err != nil {
+				var netErr net.Error
+				if errors.As(err, &netErr) && netErr.Timeout() && !a.idle() {
+					continue
+				}
+				done <- err
+				return
+			}
+		}
+	}()
+
+	select {
+	case <-a.ctx.Done():
+		return nil
+	case err := <-done:
+		a.relay.Close()
+		if errors.Is(err, io.EOF) || errors.Is(err, net.ErrClosed) {
+			return nil
+		}
+		return err
+	}
+}
+
+// serve 读取客户端发来的数据报并转发到隧道内的目标地址
+func (a *udpAssociation) serve() {
+	buf := make([]byte, maxUDPPacketSize)
+	for {
+		if a.idleTimeout > 0 {
+			a.relay.SetReadDeadline(time.Now().Add(a.idleTimeout))
+		}
+		n, src, err := a.relay.ReadFromUDP(buf)
+		if err != nil {
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() && !a.idle() {
+				continue
+			}
+			return
+		}
+		if !a.allowed(src) {
+			continue
+		}
+
+		pk, err := statute.ParseDatagram(buf[:n])
+		if err != nil || pk.Frag != 0 {
+			// 不支持分片的数据报
+			continue
+		}
+
+		target, err := a.target(src, pk)
+		if err != nil {
+			logger.Logger.Debugf("UDP associate: failed to reach %s: %v", pk.DstAddr.String(), err)
+			continue
+		}
+		if _, err := target.Write(pk.Data); err != nil {
+			logger.Logger.Debugf("UDP associate: failed to write to %s: %v", pk.DstAddr.String(), err)
+			continue
+		}
+		a.touch()
+	}
+}
+
+// allowed 检查数据报是否来自发起 UDP ASSOCIATE 的客户端
+func (a *udpAssociation) allowed(src *net.UDPAddr) bool {
+	if a.clientIP != nil && !a.clientIP.Equal(src.IP) {
+		return false
+	}
+	if a.clientPort != 0 && a.clientPort != src.Port {
+		return false
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.client == nil {
+		a.client = src
+	}
+	return a.client.Port == src.Port
+}
+
+// target 返回目标地址对应的隧道内UDP连接，不存在时创建并启动回程转发
+func (a *udpAssociation) target(src *net.UDPAddr, pk statute.Datagram) (net.Conn, error) {
+	key := pk.DstAddr.String()
+
+	a.mu.Lock()
+	conn, ok := a.targets[key]
+	a.mu.Unlock()
+	if ok {
+		return conn, nil
+	}
+
+	ctx, addr := a.ctx, pk.DstAddr
+	if addr.FQDN != "" {
+		var err error
+		ctx, addr.IP, err = a.resolver.Resolve(ctx, addr.FQDN)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// 分流规则中直连的域名不会被解析，此时 String 返回域名
+	conn, err := a.dial(ctx, "udp", addr.String())
+	if err != nil {
+		return nil, err
+	}
+
+	a.mu.Lock()
+	if existing, ok := a.targets[key]; ok {
+		a.mu.Unlock()
+		conn.Close()
+		return existing, nil
+	}
+	a.targets[key] = conn
+	a.mu.Unlock()
+
+	go a.reply(conn, key, src, pk.Header())
+	return conn, nil
+}
+
+// reply 将目标返回的数据报加上SOCKS5头部后发回客户端
+// 隧道内连接由 TimeoutConn 管理空闲超时，超时后该目标的转发结束
+func (a *udpAssociation) reply(conn net.Conn, key string, client *net.UDPAddr, header []byte) {
+	defer func() {
+		conn.Close()
+		a.mu.Lock()
+		if a.targets[key] == conn {
+			delete(a.targets, key)
+		}
+		a.mu.Unlock()
+	}()
+
+	buf := make([]byte, len(header)+maxUDPPacketSize)
+	copy(buf, header)
+	for {
+		n, err := conn.Read(buf[len(header):])
+		if err != nil {
+			return
+		}
+		if _, err := a.relay.WriteToUDP(buf[:len(header)+n], client); err != nil {
+			return
+		}
+		a.touch()
+	}
+}
+
+func (a *udpAssociation) touch() {
+	a.lastActive.Store(time.Now().UnixNano())
+}
+
+// idle 报告中继是否已超过空闲超时没有任何数据报
+func (a *udpAssociation) idle() bool {
+	if a.idleTimeout <= 0 {
+		return false
+	}
+	return time.Since(time.Unix(0, a.lastActive.Load())) >= a.idleTimeout
+}
+
+func (a *udpAssociation) closeTargets() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for key, conn := range a.targets {
+		conn.Close()
+		delete(a.targets, key)
+	}
+}
@@ -0,0 +1,115 @@
+package tunnel
+
+import (
+	"context"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/HynoR/uscf/api"
+)
+
+// Member is one of the tunnels a balanced dialer spreads connections across. Dial
+// opens a connection through the tunnel, such as the DialContext method of its
+// network stack.
+type Member struct {
+	Dial  DialFunc
+	Stats *api.TunnelStats
+}
+
+// NewBalancedDialer returns a DialFunc like NewDialer that spreads connections across
+// the tunnels of members. With the least_connections mode each connection goes to the
+// tunnel with the fewest open connections, otherwise the tunnels take turns. Tunnels
+// that are not connected are skipped as long as another one is.
+func NewBalancedDialer(members []Member, mode string, connectionTimeout, idleTimeout time.Duration) DialFunc {
+	b := &balancer{
+		stats:      make([]*api.TunnelStats, len(members)),
+		open:       make([]atomic.Int64, len(members)),
+		leastConns: mode == "least_connections",
+	}
+	dials := make([]DialFunc, len(members))
+	for i, m := range members {
+		b.stats[i] = m.Stats
+		dials[i] = newDialer(b.counted(i, m.Dial), connectionTimeout, idleTimeout)
+	}
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		return dials[b.pick()](ctx, network, addr)
+	}
+}
+
+// balancer picks the tunnel for each connection and counts the open connections of
+// every tunnel.
+type balancer struct {
+	stats      []*api.TunnelStats
+	open       []atomic.Int64
+	next       atomic.Uint64
+	leastConns bool
+}
+
+// pick returns the index of the tunnel for the next connection. When no tunnel is
+// connected it still returns one, as the dial fails or waits for a reconnect either way.
+func (b *balancer) pick() int {
+	n := len(b.stats)
+	if !b.leastConns {
+		// A skipped tunnel uses up its turn, so the connected ones still alternate evenly.
+		for i := 0; i < n; i++ {
+			if j := b.turn(); b.stats[j].Connected() {
+				return j
+			}
+		}
+		return b.turn()
+	}
+
+	// Ties go to the tunnels in turn.
+	start := b.turn()
+	best := -1
+	for i := 0; i < n; i++ {
+		j := (start + i) % n
+		if b.stats[j].Connected() && (best < 0 || b.open[j].Load() < b.open[best].Load()) {
+			best = j
+		}
+	}
+	if best < 0 {
+		return start
+	}
+	return best
+}
+
+// turn returns the next tunnel in round-robin order.
+func (b *balancer) turn() int {
+	return int((b.next.Add(1) - 1) % uint64(len(b.stats)))
+}
+
+// counted returns a dial function for tunnel i whose connections count as open
+// until they are closed.
+func (b *balancer) counted(i int, dial DialFunc) DialFunc {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		conn, err := dial(ctx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+		b.open[i].Add(1)
+		return &countedConn{Conn: conn, release: func() { b.open[i].Add(-1) }}, nil
+	}
+}
+
+// countedConn calls release once when it is closed.
+type countedConn struct {
+	net.Conn
+	release func()
+	once    sync.Once
+}
+
+func (c *countedConn) Close() error {
+	c.once.Do(c.release)
+	return c.Conn.Close()
+}
+
+// CloseWrite half-closes the connection if supported, otherwise closes it.
+func (c *countedConn) CloseWrite() error {
+	if cw, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return c.Close()
+}
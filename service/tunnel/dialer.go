@@ -0,0 +1,166 @@
+package tunnel
+
+import (
+	"context"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/HynoR/uscf/models"
+	"golang.zx2c4.com/wireguard/tun/netstack"
+)
+
+// happyEyeballsDelay is how long a connection attempt gets before the next address is
+// tried in parallel, as recommended by RFC 8305.
+const happyEyeballsDelay = 250 * time.Millisecond
+
+// DialFunc dials a destination address, typically through the tunnel network stack.
+type DialFunc func(ctx context.Context, network, addr string) (net.Conn, error)
+
+// NewDialer returns a DialFunc that dials through netTun, bounding each dial by
+// connectionTimeout and wrapping the resulting connection with idleTimeout.
+// TCP dials to an address recorded with WithAddrs race all of the recorded
+// addresses, alternating between IPv4 and IPv6.
+func NewDialer(netTun *netstack.Net, connectionTimeout, idleTimeout time.Duration) DialFunc {
+	return newDialer(netTun.DialContext, connectionTimeout, idleTimeout)
+}
+
+// newDialer implements NewDialer on top of dial, which opens a single connection
+// through the tunnel.
+func newDialer(dial DialFunc, connectionTimeout, idleTimeout time.Duration) DialFunc {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		dctx, cancel := context.WithTimeout(ctx, connectionTimeout)
+		defer cancel()
+
+		var conn net.Conn
+		var err error
+		if targets := raceTargets(ctx, network, addr); len(targets) > 1 {
+			conn, err = dialParallel(dctx, dial, network, targets)
+		} else {
+			conn, err = dial(dctx, network, addr)
+		}
+		if err != nil {
+			return nil, err
+		}
+		return &models.TimeoutConn{Conn: conn, IdleTimeout: idleTimeout}, nil
+	}
+}
+
+type addrsKey struct{}
+
+// WithAddrs records all resolved addresses of the host being dialed, so that the
+// dialer can fall back to the other addresses when the first one does not answer.
+func WithAddrs(ctx context.Context, ips []net.IP) context.Context {
+	return context.WithValue(ctx, addrsKey{}, ips)
+}
+
+// raceTargets returns the addresses to race for a TCP dial to addr: addr first, then
+// the other recorded addresses with the address families interleaved.
+// It returns nil when there is nothing to race.
+func raceTargets(ctx context.Context, network, addr string) []string {
+	if !strings.HasPrefix(network, "tcp") {
+		return nil
+	}
+	ips, _ := ctx.Value(addrsKey{}).([]net.IP)
+	if len(ips) < 2 {
+		return nil
+	}
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil
+	}
+	first := net.ParseIP(host)
+	if first == nil {
+		return nil
+	}
+
+	var same, other []net.IP
+	found := false
+	for _, ip := range ips {
+		switch {
+		case ip.Equal(first):
+			found = true
+		case (ip.To4() != nil) == (first.To4() != nil):
+			same = append(same, ip)
+		default:
+			other = append(other, ip)
+		}
+	}
+	if !found {
+		return nil
+	}
+
+	// Interleave the families, trying the other family right after the first address.
+	targets := []string{addr}
+	for len(same) > 0 || len(other) > 0 {
+		if len(other) > 0 {
+			targets = append(targets, net.JoinHostPort(other[0].String(), port))
+			other = other[1:]
+		}
+		if len(same) > 0 {
+			targets = append(targets, net.JoinHostPort(same[0].String(), port))
+			same = same[1:]
+		}
+	}
+	return targets
+}
+
+// dialParallel dials targets in order, starting the next attempt when the previous
+// one fails or has not connected within happyEyeballsDelay. The first connection
+// established wins and the remaining attempts are canceled.
+func dialParallel(ctx context.Context, dial DialFunc, network string, targets []string) (net.Conn, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	type result struct {
+		conn net.Conn
+		err  error
+	}
+	results := make(chan result, len(targets))
+	next, pending := 0, 0
+	start := func() {
+		addr := targets[next]
+		next++
+		pending++
+		go func() {
+			conn, err := dial(ctx, network, addr)
+			results <- result{conn, err}
+		}()
+	}
+
+	start()
+	timer := time.NewTimer(happyEyeballsDelay)
+	defer timer.Stop()
+
+	var firstErr error
+	for pending > 0 {
+		select {
+		case <-timer.C:
+			if next < len(targets) {
+				start()
+				timer.Reset(happyEyeballsDelay)
+			}
+		case r := <-results:
+			pending--
+			if r.err == nil {
+				// Close connections established by attempts that lost the race.
+				go func(n int) {
+					for ; n > 0; n-- {
+						if r := <-results; r.conn != nil {
+							r.conn.Close()
+						}
+					}
+				}(pending)
+				return r.conn, nil
+			}
+			if firstErr == nil {
+				firstErr = r.err
+			}
+			if next < len(targets) {
+				start()
+				timer.Reset(happyEyeballsDelay)
+			}
+		}
+	}
+	return nil, firstErr
+}
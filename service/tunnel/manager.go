@@ -7,13 +7,13 @@ import (
 
 // Manager abstracts the tunnel maintenance logic so it can be easily mocked.
 type Manager interface {
-	MaintainTunnel(ctx context.Context, cfg api.ConnectionConfig, dev api.TunnelDevice)
+	MaintainTunnel(ctx context.Context, cfg api.ConnectionConfig, dev api.TunnelDevice) error
 }
 
 // DefaultManager uses api.MaintainTunnel for production.
 type DefaultManager struct{}
 
 // MaintainTunnel implements Manager by delegating to api.MaintainTunnel.
-func (DefaultManager) MaintainTunnel(ctx context.Context, cfg api.ConnectionConfig, dev api.TunnelDevice) {
-	api.MaintainTunnel(ctx, cfg, dev)
+func (DefaultManager) MaintainTunnel(ctx context.Context, cfg api.ConnectionConfig, dev api.TunnelDevice) error {
+	return api.MaintainTunnel(ctx, cfg, dev)
 }
@@ -0,0 +1,141 @@
+package tunnel
+
+import (
+	"context"
+	"net"
+	"net/netip"
+	"strings"
+	"time"
+
+	"github.com/HynoR/uscf/config"
+	"github.com/HynoR/uscf/internal/logger"
+	"github.com/HynoR/uscf/models"
+)
+
+// Router decides per destination whether to dial through the tunnel or directly
+// via the host network. A nil Router sends everything through the tunnel.
+type Router struct {
+	rules  ruleMatcher
+	invert bool
+
+	direct *net.Dialer
+	idle   time.Duration
+}
+
+// NewRouter parses the routing rules in cfg. Each rule is a CIDR, an IP address or a
+// domain suffix ("example.com" also matches its subdomains, a leading "*." is ignored).
+// Matching destinations are dialed directly, or with Invert they are the only ones
+// sent through the tunnel. Invalid rules are skipped with a warning. It returns nil
+// when no rules are configured.
+func NewRouter(cfg config.RoutingConfig, connectionTimeout, idleTimeout time.Duration) *Router {
+	if len(cfg.Rules) == 0 {
+		return nil
+	}
+
+	return &Router{
+		rules:  parseRules(cfg.Rules),
+		invert: cfg.Invert,
+		direct: &net.Dialer{Timeout: connectionTimeout},
+		idle:   idleTimeout,
+	}
+}
+
+// Direct reports whether host, a domain name or IP address, bypasses the tunnel.
+func (r *Router) Direct(host string) bool {
+	if r == nil {
+		return false
+	}
+	return r.rules.match(host) != r.invert
+}
+
+// ruleMatcher matches destinations against a list of routing rules.
+type ruleMatcher struct {
+	domains  []string // lower-case domain suffixes
+	prefixes []netip.Prefix
+}
+
+// parseRules parses the rules accepted by NewRouter, skipping invalid ones with a warning.
+func parseRules(rules []string) ruleMatcher {
+	var m ruleMatcher
+	for _, rule := range rules {
+		rule = strings.TrimSpace(rule)
+		if prefix, err := netip.ParsePrefix(rule); err == nil {
+			m.prefixes = append(m.prefixes, prefix.Masked())
+			continue
+		}
+		if addr, err := netip.ParseAddr(rule); err == nil {
+			m.prefixes = append(m.prefixes, netip.PrefixFrom(addr, addr.BitLen()))
+			continue
+		}
+		domain := strings.ToLower(strings.TrimSuffix(strings.TrimPrefix(rule, "*."), "."))
+		if domain == "" || strings.ContainsAny(domain, "/: ") {
+			logger.Logger.Warnf("Ignoring invalid routing rule %q", rule)
+			continue
+		}
+		m.domains = append(m.domains, domain)
+	}
+	return m
+}
+
+// empty reports whether no valid rules were configured.
+func (m ruleMatcher) empty() bool {
+	return len(m.domains) == 0 && len(m.prefixes) == 0
+}
+
+func (m ruleMatcher) match(host string) bool {
+	if addr, err := netip.ParseAddr(host); err == nil {
+		addr = addr.Unmap()
+		for _, prefix := range m.prefixes {
+			if prefix.Contains(addr) {
+				return true
+			}
+		}
+		return false
+	}
+
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	for _, domain := range m.domains {
+		if host == domain || strings.HasSuffix(host, "."+domain) {
+			return true
+		}
+	}
+	return false
+}
+
+// requestedHost returns the host recorded with WithHost, or the host part of addr.
+// The second result reports whether the host was recorded.
+func requestedHost(ctx context.Context, addr string) (string, bool) {
+	if host, ok := ctx.Value(hostKey{}).(string); ok {
+		return host, true
+	}
+	host, _, _ := net.SplitHostPort(addr)
+	return host, false
+}
+
+type hostKey struct{}
+
+// WithHost records the host name a connection was requested for, so that a dial to
+// the resolved IP is still routed by the name.
+func WithHost(ctx context.Context, host string) context.Context {
+	return context.WithValue(ctx, hostKey{}, host)
+}
+
+// Wrap returns a DialFunc that dials direct destinations itself and passes all others
+// to tunnelDial. The host recorded with WithHost takes precedence over the address.
+func (r *Router) Wrap(tunnelDial DialFunc) DialFunc {
+	if r == nil {
+		return tunnelDial
+	}
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		host, _ := requestedHost(ctx, addr)
+		if !r.Direct(host) {
+			return tunnelDial(ctx, network, addr)
+		}
+
+		conn, err := r.direct.DialContext(ctx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+		return &models.TimeoutConn{Conn: conn, IdleTimeout: r.idle}, nil
+	}
+}
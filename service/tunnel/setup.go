@@ -1,20 +1,23 @@
 package tunnel
 
 import (
-       "context"
-       "crypto/tls"
-       "fmt"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
 
-       "net"
-       "net/netip"
-       "time"
+	"net"
+	"net/netip"
+	"strconv"
+	"sync"
+	"time"
 
 	"github.com/HynoR/uscf/api"
 	"github.com/HynoR/uscf/config"
-       "github.com/HynoR/uscf/internal"
-       "github.com/HynoR/uscf/internal/logger"
-       "golang.zx2c4.com/wireguard/tun"
-       "golang.zx2c4.com/wireguard/tun/netstack"
+	"github.com/HynoR/uscf/internal"
+	"github.com/HynoR/uscf/internal/logger"
+	"golang.zx2c4.com/wireguard/tun"
+	"golang.zx2c4.com/wireguard/tun/netstack"
 )
 
 // PrepareTLSConfig creates a TLS configuration for the MASQUE tunnel.
@@ -43,11 +46,9 @@ func PrepareTLSConfig(cfg *config.Config) (*tls.Config, error) {
 
 // PrepareNetworkConfig returns tunnel endpoint and address configuration.
 func PrepareNetworkConfig(cfg *config.Config) (*net.UDPAddr, []netip.Addr, []netip.Addr, error) {
-	var endpoint *net.UDPAddr
-	if cfg.Tunnel.UseIPv6 {
-		endpoint = &net.UDPAddr{IP: net.ParseIP(cfg.EndpointV6), Port: cfg.Tunnel.ConnectPort}
-	} else {
-		endpoint = &net.UDPAddr{IP: net.ParseIP(cfg.EndpointV4), Port: cfg.Tunnel.ConnectPort}
+	endpoint, err := selectEndpoint(cfg)
+	if err != nil {
+		return nil, nil, nil, err
 	}
 
 	var locals []netip.Addr
@@ -78,6 +79,122 @@ func PrepareNetworkConfig(cfg *config.Config) (*net.UDPAddr, []netip.Addr, []net
 	return endpoint, locals, dnsAddrs, nil
 }
 
+// selectEndpoint picks the MASQUE endpoint by tunnel.address_preference. The preferred
+// family is used when its endpoint is configured. With auto, a preferred endpoint that
+// cannot be resolved or used from this host falls back to the other family.
+func selectEndpoint(cfg *config.Config) (*net.UDPAddr, error) {
+	type candidate struct{ host, network string }
+	preferred, other := candidate{cfg.EndpointV4, "ip4"}, candidate{cfg.EndpointV6, "ip6"}
+	if cfg.Tunnel.PreferIPv6Endpoint() {
+		preferred, other = other, preferred
+	}
+	if preferred.host == "" {
+		preferred, other = other, candidate{}
+	}
+
+	endpoint, err := prepareEndpoint(cfg, preferred.host, preferred.network)
+	auto := cfg.Tunnel.AddressPreference == "" || cfg.Tunnel.AddressPreference == "auto"
+	if err == nil || !auto || other.host == "" {
+		return endpoint, err
+	}
+	logger.Logger.Warnf("Endpoint %s is unusable, trying the %s endpoint: %v", preferred.host, other.network, err)
+	if endpoint, otherErr := prepareEndpoint(cfg, other.host, other.network); otherErr == nil {
+		return endpoint, nil
+	}
+	return nil, err
+}
+
+// prepareEndpoint resolves host and checks that the tunnel socket can reach it.
+func prepareEndpoint(cfg *config.Config, host, network string) (*net.UDPAddr, error) {
+	ip, err := resolveEndpoint(host, network)
+	if err != nil {
+		return nil, err
+	}
+	endpoint := &net.UDPAddr{IP: ip, Port: cfg.Tunnel.ConnectPort}
+	if err := UDPOptions(cfg).Check(endpoint); err != nil {
+		return nil, fmt.Errorf("cannot create tunnel socket: %w", err)
+	}
+	return endpoint, nil
+}
+
+// EndpointNetwork returns "ip4" or "ip6" for the address family of endpoint.
+func EndpointNetwork(endpoint *net.UDPAddr) string {
+	if endpoint.IP.To4() != nil {
+		return "ip4"
+	}
+	return "ip6"
+}
+
+// resolveEndpoint returns host as an IP, looking it up with the system resolver
+// when it is a hostname. network is "ip4" or "ip6".
+func resolveEndpoint(host, network string) (net.IP, error) {
+	if ip := net.ParseIP(host); ip != nil {
+		return ip, nil
+	}
+	if host == "" {
+		return nil, fmt.Errorf("no endpoint configured")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	ips, err := net.DefaultResolver.LookupIP(ctx, network, host)
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve endpoint %s: %w", host, err)
+	}
+	if len(ips) == 0 {
+		return nil, fmt.Errorf("failed to resolve endpoint %s: no %s addresses", host, network)
+	}
+	if len(ips) > 1 {
+		logger.Logger.Infof("Endpoint %s resolved to %d addresses, using %s", host, len(ips), ips[0])
+	} else {
+		logger.Logger.Infof("Endpoint %s resolved to %s", host, ips[0])
+	}
+	return ips[0], nil
+}
+
+// failoverEndpoints resolves the backup endpoints from cfg.Tunnel.Endpoints in the
+// address family given by network. Entries without a port use connect_port; entries
+// that fail to resolve are skipped.
+func failoverEndpoints(cfg *config.Config, network string) []*net.UDPAddr {
+	var endpoints []*net.UDPAddr
+	for _, entry := range cfg.Tunnel.Endpoints {
+		endpoint, err := ResolveEndpointEntry(entry, cfg.Tunnel.ConnectPort, network)
+		if err != nil {
+			logger.Logger.Warnf("Ignoring endpoint %q: %v", entry, err)
+			continue
+		}
+		endpoints = append(endpoints, endpoint)
+	}
+	return endpoints
+}
+
+// ResolveEndpointEntry resolves an endpoint given as host or host:port. Entries
+// without a port use defaultPort. network is "ip4" or "ip6".
+func ResolveEndpointEntry(entry string, defaultPort int, network string) (*net.UDPAddr, error) {
+	host, port := entry, defaultPort
+	if h, p, err := net.SplitHostPort(entry); err == nil {
+		n, err := strconv.Atoi(p)
+		if err != nil || n <= 0 || n > 65535 {
+			return nil, fmt.Errorf("invalid port %q", p)
+		}
+		host, port = h, n
+	}
+	ip, err := resolveEndpoint(host, network)
+	if err != nil {
+		return nil, err
+	}
+	return &net.UDPAddr{IP: ip, Port: port}, nil
+}
+
+// UDPOptions returns the socket options for the tunnel's UDP socket.
+func UDPOptions(cfg *config.Config) api.UDPOptions {
+	return api.UDPOptions{
+		Mark:        cfg.Tunnel.FwMark,
+		LocalAddr:   cfg.Tunnel.LocalAddress,
+		SNIFragment: cfg.Tunnel.SNIFragment,
+	}
+}
+
 // TimeoutSettings returns the connection and idle timeout values.
 func TimeoutSettings(cfg *config.Config) (time.Duration, time.Duration) {
 	conn := cfg.Tunnel.ConnectionTimeout.Duration()
@@ -91,33 +208,237 @@ func TimeoutSettings(cfg *config.Config) (time.Duration, time.Duration) {
 	return conn, idle
 }
 
+// defaultMTU is the tunnel MTU known to work on every path.
+const defaultMTU = 1280
+
+// mtuProbeTarget is the address probed when tunnel.dns has no IPv4 server.
+var mtuProbeTarget = netip.MustParseAddr("1.1.1.1")
+
+// mtuWarning makes the non-default MTU warning appear once per process rather than
+// once per per-client tunnel.
+var mtuWarning sync.Once
+
+// keepaliveNotice makes the disabled keepalive notice appear once per process rather
+// than once per per-client tunnel.
+var keepaliveNotice sync.Once
+
+// ResolveMTU returns cfg unchanged unless tunnel.mtu is "auto". Then it probes the
+// largest MTU that round-trips through a fresh tunnel connection, pinging the first
+// IPv4 DNS server, and returns a copy of cfg using that MTU. If probing fails the
+// copy uses the default 1280.
+func ResolveMTU(ctx context.Context, tlsCfg *tls.Config, endpoint *net.UDPAddr, cfg *config.Config) *config.Config {
+	if cfg.Tunnel.MTU != config.MTUAuto {
+		return cfg
+	}
+	resolved := *cfg
+	resolved.Tunnel.MTU = defaultMTU
+
+	src, err := netip.ParseAddr(cfg.IPv4)
+	if err != nil || cfg.Tunnel.NoTunnelIPv4 {
+		logger.Logger.Warnf("MTU probing needs IPv4 in the tunnel, using MTU %d", defaultMTU)
+		return &resolved
+	}
+	dst := mtuProbeTarget
+	for _, dns := range cfg.Tunnel.DNS {
+		if addr, err := netip.ParseAddr(dns); err == nil && addr.Is4() {
+			dst = addr
+			break
+		}
+	}
+
+	logger.Logger.Infof("Probing the tunnel MTU by pinging %s", dst)
+	mtu, err := api.ProbeMTU(ctx, oneOffConnectionConfig(tlsCfg, endpoint, cfg), src, dst)
+	if err != nil {
+		logger.Logger.Warnf("MTU probing failed, using MTU %d: %v", defaultMTU, err)
+		return &resolved
+	}
+	logger.Logger.Infof("Probed tunnel MTU: %d", mtu)
+	resolved.Tunnel.MTU = config.MTU(mtu)
+	// The probed MTU is known to work on this path, so it does not need the warning.
+	mtuWarning.Do(func() {})
+	return &resolved
+}
+
+// Handshake establishes a single tunnel connection to endpoint, bounded by
+// connection_timeout, and closes it again. It returns how long the handshake took.
+func Handshake(ctx context.Context, tlsCfg *tls.Config, endpoint *net.UDPAddr, cfg *config.Config) (time.Duration, error) {
+	conf := oneOffConnectionConfig(tlsCfg, endpoint, cfg)
+	ctx, cancel := context.WithTimeout(ctx, conf.ConnectTimeout)
+	defer cancel()
+
+	start := time.Now()
+	_, release, err := conf.Connector.Connect(ctx, conf)
+	if err != nil {
+		if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			return 0, fmt.Errorf("handshake timed out after %v: %w", conf.ConnectTimeout, err)
+		}
+		return 0, err
+	}
+	rtt := time.Since(start)
+	release()
+	return rtt, nil
+}
+
+// oneOffConnectionConfig returns the settings for a tunnel connection made outside
+// MaintainTunnel, such as a handshake check or the MTU probe.
+func oneOffConnectionConfig(tlsCfg *tls.Config, endpoint *net.UDPAddr, cfg *config.Config) api.ConnectionConfig {
+	connTimeout, _ := TimeoutSettings(cfg)
+	return api.ConnectionConfig{
+		TLSConfig:         tlsCfg,
+		KeepAlivePeriod:   cfg.Tunnel.KeepalivePeriod.Duration(),
+		InitialPacketSize: cfg.Tunnel.InitialPacketSize,
+		Endpoint:          endpoint,
+		ConnectURI:        cfg.Tunnel.ConnectURI,
+		ConnectTimeout:    connTimeout,
+		UDPOptions:        UDPOptions(cfg),
+		Connector:         newConnector(cfg),
+	}
+}
+
 // CreateTun sets up the virtual network interface for the tunnel.
 func CreateTun(local, dns []netip.Addr, cfg *config.Config) (tun.Device, *netstack.Net, error) {
-       if cfg.Tunnel.MTU != 1280 {
-               logger.Logger.Warn("Warning: MTU is not the default 1280. Packet loss may occur")
-       }
-	dev, netTun, err := netstack.CreateNetTUN(local, dns, cfg.Tunnel.MTU)
+	if cfg.Tunnel.MTU < config.MinMTU || cfg.Tunnel.MTU > config.MaxMTU {
+		return nil, nil, fmt.Errorf("invalid MTU %d: must be between %d and %d", cfg.Tunnel.MTU, config.MinMTU, config.MaxMTU)
+	}
+	if cfg.Tunnel.MTU != defaultMTU {
+		mtuWarning.Do(func() {
+			logger.Logger.Warnf("MTU %d is not the default %d. Packet loss may occur", cfg.Tunnel.MTU, defaultMTU)
+		})
+	}
+	dev, netTun, err := netstack.CreateNetTUN(local, dns, int(cfg.Tunnel.MTU))
 	if err != nil {
 		return nil, nil, fmt.Errorf("failed to create virtual TUN device: %w", err)
 	}
 	return dev, netTun, nil
 }
 
-// StartTunnel launches the MASQUE tunnel in a background goroutine.
-func StartTunnel(ctx context.Context, m Manager, tlsCfg *tls.Config, endpoint *net.UDPAddr, cfg *config.Config, dev tun.Device) {
-	conf := api.ConnectionConfig{
+// StartTunnel launches the MASQUE tunnel in a background goroutine and returns its live
+// statistics and a channel that is closed once the tunnel has stopped. If the tunnel
+// stops with an error, such as after max_reconnect_attempts, the error is sent on the
+// channel before it is closed.
+func StartTunnel(ctx context.Context, m Manager, tlsCfg *tls.Config, endpoint *net.UDPAddr, cfg *config.Config, dev tun.Device) (*api.TunnelStats, <-chan error) {
+	return StartTunnelWithConfig(ctx, m, NewConnectionConfig(tlsCfg, endpoint, cfg), dev)
+}
+
+// StartTunnelWithConfig is like StartTunnel but takes connection settings built by
+// NewConnectionConfig, so that the caller can adjust them first.
+func StartTunnelWithConfig(ctx context.Context, m Manager, conf api.ConnectionConfig, dev tun.Device) (*api.TunnelStats, <-chan error) {
+	done := make(chan error, 1)
+	go func() {
+		defer close(done)
+		if err := m.MaintainTunnel(ctx, conf, api.NewNetstackAdapter(dev)); err != nil {
+			done <- err
+		}
+	}()
+	return conf.Stats, done
+}
+
+// WaitStopped waits for a tunnel started with StartTunnel to stop, so that its QUIC
+// connection is closed cleanly before the process exits. It gives up after twice
+// api.CloseTimeout.
+func WaitStopped(done <-chan error) {
+	select {
+	case <-done:
+	case <-time.After(2 * api.CloseTimeout):
+		logger.Logger.Debug("Tunnel did not stop in time, exiting anyway")
+	}
+}
+
+// NewConnectionConfig builds the tunnel connection settings from cfg, including the
+// resolved failover endpoints and a fresh statistics collector.
+func NewConnectionConfig(tlsCfg *tls.Config, endpoint *net.UDPAddr, cfg *config.Config) api.ConnectionConfig {
+	connTimeout, idleTimeout := TimeoutSettings(cfg)
+	statsFile := ""
+	if !cfg.Tunnel.PerClient {
+		// 共享隧道在空闲后会立即重建，关闭它没有意义
+		idleTimeout = 0
+		// 每个客户端的隧道各有统计信息，不能写入同一个文件
+		statsFile = cfg.Tunnel.StatsFile
+	}
+	if cfg.Tunnel.KeepalivePeriod <= 0 {
+		keepaliveNotice.Do(func() {
+			logger.Logger.Info("QUIC keepalive disabled, an idle tunnel will time out and be re-established")
+		})
+	}
+	return api.ConnectionConfig{
 		TLSConfig:         tlsCfg,
 		KeepAlivePeriod:   cfg.Tunnel.KeepalivePeriod.Duration(),
 		InitialPacketSize: cfg.Tunnel.InitialPacketSize,
 		Endpoint:          endpoint,
-		MTU:               cfg.Tunnel.MTU,
-		MaxPacketRate:     8192,
-		MaxBurst:          1024,
-		ReconnectStrategy: &api.ExponentialBackoff{
-			InitialDelay: cfg.Tunnel.ReconnectDelay.Duration(),
-			MaxDelay:     5 * time.Minute,
-			Factor:       2.0,
-		},
-	}
-	go m.MaintainTunnel(ctx, conf, api.NewNetstackAdapter(dev))
+		ConnectURI:        cfg.Tunnel.ConnectURI,
+		ConnectTimeout:    connTimeout,
+		Endpoints:         append([]*net.UDPAddr{endpoint}, failoverEndpoints(cfg, EndpointNetwork(endpoint))...),
+		FailoverAfter:     cfg.Tunnel.FailoverAfter,
+		MaxReconnects:     cfg.Tunnel.MaxReconnectAttempts,
+		MTU:               int(cfg.Tunnel.MTU),
+		MaxPacketRate:     cfg.Tunnel.MaxPacketRate,
+		MaxBurst:          cfg.Tunnel.MaxBurst,
+		MaxBandwidth:      cfg.Tunnel.MaxBandwidthBps,
+		ReconnectStrategy: newBackoff(cfg),
+		Stats:             &api.TunnelStats{},
+		StatsInterval:     cfg.Tunnel.StatsInterval.Duration(),
+		StatsFile:         statsFile,
+		PacketDumpBytes:   cfg.Logging.PacketDumpBytes,
+		StallTimeout:      cfg.Tunnel.StallTimeout.Duration(),
+		IdleTimeout:       idleTimeout,
+		UDPOptions:        UDPOptions(cfg),
+		Connector:         newConnector(cfg),
+	}
+}
+
+// newConnector returns the connector for cfg.Tunnel.Transport. With the QUIC transport
+// and ws_fallback_after set, it falls back to the WebSocket relay after that many
+// consecutive failures.
+func newConnector(cfg *config.Config) api.Connector {
+	ws := api.WebSocketConnector{URL: cfg.Tunnel.WSURL}
+	if cfg.Tunnel.Transport == "ws" {
+		logger.Logger.Infof("Using the WebSocket transport via %s", ws.URL)
+		return ws
+	}
+	if cfg.Tunnel.WSURL != "" && cfg.Tunnel.WSFallbackAfter > 0 {
+		return &api.FallbackConnector{Primary: api.MasqueConnector{}, Fallback: ws, After: cfg.Tunnel.WSFallbackAfter}
+	}
+	return api.MasqueConnector{}
+}
+
+// newBackoff builds the reconnect strategy selected by cfg.Tunnel.ReconnectStrategy.
+// Unset tuning parameters fall back to their defaults, and unknown strategies fall
+// back to exponential backoff.
+func newBackoff(cfg *config.Config) api.BackoffStrategy {
+	t := cfg.Tunnel
+	maxDelay := t.ReconnectMaxDelay.Duration()
+	if maxDelay <= 0 {
+		maxDelay = 5 * time.Minute
+	}
+
+	switch t.ReconnectStrategy {
+	case "constant":
+		return &api.ConstantBackoff{
+			Delay:  t.ReconnectDelay.Duration(),
+			Jitter: 0.1,
+		}
+	case "linear":
+		step := t.ReconnectIncrement.Duration()
+		if step <= 0 {
+			step = time.Second
+		}
+		return &api.LinearBackoff{
+			InitialDelay: t.ReconnectDelay.Duration(),
+			Increment:    step,
+			MaxDelay:     maxDelay,
+		}
+	case "", "exponential":
+	default:
+		logger.Logger.Warnf("Unknown reconnect strategy %q, using exponential", t.ReconnectStrategy)
+	}
+
+	factor := t.ReconnectFactor
+	if factor <= 1 {
+		factor = 2.0
+	}
+	return &api.ExponentialBackoff{
+		InitialDelay: t.ReconnectDelay.Duration(),
+		MaxDelay:     maxDelay,
+		Factor:       factor,
+	}
 }
@@ -0,0 +1,159 @@
+package tunnel
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/HynoR/uscf/config"
+	"github.com/HynoR/uscf/internal/logger"
+	"golang.org/x/net/proxy"
+)
+
+// Upstream chains TCP connections leaving the tunnel through an upstream proxy: the
+// proxy is dialed through the tunnel and asked to connect to the destination. A nil
+// Upstream dials destinations directly through the tunnel.
+type Upstream struct {
+	proxy *url.URL
+	rules ruleMatcher // destinations that use the proxy, empty matches all
+}
+
+// NewUpstream returns the upstream proxy configured in cfg, or nil when none is set.
+// The proxy is a socks5, socks5h or http URL, optionally with credentials. With
+// socks5h and http the proxy resolves host names itself; with socks5 it is given the
+// address resolved through the tunnel. UpstreamRules, in the format of NewRouter's
+// rules, limit which destinations use the proxy.
+func NewUpstream(cfg config.RoutingConfig) *Upstream {
+	if cfg.Upstream == "" {
+		return nil
+	}
+	u, err := url.Parse(cfg.Upstream)
+	if err != nil || u.Host == "" {
+		logger.Logger.Warnf("Ignoring invalid upstream proxy %q", cfg.Upstream)
+		return nil
+	}
+	if u.Port() == "" {
+		port := "1080"
+		if u.Scheme == "http" {
+			port = "80"
+		}
+		u.Host = net.JoinHostPort(u.Hostname(), port)
+	}
+	return &Upstream{proxy: u, rules: parseRules(cfg.UpstreamRules)}
+}
+
+// Wrap returns a DialFunc that sends matching TCP connections through the upstream
+// proxy, using tunnelDial to reach the proxy. Other connections, including UDP, are
+// passed to tunnelDial unchanged.
+func (u *Upstream) Wrap(tunnelDial DialFunc) DialFunc {
+	if u == nil {
+		return tunnelDial
+	}
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		host, recorded := requestedHost(ctx, addr)
+		if !strings.HasPrefix(network, "tcp") || (!u.rules.empty() && !u.rules.match(host)) {
+			return tunnelDial(ctx, network, addr)
+		}
+
+		target := addr
+		if recorded && u.proxy.Scheme != "socks5" {
+			if _, port, err := net.SplitHostPort(addr); err == nil {
+				target = net.JoinHostPort(host, port)
+			}
+		}
+		// The proxy is not one of the destination's addresses, so skip Happy Eyeballs.
+		ctx = WithAddrs(ctx, nil)
+
+		var conn net.Conn
+		var err error
+		if u.proxy.Scheme == "http" {
+			conn, err = u.dialHTTP(ctx, tunnelDial, target)
+		} else {
+			conn, err = u.dialSOCKS(ctx, tunnelDial, target)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("upstream proxy %s: %w", u.proxy.Host, err)
+		}
+		return conn, nil
+	}
+}
+
+// dialSOCKS connects to target through a SOCKS5 proxy.
+func (u *Upstream) dialSOCKS(ctx context.Context, tunnelDial DialFunc, target string) (net.Conn, error) {
+	var auth *proxy.Auth
+	if u.proxy.User != nil {
+		password, _ := u.proxy.User.Password()
+		auth = &proxy.Auth{User: u.proxy.User.Username(), Password: password}
+	}
+	d, err := proxy.SOCKS5("tcp", u.proxy.Host, auth, forwardDialer(tunnelDial))
+	if err != nil {
+		return nil, err
+	}
+	return d.(proxy.ContextDialer).DialContext(ctx, "tcp", target)
+}
+
+// dialHTTP connects to target through an HTTP proxy with a CONNECT request.
+func (u *Upstream) dialHTTP(ctx context.Context, tunnelDial DialFunc, target string) (net.Conn, error) {
+	conn, err := tunnelDial(ctx, "tcp", u.proxy.Host)
+	if err != nil {
+		return nil, err
+	}
+
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: target},
+		Host:   target,
+		Header: make(http.Header),
+	}
+	if u.proxy.User != nil {
+		password, _ := u.proxy.User.Password()
+		credentials := base64.StdEncoding.EncodeToString([]byte(u.proxy.User.Username() + ":" + password))
+		req.Header.Set("Proxy-Authorization", "Basic "+credentials)
+	}
+	if err := req.Write(conn); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		conn.Close()
+		return nil, fmt.Errorf("CONNECT %s: %s", target, resp.Status)
+	}
+	// The destination may already have sent data behind the response.
+	if br.Buffered() > 0 {
+		return &bufferedConn{Conn: conn, r: br}, nil
+	}
+	return conn, nil
+}
+
+// forwardDialer adapts a DialFunc to the dialer interfaces of golang.org/x/net/proxy.
+type forwardDialer DialFunc
+
+func (d forwardDialer) Dial(network, addr string) (net.Conn, error) {
+	return d(context.Background(), network, addr)
+}
+
+func (d forwardDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	return d(ctx, network, addr)
+}
+
+// bufferedConn reads the data left in r before reading from the connection.
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
@@ -0,0 +1,107 @@
+//go:build linux
+
+package vpn
+
+import (
+	"fmt"
+	"net"
+	"net/netip"
+	"os/exec"
+	"strings"
+
+	"github.com/HynoR/uscf/internal/logger"
+	"golang.zx2c4.com/wireguard/tun"
+)
+
+// Supported reports whether VPN mode is available on this platform.
+const Supported = true
+
+func createTUN(name string, mtu int) (tun.Device, error) {
+	return tun.CreateTUN(name, mtu)
+}
+
+// hostConfig records changes made to the host network so they can be undone.
+// Addresses and routes on the TUN interface disappear with it; only the endpoint
+// bypass routes need to be removed explicitly.
+type hostConfig struct {
+	undo [][]string
+}
+
+// configureHost brings the interface up, assigns the tunnel addresses and installs routes.
+// Before the tunnel routes are added, each MASQUE endpoint gets a host route through its
+// current gateway so the tunnel's own traffic is not routed back into the tunnel.
+func configureHost(name string, mtu int, locals []netip.Addr, routes []netip.Prefix, endpoints []*net.UDPAddr) (*hostConfig, error) {
+	h := &hostConfig{}
+
+	if err := ipCmd("link", "set", "dev", name, "mtu", fmt.Sprint(mtu), "up"); err != nil {
+		return nil, err
+	}
+	for _, addr := range locals {
+		prefix := netip.PrefixFrom(addr, addr.BitLen())
+		if err := ipCmd("addr", "add", prefix.String(), "dev", name); err != nil {
+			return nil, err
+		}
+	}
+
+	seen := make(map[string]bool)
+	for _, ep := range endpoints {
+		ip := ep.IP.String()
+		if seen[ip] {
+			continue
+		}
+		seen[ip] = true
+		if err := h.bypass(ip); err != nil {
+			logger.Logger.Warnf("Failed to add bypass route for endpoint %s: %v", ip, err)
+		}
+	}
+
+	for _, route := range routes {
+		if err := ipCmd("route", "add", route.String(), "dev", name); err != nil {
+			h.restore()
+			return nil, err
+		}
+	}
+	return h, nil
+}
+
+// bypass pins the current route to ip as a host route.
+func (h *hostConfig) bypass(ip string) error {
+	out, err := exec.Command("ip", "route", "get", ip).Output()
+	if err != nil {
+		return fmt.Errorf("ip route get %s: %w", ip, err)
+	}
+
+	args := []string{"route", "add", ip}
+	fields := strings.Fields(string(out))
+	for i := 0; i+1 < len(fields); i++ {
+		switch fields[i] {
+		case "via", "dev":
+			args = append(args, fields[i], fields[i+1])
+		}
+	}
+	if err := ipCmd(args...); err != nil {
+		return err
+	}
+
+	args[1] = "del"
+	h.undo = append(h.undo, args)
+	return nil
+}
+
+// restore removes the bypass routes added by configureHost.
+func (h *hostConfig) restore() {
+	for _, args := range h.undo {
+		if err := ipCmd(args...); err != nil {
+			logger.Logger.Warnf("%v", err)
+		}
+	}
+	h.undo = nil
+}
+
+func ipCmd(args ...string) error {
+	out, err := exec.Command("ip", args...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("ip %s: %v: %s", strings.Join(args, " "), err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
@@ -0,0 +1,25 @@
+//go:build !linux
+
+package vpn
+
+import (
+	"net"
+	"net/netip"
+
+	"golang.zx2c4.com/wireguard/tun"
+)
+
+// Supported reports whether VPN mode is available on this platform.
+const Supported = false
+
+func createTUN(name string, mtu int) (tun.Device, error) {
+	return nil, ErrUnsupported
+}
+
+type hostConfig struct{}
+
+func configureHost(name string, mtu int, locals []netip.Addr, routes []netip.Prefix, endpoints []*net.UDPAddr) (*hostConfig, error) {
+	return nil, ErrUnsupported
+}
+
+func (h *hostConfig) restore() {}
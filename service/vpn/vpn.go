@@ -0,0 +1,181 @@
+package vpn
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/netip"
+	"sync/atomic"
+
+	"github.com/HynoR/uscf/api"
+	"github.com/HynoR/uscf/config"
+	"github.com/HynoR/uscf/internal/control"
+	"github.com/HynoR/uscf/internal/logger"
+	"github.com/HynoR/uscf/internal/metrics"
+	"github.com/HynoR/uscf/internal/sdnotify"
+	"github.com/HynoR/uscf/service/tunnel"
+)
+
+// defaultInterfaceName is used when vpn.interface_name is not set.
+const defaultInterfaceName = "uscf0"
+
+// ErrUnsupported is returned by Run on platforms without VPN mode support.
+var ErrUnsupported = errors.New("VPN mode is not supported on this platform")
+
+// Service routes host traffic through the MASQUE tunnel via an OS TUN interface.
+type Service struct {
+	Tunnel tunnel.Manager
+
+	stats atomic.Pointer[api.TunnelStats]
+}
+
+// New creates a Service with the given tunnel manager.
+func New(m tunnel.Manager) *Service {
+	return &Service{Tunnel: m}
+}
+
+// Run creates the TUN interface, assigns the tunnel addresses, installs routes and
+// maintains the tunnel until ctx is canceled. Host changes are undone on return.
+func (s *Service) Run(ctx context.Context, cfg *config.Config) error {
+	if !Supported {
+		return ErrUnsupported
+	}
+
+	tlsCfg, err := tunnel.PrepareTLSConfig(cfg)
+	if err != nil {
+		return err
+	}
+
+	endpoint, locals, _, err := tunnel.PrepareNetworkConfig(cfg)
+	if err != nil {
+		return err
+	}
+
+	routes, err := parseRoutes(cfg.VPN.Routes, locals)
+	if err != nil {
+		return err
+	}
+
+	name := cfg.VPN.InterfaceName
+	if name == "" {
+		name = defaultInterfaceName
+	}
+
+	cfg = tunnel.ResolveMTU(ctx, tlsCfg, endpoint, cfg)
+	dev, err := createTUN(name, int(cfg.Tunnel.MTU))
+	if err != nil {
+		return fmt.Errorf("failed to create TUN interface %s: %w", name, err)
+	}
+	defer dev.Close()
+	if actual, err := dev.Name(); err == nil {
+		name = actual
+	}
+
+	conf := tunnel.NewConnectionConfig(tlsCfg, endpoint, cfg)
+	conf.Reconnector = api.NewReconnector()
+	s.stats.Store(conf.Stats)
+
+	host, err := configureHost(name, int(cfg.Tunnel.MTU), locals, routes, conf.Endpoints)
+	if err != nil {
+		return err
+	}
+	defer host.restore()
+	logger.Logger.Infof("VPN interface %s is up, routing %v", name, routes)
+
+	registry := metrics.NewRegistry()
+	metrics.RegisterTunnelStats(registry, conf.Stats)
+	go sdnotify.Run(ctx, conf.Stats)
+	if cfg.Metrics.HealthAddress != "" {
+		go func() {
+			if err := metrics.RunHealth(ctx, cfg.Metrics.HealthAddress, conf.Stats); err != nil {
+				logger.Logger.Errorf("%v", err)
+			}
+		}()
+	}
+	if cfg.Metrics.Address != "" {
+		go func() {
+			if err := metrics.Run(ctx, cfg.Metrics.Address, registry); err != nil {
+				logger.Logger.Errorf("%v", err)
+			}
+		}()
+	}
+	if cfg.Metrics.PprofAddress != "" {
+		go func() {
+			if err := metrics.RunPprof(ctx, cfg.Metrics.PprofAddress); err != nil {
+				logger.Logger.Errorf("%v", err)
+			}
+		}()
+	}
+	if cfg.Control.SocketPath != "" {
+		go func() {
+			srv := control.NewServer(conf.Stats)
+			srv.HandleReconnect(conf.Reconnector)
+			if err := srv.Run(ctx, cfg.Control.SocketPath); err != nil {
+				logger.Logger.Errorf("%v", err)
+			}
+		}()
+	}
+
+	tunnelDone := make(chan error, 1)
+	go func() {
+		defer close(tunnelDone)
+		if err := s.Tunnel.MaintainTunnel(ctx, conf, api.NewTunAdapter(dev, int(cfg.Tunnel.MTU))); err != nil {
+			tunnelDone <- err
+		}
+	}()
+
+	select {
+	case err := <-tunnelDone:
+		// 隧道放弃重连，移除接口后以错误退出
+		if err != nil {
+			return err
+		}
+		<-ctx.Done()
+	case <-ctx.Done():
+	}
+	logger.Logger.Infof("Shutting down VPN interface %s", name)
+	tunnel.WaitStopped(tunnelDone)
+	return nil
+}
+
+// Stats returns the live tunnel statistics, or nil before the tunnel is set up.
+func (s *Service) Stats() *api.TunnelStats {
+	return s.stats.Load()
+}
+
+// parseRoutes parses the configured routes and drops those of an address family the
+// tunnel has no local address for. Without configured routes all traffic of each
+// available family is routed, using two half-range prefixes so the default route stays intact.
+func parseRoutes(entries []string, locals []netip.Addr) ([]netip.Prefix, error) {
+	var has4, has6 bool
+	for _, addr := range locals {
+		if addr.Is4() {
+			has4 = true
+		} else {
+			has6 = true
+		}
+	}
+
+	if len(entries) == 0 {
+		if has4 {
+			entries = append(entries, "0.0.0.0/1", "128.0.0.0/1")
+		}
+		if has6 {
+			entries = append(entries, "::/1", "8000::/1")
+		}
+	}
+
+	var routes []netip.Prefix
+	for _, entry := range entries {
+		prefix, err := netip.ParsePrefix(entry)
+		if err != nil {
+			return nil, fmt.Errorf("invalid route %q: %w", entry, err)
+		}
+		if prefix.Addr().Is4() && !has4 || prefix.Addr().Is6() && !has6 {
+			logger.Logger.Warnf("Ignoring route %s: no tunnel address of that family", prefix)
+			continue
+		}
+		routes = append(routes, prefix.Masked())
+	}
+	return routes, nil
+}